@@ -0,0 +1,298 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/temelpa/timetravel/auth"
+	"github.com/temelpa/timetravel/data"
+	"github.com/temelpa/timetravel/entity"
+	"github.com/temelpa/timetravel/logging"
+	"github.com/temelpa/timetravel/service"
+	"github.com/temelpa/timetravel/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// APIAdmin manages the server itself, and records beyond what clients may
+// do with them. All its routes are the admin operation.
+type APIAdmin struct {
+	keys    service.APIKeyService
+	records service.RecordService
+	// Holds a token while a backup runs, so only one copy is made at once.
+	backups chan struct{}
+}
+
+// generates all admin routes
+func (a *APIAdmin) CreateRoutes(routes *mux.Router, authorize Authorize) {
+	routes.Path("/api-keys").Handler(authorize(auth.OpAdmin, a.postAPIKeys)).Methods("POST")
+	routes.Path("/api-keys").Handler(authorize(auth.OpAdmin, a.getAPIKeys)).Methods("GET")
+	routes.Path("/api-keys/{keyID}").Handler(authorize(auth.OpAdmin, a.deleteAPIKey)).Methods("DELETE")
+	routes.Path("/records/{id}/erase").Handler(authorize(auth.OpAdmin, a.postErase)).Methods("POST")
+	routes.Path("/import").Handler(authorize(auth.OpAdmin, a.postImport)).Methods("POST")
+	routes.Path("/backup").Handler(authorize(auth.OpAdmin, a.getBackup)).Methods("GET")
+}
+
+// The key as returned once, on creation; the secret is never shown again.
+type createdAPIKey struct {
+	entity.APIKey
+	Key string `json:"key"`
+}
+
+// POST /admin/api-keys
+// Creates a key for the principal and roles in the body, e.g.
+// {"principal": "billing", "roles": ["read-current"]}.
+func (a *APIAdmin) postAPIKeys(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var body struct {
+		Principal string   `json:"principal"`
+		Roles     []string `json:"roles"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		err := writeError(w, r, errInvalidJSON)
+		logError(ctx, err)
+		return
+	}
+	if body.Principal == "" {
+		err := writeError(w, r, Error{
+			Status:  http.StatusBadRequest,
+			Code:    CodeInvalidAPIKey,
+			Message: "invalid api key; a principal is required",
+		})
+		logError(ctx, err)
+		return
+	}
+	if body.Roles == nil {
+		body.Roles = []string{}
+	}
+
+	id, secret, err := auth.NewAPIKey()
+	if err != nil {
+		err := writeError(w, r, serviceError(err))
+		logError(ctx, err)
+		return
+	}
+	key := entity.APIKey{
+		ID:        id,
+		Principal: body.Principal,
+		Roles:     body.Roles,
+		KeyHash:   auth.HashAPIKey(secret),
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := a.keys.CreateAPIKey(ctx, key); err != nil {
+		err := writeError(w, r, serviceError(err))
+		logError(ctx, err)
+		return
+	}
+	logging.FromContext(ctx).Info("api key created", "api_key_id", key.ID, "api_key_principal", key.Principal)
+
+	err = writeJSON(w, createdAPIKey{key, secret}, http.StatusCreated)
+	logError(ctx, err)
+}
+
+// GET /admin/api-keys
+// Lists all keys, revoked ones included, oldest first.
+func (a *APIAdmin) getAPIKeys(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	keys, err := a.keys.ListAPIKeys(ctx)
+	if err != nil {
+		err := writeError(w, r, serviceError(err))
+		logError(ctx, err)
+		return
+	}
+
+	err = writeJSON(w, keys, http.StatusOK)
+	logError(ctx, err)
+}
+
+// DELETE /admin/api-keys/{keyID}
+// Revokes a key. Revoking a key twice is not an error.
+func (a *APIAdmin) deleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := mux.Vars(r)["keyID"]
+	if err := a.keys.RevokeAPIKey(ctx, id); err != nil {
+		err := writeError(w, r, serviceError(err))
+		logError(ctx, err)
+		return
+	}
+	logging.FromContext(ctx).Info("api key revoked", "api_key_id", id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /admin/records/{id}/erase
+// Erases keys from every version of a record, e.g. {"keys": ["email"]},
+// or the whole record with {"all": true}. The record and its version
+// numbers remain; the response is the marker left in its history.
+func (a *APIAdmin) postErase(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	idNumber, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || idNumber <= 0 {
+		err := writeError(w, r, errInvalidID)
+		logError(ctx, err)
+		return
+	}
+	ctx = logging.Annotate(ctx, "record_id", idNumber)
+	tracing.Annotate(ctx, attribute.Int64("record.id", idNumber))
+	r = r.WithContext(ctx)
+
+	var body struct {
+		Keys []string `json:"keys"`
+		All  bool     `json:"all"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		err := writeError(w, r, errInvalidJSON)
+		logError(ctx, err)
+		return
+	}
+	if len(body.Keys) == 0 && !body.All {
+		err := writeError(w, r, Error{
+			Status:  http.StatusBadRequest,
+			Code:    CodeInvalidErasure,
+			Message: "invalid erasure; give the keys to erase, or all",
+		})
+		logError(ctx, err)
+		return
+	}
+
+	principal, _ := auth.PrincipalFromContext(ctx)
+
+	rwlock := a.records.GetRWLockForAPI()
+	wLock(ctx, rwlock)
+	defer rwlock.Unlock()
+	erasure, err := a.records.EraseRecord(ctx, idNumber, body.Keys, body.All, principal.ID)
+	if err != nil {
+		err := writeError(w, r, serviceError(err))
+		logError(ctx, err)
+		return
+	}
+	// The marker only names keys, so it's safe to log
+	logging.FromContext(ctx).Info("record erased", "keys", erasure.Keys, "whole_record", erasure.WholeRecord, "erasure_sequence", erasure.Sequence)
+
+	err = writeJSON(w, erasure, http.StatusOK)
+	logError(ctx, err)
+}
+
+// What became of an import. Only the lines that failed are listed.
+type importSummary struct {
+	Imported int                   `json:"imported"`
+	Failed   int                   `json:"failed"`
+	Errors   []entity.ImportResult `json:"errors"`
+}
+
+// POST /admin/import
+// Imports records with their histories from an NDJSON body in the format
+// GET /export writes. Lines that fail, such as records that already exist,
+// are listed in the response and don't stop the rest. If the import stops
+// partway, the batches written before it stay, so sending the same body
+// again finishes it.
+func (a *APIAdmin) postImport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	importer, ok := a.records.(service.ImportService)
+	if !ok {
+		err := writeError(w, r, Error{
+			Status:  http.StatusNotImplemented,
+			Code:    CodeNotImplemented,
+			Message: "import isn't supported by this storage backend",
+		})
+		logError(ctx, err)
+		return
+	}
+
+	// An import reads for as long as the file takes to upload
+	liftDeadlines(ctx, w)
+
+	// The lock is taken per batch, so other writers aren't held up for the
+	// whole import
+	importBatch := func(ctx context.Context, records []entity.ExportedRecord) ([]error, error) {
+		rwlock := importer.GetRWLockForAPI()
+		wLock(ctx, rwlock)
+		defer rwlock.Unlock()
+		return importer.ImportRecords(ctx, records)
+	}
+	summary := importSummary{Errors: []entity.ImportResult{}}
+	err := service.ImportNDJSON(ctx, r.Body, importBatch, func(result entity.ImportResult) {
+		if result.Error != "" {
+			summary.Failed++
+			summary.Errors = append(summary.Errors, result)
+			return
+		}
+		summary.Imported++
+	})
+	logging.FromContext(ctx).Info("records imported", "records", summary.Imported, "failed", summary.Failed)
+	if err != nil {
+		err := writeError(w, r, serviceError(err))
+		logError(ctx, err)
+		return
+	}
+
+	err = writeJSON(w, summary, http.StatusOK)
+	logError(ctx, err)
+}
+
+// GET /admin/backup
+// Downloads a consistent copy of the database, taken while the server
+// keeps serving. The copy is staged beside the database, and removed once
+// it's sent. A backup requested while another runs is refused.
+func (a *APIAdmin) getBackup(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	backups, ok := a.records.(service.BackupService)
+	if !ok {
+		err := writeError(w, r, Error{
+			Status:  http.StatusNotImplemented,
+			Code:    CodeNotImplemented,
+			Message: "backup isn't supported by this storage backend",
+		})
+		logError(ctx, err)
+		return
+	}
+
+	select {
+	case a.backups <- struct{}{}:
+		defer func() { <-a.backups }()
+	default:
+		err := writeError(w, r, Error{
+			Status:  http.StatusConflict,
+			Code:    CodeBackupInProgress,
+			Message: "another backup is already running",
+		})
+		logError(ctx, err)
+		return
+	}
+
+	// Copying and sending the database takes as long as it's big
+	liftDeadlines(ctx, w)
+	staged, err := backups.StageBackup(ctx)
+	if err != nil {
+		err := writeError(w, r, serviceError(err))
+		logError(ctx, err)
+		return
+	}
+	defer os.Remove(staged)
+	backup, err := os.Open(staged)
+	if err != nil {
+		err := writeError(w, r, serviceError(err))
+		logError(ctx, err)
+		return
+	}
+	defer backup.Close()
+	info, err := backup.Stat()
+	if err != nil {
+		err := writeError(w, r, serviceError(err))
+		logError(ctx, err)
+		return
+	}
+	logging.FromContext(ctx).Info("database backed up", "bytes", info.Size())
+
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+data.TIMETRAVEL_DB+`"`)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.WriteHeader(http.StatusOK)
+	_, err = io.Copy(w, backup)
+	logError(ctx, err)
+}
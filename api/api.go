@@ -1,33 +1,115 @@
 package api
 
 import (
+	"context"
+	"net/http"
+	"strconv"
+
 	"github.com/gorilla/mux"
+	"github.com/temelpa/timetravel/auth"
 	"github.com/temelpa/timetravel/entity"
+	"github.com/temelpa/timetravel/logging"
+	"github.com/temelpa/timetravel/redact"
 	"github.com/temelpa/timetravel/service"
 )
 
 type APIVersion interface {
-	CreateRoutes(*mux.Router)
-	Sanitize(entity.Record) interface{}
+	CreateRoutes(*mux.Router, Authorize)
+	// Sanitize turns a record into what the version responds with, as the
+	// caller in ctx may see it. Every record a response includes, history
+	// included, must go through it.
+	Sanitize(context.Context, entity.Record) (interface{}, error)
+	// SanitizeVersion is Sanitize for a version whose link is already
+	// known, such as one written in a transaction that hasn't committed.
+	SanitizeVersion(context.Context, entity.Record, entity.VersionHash) (interface{}, error)
 }
 
+// Authorize wraps a route's handler so it only runs if the caller may
+// perform op on the record the route names.
+type Authorize func(op auth.Operation, handler http.HandlerFunc) http.Handler
+
 type API struct {
 	versions map[string]APIVersion
+	admin    *APIAdmin
+	policy   *auth.Policy
 }
 
-func NewAPI(records service.RecordService) *API {
+// NewAPI serves records, letting authenticated principals do what policy
+// allows and see what redactor lets their roles see. A nil policy means
+// auth.DefaultPolicy, and a nil redactor shows everything.
+func NewAPI(records service.RecordService, policy *auth.Policy, redactor *redact.Redactor) *API {
+	if policy == nil {
+		policy = auth.DefaultPolicy()
+	}
 	return &API{
 		versions: map[string]APIVersion{
-			"v1": &APIv1{records},
-			"v2": &APIv2{records},
+			"v1": &APIv1{records, redactor},
+			"v2": &APIv2{records, redactor},
 		},
+		admin:  &APIAdmin{keys: records, records: records, backups: make(chan struct{}, 1)},
+		policy: policy,
 	}
 }
 
-// generates all api routes for all versions
-func (a *API) CreateRoutes(routes *mux.Router) {
+// generates all api routes for all versions, plus the admin routes, all
+// under /api and behind the given middleware (e.g. authentication)
+func (a *API) CreateRoutes(routes *mux.Router, middleware ...mux.MiddlewareFunc) {
+	apiRoutes := routes.PathPrefix("/api").Subrouter()
+	apiRoutes.Use(middleware...)
 	for key, api := range a.versions {
-		apiRoute := routes.PathPrefix("/api/" + key).Subrouter()
-		api.CreateRoutes(apiRoute)
+		versionRoute := apiRoutes.PathPrefix("/" + key).Subrouter()
+		api.CreateRoutes(versionRoute, a.authorize)
 	}
+	a.admin.CreateRoutes(apiRoutes.PathPrefix("/admin").Subrouter(), a.authorize)
+}
+
+// authorize checks the policy before handing the request to the handler.
+// Requests without a principal were let in with authentication disabled,
+// so they are allowed anything but admin operations, which nobody may then
+// perform. An unparseable record id is left for the handler to reject.
+func (a *API) authorize(op auth.Operation, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forbid := func(message string) {
+			ctx := logging.Annotate(r.Context(), "operation", string(op))
+			err := writeError(w, r.WithContext(ctx), Error{
+				Status:  http.StatusForbidden,
+				Code:    CodeForbidden,
+				Message: message,
+			})
+			logError(ctx, err)
+		}
+
+		principal, authenticated := auth.PrincipalFromContext(r.Context())
+		if !authenticated {
+			if op == auth.OpAdmin {
+				forbid("admin operations need authentication to be enabled")
+				return
+			}
+			handler(w, r)
+			return
+		}
+
+		var id int64
+		if rawID, ok := mux.Vars(r)["id"]; ok {
+			parsed, err := strconv.ParseInt(rawID, 10, 64)
+			if err != nil || parsed <= 0 {
+				handler(w, r)
+				return
+			}
+			id = parsed
+		}
+
+		if !a.policy.Allows(principal, op, id) {
+			forbid("not allowed to " + string(op) + " this resource")
+			return
+		}
+		handler(w, r)
+	})
+}
+
+// redactRecord hides the record's sensitive fields from the caller in ctx.
+func redactRecord(ctx context.Context, redactor *redact.Redactor, record entity.Record) entity.Record {
+	principal, _ := auth.PrincipalFromContext(ctx)
+	record.Data = redactor.Redact(principal.Roles, record.Data)
+	return record
 }
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/temelpa/timetravel/service"
+)
+
+var (
+	ErrInternal = errors.New("internal error")
+)
+
+// Error is an error as reported to API clients: an HTTP status, a stable
+// machine-readable code, and a human-readable message. The cause, if any,
+// is logged but never sent to the client.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+	Cause   error
+}
+
+func (e Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func (e Error) Unwrap() error {
+	return e.Cause
+}
+
+// Machine-readable error codes returned in the "code" field of error bodies.
+const (
+	CodeInvalidID            = "invalid_id"
+	CodeInvalidVersionID     = "invalid_version_id"
+	CodeInvalidJSON          = "invalid_json"
+	CodeIdempotencyKeyReused = "idempotency_key_reused"
+	CodeRecordNotFound       = "record_not_found"
+	CodeVersionNotFound      = "version_not_found"
+	CodeVersionCompacted     = "version_compacted"
+	CodeRecordAlreadyExists  = "record_already_exists"
+	CodeRecordIDInvalid      = "record_id_invalid"
+	CodeUnauthenticated      = "unauthenticated"
+	CodeForbidden            = "forbidden"
+	CodeInvalidAPIKey        = "invalid_api_key"
+	CodeAPIKeyNotFound       = "api_key_not_found"
+	CodeInvalidErasure       = "invalid_erasure"
+	CodeInvalidExport        = "invalid_export"
+	CodeInvalidImport        = "invalid_import"
+	CodeBackupInProgress     = "backup_in_progress"
+	CodeNotImplemented       = "not_implemented"
+	CodeInternal             = "internal"
+)
+
+var (
+	errInvalidID = Error{
+		Status:  http.StatusBadRequest,
+		Code:    CodeInvalidID,
+		Message: "invalid id; id must be a positive number",
+	}
+	errInvalidVersionID = Error{
+		Status:  http.StatusBadRequest,
+		Code:    CodeInvalidVersionID,
+		Message: "invalid version id; version id must be a positive number",
+	}
+	errInvalidJSON = Error{
+		Status:  http.StatusBadRequest,
+		Code:    CodeInvalidJSON,
+		Message: "invalid input; could not parse json",
+	}
+	errIdempotencyKeyReused = Error{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    CodeIdempotencyKeyReused,
+		Message: "idempotency key was already used for a different request",
+	}
+)
+
+// serviceError maps an error returned by the service layer onto the
+// status and code the API reports it as. Anything unrecognized is an
+// internal error, and its details are kept out of the response.
+func serviceError(err error) Error {
+	switch {
+	case errors.Is(err, service.ErrRecordDoesNotExist):
+		return Error{http.StatusNotFound, CodeRecordNotFound, err.Error(), err}
+	case errors.Is(err, service.ErrVersionDoesNotExist):
+		return Error{http.StatusNotFound, CodeVersionNotFound, err.Error(), err}
+	case errors.Is(err, service.ErrVersionCompacted):
+		return Error{http.StatusGone, CodeVersionCompacted, err.Error(), err}
+	case errors.Is(err, service.ErrRecordAlreadyExists):
+		return Error{http.StatusConflict, CodeRecordAlreadyExists, err.Error(), err}
+	case errors.Is(err, service.ErrRecordIDInvalid):
+		return Error{http.StatusUnprocessableEntity, CodeRecordIDInvalid, err.Error(), err}
+	case errors.Is(err, service.ErrAPIKeyDoesNotExist):
+		return Error{http.StatusNotFound, CodeAPIKeyNotFound, err.Error(), err}
+	case errors.Is(err, service.ErrImportLineTooLong):
+		return Error{http.StatusBadRequest, CodeInvalidImport, err.Error(), err}
+	default:
+		return Error{http.StatusInternalServerError, CodeInternal, ErrInternal.Error(), err}
+	}
+}
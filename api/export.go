@@ -0,0 +1,102 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/temelpa/timetravel/auth"
+	"github.com/temelpa/timetravel/entity"
+	"github.com/temelpa/timetravel/logging"
+	"github.com/temelpa/timetravel/redact"
+	"github.com/temelpa/timetravel/service"
+)
+
+// GET /export
+// Export streams every record with its whole history as NDJSON, one record
+// per line, in order of id. ?ids=min-max narrows it to a range of ids, and
+// ?as_of= (RFC 3339) to the versions written by then.
+//
+// Versions are redacted for the caller. Callers who can't see every field
+// get no timestamps, which along with the hashes would let them guess
+// hidden values, and so can't filter by time either.
+func Export(records service.RecordServiceV2, redactor *redact.Redactor, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	exporter, ok := records.(service.ExportService)
+	if !ok {
+		err := writeError(w, r, Error{
+			Status:  http.StatusNotImplemented,
+			Code:    CodeNotImplemented,
+			Message: "export isn't supported by this storage backend",
+		})
+		logError(ctx, err)
+		return
+	}
+
+	query := r.URL.Query()
+	filter, err := entity.ParseExportFilter(query.Get("ids"), query.Get("as_of"))
+	if err != nil {
+		err := writeError(w, r, Error{
+			Status:  http.StatusBadRequest,
+			Code:    CodeInvalidExport,
+			Message: "invalid export; " + err.Error(),
+			Cause:   err,
+		})
+		logError(ctx, err)
+		return
+	}
+	principal, _ := auth.PrincipalFromContext(ctx)
+	hidesFields := redactor.HidesFrom(principal.Roles)
+	if hidesFields && !filter.AsOf.IsZero() {
+		err := writeError(w, r, Error{
+			Status:  http.StatusForbidden,
+			Code:    CodeForbidden,
+			Message: "not allowed to export as of a time without seeing every field",
+		})
+		logError(ctx, err)
+		return
+	}
+
+	// An export streams for as long as the history it covers takes
+	liftDeadlines(ctx, w)
+	unlock := rLockReads(ctx, records)
+	defer unlock()
+
+	// Nothing is written until the first record is ready, so an export
+	// that can't start still gets an error status
+	encoder := json.NewEncoder(w)
+	started := false
+	start := func() {
+		w.Header().Add("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		started = true
+	}
+	exported := 0
+	err = exporter.Export(ctx, filter, func(record entity.ExportedRecord) error {
+		if !started {
+			start()
+		}
+		for i, version := range record.Versions {
+			record.Versions[i].Data = redactor.Redact(principal.Roles, version.Data)
+			if hidesFields {
+				record.Versions[i].CreatedAt = nil
+			}
+		}
+		exported++
+		return encoder.Encode(record)
+	})
+	if err != nil && !started {
+		err := writeError(w, r, serviceError(err))
+		logError(ctx, err)
+		return
+	}
+	if err != nil {
+		// The status is already sent, so cut the response off rather than
+		// let a partial export pass for a whole one
+		logError(ctx, err)
+		panic(http.ErrAbortHandler)
+	}
+	if !started {
+		start()
+	}
+	logging.FromContext(ctx).Info("records exported", "records", exported)
+}
@@ -1,12 +1,14 @@
 package api
 
 import (
-	"fmt"
 	"net/http"
 	"strconv"
 
 	"github.com/gorilla/mux"
+	"github.com/temelpa/timetravel/logging"
 	"github.com/temelpa/timetravel/service"
+	"github.com/temelpa/timetravel/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // GET /records/{id}
@@ -17,26 +19,35 @@ func GetRecords(a APIVersion, records service.RecordServiceV1, w http.ResponseWr
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	idNumber, err := strconv.ParseInt(id, 10, 32)
+	idNumber, err := strconv.ParseInt(id, 10, 64)
 	if err != nil || idNumber <= 0 {
-		err := writeError(w, "invalid id; id must be a positive number", http.StatusBadRequest)
-		logError(err)
+		err := writeError(w, r, errInvalidID)
+		logError(ctx, err)
 		return
 	}
+	ctx = logging.Annotate(ctx, "record_id", idNumber)
+	tracing.Annotate(ctx, attribute.Int64("record.id", idNumber))
+	r = r.WithContext(ctx)
 
-	rwlock := records.GetRWLockForAPI()
-	rwlock.RLock()
-	defer rwlock.RUnlock()
+	unlock := rLockReads(ctx, records)
+	defer unlock()
 	record, err := records.GetRecord(
 		ctx,
-		int(idNumber),
+		idNumber,
 	)
 	if err != nil {
-		err := writeError(w, fmt.Sprintf("record of id %v does not exist", idNumber), http.StatusBadRequest)
-		logError(err)
+		err := writeError(w, r, serviceError(err))
+		logError(ctx, err)
 		return
 	}
 
-	err = writeJSON(w, a.Sanitize(record), http.StatusOK)
-	logError(err)
+	sanitized, err := a.Sanitize(ctx, record)
+	if err != nil {
+		err := writeError(w, r, serviceError(err))
+		logError(ctx, err)
+		return
+	}
+
+	err = writeJSON(w, sanitized, http.StatusOK)
+	logError(ctx, err)
 }
@@ -1,12 +1,16 @@
 package api
 
 import (
-	"fmt"
+	"context"
 	"net/http"
 	"strconv"
 
 	"github.com/gorilla/mux"
+	"github.com/temelpa/timetravel/entity"
+	"github.com/temelpa/timetravel/logging"
 	"github.com/temelpa/timetravel/service"
+	"github.com/temelpa/timetravel/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // GET /records/{id}/versions/{vid}
@@ -17,74 +21,152 @@ func GetVersionedRecord(a APIVersion, records service.RecordServiceV2, w http.Re
 	id := vars["id"]
 	versionId := vars["vid"]
 
-	idNumber, err := strconv.ParseInt(id, 10, 32)
+	idNumber, err := strconv.ParseInt(id, 10, 64)
 	if err != nil || idNumber <= 0 {
-		err := writeError(w, "invalid id; id must be a positive number", http.StatusBadRequest)
-		logError(err)
+		err := writeError(w, r, errInvalidID)
+		logError(ctx, err)
 		return
 	}
+	ctx = logging.Annotate(ctx, "record_id", idNumber)
+	tracing.Annotate(ctx, attribute.Int64("record.id", idNumber))
+	r = r.WithContext(ctx)
 
 	vidNumber, err := strconv.ParseInt(versionId, 10, 32)
 	if err != nil || vidNumber <= 0 {
-		err := writeError(w, "invalid version id; version id must be a positive number", http.StatusBadRequest)
-		logError(err)
+		err := writeError(w, r, errInvalidVersionID)
+		logError(ctx, err)
 		return
 	}
+	ctx = logging.Annotate(ctx, "version", vidNumber)
+	tracing.Annotate(ctx, attribute.Int64("record.version", vidNumber))
+	r = r.WithContext(ctx)
 
-	rwlock := records.GetRWLockForAPI()
-	rwlock.RLock()
-	defer rwlock.RUnlock()
-	record, err := records.GetVersionedRecord(
-		ctx,
-		int(idNumber),
-		int(vidNumber),
-	)
+	unlock := rLockReads(ctx, records)
+	defer unlock()
+	history, err := readHistory(ctx, records, idNumber, int(vidNumber))
 	if err != nil {
-		err := writeError(w, fmt.Sprintf("record of id %v does not exist, or vid %d does not exist", idNumber, vidNumber), http.StatusBadRequest)
-		logError(err)
+		err := writeError(w, r, serviceError(err))
+		logError(ctx, err)
 		return
 	}
 
-	err = writeJSON(w, a.Sanitize(record), http.StatusOK)
-	logError(err)
+	sanitized, err := a.SanitizeVersion(ctx, history.Versions[0], history.Links[0])
+	if err != nil {
+		err := writeError(w, r, serviceError(err))
+		logError(ctx, err)
+		return
+	}
+
+	err = writeJSON(w, sanitized, http.StatusOK)
+	logError(ctx, err)
 }
 
 // GET /records/{id}/versions
 // GetVersionedRecords retrieves all versions of a given record.
 // The first element will be the oldest version, and the last the newest version.
+// Markers of any erasures of the record are listed alongside, oldest first,
+// under "erasures", as are ranges of versions retention compacted away,
+// under "compactions".
 func GetVersionedRecords(a APIVersion, records service.RecordServiceV2, w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	idNumber, err := strconv.ParseInt(id, 10, 32)
+	idNumber, err := strconv.ParseInt(id, 10, 64)
 	if err != nil || idNumber <= 0 {
-		err := writeError(w, "invalid id; id must be a positive number", http.StatusBadRequest)
-		logError(err)
+		err := writeError(w, r, errInvalidID)
+		logError(ctx, err)
 		return
 	}
+	ctx = logging.Annotate(ctx, "record_id", idNumber)
+	tracing.Annotate(ctx, attribute.Int64("record.id", idNumber))
+	r = r.WithContext(ctx)
 
-	rwlock := records.GetRWLockForAPI()
-	rwlock.RLock()
-	defer rwlock.RUnlock()
-	versions, err := records.GetAllRecordVersions(
-		ctx,
-		int(idNumber),
-	)
+	unlock := rLockReads(ctx, records)
+	defer unlock()
+	history, err := readHistory(ctx, records, idNumber, 0)
 	if err != nil {
-		err := writeError(w, fmt.Sprintf("record of id %v does not exist", idNumber), http.StatusBadRequest)
-		logError(err)
+		err := writeError(w, r, serviceError(err))
+		logError(ctx, err)
 		return
 	}
 
-	sanitizedVersions := make([]interface{}, len(versions))
-	for i, v := range versions {
-		sanitizedVersions[i] = a.Sanitize(v)
+	sanitizedVersions := make([]interface{}, len(history.Versions))
+	for i, v := range history.Versions {
+		if sanitizedVersions[i], err = a.SanitizeVersion(ctx, v, history.Links[i]); err != nil {
+			err := writeError(w, r, serviceError(err))
+			logError(ctx, err)
+			return
+		}
 	}
 
+	// Erasures are part of the history, so it says where data went missing.
+	// Records never erased respond as they always have.
 	response := map[string]interface{}{
 		"versions": sanitizedVersions,
 	}
+	if len(history.Erasures) > 0 {
+		response["erasures"] = history.Erasures
+	}
+	if len(history.Compactions) > 0 {
+		response["compactions"] = history.Compactions
+	}
 	err = writeJSON(w, response, http.StatusOK)
-	logError(err)
+	logError(ctx, err)
+}
+
+// readHistory reads the given version of a record, or every version if
+// version is 0 along with the record's erasures and compactions, for the
+// history routes. Services that read history alongside writes read it all
+// in one snapshot, so every hash returned matches its version. Others do
+// under the API lock, one piece at a time. Without the lock, an erasure or
+// compaction may land after the versions were read, but reading markers
+// second means one never goes missing from the response.
+func readHistory(ctx context.Context, records service.RecordServiceV2, id int64, version int) (service.RecordHistory, error) {
+	if reader, ok := records.(service.HistoryReader); ok {
+		return reader.GetHistory(ctx, id, version)
+	}
+
+	var history service.RecordHistory
+	if version == 0 {
+		versions, err := records.GetAllRecordVersions(ctx, id)
+		if err != nil {
+			return service.RecordHistory{}, err
+		}
+		history.Versions = versions
+	} else {
+		record, err := records.GetVersionedRecord(ctx, id, version)
+		if err != nil {
+			return service.RecordHistory{}, err
+		}
+		history.Versions = []entity.Record{record}
+	}
+
+	history.Links = make([]entity.VersionHash, len(history.Versions))
+	for i, v := range history.Versions {
+		link, err := records.GetVersionHash(ctx, id, v.Version)
+		if err != nil {
+			return service.RecordHistory{}, err
+		}
+		history.Links[i] = link
+	}
+	if version != 0 {
+		return history, nil
+	}
+
+	if erasureService, ok := records.(service.ErasureService); ok {
+		erasures, err := erasureService.GetErasures(ctx, id)
+		if err != nil {
+			return service.RecordHistory{}, err
+		}
+		history.Erasures = erasures
+	}
+	if compactionService, ok := records.(service.CompactionService); ok {
+		compactions, err := compactionService.GetCompactions(ctx, id)
+		if err != nil {
+			return service.RecordHistory{}, err
+		}
+		history.Compactions = compactions
+	}
+	return history, nil
 }
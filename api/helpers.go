@@ -1,23 +1,86 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"log"
+	"log/slog"
 	"net/http"
-)
+	"sync"
+	"time"
 
-var (
-	ErrInternal = errors.New("internal error")
+	"github.com/temelpa/timetravel/auth"
+	"github.com/temelpa/timetravel/logging"
+	"github.com/temelpa/timetravel/metrics"
+	"github.com/temelpa/timetravel/service"
+	"github.com/temelpa/timetravel/tracing"
 )
 
-// logs an error if it's not nil
-func logError(err error) {
+// logs an error if it's not nil, tagged with whatever the context's logger
+// carries (request id, route, record id...)
+func logError(ctx context.Context, err error) {
 	if err != nil {
-		log.Printf("error: %v", err)
+		logging.FromContext(ctx).Error("request failed", "error", err)
+	}
+}
+
+// rLock takes the read lock, recording how long it had to wait for it.
+func rLock(ctx context.Context, rwlock *sync.RWMutex) {
+	start := time.Now()
+	_, span := tracing.Start(ctx, "lock.read")
+	rwlock.RLock()
+	span.End()
+	metrics.ObserveLockWait("read", start)
+}
+
+// rLockReads takes the read lock around a read of records, unless the
+// service reads consistent snapshots without it. Call the returned function
+// once the read is done.
+func rLockReads(ctx context.Context, records service.RecordServiceBase) func() {
+	if reader, ok := records.(service.SnapshotReader); ok && reader.ReadsSnapshots() {
+		return func() {}
+	}
+	rwlock := records.GetRWLockForAPI()
+	rLock(ctx, rwlock)
+	return rwlock.RUnlock
+}
+
+// liftDeadlines clears the server's read and write timeouts for a request
+// that streams, since it takes as long as the data it streams does. Writers
+// that can't set deadlines, e.g. in tests, are left as they are.
+func liftDeadlines(ctx context.Context, w http.ResponseWriter) {
+	controller := http.NewResponseController(w)
+	for _, err := range []error{
+		controller.SetReadDeadline(time.Time{}),
+		controller.SetWriteDeadline(time.Time{}),
+	} {
+		if !errors.Is(err, http.ErrNotSupported) {
+			logError(ctx, err)
+		}
 	}
 }
 
+// wLock takes the write lock, recording how long it had to wait for it.
+func wLock(ctx context.Context, rwlock *sync.RWMutex) {
+	start := time.Now()
+	_, span := tracing.Start(ctx, "lock.write")
+	rwlock.Lock()
+	span.End()
+	metrics.ObserveLockWait("write", start)
+}
+
+// requestID returns the id the logging middleware assigned this request,
+// falling back to the client's header, or a new id, outside of it.
+func requestID(r *http.Request) string {
+	if id := logging.RequestID(r.Context()); id != "" {
+		return id
+	}
+	if id := r.Header.Get(logging.RequestIDHeader); id != "" {
+		return id
+	}
+	return logging.NewRequestID()
+}
+
 // writeJSON writes the data as json.
 func writeJSON(w http.ResponseWriter, data interface{}, statusCode int) error {
 	w.Header().Add("Content-Type", "application/json; charset=utf-8")
@@ -26,12 +89,59 @@ func writeJSON(w http.ResponseWriter, data interface{}, statusCode int) error {
 	return err
 }
 
-// writeError writes the message as an error
-func writeError(w http.ResponseWriter, message string, statusCode int) error {
-	log.Printf("response errored: %s", message)
+// writeRawJSON writes bytes that are already encoded as json.
+func writeRawJSON(w http.ResponseWriter, data []byte, statusCode int) error {
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(statusCode)
+	_, err := w.Write(data)
+	return err
+}
+
+// writeError writes the error's status, and a body carrying its code,
+// message and the request id.
+func writeError(w http.ResponseWriter, r *http.Request, apiErr Error) error {
+	id := requestID(r)
+	args := []any{"code", apiErr.Code, "message", apiErr.Message}
+	if apiErr.Cause != nil {
+		args = append(args, "error", apiErr.Cause)
+	}
+	// Client mistakes are expected; only our own failures are errors
+	level := slog.LevelInfo
+	if apiErr.Status >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	logging.FromContext(r.Context()).Log(r.Context(), level, "response errored", args...)
+
+	w.Header().Set(logging.RequestIDHeader, id)
 	return writeJSON(
 		w,
-		map[string]string{"error": message},
-		statusCode,
+		map[string]string{
+			"error":      apiErr.Message,
+			"code":       apiErr.Code,
+			"request_id": id,
+		},
+		apiErr.Status,
 	)
 }
+
+// Unauthenticated answers requests the authentication middleware rejected
+// with a 401, challenging the client for the accepted credentials.
+func Unauthenticated(w http.ResponseWriter, r *http.Request, err error) {
+	message := "authentication required"
+	if errors.Is(err, auth.ErrInvalidCredentials) {
+		message = "invalid credentials"
+	} else if !errors.Is(err, auth.ErrNoCredentials) {
+		errInWriting := writeError(w, r, serviceError(err))
+		logError(r.Context(), errInWriting)
+		return
+	}
+
+	w.Header().Set("WWW-Authenticate", `Bearer, APIKey header="`+auth.APIKeyHeader+`"`)
+	errInWriting := writeError(w, r, Error{
+		Status:  http.StatusUnauthorized,
+		Code:    CodeUnauthenticated,
+		Message: message,
+		Cause:   err,
+	})
+	logError(r.Context(), errInWriting)
+}
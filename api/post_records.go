@@ -1,38 +1,56 @@
 package api
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"strconv"
 
 	"github.com/gorilla/mux"
+	"github.com/temelpa/timetravel/auth"
 	"github.com/temelpa/timetravel/entity"
+	"github.com/temelpa/timetravel/logging"
 	"github.com/temelpa/timetravel/service"
+	"github.com/temelpa/timetravel/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// Clients may set this header on a POST so that retries of the same request
+// replay the first response instead of applying the update again.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// Set on responses that were replayed from a stored idempotent response.
+const IdempotentReplayHeader = "Idempotent-Replayed"
+
 // POST /records/{id}
 // if the record exists, the record is updated.
 // if the record doesn't exist, the record is created.
+// If an Idempotency-Key header is given and was already used for this exact
+// request, the stored response is returned and the record is left untouched.
 // Since v1 + v2 behave the same given this API, we use this for both versions.
 func PostRecords(a APIVersion, records service.RecordServiceV1, w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	idNumber, err := strconv.ParseInt(id, 10, 32)
+	idNumber, err := strconv.ParseInt(id, 10, 64)
 	if err != nil || idNumber <= 0 {
-		err := writeError(w, "invalid id; id must be a positive number", http.StatusBadRequest)
-		logError(err)
+		err := writeError(w, r, errInvalidID)
+		logError(ctx, err)
 		return
 	}
+	ctx = logging.Annotate(ctx, "record_id", idNumber)
+	tracing.Annotate(ctx, attribute.Int64("record.id", idNumber))
+	r = r.WithContext(ctx)
 
 	var body map[string]*string
 	err = json.NewDecoder(r.Body).Decode(&body)
 
 	if err != nil {
-		err := writeError(w, "invalid input; could not parse json", http.StatusBadRequest)
-		logError(err)
+		err := writeError(w, r, errInvalidJSON)
+		logError(ctx, err)
 		return
 	}
 
@@ -41,40 +59,108 @@ func PostRecords(a APIVersion, records service.RecordServiceV1, w http.ResponseW
 	// a creation between our check and actual update (a true
 	// write operation)
 	rwlock := records.GetRWLockForAPI()
-	rwlock.Lock()
+	wLock(ctx, rwlock)
 	defer rwlock.Unlock()
-	record, err := records.GetRecord(
-		ctx,
-		int(idNumber),
-	)
-
-	if !errors.Is(err, service.ErrRecordDoesNotExist) { // record exists
-		record, err = records.UpdateRecord(ctx, int(idNumber), body)
-	} else { // record does not exist
-
-		// exclude the delete updates
-		recordMap := map[string]string{}
-		for key, value := range body {
-			if value != nil {
-				recordMap[key] = *value
+
+	idempotencyKey := r.Header.Get(IdempotencyKeyHeader)
+	requestHash := hashRequest(r, body)
+	if idempotencyKey != "" {
+		stored, err := records.GetIdempotentResponse(ctx, idempotencyKey)
+		if err == nil {
+			replayIdempotentResponse(w, r, stored, requestHash)
+			return
+		} else if !errors.Is(err, service.ErrIdempotencyKeyNotFound) {
+			errInWriting := writeError(w, r, serviceError(err))
+			logError(ctx, errInWriting)
+			return
+		}
+	}
+
+	// With a key, the response is stored in the same transaction as the
+	// write, so a retry never finds the write without its response. The
+	// version isn't readable until then, so it's sanitized with the link
+	// the service wrote.
+	var response []byte
+	var keyed service.IdempotentResponder
+	if idempotencyKey != "" {
+		keyed = func(record entity.Record, link entity.VersionHash) (entity.IdempotentResponse, error) {
+			sanitized, err := a.SanitizeVersion(ctx, record, link)
+			if err != nil {
+				return entity.IdempotentResponse{}, err
+			}
+			if response, err = json.Marshal(sanitized); err != nil {
+				return entity.IdempotentResponse{}, err
 			}
+			return entity.IdempotentResponse{
+				Key:         idempotencyKey,
+				RecordID:    idNumber,
+				RequestHash: requestHash,
+				StatusCode:  http.StatusOK,
+				Body:        response,
+			}, nil
 		}
+	}
 
-		record = entity.Record{
-			ID:      int(idNumber),
-			Data:    recordMap,
-			Version: 1,
+	// Backends without an API lock that keeps writers apart decide between
+	// creating and updating in the write's transaction, and claim the key
+	// there, so a retry racing this request may win it
+	record, err := records.UpsertRecordKeyed(ctx, idNumber, body, keyed)
+	var used *service.IdempotencyKeyUsedError
+	if errors.As(err, &used) {
+		replayIdempotentResponse(w, r, used.Stored, requestHash)
+		return
+	}
+	if err == nil && keyed == nil {
+		var sanitized interface{}
+		if sanitized, err = a.Sanitize(ctx, record); err == nil {
+			response, err = json.Marshal(sanitized)
 		}
-		err = records.CreateRecord(ctx, record)
 	}
 
 	if err != nil {
-		errInWriting := writeError(w, ErrInternal.Error(), http.StatusInternalServerError)
-		logError(err)
-		logError(errInWriting)
+		errInWriting := writeError(w, r, serviceError(err))
+		logError(ctx, errInWriting)
 		return
 	}
 
-	err = writeJSON(w, a.Sanitize(record), http.StatusOK)
-	logError(err)
+	err = writeRawJSON(w, response, http.StatusOK)
+	logError(ctx, err)
+}
+
+// replayIdempotentResponse answers with the response stored for the
+// request's idempotency key, unless the key was used for another request.
+func replayIdempotentResponse(w http.ResponseWriter, r *http.Request, stored entity.IdempotentResponse, requestHash string) {
+	ctx := r.Context()
+	if stored.RequestHash != requestHash {
+		err := writeError(w, r, errIdempotencyKeyReused)
+		logError(ctx, err)
+		return
+	}
+	w.Header().Set(IdempotentReplayHeader, "true")
+	err := writeRawJSON(w, stored.Body, stored.StatusCode)
+	logError(ctx, err)
+}
+
+// hashRequest fingerprints the parts of a request that decide its effect,
+// so that reusing an idempotency key for a different request is detectable.
+func hashRequest(r *http.Request, body map[string]*string) string {
+	// Re-encoding sorts the keys, so formatting differences between
+	// retries of the same payload don't count as a different request.
+	canonicalBody, _ := json.Marshal(body)
+
+	// Responses are redacted for the caller, so replaying one to another
+	// principal could reveal what it may not see. Keys are one namespace
+	// shared by every principal, so hashing the principal makes another
+	// principal's use of a key a different request, which is refused.
+	principal, _ := auth.PrincipalFromContext(r.Context())
+
+	hash := sha256.New()
+	hash.Write([]byte(principal.ID))
+	hash.Write([]byte{0})
+	hash.Write([]byte(r.Method))
+	hash.Write([]byte{0})
+	hash.Write([]byte(r.URL.Path))
+	hash.Write([]byte{0})
+	hash.Write(canonicalBody)
+	return hex.EncodeToString(hash.Sum(nil))
 }
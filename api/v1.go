@@ -1,25 +1,34 @@
 package api
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/temelpa/timetravel/auth"
 	"github.com/temelpa/timetravel/entity"
+	"github.com/temelpa/timetravel/redact"
 	"github.com/temelpa/timetravel/service"
 )
 
 type APIv1 struct {
-	records service.RecordServiceV1
+	records  service.RecordServiceV1
+	redactor *redact.Redactor
 }
 
 // generates all api routes
-func (a *APIv1) CreateRoutes(routes *mux.Router) {
-	routes.Path("/records/{id}").HandlerFunc(a.getRecords).Methods("GET")
-	routes.Path("/records/{id}").HandlerFunc(a.postRecords).Methods("POST")
+func (a *APIv1) CreateRoutes(routes *mux.Router, authorize Authorize) {
+	routes.Path("/records/{id}").Handler(authorize(auth.OpReadCurrent, a.getRecords)).Methods("GET")
+	routes.Path("/records/{id}").Handler(authorize(auth.OpWrite, a.postRecords)).Methods("POST")
 }
 
-func (a *APIv1) Sanitize(r entity.Record) interface{} {
-	return r.IntoV1()
+func (a *APIv1) Sanitize(ctx context.Context, r entity.Record) (interface{}, error) {
+	r = redactRecord(ctx, a.redactor, r)
+	return r.IntoV1(), nil
+}
+
+func (a *APIv1) SanitizeVersion(ctx context.Context, r entity.Record, link entity.VersionHash) (interface{}, error) {
+	return a.Sanitize(ctx, r)
 }
 
 func (a *APIv1) getRecords(w http.ResponseWriter, r *http.Request) {
@@ -1,27 +1,45 @@
 package api
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/temelpa/timetravel/auth"
 	"github.com/temelpa/timetravel/entity"
+	"github.com/temelpa/timetravel/redact"
 	"github.com/temelpa/timetravel/service"
 )
 
 type APIv2 struct {
-	records service.RecordServiceV2
+	records  service.RecordServiceV2
+	redactor *redact.Redactor
 }
 
 // generates all api routes
-func (a *APIv2) CreateRoutes(routes *mux.Router) {
-	routes.Path("/records/{id}").HandlerFunc(a.getRecords).Methods("GET")
-	routes.Path("/records/{id}").HandlerFunc(a.postRecords).Methods("POST")
-	routes.Path("/records/{id}/versions").HandlerFunc(a.getVersionedRecords).Methods("GET")
-	routes.Path("/records/{id}/versions/{vid}").HandlerFunc(a.getVersionedRecord).Methods("GET")
+func (a *APIv2) CreateRoutes(routes *mux.Router, authorize Authorize) {
+	routes.Path("/records/{id}").Handler(authorize(auth.OpReadCurrent, a.getRecords)).Methods("GET")
+	routes.Path("/records/{id}").Handler(authorize(auth.OpWrite, a.postRecords)).Methods("POST")
+	routes.Path("/records/{id}/versions").Handler(authorize(auth.OpReadHistory, a.getVersionedRecords)).Methods("GET")
+	routes.Path("/records/{id}/versions/{vid}").Handler(authorize(auth.OpReadHistory, a.getVersionedRecord)).Methods("GET")
+	routes.Path("/records/{id}/verify").Handler(authorize(auth.OpReadHistory, a.verifyRecord)).Methods("GET")
+	routes.Path("/export").Handler(authorize(auth.OpReadHistory, a.export)).Methods("GET")
 }
 
-func (a *APIv2) Sanitize(r entity.Record) interface{} {
-	return r
+// Sanitize adds the version's hash. The hash covers unredacted data, but
+// also the version's timestamp, which is never exposed, so it can't be used
+// to guess redacted values.
+func (a *APIv2) Sanitize(ctx context.Context, r entity.Record) (interface{}, error) {
+	link, err := a.records.GetVersionHash(ctx, r.ID, r.Version)
+	if err != nil {
+		return nil, err
+	}
+	return a.SanitizeVersion(ctx, r, link)
+}
+
+func (a *APIv2) SanitizeVersion(ctx context.Context, r entity.Record, link entity.VersionHash) (interface{}, error) {
+	r = redactRecord(ctx, a.redactor, r)
+	return r.IntoV2(link.Hash), nil
 }
 
 func (a *APIv2) getRecords(w http.ResponseWriter, r *http.Request) {
@@ -39,3 +57,11 @@ func (a *APIv2) getVersionedRecord(w http.ResponseWriter, r *http.Request) {
 func (a *APIv2) getVersionedRecords(w http.ResponseWriter, r *http.Request) {
 	GetVersionedRecords(a, a.records, w, r)
 }
+
+func (a *APIv2) verifyRecord(w http.ResponseWriter, r *http.Request) {
+	VerifyRecord(a.records, w, r)
+}
+
+func (a *APIv2) export(w http.ResponseWriter, r *http.Request) {
+	Export(a.records, a.redactor, w, r)
+}
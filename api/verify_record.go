@@ -0,0 +1,51 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/temelpa/timetravel/logging"
+	"github.com/temelpa/timetravel/service"
+	"github.com/temelpa/timetravel/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// GET /records/{id}/verify
+// VerifyRecord recomputes the hash chain over every version of a record,
+// and reports whether the history matches it. A broken chain is reported
+// in the body, not as an error status.
+func VerifyRecord(records service.RecordServiceV2, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	idNumber, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || idNumber <= 0 {
+		err := writeError(w, r, errInvalidID)
+		logError(ctx, err)
+		return
+	}
+	ctx = logging.Annotate(ctx, "record_id", idNumber)
+	tracing.Annotate(ctx, attribute.Int64("record.id", idNumber))
+	r = r.WithContext(ctx)
+
+	rwlock := records.GetRWLockForAPI()
+	rLock(ctx, rwlock)
+	defer rwlock.RUnlock()
+	verification, err := service.VerifyRecord(ctx, records, idNumber)
+	if err != nil {
+		err := writeError(w, r, serviceError(err))
+		logError(ctx, err)
+		return
+	}
+	if !verification.Valid {
+		logging.FromContext(ctx).Warn("record history failed verification",
+			"broken_version", verification.BrokenVersion,
+			"broken_erasure", verification.BrokenErasure,
+		)
+	}
+
+	err = writeJSON(w, verification, http.StatusOK)
+	logError(ctx, err)
+}
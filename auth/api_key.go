@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/temelpa/timetravel/service"
+)
+
+// Header carrying an API key.
+const APIKeyHeader = "X-API-Key"
+
+// Prefix of generated API keys, so they are recognizable when leaked.
+const apiKeyPrefix = "tt_"
+
+// Principal authenticated by the bootstrap admin key.
+const bootstrapPrincipal = "bootstrap-admin"
+
+// APIKeyAuthenticator accepts keys sent in the X-API-Key header, looked up
+// by their hash.
+type APIKeyAuthenticator struct {
+	keys service.APIKeyService
+
+	// Hash of a key from the configuration granting the admin role, so
+	// the first real keys can be created. Empty if there is none.
+	bootstrapHash string
+}
+
+// NewAPIKeyAuthenticator returns an authenticator checking keys against
+// the ones stored in keys and, if it's not empty, the bootstrap admin key.
+func NewAPIKeyAuthenticator(keys service.APIKeyService, bootstrapKey string) *APIKeyAuthenticator {
+	authenticator := &APIKeyAuthenticator{keys: keys}
+	if bootstrapKey != "" {
+		authenticator.bootstrapHash = HashAPIKey(bootstrapKey)
+	}
+	return authenticator
+}
+
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		return Principal{}, ErrNoCredentials
+	}
+	hash := HashAPIKey(key)
+
+	if a.bootstrapHash != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(a.bootstrapHash)) == 1 {
+		return Principal{ID: bootstrapPrincipal, Roles: []string{RoleAdmin}, Method: MethodAPIKey}, nil
+	}
+
+	stored, err := a.keys.GetAPIKeyByHash(r.Context(), hash)
+	if errors.Is(err, service.ErrAPIKeyDoesNotExist) {
+		return Principal{}, fmt.Errorf("unknown api key: %w", ErrInvalidCredentials)
+	}
+	if err != nil {
+		return Principal{}, err
+	}
+	if stored.RevokedAt != nil {
+		return Principal{}, fmt.Errorf("api key %s was revoked: %w", stored.ID, ErrInvalidCredentials)
+	}
+	return Principal{ID: stored.Principal, Roles: stored.Roles, Method: MethodAPIKey}, nil
+}
+
+// HashAPIKey returns the hash API keys are stored and looked up by. Keys
+// are long and random, so a fast unsalted hash is enough.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewAPIKey generates a random id and secret for a new API key.
+func NewAPIKey() (id string, key string, err error) {
+	idBytes := make([]byte, 8)
+	keyBytes := make([]byte, 32)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", "", err
+	}
+	if _, err := rand.Read(keyBytes); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(idBytes), apiKeyPrefix + base64.RawURLEncoding.EncodeToString(keyBytes), nil
+}
@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/temelpa/timetravel/logging"
+	"github.com/temelpa/timetravel/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Ways a caller can authenticate.
+const (
+	MethodAPIKey = "api_key"
+	MethodJWT    = "jwt"
+)
+
+// Role allowed to manage API keys.
+const RoleAdmin = "admin"
+
+var (
+	// ErrNoCredentials is returned by an Authenticator when the request
+	// doesn't carry the kind of credentials it checks, so the next one
+	// should be tried.
+	ErrNoCredentials = errors.New("no credentials")
+
+	// ErrInvalidCredentials is returned when credentials were given but are
+	// unknown, revoked, expired or otherwise unacceptable.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Principal is whoever a request was authenticated as.
+type Principal struct {
+	// Who the caller is, e.g. the API key's principal or the JWT subject.
+	ID    string
+	Roles []string
+	// How the caller authenticated, one of the Method constants.
+	Method string
+}
+
+// HasRole reports whether the principal was granted role.
+func (p Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator checks one kind of credentials.
+type Authenticator interface {
+	// Authenticate returns the principal the request's credentials belong
+	// to, ErrNoCredentials if it carries none of this kind, or an error
+	// wrapping ErrInvalidCredentials if they don't check out.
+	Authenticate(r *http.Request) (Principal, error)
+}
+
+type contextKey int
+
+const principalKey contextKey = iota
+
+// WithPrincipal returns a context carrying the authenticated principal.
+func WithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey, principal)
+}
+
+// PrincipalFromContext returns the principal the request was authenticated
+// as. It reports false if authentication is disabled.
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey).(Principal)
+	return principal, ok
+}
+
+// Middleware rejects requests that none of the authenticators accept by
+// calling reject, and otherwise puts the principal into the request
+// context and tags logs and spans with it. Authenticators are tried in
+// order; the first one finding credentials of its kind decides.
+func Middleware(
+	authenticators []Authenticator,
+	reject func(w http.ResponseWriter, r *http.Request, err error),
+) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, err := authenticate(authenticators, r)
+			if err != nil {
+				reject(w, r, err)
+				return
+			}
+
+			ctx := WithPrincipal(r.Context(), principal)
+			ctx = logging.Annotate(ctx, "principal", principal.ID, "auth_method", principal.Method)
+			tracing.Annotate(ctx, attribute.String("enduser.id", principal.ID))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func authenticate(authenticators []Authenticator, r *http.Request) (Principal, error) {
+	for _, authenticator := range authenticators {
+		principal, err := authenticator.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return principal, err
+	}
+	return Principal{}, ErrNoCredentials
+}
@@ -0,0 +1,223 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/temelpa/timetravel/entity"
+	"github.com/temelpa/timetravel/service"
+)
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	keys, err := service.NewInMemoryRecordService(service.InMemoryRecordServiceSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	id, secret, err := NewAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.CreateAPIKey(ctx, entity.APIKey{
+		ID:        id,
+		Principal: "billing",
+		Roles:     []string{"write"},
+		KeyHash:   HashAPIKey(secret),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	authenticator := NewAPIKeyAuthenticator(keys, "bootstrap")
+	authenticate := func(key string) (Principal, error) {
+		req := httptest.NewRequest("GET", "/api/v2/records/1", nil)
+		if key != "" {
+			req.Header.Set(APIKeyHeader, key)
+		}
+		return authenticator.Authenticate(req)
+	}
+
+	if _, err := authenticate(""); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("Expected no credentials, got error %v", err)
+	}
+	if _, err := authenticate("tt_wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Expected invalid credentials, got error %v", err)
+	}
+	principal, err := authenticate(secret)
+	if err != nil || principal.ID != "billing" || !principal.HasRole("write") || principal.Method != MethodAPIKey {
+		t.Errorf("Expected billing principal, got %v, error %v", principal, err)
+	}
+	principal, err = authenticate("bootstrap")
+	if err != nil || !principal.HasRole(RoleAdmin) {
+		t.Errorf("Expected bootstrap admin, got %v, error %v", principal, err)
+	}
+
+	if err := keys.RevokeAPIKey(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticate(secret); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Revoked key should be invalid, got error %v", err)
+	}
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, strangerKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encode := base64.RawURLEncoding.EncodeToString
+	jwks, err := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kid": "rsa",
+				"kty": "RSA",
+				"use": "sig",
+				"n":   encode(rsaKey.N.Bytes()),
+				"e":   encode(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{"kid": "ed", "kty": "OKP", "crv": "Ed25519", "x": encode(edPublic)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksFile, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	authenticator, err := NewJWTAuthenticator(JWTSettings{
+		JWKSFile: jwksFile,
+		Issuer:   "https://issuer.example",
+		Audience: "timetravel",
+	})
+	if err != nil {
+		t.Fatalf("Unable to load jwks, error %v", err)
+	}
+
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub":   "alice",
+			"iss":   "https://issuer.example",
+			"aud":   "timetravel",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"roles": []string{"read-current", "read-history"},
+		}
+	}
+	sign := func(method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	authenticate := func(authorization string) (Principal, error) {
+		req := httptest.NewRequest("GET", "/api/v2/records/1", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		return authenticator.Authenticate(req)
+	}
+
+	for _, test := range []struct {
+		name  string
+		token string
+	}{
+		{"rsa", sign(jwt.SigningMethodRS256, "rsa", rsaKey, validClaims())},
+		{"ed25519", sign(jwt.SigningMethodEdDSA, "ed", edPrivate, validClaims())},
+	} {
+		principal, err := authenticate("Bearer " + test.token)
+		if err != nil || principal.ID != "alice" || !principal.HasRole("read-history") || principal.Method != MethodJWT {
+			t.Errorf("%s: expected alice, got %v, error %v", test.name, principal, err)
+		}
+	}
+
+	if _, err := authenticate(""); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("Expected no credentials, got error %v", err)
+	}
+	if _, err := authenticate("Basic dXNlcjpwYXNz"); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("Other schemes carry no bearer token, got error %v", err)
+	}
+
+	expired := validClaims()
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	wrongAudience := validClaims()
+	wrongAudience["aud"] = "someone-else"
+	noExpiry := validClaims()
+	delete(noExpiry, "exp")
+	for _, test := range []struct {
+		name  string
+		token string
+	}{
+		{"garbage", "not-a-token"},
+		{"expired", sign(jwt.SigningMethodEdDSA, "ed", edPrivate, expired)},
+		{"wrong audience", sign(jwt.SigningMethodEdDSA, "ed", edPrivate, wrongAudience)},
+		{"no expiry", sign(jwt.SigningMethodEdDSA, "ed", edPrivate, noExpiry)},
+		{"unknown key", sign(jwt.SigningMethodEdDSA, "ed", strangerKey, validClaims())},
+		{"unknown kid", sign(jwt.SigningMethodEdDSA, "other", edPrivate, validClaims())},
+		{"hmac", sign(jwt.SigningMethodHS256, "ed", []byte(edPublic), validClaims())},
+	} {
+		if _, err := authenticate("Bearer " + test.token); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%s: expected invalid credentials, got error %v", test.name, err)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	keys, err := service.NewInMemoryRecordService(service.InMemoryRecordServiceSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rejected error
+	handler := Middleware(
+		[]Authenticator{NewAPIKeyAuthenticator(keys, "bootstrap")},
+		func(w http.ResponseWriter, r *http.Request, err error) {
+			rejected = err
+			w.WriteHeader(http.StatusUnauthorized)
+		},
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := PrincipalFromContext(r.Context())
+		if !ok || principal.ID != bootstrapPrincipal {
+			t.Errorf("Expected the bootstrap principal in the context, got %v", principal)
+		}
+	}))
+
+	req := httptest.NewRequest("GET", "/api/v2/records/1", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized || !errors.Is(rejected, ErrNoCredentials) {
+		t.Errorf("Expected rejection without credentials, got %v, error %v", rr.Code, rejected)
+	}
+
+	req.Header.Set(APIKeyHeader, "bootstrap")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected bootstrap key to be accepted, got %v", rr.Code)
+	}
+}
@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/temelpa/timetravel/entity"
+)
+
+// Operation is what a route does, and what policies grant.
+type Operation string
+
+const (
+	// Reading the latest version of a record.
+	OpReadCurrent Operation = "read-current"
+	// Reading older versions of a record, or its whole history.
+	OpReadHistory Operation = "read-history"
+	// Creating or updating a record.
+	OpWrite Operation = "write"
+	// Managing the server itself, e.g. API keys.
+	OpAdmin Operation = "admin"
+)
+
+var operations = map[Operation]bool{
+	OpReadCurrent: true,
+	OpReadHistory: true,
+	OpWrite:       true,
+	OpAdmin:       true,
+}
+
+// IDRange is an inclusive range of record ids.
+type IDRange = entity.IDRange
+
+// Rule grants a role some operations. Without ids or collections it applies
+// to every record; otherwise only to records whose id falls in one of the
+// ranges or collections.
+type Rule struct {
+	Role        string      `json:"role"`
+	Operations  []Operation `json:"operations"`
+	IDs         []IDRange   `json:"ids,omitempty"`
+	Collections []string    `json:"collections,omitempty"`
+}
+
+// Policy decides which operations principals may perform. Anything not
+// granted by a rule is denied.
+type Policy struct {
+	// Named sets of record id ranges rules can be scoped to.
+	Collections map[string][]IDRange `json:"collections,omitempty"`
+	Rules       []Rule               `json:"rules"`
+}
+
+// DefaultPolicy lets agents read and update current records, auditors read
+// history, and admins do anything.
+func DefaultPolicy() *Policy {
+	return &Policy{
+		Rules: []Rule{
+			{Role: "agent", Operations: []Operation{OpReadCurrent, OpWrite}},
+			{Role: "auditor", Operations: []Operation{OpReadHistory}},
+			{Role: RoleAdmin, Operations: []Operation{OpReadCurrent, OpReadHistory, OpWrite, OpAdmin}},
+		},
+	}
+}
+
+// LoadPolicy reads a JSON policy file and validates it.
+func LoadPolicy(path string) (*Policy, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy Policy
+	if err := json.Unmarshal(contents, &policy); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", path, err)
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", path, err)
+	}
+	return &policy, nil
+}
+
+// Validate reports the first rule or collection that can't be enforced.
+func (p *Policy) Validate() error {
+	for name, ranges := range p.Collections {
+		for _, r := range ranges {
+			if r.Min > r.Max {
+				return fmt.Errorf("collection %q has an empty id range %d-%d", name, r.Min, r.Max)
+			}
+		}
+	}
+	for i, rule := range p.Rules {
+		if rule.Role == "" {
+			return fmt.Errorf("rule %d has no role", i)
+		}
+		for _, op := range rule.Operations {
+			if !operations[op] {
+				return fmt.Errorf("rule %d grants unknown operation %q", i, op)
+			}
+		}
+		for _, r := range rule.IDs {
+			if r.Min > r.Max {
+				return fmt.Errorf("rule %d has an empty id range %d-%d", i, r.Min, r.Max)
+			}
+		}
+		for _, collection := range rule.Collections {
+			if _, ok := p.Collections[collection]; !ok {
+				return fmt.Errorf("rule %d is scoped to unknown collection %q", i, collection)
+			}
+		}
+	}
+	return nil
+}
+
+// Allows reports whether the principal may perform op on the record with
+// the given id. Operations that don't concern a single record pass an id
+// of 0, which only rules that aren't scoped match.
+func (p *Policy) Allows(principal Principal, op Operation, id int64) bool {
+	for _, rule := range p.Rules {
+		if principal.HasRole(rule.Role) && rule.grants(op) && p.covers(rule, id) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Rule) grants(op Operation) bool {
+	for _, granted := range r.Operations {
+		if granted == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) covers(rule Rule, id int64) bool {
+	if len(rule.IDs) == 0 && len(rule.Collections) == 0 {
+		return true
+	}
+	if id <= 0 {
+		return false
+	}
+	for _, r := range rule.IDs {
+		if r.Contains(id) {
+			return true
+		}
+	}
+	for _, collection := range rule.Collections {
+		for _, r := range p.Collections[collection] {
+			if r.Contains(id) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test what each role of the default policy may do
+func TestDefaultPolicy(t *testing.T) {
+	policy := DefaultPolicy()
+	if err := policy.Validate(); err != nil {
+		t.Fatalf("Default policy should be valid, got error %v", err)
+	}
+
+	for _, test := range []struct {
+		role    string
+		allowed map[Operation]bool
+	}{
+		{"agent", map[Operation]bool{OpReadCurrent: true, OpWrite: true}},
+		{"auditor", map[Operation]bool{OpReadHistory: true}},
+		{"admin", map[Operation]bool{OpReadCurrent: true, OpReadHistory: true, OpWrite: true, OpAdmin: true}},
+		{"stranger", map[Operation]bool{}},
+	} {
+		principal := Principal{ID: test.role, Roles: []string{test.role}}
+		for op := range operations {
+			if got := policy.Allows(principal, op, 42); got != test.allowed[op] {
+				t.Errorf("%s: expected %s allowed to be %v, got %v", test.role, op, test.allowed[op], got)
+			}
+		}
+	}
+
+	if policy.Allows(Principal{ID: "nobody"}, OpReadCurrent, 42) {
+		t.Errorf("A principal without roles should be denied")
+	}
+}
+
+// Test rules scoped to id ranges and collections
+func TestScopedPolicy(t *testing.T) {
+	policy := &Policy{
+		Collections: map[string][]IDRange{
+			"claims": {{Min: 1000, Max: 1999}, {Min: 5000, Max: 5000}},
+		},
+		Rules: []Rule{
+			{Role: "claims-agent", Operations: []Operation{OpReadCurrent, OpWrite}, Collections: []string{"claims"}},
+			{Role: "intern", Operations: []Operation{OpReadCurrent}, IDs: []IDRange{{Min: 1, Max: 10}}},
+			{Role: "scoped-admin", Operations: []Operation{OpAdmin}, IDs: []IDRange{{Min: 1, Max: 10}}},
+		},
+	}
+	if err := policy.Validate(); err != nil {
+		t.Fatalf("Policy should be valid, got error %v", err)
+	}
+
+	claimsAgent := Principal{ID: "c", Roles: []string{"claims-agent"}}
+	intern := Principal{ID: "i", Roles: []string{"intern"}}
+	both := Principal{ID: "b", Roles: []string{"intern", "claims-agent"}}
+	for _, test := range []struct {
+		principal Principal
+		op        Operation
+		id        int64
+		allowed   bool
+	}{
+		{claimsAgent, OpWrite, 1000, true},
+		{claimsAgent, OpWrite, 1999, true},
+		{claimsAgent, OpWrite, 5000, true},
+		{claimsAgent, OpWrite, 2000, false},
+		{claimsAgent, OpReadHistory, 1000, false},
+		{intern, OpReadCurrent, 10, true},
+		{intern, OpReadCurrent, 11, false},
+		{intern, OpWrite, 5, false},
+		{both, OpReadCurrent, 5, true},
+		{both, OpWrite, 1500, true},
+		{both, OpWrite, 5, false},
+		// Scoped rules never grant operations that aren't about one record
+		{Principal{ID: "s", Roles: []string{"scoped-admin"}}, OpAdmin, 0, false},
+	} {
+		if got := policy.Allows(test.principal, test.op, test.id); got != test.allowed {
+			t.Errorf("%v %s on %d: expected %v, got %v", test.principal.Roles, test.op, test.id, test.allowed, got)
+		}
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	dir := t.TempDir()
+	load := func(contents string) (*Policy, error) {
+		path := filepath.Join(dir, "policy.json")
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return LoadPolicy(path)
+	}
+
+	policy, err := load(`{
+		"collections": {"claims": [{"min": 1, "max": 99}]},
+		"rules": [{"role": "agent", "operations": ["read-current"], "collections": ["claims"]}]
+	}`)
+	if err != nil || !policy.Allows(Principal{Roles: []string{"agent"}}, OpReadCurrent, 50) {
+		t.Errorf("Expected a working policy, got %v, error %v", policy, err)
+	}
+
+	for _, contents := range []string{
+		`not json`,
+		`{"rules": [{"operations": ["write"]}]}`,
+		`{"rules": [{"role": "agent", "operations": ["delete"]}]}`,
+		`{"rules": [{"role": "agent", "operations": ["write"], "ids": [{"min": 5, "max": 1}]}]}`,
+		`{"rules": [{"role": "agent", "operations": ["write"], "collections": ["missing"]}]}`,
+		`{"collections": {"claims": [{"min": 9, "max": 1}]}, "rules": []}`,
+	} {
+		if _, err := load(contents); err == nil {
+			t.Errorf("Expected %s to be rejected", contents)
+		}
+	}
+}
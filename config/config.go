@@ -0,0 +1,459 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/temelpa/timetravel/auth"
+	"github.com/temelpa/timetravel/entity"
+	"github.com/temelpa/timetravel/service"
+	"github.com/temelpa/timetravel/tracing"
+)
+
+// Storage backends the server can run on.
+const (
+	StorageSQLite = "sqlite"
+	StorageMemory = "memory"
+	// PostgreSQL, for several replicas sharing one database.
+	StoragePostgres = "postgres"
+	// bbolt, an embedded key-value store, for heavy write volumes.
+	StorageBolt = "bolt"
+)
+
+// Prefix for environment variables overriding settings, e.g.
+// TIMETRAVEL_ADDRESS for -address.
+const EnvPrefix = "TIMETRAVEL_"
+
+// Config holds everything needed to start the server.
+//
+// Settings are resolved in order of increasing precedence: defaults, the
+// JSON config file given by -config, TIMETRAVEL_* environment variables,
+// then command-line flags.
+type Config struct {
+	ConfigFile string
+
+	Address      string
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// How long to wait for in-flight requests on SIGINT/SIGTERM before
+	// closing the storage backend anyway.
+	ShutdownTimeout time.Duration
+
+	Storage      string
+	DatabaseDir  string
+	ResetOnStart bool
+	// Connection string of the postgres backend, as a URL or key=value
+	// pairs; prefer the environment variable, since it may hold a password.
+	PostgresDSN string
+
+	// How often the memory backend snapshots to DatabaseDir. Zero disables
+	// snapshots, so nothing written to the memory backend survives a restart.
+	SnapshotInterval time.Duration
+
+	// Whether the memory backend logs every write to DatabaseDir before
+	// applying it, so writes since the last snapshot survive a crash, and
+	// when the log is flushed: always, interval or never.
+	WriteAheadLog   bool
+	WALSync         string
+	WALSyncInterval time.Duration
+
+	// Connection settings of the sqlite backend: its journal mode, one of
+	// wal, delete, truncate or persist; how durable each commit is, one of
+	// normal, full or extra; how long to wait on a locked database; and how
+	// many connections readers may hold open in WAL mode.
+	SQLiteJournalMode     string
+	SQLiteSynchronous     string
+	SQLiteBusyTimeout     time.Duration
+	SQLiteReadConnections int
+
+	// How many reconstructed historical versions the sqlite backend keeps in
+	// memory; 0 disables the cache.
+	VersionCacheSize int
+
+	IdempotencyKeyTTL time.Duration
+
+	LogLevel slog.Level
+
+	// Where to send traces, one of none, stdout or otlp, and the OTLP/HTTP
+	// collector to use for the latter.
+	TraceExporter string
+	OTLPEndpoint  string
+
+	// Comma-separated ways /api requests may authenticate, api_key and/or
+	// jwt, or none to leave the API open.
+	AuthMethods string
+	// A key granting the admin role, to create the first stored API keys.
+	AdminAPIKey string
+	// Keys and expected claims for JWT bearer tokens.
+	JWKSFile    string
+	JWTIssuer   string
+	JWTAudience string
+	// JSON policy deciding what authenticated principals may do. The
+	// default policy is used if empty.
+	PolicyFile string
+
+	// JSON config of record fields to mask or omit in responses, unless
+	// the caller has a role allowed to see them.
+	RedactionFile string
+
+	// Keys record data is encrypted at rest with, as a file or inline,
+	// e.g. from TIMETRAVEL_ENCRYPTION_KEYS. See encryption.ParseKeyring.
+	EncryptionKeyFile string
+	EncryptionKeys    string
+
+	// JSON retention policy deciding which old versions of records the
+	// sqlite backend compacts away, and how often it does. Every version
+	// is kept if empty.
+	RetentionFile      string
+	CompactionInterval time.Duration
+
+	// Instead of serving, check every record's history in the sqlite
+	// database against its hash chain, then exit.
+	Verify bool
+
+	// Instead of serving, write every record in the sqlite database with
+	// its history to this file as NDJSON, or to stdout if it's "-", then
+	// exit. The export can be narrowed to an id range, as "min-max", and to
+	// the versions written by a time, in RFC 3339.
+	Export     string
+	ExportIDs  string
+	ExportAsOf string
+
+	// Instead of serving, read records with their histories from this
+	// NDJSON file, or from stdin if it's "-", in the format export writes,
+	// write them to the sqlite database, then exit.
+	Import string
+
+	// Instead of serving, write a consistent copy of the sqlite database to
+	// this file, then exit. It can run while a server uses the database.
+	Backup string
+
+	// Instead of serving, replace the sqlite database with a copy of this
+	// backup, then exit. The server must be stopped. The copy can be
+	// rewound to a change sequence, or to the versions written by an RFC
+	// 3339 time.
+	Restore         string
+	RestoreSequence string
+	RestoreAsOf     string
+}
+
+// Value of AuthMethods leaving the API unauthenticated.
+const AuthNone = "none"
+
+// Load resolves the configuration from the command-line arguments (without
+// the program name), the environment and the config file, and validates it.
+func Load(args []string, getenv func(string) string) (Config, error) {
+	var cfg Config
+	var logLevel string
+
+	fs := flag.NewFlagSet("timetravel", flag.ContinueOnError)
+	fs.StringVar(&cfg.ConfigFile, "config", "", "path to a JSON config file")
+	fs.StringVar(&cfg.Address, "address", "127.0.0.1:8000", "host:port to listen on")
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", 15*time.Second, "maximum duration for reading a request, except streams")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout", 15*time.Second, "maximum duration for writing a response, except streams")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", 15*time.Second, "maximum duration to drain in-flight requests on shutdown")
+	fs.StringVar(&cfg.Storage, "storage", StorageSQLite, "storage backend, one of sqlite, memory, postgres or bolt")
+	fs.StringVar(&cfg.DatabaseDir, "db-dir", "rainbow_test", "directory holding the database or snapshots")
+	fs.BoolVar(&cfg.ResetOnStart, "reset-on-start", false, "purge the sqlite, postgres or bolt database at startup")
+	fs.StringVar(&cfg.PostgresDSN, "postgres-dsn", "", "connection string of the postgres database; prefer the environment variable")
+	fs.DurationVar(&cfg.SnapshotInterval, "snapshot-interval", 0, "how often the memory backend snapshots to disk; 0 disables")
+	fs.BoolVar(&cfg.WriteAheadLog, "wal", false, "log every write of the memory backend to disk, to replay after a crash")
+	fs.StringVar(&cfg.WALSync, "wal-sync", string(service.LogSyncAlways), "when the write-ahead log is flushed to disk, one of always, interval or never")
+	fs.DurationVar(&cfg.WALSyncInterval, "wal-sync-interval", time.Second, "how often the write-ahead log is flushed with -wal-sync interval")
+	fs.StringVar(&cfg.SQLiteJournalMode, "sqlite-journal-mode", string(service.DefaultSQLiteJournalMode), "journal mode of the sqlite database, one of wal, delete, truncate or persist")
+	fs.StringVar(&cfg.SQLiteSynchronous, "sqlite-synchronous", string(service.DefaultSQLiteSynchronous), "how durable each sqlite commit is, one of normal, full or extra")
+	fs.DurationVar(&cfg.SQLiteBusyTimeout, "sqlite-busy-timeout", service.DefaultSQLiteBusyTimeout, "how long to wait for a lock on the sqlite database")
+	fs.IntVar(&cfg.SQLiteReadConnections, "sqlite-read-connections", service.DefaultSQLiteReadConnections, "how many connections sqlite readers may hold open in wal mode")
+	fs.IntVar(&cfg.VersionCacheSize, "version-cache-size", service.DefaultVersionCacheSize, "how many historical versions the sqlite backend caches; 0 disables")
+	fs.DurationVar(&cfg.IdempotencyKeyTTL, "idempotency-key-ttl", 24*time.Hour, "how long idempotent responses are replayed")
+	fs.StringVar(&logLevel, "log-level", "info", "one of debug, info, warn or error")
+	fs.StringVar(&cfg.TraceExporter, "trace-exporter", tracing.ExporterNone, "where to send traces, one of none, stdout or otlp")
+	fs.StringVar(&cfg.OTLPEndpoint, "otlp-endpoint", "localhost:4318", "host:port of the OTLP/HTTP trace collector")
+	fs.StringVar(&cfg.AuthMethods, "auth-methods", AuthNone, "comma-separated authentication methods, api_key and/or jwt, or none")
+	fs.StringVar(&cfg.AdminAPIKey, "admin-api-key", "", "bootstrap API key granting the admin role")
+	fs.StringVar(&cfg.JWKSFile, "jwks-file", "", "JWKS file holding the keys JWTs are signed with")
+	fs.StringVar(&cfg.JWTIssuer, "jwt-issuer", "", "required JWT issuer, if any")
+	fs.StringVar(&cfg.JWTAudience, "jwt-audience", "", "required JWT audience, if any")
+	fs.StringVar(&cfg.PolicyFile, "policy-file", "", "JSON authorization policy; defaults to the built-in agent/auditor/admin roles")
+	fs.StringVar(&cfg.RedactionFile, "redaction-file", "", "JSON config of sensitive record fields to mask or omit by role")
+	fs.StringVar(&cfg.EncryptionKeyFile, "encryption-key-file", "", "file of id:base64key encryption keys, current key first")
+	fs.StringVar(&cfg.EncryptionKeys, "encryption-keys", "", "comma-separated id:base64key encryption keys, current key first; prefer the environment variable")
+	fs.StringVar(&cfg.RetentionFile, "retention-file", "", "JSON retention policy of old versions to compact away; keeps every version if empty")
+	fs.DurationVar(&cfg.CompactionInterval, "compaction-interval", 24*time.Hour, "how often history is compacted under the retention policy")
+	fs.BoolVar(&cfg.Verify, "verify", false, "verify the history of every record in the sqlite database against its hash chain, then exit")
+	fs.StringVar(&cfg.Export, "export", "", "write every record in the sqlite database with its history to this file as NDJSON, or to stdout if -, then exit")
+	fs.StringVar(&cfg.ExportIDs, "export-ids", "", "only export records with ids in this range, as min-max")
+	fs.StringVar(&cfg.ExportAsOf, "export-as-of", "", "only export versions written by this RFC 3339 time")
+	fs.StringVar(&cfg.Backup, "backup", "", "write a consistent copy of the sqlite database to this file, then exit")
+	fs.StringVar(&cfg.Restore, "restore", "", "replace the sqlite database with this backup, then exit; stop the server first")
+	fs.StringVar(&cfg.RestoreSequence, "restore-sequence", "", "rewind the restored database to this change sequence")
+	fs.StringVar(&cfg.RestoreAsOf, "restore-as-of", "", "rewind the restored database to the versions written by this RFC 3339 time")
+	fs.StringVar(&cfg.Import, "import", "", "write records with their histories from this NDJSON file, or from stdin if -, to the sqlite database, then exit")
+
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if fs.NArg() != 0 {
+		return Config{}, fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+
+	// Anything given on the command line wins over the environment and file
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	if cfg.ConfigFile == "" {
+		cfg.ConfigFile = getenv(envName("config"))
+	}
+	if cfg.ConfigFile != "" {
+		if err := applyFile(fs, cfg.ConfigFile, explicit); err != nil {
+			return Config{}, err
+		}
+	}
+
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		value := getenv(envName(f.Name))
+		if value == "" || explicit[f.Name] || envErr != nil {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			envErr = fmt.Errorf("invalid value %q for %s: %w", value, envName(f.Name), err)
+		}
+	})
+	if envErr != nil {
+		return Config{}, envErr
+	}
+
+	if err := cfg.LogLevel.UnmarshalText([]byte(logLevel)); err != nil {
+		return Config{}, fmt.Errorf("invalid log level %q", logLevel)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// Validate reports the first setting that can't be used to start the server.
+func (c Config) Validate() error {
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		return fmt.Errorf("invalid address %q: %w", c.Address, err)
+	}
+	if c.ReadTimeout <= 0 || c.WriteTimeout <= 0 || c.ShutdownTimeout <= 0 {
+		return errors.New("read, write and shutdown timeouts must be positive")
+	}
+	switch c.Storage {
+	case StorageSQLite, StorageMemory, StorageBolt:
+	case StoragePostgres:
+		if c.PostgresDSN == "" {
+			return errors.New("the postgres backend requires a postgres dsn")
+		}
+	default:
+		return fmt.Errorf("unknown storage backend %q", c.Storage)
+	}
+	if c.DatabaseDir == "" && (c.Storage == StorageSQLite || c.Storage == StorageBolt || c.SnapshotInterval > 0 || c.WriteAheadLog) {
+		return errors.New("a database directory is required")
+	}
+	if c.SnapshotInterval < 0 {
+		return errors.New("snapshot interval must not be negative")
+	}
+	if c.SnapshotInterval > 0 && c.Storage != StorageMemory {
+		return errors.New("snapshot interval only applies to the memory backend")
+	}
+	if c.WriteAheadLog && c.Storage != StorageMemory {
+		return errors.New("the write-ahead log only applies to the memory backend")
+	}
+	switch c.WALSync {
+	case string(service.LogSyncAlways), string(service.LogSyncInterval), string(service.LogSyncNever):
+	default:
+		return fmt.Errorf("unknown write-ahead log sync policy %q", c.WALSync)
+	}
+	if c.WALSyncInterval <= 0 {
+		return errors.New("write-ahead log sync interval must be positive")
+	}
+	switch service.SQLiteJournalMode(c.SQLiteJournalMode) {
+	case service.SQLiteJournalWAL, service.SQLiteJournalDelete, service.SQLiteJournalTruncate, service.SQLiteJournalPersist:
+	default:
+		return fmt.Errorf("unknown sqlite journal mode %q", c.SQLiteJournalMode)
+	}
+	switch service.SQLiteSynchronous(c.SQLiteSynchronous) {
+	case service.SQLiteSynchronousNormal, service.SQLiteSynchronousFull, service.SQLiteSynchronousExtra:
+	default:
+		return fmt.Errorf("unknown sqlite synchronous level %q", c.SQLiteSynchronous)
+	}
+	if c.SQLiteBusyTimeout <= 0 {
+		return errors.New("sqlite busy timeout must be positive")
+	}
+	if c.SQLiteReadConnections <= 0 {
+		return errors.New("sqlite read connections must be positive")
+	}
+	if c.VersionCacheSize < 0 {
+		return errors.New("version cache size can't be negative")
+	}
+	if c.IdempotencyKeyTTL <= 0 {
+		return errors.New("idempotency key ttl must be positive")
+	}
+	switch c.TraceExporter {
+	case tracing.ExporterNone, tracing.ExporterStdout:
+	case tracing.ExporterOTLP:
+		if _, _, err := net.SplitHostPort(c.OTLPEndpoint); err != nil {
+			return fmt.Errorf("invalid otlp endpoint %q: %w", c.OTLPEndpoint, err)
+		}
+	default:
+		return fmt.Errorf("unknown trace exporter %q", c.TraceExporter)
+	}
+	methods := map[string]bool{}
+	for _, method := range c.AuthMethodList() {
+		if method != auth.MethodAPIKey && method != auth.MethodJWT {
+			return fmt.Errorf("unknown auth method %q", method)
+		}
+		methods[method] = true
+	}
+	if methods[auth.MethodJWT] && c.JWKSFile == "" {
+		return errors.New("jwt authentication requires a jwks file")
+	}
+	if c.AdminAPIKey != "" && !methods[auth.MethodAPIKey] {
+		return errors.New("an admin api key requires api_key authentication")
+	}
+	if c.PolicyFile != "" && len(methods) == 0 {
+		return errors.New("an authorization policy requires authentication")
+	}
+	if c.EncryptionKeyFile != "" && c.EncryptionKeys != "" {
+		return errors.New("give encryption keys either as a file or inline, not both")
+	}
+	if (c.EncryptionKeyFile != "" || c.EncryptionKeys != "") && c.Storage != StorageSQLite {
+		return errors.New("encryption at rest only applies to the sqlite backend")
+	}
+	if c.RetentionFile != "" && c.Storage != StorageSQLite {
+		return errors.New("retention only applies to the sqlite backend")
+	}
+	if c.CompactionInterval <= 0 {
+		return errors.New("compaction interval must be positive")
+	}
+	// Each of these modes runs instead of the server, and exits
+	var modes []string
+	for _, mode := range []struct {
+		flag string
+		set  bool
+	}{
+		{"-verify", c.Verify},
+		{"-export", c.Export != ""},
+		{"-import", c.Import != ""},
+		{"-backup", c.Backup != ""},
+		{"-restore", c.Restore != ""},
+	} {
+		if mode.set {
+			modes = append(modes, mode.flag)
+		}
+	}
+	if len(modes) > 1 {
+		return fmt.Errorf("%s can't run together; set at most one", strings.Join(modes, ", "))
+	}
+	if c.Verify && c.Storage != StorageSQLite {
+		return errors.New("verification only applies to the sqlite backend")
+	}
+	if c.Verify && c.ResetOnStart {
+		return errors.New("verification can't reset the database it verifies")
+	}
+	if c.Export != "" && c.Storage != StorageSQLite {
+		return errors.New("export only applies to the sqlite backend")
+	}
+	if c.Export != "" && c.ResetOnStart {
+		return errors.New("export can't reset the database it exports")
+	}
+	if (c.ExportIDs != "" || c.ExportAsOf != "") && c.Export == "" {
+		return errors.New("export filters require -export")
+	}
+	if _, err := c.ExportFilter(); err != nil {
+		return err
+	}
+	if c.Import != "" && c.Storage != StorageSQLite {
+		return errors.New("import only applies to the sqlite backend")
+	}
+	if (c.Backup != "" || c.Restore != "") && c.Storage != StorageSQLite {
+		return errors.New("backup and restore only apply to the sqlite backend")
+	}
+	if c.Restore != "" && c.ResetOnStart {
+		return errors.New("restore can't reset the database it restores")
+	}
+	if (c.RestoreSequence != "" || c.RestoreAsOf != "") && c.Restore == "" {
+		return errors.New("restore points require -restore")
+	}
+	if _, err := c.RestorePoint(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// RestorePoint returns what -restore-sequence or -restore-as-of rewind to.
+func (c Config) RestorePoint() (entity.RestorePoint, error) {
+	return entity.ParseRestorePoint(c.RestoreSequence, c.RestoreAsOf)
+}
+
+// ExportFilter returns what -export-ids and -export-as-of select.
+func (c Config) ExportFilter() (entity.ExportFilter, error) {
+	return entity.ParseExportFilter(c.ExportIDs, c.ExportAsOf)
+}
+
+// AuthMethodList returns the enabled authentication methods, none if the
+// API is open.
+func (c Config) AuthMethodList() []string {
+	if c.AuthMethods == AuthNone || c.AuthMethods == "" {
+		return nil
+	}
+	var methods []string
+	for _, method := range strings.Split(c.AuthMethods, ",") {
+		methods = append(methods, strings.TrimSpace(method))
+	}
+	return methods
+}
+
+// applyFile sets every flag named in the JSON object in path, unless it was
+// already given on the command line.
+func applyFile(fs *flag.FlagSet, path string, explicit map[string]bool) error {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Numbers are kept as written, since as floats large ones would be
+	// passed on as 1e+06
+	var settings map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.UseNumber()
+	if err := decoder.Decode(&settings); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	if decoder.More() {
+		return fmt.Errorf("invalid config file %s: trailing data after settings", path)
+	}
+
+	for name, value := range settings {
+		if fs.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("unknown setting %q in config file %s", name, path)
+		}
+		if explicit[name] {
+			continue
+		}
+		if err := fs.Set(name, fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("invalid value %v for %q in config file %s: %w", value, name, path, err)
+		}
+	}
+	return nil
+}
+
+// envName maps a flag name onto the environment variable overriding it.
+func envName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
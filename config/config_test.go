@@ -0,0 +1,143 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// Test that flags beat the environment, which beats the config file, which beats defaults
+func TestLoadPrecedence(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configFile, []byte(`{
+		"address": "0.0.0.0:9000",
+		"storage": "memory",
+		"db-dir": "from_file",
+		"snapshot-interval": "1m",
+		"log-level": "warn",
+		"version-cache-size": 1000000
+	}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"TIMETRAVEL_CONFIG":  configFile,
+		"TIMETRAVEL_DB_DIR":  "from_env",
+		"TIMETRAVEL_ADDRESS": "0.0.0.0:9001",
+	}
+	cfg, err := Load([]string{"-address", "0.0.0.0:9002"}, func(key string) string {
+		return env[key]
+	})
+	if err != nil {
+		t.Fatalf("Unable to load config, error %v", err)
+	}
+
+	if cfg.Address != "0.0.0.0:9002" {
+		t.Errorf("Expected flag to win, got address %s", cfg.Address)
+	}
+	if cfg.DatabaseDir != "from_env" {
+		t.Errorf("Expected environment to win over file, got db dir %s", cfg.DatabaseDir)
+	}
+	if cfg.Storage != StorageMemory || cfg.SnapshotInterval != time.Minute || cfg.LogLevel != slog.LevelWarn {
+		t.Errorf("Expected settings from config file, got %+v", cfg)
+	}
+	if cfg.VersionCacheSize != 1000000 {
+		t.Errorf("Expected large number from config file, got version cache size %d", cfg.VersionCacheSize)
+	}
+	if cfg.ReadTimeout != 15*time.Second {
+		t.Errorf("Expected default read timeout, got %v", cfg.ReadTimeout)
+	}
+}
+
+// Test that unusable settings are rejected at startup
+func TestLoadValidation(t *testing.T) {
+	noEnv := func(string) string { return "" }
+
+	for _, args := range [][]string{
+		{"-address", "nope"},
+		{"-storage", "mysql"},
+		{"-storage", "postgres"},
+		{"-storage", "bolt", "-db-dir", ""},
+		{"-storage", "bolt", "-verify"},
+		{"-read-timeout", "0s"},
+		{"-log-level", "loud"},
+		{"-snapshot-interval", "1m"},
+		{"-storage", "memory", "-snapshot-interval", "-1m"},
+		{"-wal"},
+		{"-storage", "memory", "-wal", "-db-dir", ""},
+		{"-storage", "memory", "-wal", "-wal-sync", "sometimes"},
+		{"-storage", "memory", "-wal", "-wal-sync-interval", "0s"},
+		{"-sqlite-journal-mode", "off"},
+		{"-sqlite-synchronous", "off"},
+		{"-sqlite-busy-timeout", "0s"},
+		{"-sqlite-read-connections", "0"},
+		{"-version-cache-size", "-1"},
+		{"-db-dir", ""},
+		{"-trace-exporter", "jaeger"},
+		{"-trace-exporter", "otlp", "-otlp-endpoint", "collector"},
+		{"-auth-methods", "password"},
+		{"-auth-methods", "jwt"},
+		{"-admin-api-key", "secret"},
+		{"-policy-file", "policy.json"},
+		{"-encryption-key-file", "keys", "-encryption-keys", "a:b"},
+		{"-storage", "memory", "-encryption-keys", "a:b"},
+		{"-storage", "memory", "-verify"},
+		{"-verify", "-reset-on-start"},
+		{"-storage", "memory", "-export", "-"},
+		{"-export", "-", "-verify"},
+		{"-export-ids", "1-10"},
+		{"-export", "-", "-export-ids", "10-1"},
+		{"-export", "-", "-export-as-of", "yesterday"},
+		{"-storage", "memory", "-import", "-"},
+		{"-import", "-", "-export", "out.ndjson"},
+		{"-storage", "memory", "-backup", "copy.db"},
+		{"-backup", "copy.db", "-restore", "copy.db"},
+		{"-backup", "copy.db", "-verify"},
+		{"-restore", "copy.db", "-import", "-"},
+		{"-restore", "copy.db", "-reset-on-start"},
+		{"-restore-sequence", "10"},
+		{"-restore", "copy.db", "-restore-sequence", "0"},
+		{"-restore", "copy.db", "-restore-as-of", "yesterday"},
+		{"-restore", "copy.db", "-restore-sequence", "10", "-restore-as-of", "2024-01-01T00:00:00Z"},
+		{"-storage", "memory", "-retention-file", "retention.json"},
+		{"-compaction-interval", "0s"},
+		{"extra"},
+	} {
+		if _, err := Load(args, noEnv); err == nil {
+			t.Errorf("Expected %v to be rejected", args)
+		}
+	}
+
+	if _, err := Load(nil, func(key string) string {
+		if key == "TIMETRAVEL_WRITE_TIMEOUT" {
+			return "soon"
+		}
+		return ""
+	}); err == nil {
+		t.Errorf("Expected malformed environment variable to be rejected")
+	}
+
+	if _, err := Load(nil, noEnv); err != nil {
+		t.Errorf("Defaults should be valid, got error %v", err)
+	}
+
+	cfg, err := Load([]string{"-auth-methods", "api_key, jwt", "-jwks-file", "jwks.json"}, noEnv)
+	if err != nil || !cmp.Equal(cfg.AuthMethodList(), []string{"api_key", "jwt"}) {
+		t.Errorf("Expected both auth methods, got %v, error %v", cfg.AuthMethodList(), err)
+	}
+
+	dsn := "postgres://timetravel@db/timetravel"
+	cfg, err = Load([]string{"-storage", "postgres"}, func(key string) string {
+		if key == "TIMETRAVEL_POSTGRES_DSN" {
+			return dsn
+		}
+		return ""
+	})
+	if err != nil || cfg.PostgresDSN != dsn {
+		t.Errorf("Expected the postgres dsn from the environment, got %q, error %v", cfg.PostgresDSN, err)
+	}
+}
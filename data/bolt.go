@@ -0,0 +1,36 @@
+package data
+
+// The bbolt store keeps each table of the SQLite schema in a bucket of the
+// same name. Keys are big-endian, so a record's rows sort together and in
+// version order:
+//
+//	records:          id                        -> the record's latest version
+//	record_deltas:    id, versionBeforeDelta    -> inverse delta, hash, createdAt
+//	record_erasures:  id, sequence              -> erasure marker
+//	idempotency_keys: key                       -> idempotent response
+//	api_keys:         id                        -> api key
+//	api_key_hashes:   key hash                  -> api key id
+//
+// Values are JSON. Encryption at rest and retention are only supported by
+// the SQLite backend.
+const TIMETRAVEL_BOLT_DB = "timetravel.bolt"
+
+// Stored under SCHEMA_VERSION_KEY in the meta bucket. Bump this whenever
+// the buckets above change shape, as with SCHEMA_VERSION.
+const BOLT_SCHEMA_VERSION = 1
+
+const META_BUCKET = "meta"
+const SCHEMA_VERSION_KEY = "schema_version"
+
+// Looks up api keys by their hash, which is how callers authenticate.
+const API_KEY_HASHES_BUCKET = "api_key_hashes"
+
+var BOLT_BUCKETS = []string{
+	META_BUCKET,
+	RECORDS_TABLE,
+	RECORD_DELTAS_TABLE,
+	RECORD_ERASURES_TABLE,
+	IDEMPOTENCY_KEYS_TABLE,
+	API_KEYS_TABLE,
+	API_KEY_HASHES_BUCKET,
+}
@@ -0,0 +1,146 @@
+package data
+
+// The PostgreSQL schema mirrors the SQLite one, bar encryption at rest and
+// retention, which only the SQLite backend supports. Statements use
+// Postgres' numbered placeholders, and are prefixed with PG_.
+
+// Stored in the schema_version table. Bump this whenever the tables below
+// change shape, as with SCHEMA_VERSION.
+const PG_SCHEMA_VERSION = 1
+
+const SCHEMA_VERSION_TABLE = "schema_version"
+const PG_CREATE_SCHEMA_VERSION_TABLE = `CREATE TABLE IF NOT EXISTS ` +
+	SCHEMA_VERSION_TABLE + `(
+		version INTEGER NOT NULL
+	);`
+const PG_QUERY_SCHEMA_VERSION = `SELECT COALESCE(MAX(version), 0) FROM ` + SCHEMA_VERSION_TABLE
+const PG_UPDATE_SCHEMA_VERSION = `INSERT INTO ` + SCHEMA_VERSION_TABLE + ` (version) VALUES ($1)`
+
+// Held for the length of a migration, so replicas starting together don't
+// race to create the same tables.
+const PG_MIGRATION_LOCK = `SELECT pg_advisory_xact_lock(7454817)`
+
+const PG_DROP_TABLES = `DROP TABLE IF EXISTS ` +
+	RECORDS_TABLE + `, ` +
+	RECORD_DELTAS_TABLE + `, ` +
+	IDEMPOTENCY_KEYS_TABLE + `, ` +
+	API_KEYS_TABLE + `, ` +
+	RECORD_ERASURES_TABLE + `, ` +
+	SCHEMA_VERSION_TABLE
+
+const PG_CREATE_RECORDS_TABLE = `CREATE TABLE IF NOT EXISTS ` +
+	RECORDS_TABLE + `(
+		id BIGINT PRIMARY KEY,
+		version INTEGER NOT NULL,
+		jsonData TEXT NOT NULL
+	);`
+
+// Inserts nothing if the record exists. If another transaction is creating
+// it, this waits to see whether it commits.
+const PG_INSERT_RECORD = `INSERT INTO ` + RECORDS_TABLE +
+	` (id, version, jsonData) VALUES ($1, 1, $2) ON CONFLICT (id) DO NOTHING`
+const PG_UPDATE_RECORD = `UPDATE ` + RECORDS_TABLE +
+	` SET version = $1, jsonData = $2 WHERE id = $3`
+const PG_QUERY_RECORD = `SELECT id, version, jsonData FROM ` + RECORDS_TABLE +
+	` WHERE id = $1`
+const PG_QUERY_RECORD_VERSION = `SELECT version FROM ` + RECORDS_TABLE + ` WHERE id = $1`
+
+// Writers lock the record's row for the rest of their transaction, so
+// concurrent updates to a record apply one after the other.
+const PG_QUERY_RECORD_FOR_UPDATE = PG_QUERY_RECORD + ` FOR UPDATE`
+
+const PG_CREATE_RECORD_DELTAS_TABLE = `CREATE TABLE IF NOT EXISTS ` +
+	RECORD_DELTAS_TABLE + `(
+		id BIGINT NOT NULL,
+		versionBeforeDelta INTEGER NOT NULL,
+		inverseDelta TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		createdAt BIGINT NOT NULL,
+		PRIMARY KEY (id, versionBeforeDelta)
+	);`
+const PG_INSERT_RECORD_DELTA = `INSERT INTO ` + RECORD_DELTAS_TABLE +
+	` (id, versionBeforeDelta, inverseDelta, hash, createdAt) VALUES ($1, $2, $3, $4, $5)`
+const PG_QUERY_RECORD_DELTA_HASH = `SELECT hash, createdAt FROM ` + RECORD_DELTAS_TABLE +
+	` WHERE id = $1 AND versionBeforeDelta = $2`
+const PG_QUERY_RECORD_DELTA_HASHES = `SELECT versionBeforeDelta, hash, createdAt FROM ` + RECORD_DELTAS_TABLE +
+	` WHERE id = $1 ORDER BY versionBeforeDelta ASC`
+const PG_UPDATE_RECORD_DELTA_HASH = `UPDATE ` + RECORD_DELTAS_TABLE +
+	` SET hash = $1 WHERE id = $2 AND versionBeforeDelta = $3`
+const PG_QUERY_RECORD_DELTAS = `SELECT versionBeforeDelta, inverseDelta FROM ` + RECORD_DELTAS_TABLE +
+	` WHERE versionBeforeDelta >= $1 AND id = $2
+	  ORDER BY versionBeforeDelta DESC`
+const PG_UPDATE_RECORD_DELTA = `UPDATE ` + RECORD_DELTAS_TABLE +
+	` SET inverseDelta = $1 WHERE id = $2 AND versionBeforeDelta = $3`
+
+const PG_CREATE_IDEMPOTENCY_KEYS_TABLE = `CREATE TABLE IF NOT EXISTS ` +
+	IDEMPOTENCY_KEYS_TABLE + `(
+		idempotencyKey TEXT PRIMARY KEY,
+		requestHash TEXT NOT NULL,
+		statusCode INTEGER NOT NULL,
+		response BYTEA NOT NULL,
+		createdAt BIGINT NOT NULL,
+		recordID BIGINT NOT NULL DEFAULT 0
+	);`
+
+// Stores a response unless a live one, created no earlier than $7, is
+// stored for the key. Nothing being inserted or updated means the key is
+// in use.
+const PG_CLAIM_IDEMPOTENCY_KEY = `INSERT INTO ` + IDEMPOTENCY_KEYS_TABLE +
+	` (idempotencyKey, requestHash, statusCode, response, createdAt, recordID) VALUES ($1, $2, $3, $4, $5, $6)
+	  ON CONFLICT (idempotencyKey) DO UPDATE SET
+		requestHash = EXCLUDED.requestHash,
+		statusCode = EXCLUDED.statusCode,
+		response = EXCLUDED.response,
+		createdAt = EXCLUDED.createdAt,
+		recordID = EXCLUDED.recordID
+	  WHERE ` + IDEMPOTENCY_KEYS_TABLE + `.createdAt < $7`
+const PG_QUERY_IDEMPOTENCY_KEY = `SELECT idempotencyKey, requestHash, statusCode, response, createdAt, recordID FROM ` + IDEMPOTENCY_KEYS_TABLE +
+	` WHERE idempotencyKey = $1 AND createdAt >= $2`
+
+// Skips keys other writers hold, so writers purging at once don't deadlock.
+const PG_DELETE_EXPIRED_IDEMPOTENCY_KEYS = `DELETE FROM ` + IDEMPOTENCY_KEYS_TABLE +
+	` WHERE idempotencyKey IN (SELECT idempotencyKey FROM ` + IDEMPOTENCY_KEYS_TABLE +
+	` WHERE createdAt < $1 FOR UPDATE SKIP LOCKED)`
+const PG_DELETE_RECORD_IDEMPOTENCY_KEYS = `DELETE FROM ` + IDEMPOTENCY_KEYS_TABLE +
+	` WHERE recordID = $1`
+
+const PG_CREATE_RECORD_ERASURES_TABLE = `CREATE TABLE IF NOT EXISTS ` +
+	RECORD_ERASURES_TABLE + `(
+		id BIGINT NOT NULL,
+		sequence INTEGER NOT NULL,
+		atVersion INTEGER NOT NULL,
+		keys TEXT NOT NULL,
+		wholeRecord BOOLEAN NOT NULL,
+		principal TEXT NOT NULL,
+		erasedAt BIGINT NOT NULL,
+		previousHash TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		PRIMARY KEY (id, sequence)
+	);`
+const PG_INSERT_RECORD_ERASURE = `INSERT INTO ` + RECORD_ERASURES_TABLE +
+	` (id, sequence, atVersion, keys, wholeRecord, principal, erasedAt, previousHash, hash)
+	  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+const PG_QUERY_RECORD_ERASURES = `SELECT id, sequence, atVersion, keys, wholeRecord, principal, erasedAt, previousHash, hash FROM ` +
+	RECORD_ERASURES_TABLE + ` WHERE id = $1 ORDER BY sequence ASC`
+const PG_QUERY_ALL_RECORD_DELTAS = `SELECT versionBeforeDelta, inverseDelta FROM ` + RECORD_DELTAS_TABLE +
+	` WHERE id = $1`
+
+const PG_CREATE_API_KEYS_TABLE = `CREATE TABLE IF NOT EXISTS ` +
+	API_KEYS_TABLE + `(
+		id TEXT PRIMARY KEY,
+		keyHash TEXT NOT NULL UNIQUE,
+		principal TEXT NOT NULL,
+		roles TEXT NOT NULL,
+		createdAt BIGINT NOT NULL,
+		revokedAt BIGINT
+	);`
+const PG_INSERT_API_KEY = `INSERT INTO ` + API_KEYS_TABLE +
+	` (id, keyHash, principal, roles, createdAt) VALUES ($1, $2, $3, $4, $5)`
+const PG_QUERY_API_KEY_BY_HASH = `SELECT id, keyHash, principal, roles, createdAt, revokedAt FROM ` + API_KEYS_TABLE +
+	` WHERE keyHash = $1`
+const PG_QUERY_API_KEYS = `SELECT id, keyHash, principal, roles, createdAt, revokedAt FROM ` + API_KEYS_TABLE +
+	` ORDER BY createdAt ASC`
+const PG_REVOKE_API_KEY = `UPDATE ` + API_KEYS_TABLE +
+	` SET revokedAt = $1 WHERE id = $2 AND revokedAt IS NULL`
+const PG_QUERY_API_KEY_EXISTS = `SELECT COUNT(*) FROM ` + API_KEYS_TABLE +
+	` WHERE id = $1`
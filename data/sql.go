@@ -2,34 +2,265 @@ package data
 
 const TIMETRAVEL_DB = "timetravel.db"
 
+// Held, beside the database, by everything that has it open, so a restore
+// can tell it isn't.
+const TIMETRAVEL_DB_LOCK = "timetravel.db.lock"
+
+// Stored in the database's user_version pragma. Bump this whenever the
+// tables below change shape, so a server never runs against a schema it
+// doesn't understand.
+const SCHEMA_VERSION = 8
+const QUERY_SCHEMA_VERSION = `PRAGMA user_version`
+const UPDATE_SCHEMA_VERSION = `PRAGMA user_version = `
+
+// Copies the database to the file given, from a single snapshot.
+const BACKUP_INTO = `VACUUM INTO ?`
+
+// Moves everything in the write-ahead log into the database file, leaving
+// the log empty. It does nothing outside WAL mode.
+const CHECKPOINT_WAL = `PRAGMA wal_checkpoint(TRUNCATE)`
+
+// Databases created before schemas were versioned have a user_version of
+// 0, but the records table already exists in them.
+const QUERY_RECORDS_TABLE_EXISTS = `SELECT COUNT(*) FROM sqlite_master
+	WHERE type = 'table' AND name = '` + RECORDS_TABLE + `'`
+
+// Statements that bring an existing database from the previous schema
+// version to the keyed one. They run after every CREATE TABLE IF NOT EXISTS
+// statement, so versions that only add tables need no entry here.
+//
+//	1: records, record_deltas and idempotency_keys
+//	2: api_keys
+//	3: keyID on every table holding record data, for encryption at rest
+//	4: record_erasures, and the record idempotent responses are about
+//	5: hash and createdAt on record_deltas, chaining every version's hash
+//	6: record_compactions
+//	7: author on record_deltas, for versions imported with one
+//	8: sequence on record_deltas, numbering every version written in order
+var MIGRATIONS = map[int][]string{
+	3: {
+		`ALTER TABLE ` + RECORDS_TABLE + ` ADD COLUMN keyID TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE ` + RECORD_DELTAS_TABLE + ` ADD COLUMN keyID TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE ` + IDEMPOTENCY_KEYS_TABLE + ` ADD COLUMN keyID TEXT NOT NULL DEFAULT ''`,
+	},
+	4: {
+		`ALTER TABLE ` + IDEMPOTENCY_KEYS_TABLE + ` ADD COLUMN recordID INTEGER NOT NULL DEFAULT 0`,
+	},
+	5: {
+		`ALTER TABLE ` + RECORD_DELTAS_TABLE + ` ADD COLUMN hash TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE ` + RECORD_DELTAS_TABLE + ` ADD COLUMN createdAt INTEGER NOT NULL DEFAULT 0`,
+	},
+	7: {
+		`ALTER TABLE ` + RECORD_DELTAS_TABLE + ` ADD COLUMN author TEXT NOT NULL DEFAULT ''`,
+	},
+	// Rows were inserted in the order they were written, give or take rows
+	// compaction deleted
+	8: {
+		`ALTER TABLE ` + RECORD_DELTAS_TABLE + ` ADD COLUMN sequence INTEGER NOT NULL DEFAULT 0`,
+		`UPDATE ` + RECORD_DELTAS_TABLE + ` SET sequence = rowid`,
+	},
+}
+
+// Indexes are created once migrations have added the columns they cover.
+var INDEXES = []string{
+	CREATE_RECORD_DELTAS_SEQUENCE_INDEX,
+}
+
+// Columns holding record data (jsonData, inverseDelta and response) are
+// encrypted when the server has encryption keys. keyID names the key a
+// row's data was encrypted with, and is empty for plaintext rows.
+
+// Append a table name to count its rows.
+const COUNT_ROWS = `SELECT COUNT(*) FROM `
+
 const RECORDS_TABLE = "records"
 const CREATE_RECORDS_TABLE = `CREATE TABLE IF NOT EXISTS ` +
 	RECORDS_TABLE + `(
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		version INTEGER NOT NULL,
-		jsonData TEXT NOT NULL
+		jsonData TEXT NOT NULL,
+		keyID TEXT NOT NULL DEFAULT ''
 	);`
 const INSERT_RECORD = `INSERT INTO ` + RECORDS_TABLE +
-	` (id, version, jsonData) VALUES (?, 1, ?)`
+	` (id, version, jsonData, keyID) VALUES (?, 1, ?, ?)`
 const UPDATE_RECORD = `UPDATE ` + RECORDS_TABLE +
-	` SET version = ?, jsonData = ? WHERE id = ?`
-const QUERY_RECORD = `SELECT * FROM ` + RECORDS_TABLE +
+	` SET version = ?, jsonData = ?, keyID = ? WHERE id = ?`
+const QUERY_RECORD = `SELECT id, version, jsonData, keyID FROM ` + RECORDS_TABLE +
 	` WHERE id = ?`
+const QUERY_RECORD_VERSION = `SELECT version FROM ` + RECORDS_TABLE + ` WHERE id = ?`
+
+// Imported records arrive at whatever version their history reached.
+const INSERT_IMPORTED_RECORD = `INSERT INTO ` + RECORDS_TABLE +
+	` (id, version, jsonData, keyID) VALUES (?, ?, ?, ?)`
+const QUERY_RECORD_IDS = `SELECT id FROM ` + RECORDS_TABLE + ` ORDER BY id ASC`
+
+// Takes the lowest and highest id, and how many ids to return at most.
+const QUERY_RECORD_IDS_BETWEEN = `SELECT id FROM ` + RECORDS_TABLE +
+	` WHERE id >= ? AND id <= ? ORDER BY id ASC LIMIT ?`
 
+// Each row also carries the hash and creation time of the version the
+// delta leads to, versionBeforeDelta + 1. Creating a record writes a row
+// with versionBeforeDelta 0 for the first version, whose inverse delta
+// removes every key. Rows written before schema version 5 have no hash.
+// author is only known for versions imported from elsewhere, and isn't
+// part of the hash. sequence numbers every version across all records in
+// the order they were written, so a database can be rewound to any point
+// in it.
 const RECORD_DELTAS_TABLE = "record_deltas"
 const CREATE_RECORD_DELTAS_TABLE = `CREATE TABLE IF NOT EXISTS ` +
 	RECORD_DELTAS_TABLE + `(
 		id INTEGER NOT NULL,
 		versionBeforeDelta INTEGER NOT NULL,
 		inverseDelta TEXT NOT NULL,
+		keyID TEXT NOT NULL DEFAULT '',
+		hash TEXT NOT NULL DEFAULT '',
+		createdAt INTEGER NOT NULL DEFAULT 0,
+		author TEXT NOT NULL DEFAULT '',
+		sequence INTEGER NOT NULL DEFAULT 0,
 		PRIMARY KEY (id, versionBeforeDelta)
 	);`
+const CREATE_RECORD_DELTAS_SEQUENCE_INDEX = `CREATE INDEX IF NOT EXISTS record_deltas_sequence ON ` +
+	RECORD_DELTAS_TABLE + ` (sequence)`
+
+// Rows are inserted under the write lock, so the next sequence is one past
+// the highest.
+const NEXT_SEQUENCE = `(SELECT COALESCE(MAX(sequence), 0) + 1 FROM ` + RECORD_DELTAS_TABLE + `)`
 const INSERT_RECORD_DELTA = `INSERT INTO ` + RECORD_DELTAS_TABLE +
-	` (id, versionBeforeDelta, inverseDelta) VALUES (?, ?, ?)`
+	` (id, versionBeforeDelta, inverseDelta, keyID, hash, createdAt, sequence) VALUES (?, ?, ?, ?, ?, ?, ` + NEXT_SEQUENCE + `)`
+const INSERT_IMPORTED_RECORD_DELTA = `INSERT INTO ` + RECORD_DELTAS_TABLE +
+	` (id, versionBeforeDelta, inverseDelta, keyID, hash, createdAt, author, sequence)
+	  VALUES (?, ?, ?, ?, ?, ?, ?, ` + NEXT_SEQUENCE + `)`
+const QUERY_RECORD_DELTA_PROVENANCE = `SELECT versionBeforeDelta, sequence, author FROM ` + RECORD_DELTAS_TABLE +
+	` WHERE id = ?`
+
+// Rewinding finds the records with versions past a point, and the first
+// row of each that goes. Rows without a timestamp predate hashing, and are
+// never past a time.
+const QUERY_RECORD_DELTAS_AFTER_SEQUENCE = `SELECT id, MIN(versionBeforeDelta) FROM ` + RECORD_DELTAS_TABLE +
+	` WHERE sequence > ? GROUP BY id`
+const QUERY_RECORD_DELTAS_AFTER_TIME = `SELECT id, MIN(versionBeforeDelta) FROM ` + RECORD_DELTAS_TABLE +
+	` WHERE createdAt > ? GROUP BY id`
+const QUERY_RECORD_DELTA_HASH = `SELECT hash, createdAt FROM ` + RECORD_DELTAS_TABLE +
+	` WHERE id = ? AND versionBeforeDelta = ?`
+const QUERY_RECORD_DELTA_HASHES = `SELECT versionBeforeDelta, hash, createdAt FROM ` + RECORD_DELTAS_TABLE +
+	` WHERE id = ? ORDER BY versionBeforeDelta ASC`
+const UPDATE_RECORD_DELTA_HASH = `UPDATE ` + RECORD_DELTAS_TABLE +
+	` SET hash = ? WHERE id = ? AND versionBeforeDelta = ?`
 
 // When calculating record versions, we apply inverse updates on the current
 // version. Make sure we sort the results of this query so that we iterate
 // through the most recent updates (that should be applied first).
-const QUERY_RECORD_DELTAS = `SELECT * FROM ` + RECORD_DELTAS_TABLE +
+const QUERY_RECORD_DELTAS = `SELECT id, versionBeforeDelta, inverseDelta, keyID FROM ` + RECORD_DELTAS_TABLE +
 	` WHERE versionBeforeDelta >= ? AND id = ?
 	  ORDER BY versionBeforeDelta DESC`
+
+// Responses to requests carrying an Idempotency-Key header. Rows older than
+// the service's configured TTL are treated as absent and purged on write.
+const IDEMPOTENCY_KEYS_TABLE = "idempotency_keys"
+const CREATE_IDEMPOTENCY_KEYS_TABLE = `CREATE TABLE IF NOT EXISTS ` +
+	IDEMPOTENCY_KEYS_TABLE + `(
+		idempotencyKey TEXT PRIMARY KEY,
+		requestHash TEXT NOT NULL,
+		statusCode INTEGER NOT NULL,
+		response TEXT NOT NULL,
+		createdAt INTEGER NOT NULL,
+		keyID TEXT NOT NULL DEFAULT '',
+		recordID INTEGER NOT NULL DEFAULT 0
+	);`
+const UPSERT_IDEMPOTENCY_KEY = `INSERT OR REPLACE INTO ` + IDEMPOTENCY_KEYS_TABLE +
+	` (idempotencyKey, requestHash, statusCode, response, createdAt, keyID, recordID) VALUES (?, ?, ?, ?, ?, ?, ?)`
+const QUERY_IDEMPOTENCY_KEY = `SELECT idempotencyKey, requestHash, statusCode, response, createdAt, keyID, recordID FROM ` + IDEMPOTENCY_KEYS_TABLE +
+	` WHERE idempotencyKey = ? AND createdAt >= ?`
+const DELETE_EXPIRED_IDEMPOTENCY_KEYS = `DELETE FROM ` + IDEMPOTENCY_KEYS_TABLE +
+	` WHERE createdAt < ?`
+const DELETE_RECORD_IDEMPOTENCY_KEYS = `DELETE FROM ` + IDEMPOTENCY_KEYS_TABLE +
+	` WHERE recordID = ?`
+
+// Markers left in a record's history when data is erased from it. They
+// name the erased keys, never their values, and each one's hash covers the
+// previous one's, so editing or dropping a marker is detectable.
+const RECORD_ERASURES_TABLE = "record_erasures"
+const CREATE_RECORD_ERASURES_TABLE = `CREATE TABLE IF NOT EXISTS ` +
+	RECORD_ERASURES_TABLE + `(
+		id INTEGER NOT NULL,
+		sequence INTEGER NOT NULL,
+		atVersion INTEGER NOT NULL,
+		keys TEXT NOT NULL,
+		wholeRecord INTEGER NOT NULL,
+		principal TEXT NOT NULL,
+		erasedAt INTEGER NOT NULL,
+		previousHash TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		PRIMARY KEY (id, sequence)
+	);`
+const INSERT_RECORD_ERASURE = `INSERT INTO ` + RECORD_ERASURES_TABLE +
+	` (id, sequence, atVersion, keys, wholeRecord, principal, erasedAt, previousHash, hash)
+	  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+const QUERY_RECORD_ERASURES = `SELECT id, sequence, atVersion, keys, wholeRecord, principal, erasedAt, previousHash, hash FROM ` +
+	RECORD_ERASURES_TABLE + ` WHERE id = ? ORDER BY sequence ASC`
+const QUERY_ALL_RECORD_DELTAS = `SELECT versionBeforeDelta, inverseDelta, keyID FROM ` + RECORD_DELTAS_TABLE +
+	` WHERE id = ?`
+const UPDATE_RECORD_DELTA = `UPDATE ` + RECORD_DELTAS_TABLE +
+	` SET inverseDelta = ?, keyID = ? WHERE id = ? AND versionBeforeDelta = ?`
+
+// Ranges of versions compacted away by retention. For a range from-to, the
+// delta rows that led to versions from through to are gone, and the row
+// with versionBeforeDelta = to holds an inverse delta straight back to
+// version from - 1 instead.
+const RECORD_COMPACTIONS_TABLE = "record_compactions"
+const CREATE_RECORD_COMPACTIONS_TABLE = `CREATE TABLE IF NOT EXISTS ` +
+	RECORD_COMPACTIONS_TABLE + `(
+		id INTEGER NOT NULL,
+		fromVersion INTEGER NOT NULL,
+		toVersion INTEGER NOT NULL,
+		compactedAt INTEGER NOT NULL,
+		PRIMARY KEY (id, fromVersion)
+	);`
+const INSERT_RECORD_COMPACTION = `INSERT INTO ` + RECORD_COMPACTIONS_TABLE +
+	` (id, fromVersion, toVersion, compactedAt) VALUES (?, ?, ?, ?)`
+const QUERY_RECORD_COMPACTIONS = `SELECT id, fromVersion, toVersion, compactedAt FROM ` + RECORD_COMPACTIONS_TABLE +
+	` WHERE id = ? ORDER BY fromVersion ASC`
+const DELETE_RECORD_COMPACTIONS_BETWEEN = `DELETE FROM ` + RECORD_COMPACTIONS_TABLE +
+	` WHERE id = ? AND fromVersion BETWEEN ? AND ?`
+const DELETE_RECORD = `DELETE FROM ` + RECORDS_TABLE + ` WHERE id = ?`
+const DELETE_RECORD_ERASURES = `DELETE FROM ` + RECORD_ERASURES_TABLE + ` WHERE id = ?`
+const DELETE_RECORD_DELTAS_BETWEEN = `DELETE FROM ` + RECORD_DELTAS_TABLE +
+	` WHERE id = ? AND versionBeforeDelta BETWEEN ? AND ?`
+
+// Static API keys. Only a hash of each key is stored; revokedAt is NULL
+// while the key is active.
+const API_KEYS_TABLE = "api_keys"
+const CREATE_API_KEYS_TABLE = `CREATE TABLE IF NOT EXISTS ` +
+	API_KEYS_TABLE + `(
+		id TEXT PRIMARY KEY,
+		keyHash TEXT NOT NULL UNIQUE,
+		principal TEXT NOT NULL,
+		roles TEXT NOT NULL,
+		createdAt INTEGER NOT NULL,
+		revokedAt INTEGER
+	);`
+const INSERT_API_KEY = `INSERT INTO ` + API_KEYS_TABLE +
+	` (id, keyHash, principal, roles, createdAt) VALUES (?, ?, ?, ?, ?)`
+const QUERY_API_KEY_BY_HASH = `SELECT * FROM ` + API_KEYS_TABLE +
+	` WHERE keyHash = ?`
+const QUERY_API_KEYS = `SELECT * FROM ` + API_KEYS_TABLE +
+	` ORDER BY createdAt ASC`
+const REVOKE_API_KEY = `UPDATE ` + API_KEYS_TABLE +
+	` SET revokedAt = ? WHERE id = ? AND revokedAt IS NULL`
+const QUERY_API_KEY_EXISTS = `SELECT COUNT(*) FROM ` + API_KEYS_TABLE +
+	` WHERE id = ?`
+
+// Re-encrypting rows whose data isn't under the current key, a batch at a
+// time. Updates only apply if the row wasn't rewritten in the meantime.
+const QUERY_STALE_RECORDS = `SELECT id, jsonData, keyID FROM ` + RECORDS_TABLE +
+	` WHERE keyID != ? LIMIT ?`
+const REKEY_RECORD = `UPDATE ` + RECORDS_TABLE +
+	` SET jsonData = ?, keyID = ? WHERE id = ? AND keyID = ? AND jsonData = ?`
+const QUERY_STALE_RECORD_DELTAS = `SELECT id, versionBeforeDelta, inverseDelta, keyID FROM ` + RECORD_DELTAS_TABLE +
+	` WHERE keyID != ? LIMIT ?`
+const REKEY_RECORD_DELTA = `UPDATE ` + RECORD_DELTAS_TABLE +
+	` SET inverseDelta = ?, keyID = ? WHERE id = ? AND versionBeforeDelta = ? AND keyID = ? AND inverseDelta = ?`
+const QUERY_STALE_IDEMPOTENCY_KEYS = `SELECT idempotencyKey, response, keyID FROM ` + IDEMPOTENCY_KEYS_TABLE +
+	` WHERE keyID != ? LIMIT ?`
+const REKEY_IDEMPOTENCY_KEY = `UPDATE ` + IDEMPOTENCY_KEYS_TABLE +
+	` SET response = ?, keyID = ? WHERE idempotencyKey = ? AND keyID = ? AND response = ?`
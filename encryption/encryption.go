@@ -0,0 +1,148 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Keys are AES-256 keys.
+const KeySize = 32
+
+var (
+	// ErrUnknownKey is returned when data was encrypted with a key the
+	// keyring doesn't hold, e.g. one retired before rotation finished.
+	ErrUnknownKey = errors.New("encryption key not in keyring")
+
+	// ErrDecrypt is returned when data doesn't authenticate under its key,
+	// because it was corrupted, tampered with, or moved to another row.
+	ErrDecrypt = errors.New("unable to decrypt")
+)
+
+// Keyring holds the AES-GCM keys data may be encrypted with, by key id.
+// New data is always encrypted with the current key; the others are only
+// kept to read data that hasn't been re-encrypted yet.
+type Keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// ParseKeyring reads keys given as "id:base64key" entries, separated by
+// commas or newlines. The first entry is the current key. Blank lines and
+// lines starting with # are ignored.
+func ParseKeyring(spec string) (*Keyring, error) {
+	keyring := &Keyring{keys: map[string]cipher.AEAD{}}
+	for _, line := range strings.Split(spec, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, entry := range strings.Split(line, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			if err := keyring.add(entry); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if keyring.current == "" {
+		return nil, errors.New("no encryption keys given")
+	}
+	return keyring, nil
+}
+
+// LoadKeyring reads a key file in the format ParseKeyring expects.
+func LoadKeyring(path string) (*Keyring, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := ParseKeyring(string(contents))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key file %s: %w", path, err)
+	}
+	return keyring, nil
+}
+
+func (k *Keyring) add(entry string) error {
+	id, encoded, found := strings.Cut(entry, ":")
+	id = strings.TrimSpace(id)
+	if !found || id == "" {
+		return errors.New(`keys must be given as "id:base64key"`)
+	}
+	if _, exists := k.keys[id]; exists {
+		return fmt.Errorf("key %q is given twice", id)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return fmt.Errorf("key %q is not valid base64: %w", id, err)
+	}
+	if len(key) != KeySize {
+		return fmt.Errorf("key %q is %d bytes, expected %d", id, len(key), KeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	k.keys[id] = aead
+	if k.current == "" {
+		k.current = id
+	}
+	return nil
+}
+
+// CurrentKeyID returns the id of the key new data is encrypted with.
+func (k *Keyring) CurrentKeyID() string {
+	return k.current
+}
+
+// Encrypt seals plaintext with the current key, returning the key's id and
+// the nonce-prefixed ciphertext. The associated data isn't stored, but must
+// be given again to decrypt, which ties the ciphertext to e.g. its row.
+func (k *Keyring) Encrypt(plaintext []byte, associatedData []byte) (string, []byte, error) {
+	aead := k.keys[k.current]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return k.current, aead.Seal(nonce, nonce, plaintext, associatedData), nil
+}
+
+// Decrypt opens ciphertext produced by Encrypt with the key it names.
+func (k *Keyring) Decrypt(keyID string, ciphertext []byte, associatedData []byte) ([]byte, error) {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("key %q: %w", keyID, ErrUnknownKey)
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("key %q: ciphertext too short: %w", keyID, ErrDecrypt)
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %w", keyID, ErrDecrypt)
+	}
+	return plaintext, nil
+}
+
+// NewKey generates a random key, base64-encoded as key files expect.
+func NewKey() (string, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
@@ -0,0 +1,66 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyring(t *testing.T) {
+	oldKey, _ := NewKey()
+	newKey, _ := NewKey()
+
+	old, err := ParseKeyring("old:" + oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID, ciphertext, err := old.Encrypt([]byte("secret"), []byte("records:1"))
+	if err != nil || keyID != "old" {
+		t.Fatalf("Expected encryption with the old key, got %q, error %v", keyID, err)
+	}
+	if bytes.Contains(ciphertext, []byte("secret")) {
+		t.Errorf("Ciphertext contains the plaintext")
+	}
+
+	// Rotated: the new key is current, the old one still decrypts
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte("# rotated\nnew:"+newKey+"\n\nold:"+oldKey+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := LoadKeyring(path)
+	if err != nil || rotated.CurrentKeyID() != "new" {
+		t.Fatalf("Expected the new key to be current, got %v, error %v", rotated, err)
+	}
+	plaintext, err := rotated.Decrypt(keyID, ciphertext, []byte("records:1"))
+	if err != nil || string(plaintext) != "secret" {
+		t.Errorf("Expected to decrypt with the old key, got %q, error %v", plaintext, err)
+	}
+
+	if _, err := rotated.Decrypt(keyID, ciphertext, []byte("records:2")); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("Ciphertext moved to another row should not decrypt, got error %v", err)
+	}
+	tampered := append([]byte{}, ciphertext...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := rotated.Decrypt(keyID, tampered, []byte("records:1")); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("Tampered ciphertext should not decrypt, got error %v", err)
+	}
+	newOnly, _ := ParseKeyring("new:" + newKey)
+	if _, err := newOnly.Decrypt(keyID, ciphertext, []byte("records:1")); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected a retired key to be unknown, got error %v", err)
+	}
+
+	for _, spec := range []string{
+		"",
+		"# nothing",
+		oldKey,
+		"short:AAAA",
+		"bad:not base64!",
+		"a:" + oldKey + ",a:" + newKey,
+	} {
+		if _, err := ParseKeyring(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
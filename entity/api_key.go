@@ -0,0 +1,14 @@
+package entity
+
+import "time"
+
+// APIKey identifies a caller by a static secret. Only a hash of the secret
+// is ever stored; the secret itself is shown once, when the key is created.
+type APIKey struct {
+	ID        string     `json:"id"`
+	Principal string     `json:"principal"`
+	Roles     []string   `json:"roles"`
+	KeyHash   string     `json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
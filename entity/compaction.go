@@ -0,0 +1,18 @@
+package entity
+
+import "time"
+
+// Compaction marks a range of a record's versions that retention removed.
+// The versions around it keep their numbers.
+type Compaction struct {
+	RecordID int64 `json:"record_id"`
+	// The first and last version removed, inclusive.
+	FromVersion int       `json:"from_version"`
+	ToVersion   int       `json:"to_version"`
+	CompactedAt time.Time `json:"compacted_at"`
+}
+
+// Contains reports whether the version was compacted away.
+func (c Compaction) Contains(version int) bool {
+	return c.FromVersion <= version && version <= c.ToVersion
+}
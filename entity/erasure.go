@@ -0,0 +1,66 @@
+package entity
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// Erasure marks that data was purged from every version of a record, e.g.
+// for a right-to-be-forgotten request. It names the erased keys but never
+// their values. Version numbers are unaffected by erasures.
+type Erasure struct {
+	RecordID int64 `json:"record_id"`
+	// Erasures of a record are numbered from 1, in the order they happened.
+	Sequence int `json:"sequence"`
+	// The record's latest version when it was erased.
+	AtVersion int      `json:"at_version"`
+	Keys      []string `json:"keys"`
+	// Whether every key was erased, rather than chosen ones.
+	WholeRecord bool      `json:"whole_record"`
+	Principal   string    `json:"principal"`
+	ErasedAt    time.Time `json:"erased_at"`
+
+	// The hash of the record's previous erasure, empty for the first.
+	PreviousHash string `json:"previous_hash"`
+	// Covers every field above, so altering, reordering or dropping an
+	// erasure breaks the chain.
+	Hash string `json:"hash"`
+}
+
+// ComputeHash returns the hash the erasure should carry.
+func (e Erasure) ComputeHash() string {
+	keys, _ := json.Marshal(e.Keys)
+
+	hash := sha256.New()
+	for _, field := range [][]byte{
+		[]byte(e.PreviousHash),
+		[]byte(strconv.FormatInt(e.RecordID, 10)),
+		[]byte(strconv.Itoa(e.Sequence)),
+		[]byte(strconv.Itoa(e.AtVersion)),
+		keys,
+		[]byte(strconv.FormatBool(e.WholeRecord)),
+		[]byte(e.Principal),
+		[]byte(strconv.FormatInt(e.ErasedAt.UnixNano(), 10)),
+	} {
+		hash.Write(field)
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// VerifyErasures reports the sequence number of the first erasure of a
+// record, given oldest first, that doesn't chain onto the one before it,
+// or 0 if the chain is intact.
+func VerifyErasures(erasures []Erasure) int {
+	previousHash := ""
+	for i, erasure := range erasures {
+		if erasure.Sequence != i+1 || erasure.PreviousHash != previousHash || erasure.Hash != erasure.ComputeHash() {
+			return i + 1
+		}
+		previousHash = erasure.Hash
+	}
+	return 0
+}
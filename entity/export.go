@@ -0,0 +1,72 @@
+package entity
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExportFilter selects what an export includes. The zero value selects
+// every record with all of its history.
+type ExportFilter struct {
+	// Only records with ids in the range, if set.
+	IDs *IDRange
+	// If set, only versions written by then, and only records that had a
+	// version by then. Versions from before history was hashed have no
+	// timestamp, and are always included.
+	AsOf time.Time
+}
+
+// ParseExportFilter parses an id range given as "min-max" and a time given
+// in RFC 3339, either of which may be empty.
+func ParseExportFilter(ids string, asOf string) (ExportFilter, error) {
+	var filter ExportFilter
+	if ids != "" {
+		minID, maxID, ok := strings.Cut(ids, "-")
+		lower, minErr := strconv.ParseInt(minID, 10, 64)
+		upper, maxErr := strconv.ParseInt(maxID, 10, 64)
+		if !ok || minErr != nil || maxErr != nil || lower > upper {
+			return ExportFilter{}, fmt.Errorf("invalid id range %q; expected min-max", ids)
+		}
+		filter.IDs = &IDRange{Min: lower, Max: upper}
+	}
+	if asOf != "" {
+		t, err := time.Parse(time.RFC3339Nano, asOf)
+		if err != nil {
+			return ExportFilter{}, fmt.Errorf("invalid time %q; expected RFC 3339", asOf)
+		}
+		filter.AsOf = t.UTC()
+	}
+	return filter, nil
+}
+
+// Includes reports whether the version with the given link passes the
+// filter.
+func (f ExportFilter) Includes(link VersionHash) bool {
+	return f.AsOf.IsZero() || link.Hash == "" || !link.CreatedAt.After(f.AsOf)
+}
+
+// ExportedRecord is a record with every remaining version of it, oldest
+// first, and the markers of what was erased or compacted from its history.
+// An export is one per line.
+type ExportedRecord struct {
+	ID          int64             `json:"id"`
+	Versions    []ExportedVersion `json:"versions"`
+	Erasures    []Erasure         `json:"erasures,omitempty"`
+	Compactions []Compaction      `json:"compactions,omitempty"`
+}
+
+type ExportedVersion struct {
+	Version int               `json:"version"`
+	Data    map[string]string `json:"data"`
+	// When the version was written and its hash, both absent for versions
+	// written before history was hashed.
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	Hash      string     `json:"hash,omitempty"`
+	// Who wrote the version, known only for versions imported with one.
+	Author string `json:"author,omitempty"`
+	// Where the version falls among every version written to the
+	// database, which a restore can rewind to. Imports assign their own.
+	Sequence int64 `json:"sequence,omitempty"`
+}
@@ -0,0 +1,126 @@
+package entity
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// VersionHash links a version of a record into the record's hash chain.
+// Versions written before history was hashed have an empty Hash.
+type VersionHash struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Hash      string    `json:"hash"`
+}
+
+// HashVersion returns the hash of a version, given the hash of the version
+// before it (empty for the first), when it was written, and the change
+// that produced it from the version before. Any edit to a version changes
+// its hash, and so the hash of every version after it.
+func HashVersion(previousHash string, id int64, version int, createdAt time.Time, delta map[string]*string) string {
+	// Keys of a marshalled map are sorted, so this is canonical
+	deltaJSON, _ := json.Marshal(delta)
+
+	hash := sha256.New()
+	for _, field := range [][]byte{
+		[]byte(previousHash),
+		[]byte(strconv.FormatInt(id, 10)),
+		[]byte(strconv.Itoa(version)),
+		[]byte(strconv.FormatInt(createdAt.UnixNano(), 10)),
+		deltaJSON,
+	} {
+		hash.Write(field)
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Diff returns the update that takes before to after, with removed keys
+// mapped to nil.
+func Diff(before map[string]string, after map[string]string) map[string]*string {
+	delta := map[string]*string{}
+	for key, value := range after {
+		if previous, ok := before[key]; !ok || previous != value {
+			value := value
+			delta[key] = &value
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			delta[key] = nil
+		}
+	}
+	return delta
+}
+
+// ChainHashes rehashes a record's history, given every version oldest
+// first and their current links, keeping each version's timestamp.
+// Versions that were never hashed stay that way.
+func ChainHashes(id int64, versions []Record, hashes []VersionHash) []VersionHash {
+	chained := make([]VersionHash, len(hashes))
+	previousHash := ""
+	previous := map[string]string{}
+	for i, link := range hashes {
+		chained[i] = link
+		if link.Hash != "" && i < len(versions) {
+			chained[i].Hash = HashVersion(previousHash, id, link.Version, link.CreatedAt, Diff(previous, versions[i].Data))
+			previousHash = chained[i].Hash
+		}
+		if i < len(versions) {
+			previous = versions[i].Data
+		}
+	}
+	return chained
+}
+
+// Verification is the outcome of checking a record's history against its
+// hash chain, and its erasure markers against theirs.
+type Verification struct {
+	RecordID int64 `json:"record_id"`
+	Valid    bool  `json:"valid"`
+	Versions int   `json:"versions"`
+	// Versions written before history was hashed. They can't be verified,
+	// and only ever precede the hashed ones.
+	Unhashed int `json:"unhashed"`
+	// The first version that doesn't match its hash, or 0 if none.
+	BrokenVersion int `json:"broken_version,omitempty"`
+	// The first erasure marker that doesn't chain, or 0 if none.
+	BrokenErasure int `json:"broken_erasure,omitempty"`
+}
+
+// VerifyHistory recomputes the hash of every version of a record, given
+// oldest first along with their links and the record's erasures.
+func VerifyHistory(id int64, versions []Record, hashes []VersionHash, erasures []Erasure) Verification {
+	verification := Verification{RecordID: id, Versions: len(versions)}
+
+	previousHash := ""
+	previous := map[string]string{}
+	for i, version := range versions {
+		if i >= len(hashes) || hashes[i].Version != version.Version {
+			verification.BrokenVersion = version.Version
+			break
+		}
+		link := hashes[i]
+		switch {
+		case link.Hash == "" && previousHash == "":
+			verification.Unhashed++
+		case link.Hash != HashVersion(previousHash, id, version.Version, link.CreatedAt, Diff(previous, version.Data)):
+			verification.BrokenVersion = version.Version
+		}
+		if verification.BrokenVersion != 0 {
+			break
+		}
+		previousHash = link.Hash
+		previous = version.Data
+	}
+	if verification.BrokenVersion == 0 && len(hashes) > len(versions) {
+		verification.BrokenVersion = len(versions) + 1
+	}
+
+	verification.BrokenErasure = VerifyErasures(erasures)
+	verification.Valid = verification.BrokenVersion == 0 && verification.BrokenErasure == 0
+	return verification
+}
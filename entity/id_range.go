@@ -0,0 +1,12 @@
+package entity
+
+// IDRange is an inclusive range of record ids.
+type IDRange struct {
+	Min int64 `json:"min"`
+	Max int64 `json:"max"`
+}
+
+// Contains reports whether id falls in the range.
+func (r IDRange) Contains(id int64) bool {
+	return r.Min <= id && id <= r.Max
+}
@@ -0,0 +1,19 @@
+package entity
+
+import "time"
+
+// IdempotentResponse is the first response written for a given
+// Idempotency-Key, persisted so that client retries can be replayed
+// without touching the underlying record a second time.
+type IdempotentResponse struct {
+	Key string
+	// The record the request wrote, so its responses can be purged along
+	// with the record's data.
+	RecordID int64
+	// Fingerprint of the request that produced this response; a replay
+	// using the same key must match it exactly.
+	RequestHash string
+	StatusCode  int
+	Body        []byte
+	CreatedAt   time.Time
+}
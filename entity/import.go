@@ -0,0 +1,71 @@
+package entity
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ImportResult reports what became of one line of an import. Lines are
+// numbered from 1.
+type ImportResult struct {
+	Line     int    `json:"line"`
+	RecordID int64  `json:"record_id,omitempty"`
+	Versions int    `json:"versions,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ImportLinks checks that the record can be imported as it is, and returns
+// the link of each of its versions in the hash chain, oldest first.
+//
+// Versions must be numbered 1, 2, 3 and so on, and their timestamps must
+// not go backwards. Versions without a timestamp are stored unhashed, like
+// those written before history was hashed, so they may only come before
+// every timestamped one. A version that carries a hash must carry the one
+// its place in the chain gives it. Compacted histories have gaps that
+// can't be checked, and are refused.
+func (r ExportedRecord) ImportLinks() ([]VersionHash, error) {
+	if r.ID <= 0 {
+		return nil, fmt.Errorf("invalid record id %d; expected a positive id", r.ID)
+	}
+	if len(r.Versions) == 0 {
+		return nil, errors.New("record has no versions")
+	}
+	if len(r.Compactions) > 0 {
+		return nil, errors.New("compacted histories can't be imported")
+	}
+	for _, erasure := range r.Erasures {
+		if erasure.RecordID != r.ID {
+			return nil, fmt.Errorf("erasure %d belongs to record %d", erasure.Sequence, erasure.RecordID)
+		}
+	}
+	if broken := VerifyErasures(r.Erasures); broken != 0 {
+		return nil, fmt.Errorf("erasure %d doesn't match its hash", broken)
+	}
+
+	links := make([]VersionHash, 0, len(r.Versions))
+	previous := map[string]string{}
+	previousHash := ""
+	for i, version := range r.Versions {
+		if version.Version != i+1 {
+			return nil, fmt.Errorf("version %d out of order; expected version %d", version.Version, i+1)
+		}
+		link := VersionHash{Version: version.Version}
+		switch {
+		case version.CreatedAt == nil && previousHash != "":
+			return nil, fmt.Errorf("version %d has no created_at, but an earlier version does", version.Version)
+		case version.CreatedAt != nil:
+			link.CreatedAt = version.CreatedAt.UTC()
+			if previousHash != "" && link.CreatedAt.Before(links[i-1].CreatedAt) {
+				return nil, fmt.Errorf("version %d was created before version %d", version.Version, i)
+			}
+			link.Hash = HashVersion(previousHash, r.ID, version.Version, link.CreatedAt, Diff(previous, version.Data))
+			previousHash = link.Hash
+		}
+		if version.Hash != "" && version.Hash != link.Hash {
+			return nil, fmt.Errorf("version %d doesn't match its hash", version.Version)
+		}
+		links = append(links, link)
+		previous = version.Data
+	}
+	return links, nil
+}
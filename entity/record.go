@@ -3,7 +3,7 @@ package entity
 import "github.com/google/go-cmp/cmp"
 
 type Record struct {
-	ID      int               `json:"id"`
+	ID      int64             `json:"id"`
 	Data    map[string]string `json:"data"`
 	Version int               `json:"version"`
 }
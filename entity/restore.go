@@ -0,0 +1,47 @@
+package entity
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// RestorePoint is how far back a restored database is rewound. The zero
+// value keeps everything in the backup.
+type RestorePoint struct {
+	// If set, only versions with a sequence up to this one are kept.
+	Sequence int64
+	// If set, only versions written by then are kept. Versions from before
+	// history was hashed have no timestamp, and are always kept.
+	AsOf time.Time
+}
+
+// ParseRestorePoint parses a sequence number and a time given in RFC 3339,
+// at most one of which may be set.
+func ParseRestorePoint(sequence string, asOf string) (RestorePoint, error) {
+	var point RestorePoint
+	if sequence != "" && asOf != "" {
+		return RestorePoint{}, errors.New("rewind to either a sequence or a time, not both")
+	}
+	if sequence != "" {
+		n, err := strconv.ParseInt(sequence, 10, 64)
+		if err != nil || n <= 0 {
+			return RestorePoint{}, fmt.Errorf("invalid sequence %q; expected a positive number", sequence)
+		}
+		point.Sequence = n
+	}
+	if asOf != "" {
+		t, err := time.Parse(time.RFC3339Nano, asOf)
+		if err != nil {
+			return RestorePoint{}, fmt.Errorf("invalid time %q; expected RFC 3339", asOf)
+		}
+		point.AsOf = t.UTC()
+	}
+	return point, nil
+}
+
+// IsZero reports whether the point keeps everything.
+func (p RestorePoint) IsZero() bool {
+	return p.Sequence == 0 && p.AsOf.IsZero()
+}
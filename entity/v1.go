@@ -1,7 +1,7 @@
 package entity
 
 type RecordV1 struct {
-	ID   int               `json:"id"`
+	ID   int64             `json:"id"`
 	Data map[string]string `json:"data"`
 }
 
@@ -0,0 +1,18 @@
+package entity
+
+type RecordV2 struct {
+	ID      int64             `json:"id"`
+	Data    map[string]string `json:"data"`
+	Version int               `json:"version"`
+	// Absent for versions written before history was hashed.
+	Hash string `json:"hash,omitempty"`
+}
+
+func (d *Record) IntoV2(hash string) RecordV2 {
+	return RecordV2{
+		ID:      d.ID,
+		Data:    d.Data,
+		Version: d.Version,
+		Hash:    hash,
+	}
+}
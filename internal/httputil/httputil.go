@@ -0,0 +1,39 @@
+package httputil
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// RouteTemplate returns the template of the mux route r matched, such as
+// /api/v2/records/{id}, so that ids don't end up in labels or span names.
+func RouteTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unmatched"
+}
+
+// StatusRecorder remembers the status code written through it.
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status int
+}
+
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (r *StatusRecorder) WriteHeader(status int) {
+	r.Status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the writer underneath, e.g. to
+// set deadlines or flush.
+func (r *StatusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,105 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/temelpa/timetravel/internal/httputil"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Header used to correlate a request with its response and logs. If the
+// client doesn't send one, one is generated.
+const RequestIDHeader = "X-Request-ID"
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	requestIDKey
+	annotationsKey
+)
+
+// Attributes handlers learn while serving a request, such as the record id,
+// that the middleware adds to the request's completion line.
+type annotations struct {
+	args []any
+}
+
+// FromContext returns the logger carried by ctx, or the default logger.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// With returns a context whose logger adds the given attributes to every
+// line, e.g. With(ctx, "record_id", id).
+func With(ctx context.Context, args ...any) context.Context {
+	return context.WithValue(ctx, loggerKey, FromContext(ctx).With(args...))
+}
+
+// Annotate is like With, but the attributes are also added to the line the
+// middleware logs once the request completes.
+func Annotate(ctx context.Context, args ...any) context.Context {
+	if a, ok := ctx.Value(annotationsKey).(*annotations); ok {
+		a.args = append(a.args, args...)
+	}
+	return With(ctx, args...)
+}
+
+// RequestID returns the id of the request ctx belongs to, if any.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// NewRequestID generates a random request id.
+func NewRequestID() string {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		slog.Error("unable to generate request id", "error", err)
+		return ""
+	}
+	return hex.EncodeToString(idBytes)
+}
+
+// Middleware propagates the client's X-Request-ID, or assigns one, and puts
+// it along with a logger tagged with the request id and route into the
+// request context. Once the request is served it logs its status and
+// duration.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" {
+			id = NewRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		route := httputil.RouteTemplate(r)
+
+		a := &annotations{}
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		ctx = context.WithValue(ctx, annotationsKey, a)
+		ctx = With(ctx, "request_id", id, "route", route, "method", r.Method)
+		if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+			ctx = With(ctx, "trace_id", span.TraceID().String())
+		}
+
+		recorder := httputil.NewStatusRecorder(w)
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		args := append(a.args,
+			"status", recorder.Status,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+		)
+		FromContext(ctx).Info("request completed", args...)
+	})
+}
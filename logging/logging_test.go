@@ -0,0 +1,65 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Test that request ids are propagated or assigned, and every line carries them
+func TestMiddleware(t *testing.T) {
+	var logs bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	defer slog.SetDefault(previous)
+
+	router := mux.NewRouter()
+	router.Use(Middleware)
+	router.Path("/records/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := Annotate(r.Context(), "record_id", 42)
+		FromContext(ctx).Info("handling")
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	// A client-provided id is echoed back and used in the logs
+	req := httptest.NewRequest("GET", "/records/42", nil)
+	req.Header.Set(RequestIDHeader, "from-client")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if id := rr.Header().Get(RequestIDHeader); id != "from-client" {
+		t.Errorf("Expected request id to be propagated, got %s", id)
+	}
+
+	var lines []map[string]interface{}
+	decoder := json.NewDecoder(&logs)
+	for decoder.More() {
+		var line map[string]interface{}
+		if err := decoder.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("Expected a handler line and a completion line, got %v", lines)
+	}
+	for _, line := range lines {
+		if line["request_id"] != "from-client" || line["route"] != "/records/{id}" || line["record_id"] != float64(42) {
+			t.Errorf("Log line missing request attributes: %v", line)
+		}
+	}
+	if completed := lines[1]; completed["status"] != float64(http.StatusTeapot) || completed["duration_ms"] == nil {
+		t.Errorf("Completion line missing status or duration: %v", completed)
+	}
+
+	// Without one, an id is generated
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/records/42", nil))
+	if id := rr.Header().Get(RequestIDHeader); len(id) != 32 {
+		t.Errorf("Expected a generated request id, got %q", id)
+	}
+}
@@ -1,32 +1,440 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"log"
+	"log/slog"
 	"net/http"
-	"time"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/temelpa/timetravel/auth"
+	"github.com/temelpa/timetravel/config"
+	"github.com/temelpa/timetravel/encryption"
+	"github.com/temelpa/timetravel/entity"
+	"github.com/temelpa/timetravel/redact"
+	"github.com/temelpa/timetravel/retention"
 	"github.com/temelpa/timetravel/server"
 	"github.com/temelpa/timetravel/service"
+	"github.com/temelpa/timetravel/tracing"
 )
 
 func main() {
-	service, err := service.NewSQLiteRecordService(
-		"rainbow_test", service.SQLiteRecordServiceSettings{
-			ResetOnStart: false,
-		})
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
+	if err != nil {
+		log.Fatalf("Invalid configuration; got error %v", err)
+	}
+
+	// Log JSON lines, and route the standard logger through the same handler
+	// so stray log.Printf calls are structured and levelled too.
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+		Level: cfg.LogLevel,
+	})))
+
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Settings{
+		Exporter:     cfg.TraceExporter,
+		OTLPEndpoint: cfg.OTLPEndpoint,
+	})
+	if err != nil {
+		log.Fatalf("Unable to set up tracing; got error %v", err)
+	}
+
+	if cfg.Verify {
+		os.Exit(verify(cfg))
+	}
+	if cfg.Export != "" {
+		os.Exit(export(cfg))
+	}
+	if cfg.Import != "" {
+		os.Exit(importRecords(cfg))
+	}
+	if cfg.Backup != "" {
+		os.Exit(backup(cfg))
+	}
+	if cfg.Restore != "" {
+		os.Exit(restore(cfg))
+	}
+
+	records, err := newRecordService(cfg)
 	if err != nil {
 		log.Fatalf("Unable to launch backing service; got error %v", err)
 	}
-	ttServer := server.NewTimeTravelServer(&service)
+	authenticators, err := newAuthenticators(cfg, records)
+	if err != nil {
+		log.Fatalf("Unable to set up authentication; got error %v", err)
+	}
+	var policy *auth.Policy
+	if cfg.PolicyFile != "" {
+		if policy, err = auth.LoadPolicy(cfg.PolicyFile); err != nil {
+			log.Fatalf("Unable to load authorization policy; got error %v", err)
+		}
+	}
+	var redactor *redact.Redactor
+	if cfg.RedactionFile != "" {
+		if redactor, err = redact.Load(cfg.RedactionFile); err != nil {
+			log.Fatalf("Unable to load redaction config; got error %v", err)
+		}
+	}
+	ttServer := server.NewTimeTravelServer(records, server.Settings{
+		Authenticators: authenticators,
+		Policy:         policy,
+		Redactor:       redactor,
+	})
 
-	address := "127.0.0.1:8000"
 	srv := &http.Server{
 		Handler:      ttServer.Router,
-		Addr:         address,
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+		Addr:         cfg.Address,
+		WriteTimeout: cfg.WriteTimeout,
+		ReadTimeout:  cfg.ReadTimeout,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("listening", "address", cfg.Address, "storage", cfg.Storage)
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		// The server never started, or died on its own; still release storage
+		slog.Error("server stopped", "error", err)
+		closeRecordService(records)
+		os.Exit(1)
+	case <-ctx.Done():
+	}
+
+	// A second signal during draining skips straight to the default handler
+	stop()
+	slog.Info("shutting down, draining requests", "timeout", cfg.ShutdownTimeout.String())
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("requests still in flight at shutdown", "error", err)
+	}
+
+	// Take the write lock so nothing that outlived the drain is mid-write
+	// when storage is closed underneath it. Postgres, whose API lock is
+	// never shared, waits for its writes in Close instead.
+	rwlock := records.GetRWLockForAPI()
+	rwlock.Lock()
+	defer rwlock.Unlock()
+	closeRecordService(records)
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("unable to flush traces", "error", err)
+	}
+	slog.Info("shut down cleanly")
+}
+
+func closeRecordService(records service.RecordService) {
+	if err := records.Close(); err != nil {
+		slog.Error("unable to close storage", "error", err)
+	}
+}
+
+func newAuthenticators(cfg config.Config, keys service.APIKeyService) ([]auth.Authenticator, error) {
+	var authenticators []auth.Authenticator
+	for _, method := range cfg.AuthMethodList() {
+		switch method {
+		case auth.MethodAPIKey:
+			authenticators = append(authenticators, auth.NewAPIKeyAuthenticator(keys, cfg.AdminAPIKey))
+		case auth.MethodJWT:
+			jwtAuthenticator, err := auth.NewJWTAuthenticator(auth.JWTSettings{
+				JWKSFile: cfg.JWKSFile,
+				Issuer:   cfg.JWTIssuer,
+				Audience: cfg.JWTAudience,
+			})
+			if err != nil {
+				return nil, err
+			}
+			authenticators = append(authenticators, jwtAuthenticator)
+		}
+	}
+	if len(authenticators) == 0 {
+		slog.Warn("authentication is disabled; anyone who can reach the server can read and write every record")
+	}
+	return authenticators, nil
+}
+
+// loadKeyring returns the configured encryption keys, or nil if record data
+// is stored in plaintext.
+func loadKeyring(cfg config.Config) (*encryption.Keyring, error) {
+	switch {
+	case cfg.EncryptionKeyFile != "":
+		return encryption.LoadKeyring(cfg.EncryptionKeyFile)
+	case cfg.EncryptionKeys != "":
+		return encryption.ParseKeyring(cfg.EncryptionKeys)
+	default:
+		return nil, nil
+	}
+}
+
+// sqliteSettings are the settings the one-off modes, such as -verify and
+// -backup, open the sqlite database with. They leave keys unrotated, since
+// they don't run long enough to.
+func sqliteSettings(cfg config.Config, keyring *encryption.Keyring) service.SQLiteRecordServiceSettings {
+	return service.SQLiteRecordServiceSettings{
+		Keyring:            keyring,
+		DisableKeyRotation: true,
+		JournalMode:        service.SQLiteJournalMode(cfg.SQLiteJournalMode),
+		Synchronous:        service.SQLiteSynchronous(cfg.SQLiteSynchronous),
+		BusyTimeout:        cfg.SQLiteBusyTimeout,
+		ReadConnections:    cfg.SQLiteReadConnections,
+	}
+}
+
+// verify checks the history of every record in the sqlite database, logging
+// each record that fails, and returns the exit code: 1 if any did.
+func verify(cfg config.Config) int {
+	keyring, err := loadKeyring(cfg)
+	if err != nil {
+		log.Fatalf("Unable to load encryption keys; got error %v", err)
+	}
+	sqlService, err := service.NewSQLiteRecordService(cfg.DatabaseDir, sqliteSettings(cfg, keyring))
+	if err != nil {
+		log.Fatalf("Unable to open database; got error %v", err)
+	}
+	defer sqlService.Close()
+
+	var verified, failed int
+	err = sqlService.VerifyAll(context.Background(), func(verification entity.Verification, err error) {
+		verified++
+		switch {
+		case err != nil:
+			failed++
+			slog.Error("unable to verify record", "record_id", verification.RecordID, "error", err)
+		case !verification.Valid:
+			failed++
+			slog.Error("record history failed verification",
+				"record_id", verification.RecordID,
+				"broken_version", verification.BrokenVersion,
+				"broken_erasure", verification.BrokenErasure,
+			)
+		case verification.Unhashed > 0:
+			slog.Warn("record has versions from before history was hashed",
+				"record_id", verification.RecordID,
+				"unhashed", verification.Unhashed,
+			)
+		}
+	})
+	if err != nil {
+		slog.Error("unable to walk the database", "error", err)
+		return 1
 	}
 
-	log.Printf("listening on %s", address)
-	log.Fatal(srv.ListenAndServe())
+	slog.Info("verification finished", "records", verified, "failed", failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// export writes every record the export filters select from the sqlite
+// database, with its history, as NDJSON, and returns the exit code.
+func export(cfg config.Config) int {
+	keyring, err := loadKeyring(cfg)
+	if err != nil {
+		log.Fatalf("Unable to load encryption keys; got error %v", err)
+	}
+	filter, err := cfg.ExportFilter()
+	if err != nil {
+		log.Fatalf("Invalid export filter; got error %v", err)
+	}
+	sqlService, err := service.NewSQLiteRecordService(cfg.DatabaseDir, sqliteSettings(cfg, keyring))
+	if err != nil {
+		log.Fatalf("Unable to open database; got error %v", err)
+	}
+	defer sqlService.Close()
+
+	out := os.Stdout
+	if cfg.Export != "-" {
+		if out, err = os.Create(cfg.Export); err != nil {
+			slog.Error("unable to create the export file", "error", err)
+			return 1
+		}
+		defer out.Close()
+	}
+	buffered := bufio.NewWriter(out)
+	encoder := json.NewEncoder(buffered)
+
+	exported := 0
+	err = sqlService.Export(context.Background(), filter, func(record entity.ExportedRecord) error {
+		exported++
+		return encoder.Encode(record)
+	})
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err == nil && out != os.Stdout {
+		err = out.Sync()
+	}
+	if err != nil {
+		slog.Error("export failed", "records", exported, "error", err)
+		return 1
+	}
+	slog.Info("export finished", "records", exported)
+	return 0
+}
+
+// importRecords writes the records in an NDJSON file, with their
+// histories, to the sqlite database, and returns the exit code.
+func importRecords(cfg config.Config) int {
+	keyring, err := loadKeyring(cfg)
+	if err != nil {
+		log.Fatalf("Unable to load encryption keys; got error %v", err)
+	}
+	settings := sqliteSettings(cfg, keyring)
+	settings.ResetOnStart = cfg.ResetOnStart
+	sqlService, err := service.NewSQLiteRecordService(cfg.DatabaseDir, settings)
+	if err != nil {
+		log.Fatalf("Unable to open database; got error %v", err)
+	}
+	defer sqlService.Close()
+
+	in := os.Stdin
+	if cfg.Import != "-" {
+		if in, err = os.Open(cfg.Import); err != nil {
+			slog.Error("unable to open the import file", "error", err)
+			return 1
+		}
+		defer in.Close()
+	}
+
+	// Nothing else has the database open, so there's no lock to take
+	var imported, failed int
+	err = service.ImportNDJSON(context.Background(), in, sqlService.ImportRecords, func(result entity.ImportResult) {
+		if result.Error != "" {
+			failed++
+			slog.Error("unable to import line", "line", result.Line, "record_id", result.RecordID, "error", result.Error)
+			return
+		}
+		imported++
+	})
+	if err != nil {
+		slog.Error("import failed", "records", imported, "failed", failed, "error", err)
+		return 1
+	}
+	slog.Info("import finished", "records", imported, "failed", failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// backup copies the sqlite database to the -backup file, and returns the
+// exit code.
+func backup(cfg config.Config) int {
+	keyring, err := loadKeyring(cfg)
+	if err != nil {
+		log.Fatalf("Unable to load encryption keys; got error %v", err)
+	}
+	sqlService, err := service.NewSQLiteRecordService(cfg.DatabaseDir, sqliteSettings(cfg, keyring))
+	if err != nil {
+		log.Fatalf("Unable to open database; got error %v", err)
+	}
+	defer sqlService.Close()
+
+	if err := sqlService.Backup(context.Background(), cfg.Backup); err != nil {
+		slog.Error("backup failed", "error", err)
+		return 1
+	}
+	slog.Info("backup finished", "file", cfg.Backup)
+	return 0
+}
+
+// restore replaces the sqlite database with the -restore backup, rewound
+// to the restore point if one is set, and returns the exit code.
+func restore(cfg config.Config) int {
+	keyring, err := loadKeyring(cfg)
+	if err != nil {
+		log.Fatalf("Unable to load encryption keys; got error %v", err)
+	}
+	point, err := cfg.RestorePoint()
+	if err != nil {
+		log.Fatalf("Invalid restore point; got error %v", err)
+	}
+
+	result, err := service.RestoreSQLiteBackup(context.Background(), cfg.Restore, cfg.DatabaseDir, sqliteSettings(cfg, keyring), point)
+	if err != nil {
+		slog.Error("restore failed", "error", err)
+		return 1
+	}
+	slog.Info("restore finished", "file", cfg.Restore, "rewound", result.Rewound, "removed", result.Removed)
+	return 0
+}
+
+func newRecordService(cfg config.Config) (service.RecordService, error) {
+	switch cfg.Storage {
+	case config.StorageMemory:
+		settings := service.InMemoryRecordServiceSettings{
+			SnapshotInterval:  cfg.SnapshotInterval,
+			WriteAheadLog:     cfg.WriteAheadLog,
+			LogSync:           service.LogSyncPolicy(cfg.WALSync),
+			LogSyncInterval:   cfg.WALSyncInterval,
+			IdempotencyKeyTTL: cfg.IdempotencyKeyTTL,
+		}
+		if cfg.SnapshotInterval > 0 || cfg.WriteAheadLog {
+			settings.SnapshotDirectory = cfg.DatabaseDir
+		}
+		memoryService, err := service.NewInMemoryRecordService(settings)
+		if err != nil {
+			return nil, err
+		}
+		return memoryService, nil
+	case config.StoragePostgres:
+		postgresService, err := service.NewPostgresRecordService(
+			cfg.PostgresDSN, service.PostgresRecordServiceSettings{
+				ResetOnStart:      cfg.ResetOnStart,
+				IdempotencyKeyTTL: cfg.IdempotencyKeyTTL,
+			})
+		if err != nil {
+			return nil, err
+		}
+		return &postgresService, nil
+	case config.StorageBolt:
+		boltService, err := service.NewBoltRecordService(
+			cfg.DatabaseDir, service.BoltRecordServiceSettings{
+				ResetOnStart:      cfg.ResetOnStart,
+				IdempotencyKeyTTL: cfg.IdempotencyKeyTTL,
+			})
+		if err != nil {
+			return nil, err
+		}
+		return &boltService, nil
+	default:
+		keyring, err := loadKeyring(cfg)
+		if err != nil {
+			return nil, err
+		}
+		var policy *retention.Policy
+		if cfg.RetentionFile != "" {
+			if policy, err = retention.Load(cfg.RetentionFile); err != nil {
+				return nil, err
+			}
+		}
+		sqlService, err := service.NewSQLiteRecordService(
+			cfg.DatabaseDir, service.SQLiteRecordServiceSettings{
+				ResetOnStart:      cfg.ResetOnStart,
+				IdempotencyKeyTTL: cfg.IdempotencyKeyTTL,
+				Keyring:           keyring,
+				Retention:         policy,
+				JournalMode:       service.SQLiteJournalMode(cfg.SQLiteJournalMode),
+				Synchronous:       service.SQLiteSynchronous(cfg.SQLiteSynchronous),
+				BusyTimeout:       cfg.SQLiteBusyTimeout,
+				ReadConnections:   cfg.SQLiteReadConnections,
+				VersionCacheSize:  cfg.VersionCacheSize,
+			})
+		if err != nil {
+			return nil, err
+		}
+		sqlService.StartCompaction(cfg.CompactionInterval)
+		return &sqlService, nil
+	}
 }
@@ -0,0 +1,229 @@
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/temelpa/timetravel/internal/httputil"
+)
+
+const namespace = "timetravel"
+
+// Process-wide metrics. These are shared by every registry returned by
+// NewRegistry, so they can be observed from anywhere without threading a
+// registry through the service and api layers.
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests served, by route template, API version, method and status code.",
+	}, []string{"route", "version", "method", "code"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time to serve HTTP requests, by route template, API version and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "version", "method"})
+
+	lockWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "lock_wait_seconds",
+		Help:      "Time spent waiting for the record service lock, by mode (read or write).",
+		Buckets:   []float64{.00001, .0001, .001, .005, .01, .05, .1, .5, 1, 5},
+	}, []string{"mode"})
+
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "sqlite_query_duration_seconds",
+		Help:      "Time to run SQLite statements, by statement.",
+		Buckets:   []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1},
+	}, []string{"statement"})
+
+	postgresQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "postgres_query_duration_seconds",
+		Help:      "Time to run PostgreSQL statements, by statement.",
+		Buckets:   []float64{.0005, .001, .005, .01, .05, .1, .5, 1, 5},
+	}, []string{"statement"})
+
+	boltTransactionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "bolt_transaction_duration_seconds",
+		Help:      "Time to run bbolt transactions, by operation.",
+		Buckets:   []float64{.00001, .0001, .0005, .001, .005, .01, .05, .1, .5, 1},
+	}, []string{"operation"})
+
+	reconstructionDepth = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "version_reconstruction_depth",
+		Help:      "Number of inverse deltas replayed to reconstruct historical versions of a record.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	})
+
+	versionCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "version_cache_lookups_total",
+		Help:      "Lookups of historical versions in the version cache, by result (hit or miss).",
+	}, []string{"result"})
+
+	versionCacheEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "version_cache_evictions_total",
+		Help:      "Versions dropped from the version cache, by reason (capacity or invalidated).",
+	}, []string{"reason"})
+
+	versionCacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "version_cache_entries",
+		Help:      "Historical versions held in the version cache.",
+	})
+)
+
+// TableSizer is implemented by record services that can report how many
+// rows each of their tables holds.
+type TableSizer interface {
+	TableSizes(ctx context.Context) (map[string]int64, error)
+}
+
+// NewRegistry returns a registry with the process-wide metrics, Go runtime
+// metrics, and, if sizer is non-nil, table sizes collected at scrape time.
+func NewRegistry(sizer TableSizer) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestsTotal,
+		requestDuration,
+		lockWait,
+		queryDuration,
+		postgresQueryDuration,
+		boltTransactionDuration,
+		reconstructionDepth,
+		versionCacheLookups,
+		versionCacheEvictions,
+		versionCacheEntries,
+	)
+	if sizer != nil {
+		registry.MustRegister(tableSizeCollector{sizer})
+	}
+	return registry
+}
+
+// ObserveLockWait records how long it took to acquire the record service
+// lock, given when the attempt started.
+func ObserveLockWait(mode string, start time.Time) {
+	lockWait.WithLabelValues(mode).Observe(time.Since(start).Seconds())
+}
+
+// ObserveQuery records how long a SQLite statement took, given when it
+// started.
+func ObserveQuery(statement string, start time.Time) {
+	queryDuration.WithLabelValues(statement).Observe(time.Since(start).Seconds())
+}
+
+// ObservePostgresQuery records how long a PostgreSQL statement took, given
+// when it started.
+func ObservePostgresQuery(statement string, start time.Time) {
+	postgresQueryDuration.WithLabelValues(statement).Observe(time.Since(start).Seconds())
+}
+
+// ObserveBoltTransaction records how long a bbolt transaction took, given
+// when it started.
+func ObserveBoltTransaction(operation string, start time.Time) {
+	boltTransactionDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// ObserveReconstructionDepth records how many deltas were replayed to
+// reconstruct historical versions of a record.
+func ObserveReconstructionDepth(deltas int) {
+	reconstructionDepth.Observe(float64(deltas))
+}
+
+// ObserveVersionCacheLookup records whether a historical version was found
+// in the version cache.
+func ObserveVersionCacheLookup(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	versionCacheLookups.WithLabelValues(result).Inc()
+}
+
+// ObserveVersionCacheEvictions records versions dropped from the version
+// cache, either for capacity or because their history was rewritten.
+func ObserveVersionCacheEvictions(reason string, versions int) {
+	if versions > 0 {
+		versionCacheEvictions.WithLabelValues(reason).Add(float64(versions))
+	}
+}
+
+// AddVersionCacheEntries adjusts how many versions the version cache holds.
+func AddVersionCacheEntries(delta int) {
+	versionCacheEntries.Add(float64(delta))
+}
+
+// Middleware counts and times every request matched by a mux router,
+// labeled with the route template rather than the raw path so record ids
+// don't explode the label space.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := httputil.NewStatusRecorder(w)
+		next.ServeHTTP(recorder, r)
+
+		route := httputil.RouteTemplate(r)
+		version := apiVersion(route)
+
+		requestsTotal.WithLabelValues(route, version, r.Method, strconv.Itoa(recorder.Status)).Inc()
+		requestDuration.WithLabelValues(route, version, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// apiVersion extracts the version from templates such as /api/v2/records/{id}.
+func apiVersion(route string) string {
+	parts := strings.Split(strings.TrimPrefix(route, "/"), "/")
+	if len(parts) >= 2 && parts[0] == "api" {
+		return parts[1]
+	}
+	return "none"
+}
+
+var tableRowsDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "", "table_rows"),
+	"Rows in each table of the record store.",
+	[]string{"table"},
+	nil,
+)
+
+// How long a scrape may spend counting rows.
+const tableSizeTimeout = 5 * time.Second
+
+type tableSizeCollector struct {
+	sizer TableSizer
+}
+
+func (c tableSizeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tableRowsDesc
+}
+
+func (c tableSizeCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), tableSizeTimeout)
+	defer cancel()
+
+	sizes, err := c.sizer.TableSizes(ctx)
+	if err != nil {
+		slog.Error("unable to collect table sizes", "error", err)
+		ch <- prometheus.NewInvalidMetric(tableRowsDesc, err)
+		return
+	}
+	for table, rows := range sizes {
+		ch <- prometheus.MustNewConstMetric(tableRowsDesc, prometheus.GaugeValue, float64(rows), table)
+	}
+}
@@ -0,0 +1,148 @@
+package redact
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// What happens to a sensitive field for callers not allowed to see it.
+const (
+	// Replace the value with asterisks, optionally keeping its last few
+	// characters, e.g. "*****6789".
+	ActionMask = "mask"
+	// Leave the field out entirely.
+	ActionOmit = "omit"
+)
+
+// Field names record data keys that hold sensitive values.
+type Field struct {
+	// A data key, or a pattern matching several as in path.Match, e.g. "bank_*".
+	Key    string `json:"key"`
+	Action string `json:"action"`
+	// With ActionMask, how many trailing characters stay readable.
+	KeepLast int `json:"keep_last,omitempty"`
+	// Roles that see the value as stored.
+	VisibleTo []string `json:"visible_to,omitempty"`
+}
+
+// Redactor hides sensitive record fields from callers whose roles don't
+// entitle them to the values. Storage is never affected: it only changes
+// what responses show.
+type Redactor struct {
+	Fields []Field `json:"fields"`
+}
+
+// Load reads a JSON redaction config and validates it.
+func Load(configPath string) (*Redactor, error) {
+	contents, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var redactor Redactor
+	if err := json.Unmarshal(contents, &redactor); err != nil {
+		return nil, fmt.Errorf("invalid redaction file %s: %w", configPath, err)
+	}
+	if err := redactor.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid redaction file %s: %w", configPath, err)
+	}
+	return &redactor, nil
+}
+
+// Validate reports the first field that can't be applied.
+func (r *Redactor) Validate() error {
+	for i, field := range r.Fields {
+		if _, err := path.Match(field.Key, ""); err != nil || field.Key == "" {
+			return fmt.Errorf("field %d has an invalid key %q", i, field.Key)
+		}
+		if field.Action != ActionMask && field.Action != ActionOmit {
+			return fmt.Errorf("field %q has unknown action %q", field.Key, field.Action)
+		}
+		if field.KeepLast < 0 {
+			return fmt.Errorf("field %q keeps a negative number of characters", field.Key)
+		}
+	}
+	return nil
+}
+
+// Redact returns the data as a caller with the given roles may see it. The
+// data itself is left untouched; if nothing needs hiding it is returned
+// as is. A nil Redactor hides nothing.
+func (r *Redactor) Redact(roles []string, data map[string]string) map[string]string {
+	if r == nil || len(r.Fields) == 0 {
+		return data
+	}
+
+	var redacted map[string]string
+	for key, value := range data {
+		field, sensitive := r.field(key)
+		if !sensitive || field.visibleTo(roles) {
+			continue
+		}
+		if redacted == nil {
+			redacted = make(map[string]string, len(data))
+			for k, v := range data {
+				redacted[k] = v
+			}
+		}
+		switch field.Action {
+		case ActionOmit:
+			delete(redacted, key)
+		case ActionMask:
+			redacted[key] = mask(value, field.KeepLast)
+		}
+	}
+	if redacted == nil {
+		return data
+	}
+	return redacted
+}
+
+// HidesFrom reports whether any field is hidden from callers with the given
+// roles. A nil Redactor hides nothing.
+func (r *Redactor) HidesFrom(roles []string) bool {
+	if r == nil {
+		return false
+	}
+	for _, field := range r.Fields {
+		if !field.visibleTo(roles) {
+			return true
+		}
+	}
+	return false
+}
+
+// field returns the first configured field matching key.
+func (r *Redactor) field(key string) (Field, bool) {
+	for _, field := range r.Fields {
+		if matched, _ := path.Match(field.Key, key); matched {
+			return field, true
+		}
+	}
+	return Field{}, false
+}
+
+func (f Field) visibleTo(roles []string) bool {
+	for _, visible := range f.VisibleTo {
+		for _, role := range roles {
+			if role == visible {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mask hides all but the last keepLast characters of value, and all of
+// them if the value is too short for that to hide anything.
+func mask(value string, keepLast int) string {
+	characters := []rune(value)
+	if keepLast >= len(characters) {
+		keepLast = 0
+	}
+	hidden := len(characters) - keepLast
+	return strings.Repeat("*", hidden) + string(characters[hidden:])
+}
@@ -0,0 +1,93 @@
+package redact
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRedact(t *testing.T) {
+	redactor := &Redactor{Fields: []Field{
+		{Key: "ssn", Action: ActionMask, KeepLast: 4, VisibleTo: []string{"admin"}},
+		{Key: "bank_*", Action: ActionOmit, VisibleTo: []string{"admin", "billing"}},
+		{Key: "pin", Action: ActionMask, KeepLast: 8},
+	}}
+	if err := redactor.Validate(); err != nil {
+		t.Fatalf("Redactor should be valid, got error %v", err)
+	}
+
+	data := map[string]string{
+		"name":         "Jane",
+		"ssn":          "123-45-6789",
+		"bank_account": "0001",
+		"bank_routing": "0002",
+		"pin":          "1234",
+	}
+	original := map[string]string{}
+	for k, v := range data {
+		original[k] = v
+	}
+
+	for _, test := range []struct {
+		roles    []string
+		expected map[string]string
+	}{
+		{nil, map[string]string{"name": "Jane", "ssn": "*******6789", "pin": "****"}},
+		{[]string{"billing"}, map[string]string{
+			"name": "Jane", "ssn": "*******6789", "bank_account": "0001", "bank_routing": "0002", "pin": "****",
+		}},
+		{[]string{"agent", "admin"}, map[string]string{
+			"name": "Jane", "ssn": "123-45-6789", "bank_account": "0001", "bank_routing": "0002", "pin": "****",
+		}},
+	} {
+		if got := redactor.Redact(test.roles, data); !cmp.Equal(got, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.roles, test.expected, got)
+		}
+	}
+	if !cmp.Equal(data, original) {
+		t.Errorf("Redacting should not modify the data, got %v", data)
+	}
+
+	var none *Redactor
+	if got := none.Redact(nil, data); !cmp.Equal(got, data) {
+		t.Errorf("A nil redactor should hide nothing, got %v", got)
+	}
+
+	// The pin is hidden from everyone
+	if !redactor.HidesFrom([]string{"admin"}) || none.HidesFrom(nil) {
+		t.Error("Expected only the redactor to hide fields from admins")
+	}
+	if (&Redactor{Fields: redactor.Fields[:2]}).HidesFrom([]string{"admin"}) {
+		t.Error("Expected nothing hidden from admins without the pin")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	load := func(contents string) (*Redactor, error) {
+		path := filepath.Join(dir, "redaction.json")
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return Load(path)
+	}
+
+	redactor, err := load(`{"fields": [{"key": "ssn", "action": "omit", "visible_to": ["admin"]}]}`)
+	if err != nil || len(redactor.Fields) != 1 {
+		t.Errorf("Expected one field, got %v, error %v", redactor, err)
+	}
+
+	for _, contents := range []string{
+		`not json`,
+		`{"fields": [{"key": "", "action": "omit"}]}`,
+		`{"fields": [{"key": "[", "action": "omit"}]}`,
+		`{"fields": [{"key": "ssn", "action": "shred"}]}`,
+		`{"fields": [{"key": "ssn", "action": "mask", "keep_last": -1}]}`,
+	} {
+		if _, err := load(contents); err == nil {
+			t.Errorf("Expected %s to be rejected", contents)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package retention
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/temelpa/timetravel/entity"
+)
+
+// How versions past a rule's window are collapsed.
+const (
+	// Keep only the last version of each calendar year (UTC).
+	SnapshotsYearly = "yearly"
+	// Keep only the last version of each calendar month (UTC).
+	SnapshotsMonthly = "monthly"
+	// Keep none of them.
+	SnapshotsNone = "none"
+)
+
+// Rule says how long a record keeps every version. Without collections it
+// applies to every record; otherwise only to records whose id falls in one
+// of them.
+type Rule struct {
+	Collections []string `json:"collections,omitempty"`
+	// Versions written within this many days are always kept.
+	KeepAllDays int `json:"keep_all_days"`
+	// What older versions collapse to, e.g. SnapshotsYearly.
+	Snapshots string `json:"snapshots"`
+}
+
+// Policy decides which old versions of records are compacted away. A
+// record's latest version, and versions of unknown age, are always kept,
+// as is every version of records no rule applies to.
+type Policy struct {
+	// Named sets of record id ranges rules can be scoped to.
+	Collections map[string][]entity.IDRange `json:"collections,omitempty"`
+	// The first rule applying to a record is the one used.
+	Rules []Rule `json:"rules"`
+}
+
+// Load reads a JSON retention policy and validates it.
+func Load(path string) (*Policy, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy Policy
+	if err := json.Unmarshal(contents, &policy); err != nil {
+		return nil, fmt.Errorf("invalid retention file %s: %w", path, err)
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid retention file %s: %w", path, err)
+	}
+	return &policy, nil
+}
+
+// Validate reports the first rule or collection that can't be applied.
+func (p *Policy) Validate() error {
+	for name, ranges := range p.Collections {
+		for _, r := range ranges {
+			if r.Min > r.Max {
+				return fmt.Errorf("collection %q has an empty id range %d-%d", name, r.Min, r.Max)
+			}
+		}
+	}
+	for i, rule := range p.Rules {
+		if rule.KeepAllDays < 0 {
+			return fmt.Errorf("rule %d keeps versions for a negative number of days", i)
+		}
+		switch rule.Snapshots {
+		case SnapshotsYearly, SnapshotsMonthly, SnapshotsNone:
+		default:
+			return fmt.Errorf("rule %d has unknown snapshots %q", i, rule.Snapshots)
+		}
+		for _, collection := range rule.Collections {
+			if _, ok := p.Collections[collection]; !ok {
+				return fmt.Errorf("rule %d is scoped to unknown collection %q", i, collection)
+			}
+		}
+	}
+	return nil
+}
+
+// RuleFor returns the rule applying to the record with the given id, and
+// false if none does.
+func (p *Policy) RuleFor(id int64) (Rule, bool) {
+	for _, rule := range p.Rules {
+		if len(rule.Collections) == 0 {
+			return rule, true
+		}
+		for _, collection := range rule.Collections {
+			for _, r := range p.Collections[collection] {
+				if r.Contains(id) {
+					return rule, true
+				}
+			}
+		}
+	}
+	return Rule{}, false
+}
+
+// Keep decides which versions of a record to keep as of now, given when
+// each was written, oldest first. Unknown (zero) times are always kept.
+func (r Rule) Keep(createdAt []time.Time, now time.Time) []bool {
+	cutoff := now.AddDate(0, 0, -r.KeepAllDays)
+	keep := make([]bool, len(createdAt))
+	lastOfPeriod := map[string]int{}
+	for i, t := range createdAt {
+		if i == len(createdAt)-1 || t.IsZero() || !t.Before(cutoff) {
+			keep[i] = true
+			continue
+		}
+		switch r.Snapshots {
+		case SnapshotsYearly:
+			lastOfPeriod[t.UTC().Format("2006")] = i
+		case SnapshotsMonthly:
+			lastOfPeriod[t.UTC().Format("2006-01")] = i
+		}
+	}
+	for _, i := range lastOfPeriod {
+		keep[i] = true
+	}
+	return keep
+}
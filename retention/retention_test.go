@@ -0,0 +1,89 @@
+package retention
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/temelpa/timetravel/entity"
+)
+
+// Test which versions each kind of snapshot keeps
+func TestKeep(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	createdAt := []time.Time{
+		{},
+		time.Date(2020, 1, 5, 0, 0, 0, 0, time.UTC),
+		time.Date(2020, 1, 20, 0, 0, 0, 0, time.UTC),
+		time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC),
+	}
+
+	for _, test := range []struct {
+		snapshots string
+		expected  []bool
+	}{
+		{SnapshotsYearly, []bool{true, false, false, true, true, true, true}},
+		{SnapshotsMonthly, []bool{true, false, true, true, true, true, true}},
+		{SnapshotsNone, []bool{true, false, false, false, false, true, true}},
+	} {
+		rule := Rule{KeepAllDays: 365, Snapshots: test.snapshots}
+		if diff := cmp.Diff(test.expected, rule.Keep(createdAt, now)); diff != "" {
+			t.Errorf("%s: unexpected versions kept (-want +got):\n%s", test.snapshots, diff)
+		}
+	}
+
+	// The latest version is kept however old it is
+	rule := Rule{Snapshots: SnapshotsNone}
+	if diff := cmp.Diff([]bool{false, true}, rule.Keep(createdAt[1:3], now)); diff != "" {
+		t.Errorf("Unexpected versions kept (-want +got):\n%s", diff)
+	}
+}
+
+// Test loading a policy, and the first applicable rule winning
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "retention.json")
+	contents := `{
+		"collections": {"claims": [{"min": 100, "max": 199}]},
+		"rules": [
+			{"collections": ["claims"], "keep_all_days": 2555, "snapshots": "yearly"},
+			{"keep_all_days": 30, "snapshots": "none"}
+		]
+	}`
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := Load(path)
+	if err != nil {
+		t.Fatalf("Unable to load policy, error %v", err)
+	}
+	if rule, ok := policy.RuleFor(150); !ok || rule.KeepAllDays != 2555 {
+		t.Errorf("Expected the claims rule for record 150, got %+v", rule)
+	}
+	if rule, ok := policy.RuleFor(1); !ok || rule.KeepAllDays != 30 {
+		t.Errorf("Expected the catch-all rule for record 1, got %+v", rule)
+	}
+
+	scoped := &Policy{
+		Collections: map[string][]entity.IDRange{"claims": {{Min: 100, Max: 199}}},
+		Rules:       []Rule{{Collections: []string{"claims"}, Snapshots: SnapshotsNone}},
+	}
+	if _, ok := scoped.RuleFor(1); ok {
+		t.Errorf("Expected no rule for a record outside every collection")
+	}
+
+	for _, invalid := range []*Policy{
+		{Rules: []Rule{{KeepAllDays: -1, Snapshots: SnapshotsNone}}},
+		{Rules: []Rule{{Snapshots: "weekly"}}},
+		{Rules: []Rule{{Collections: []string{"claims"}, Snapshots: SnapshotsNone}}},
+		{Collections: map[string][]entity.IDRange{"claims": {{Min: 2, Max: 1}}}},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", invalid)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/temelpa/timetravel/logging"
+	"github.com/temelpa/timetravel/service"
+)
+
+// How long a readiness probe may spend checking the backing store.
+const readinessTimeout = 2 * time.Second
+
+// GET /healthz
+// Liveness: the process is up and serving HTTP. Deliberately checks nothing
+// else, so a slow database doesn't get the process restarted.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// GET /readyz
+// Readiness: the backing store is reachable and on the expected schema.
+func readyz(records service.RecordService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+
+		if err := records.CheckReady(ctx); err != nil {
+			logging.FromContext(ctx).Warn("not ready", "error", err)
+			writeStatus(w, http.StatusServiceUnavailable, map[string]string{
+				"status": "unavailable",
+				"error":  err.Error(),
+			})
+			return
+		}
+		writeStatus(w, http.StatusOK, map[string]string{"status": "ok"})
+	}
+}
+
+func writeStatus(w http.ResponseWriter, statusCode int, body map[string]string) {
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Error("unable to write status", "error", err)
+	}
+}
@@ -2,8 +2,14 @@ package server
 
 import (
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/temelpa/timetravel/api"
+	"github.com/temelpa/timetravel/auth"
+	"github.com/temelpa/timetravel/logging"
+	"github.com/temelpa/timetravel/metrics"
+	"github.com/temelpa/timetravel/redact"
 	"github.com/temelpa/timetravel/service"
+	"github.com/temelpa/timetravel/tracing"
 )
 
 type TimeTravelServer struct {
@@ -11,13 +17,38 @@ type TimeTravelServer struct {
 	Api    *api.API
 }
 
-func NewTimeTravelServer(service service.RecordService) TimeTravelServer {
+type Settings struct {
+	// If any are given, every /api request must be accepted by one of
+	// them. Health and metrics endpoints stay public so probes and
+	// scrapers need no credentials.
+	Authenticators []auth.Authenticator
+
+	// What authenticated principals may do; auth.DefaultPolicy if nil.
+	Policy *auth.Policy
+
+	// Which record fields callers see, by role. Nothing is hidden if nil.
+	Redactor *redact.Redactor
+}
+
+// NewTimeTravelServer routes requests to the service.
+func NewTimeTravelServer(service service.RecordService, settings Settings) TimeTravelServer {
 	router := mux.NewRouter()
-	api := api.NewAPI(service)
-	api.CreateRoutes(router)
+	var apiMiddleware []mux.MiddlewareFunc
+	if len(settings.Authenticators) > 0 {
+		apiMiddleware = append(apiMiddleware, auth.Middleware(settings.Authenticators, api.Unauthenticated))
+	}
+	api := api.NewAPI(service, settings.Policy, settings.Redactor)
+	api.CreateRoutes(router, apiMiddleware...)
+
+	router.Path("/healthz").HandlerFunc(healthz).Methods("GET")
+	router.Path("/readyz").HandlerFunc(readyz(service)).Methods("GET")
 
-	// TODO figure out an intelligent health check. Until then, don't
-	// even bother exposing an API for it.
+	// Table sizes are only reported by backends that can count them cheaply
+	sizer, _ := service.(metrics.TableSizer)
+	registry := metrics.NewRegistry(sizer)
+	router.Path("/metrics").Handler(promhttp.HandlerFor(registry, promhttp.HandlerOpts{})).Methods("GET")
+	// Tracing goes first so the logging middleware can tag lines with the trace id
+	router.Use(tracing.Middleware, logging.Middleware, metrics.Middleware)
 
 	return TimeTravelServer{router, api}
 }
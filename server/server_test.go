@@ -2,17 +2,29 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/temelpa/timetravel/auth"
+	"github.com/temelpa/timetravel/entity"
+	"github.com/temelpa/timetravel/redact"
 	"github.com/temelpa/timetravel/service"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 // NOTE: This code is mostly copied from github.com/gorilla/mux
@@ -29,7 +41,7 @@ func TestServerV1Sanity(t *testing.T) {
 		os.RemoveAll("testdata")
 	}()
 
-	ttServer := NewTimeTravelServer(&sqlService)
+	ttServer := NewTimeTravelServer(&sqlService, Settings{})
 
 	// Test that using an unsupported version fails
 	req := newTestRequest(t, "GET", fmt.Sprintf("/api/v0/records/%d", 42), nil)
@@ -44,7 +56,7 @@ func TestServerV1Sanity(t *testing.T) {
 	req = newTestRequest(t, "GET", testRecordPath, nil)
 	rr = httptest.NewRecorder()
 	ttServer.Router.ServeHTTP(rr, req)
-	if rr.Code != http.StatusBadRequest {
+	if rr.Code != http.StatusNotFound {
 		t.Errorf("Should have failed to read non-existant record, but got %v", rr.Code)
 	}
 
@@ -143,7 +155,7 @@ func TestServerV2Sanity(t *testing.T) {
 		os.RemoveAll("testdata")
 	}()
 
-	ttServer := NewTimeTravelServer(&sqlService)
+	ttServer := NewTimeTravelServer(&sqlService, Settings{})
 
 	// Test that using an unsupported version fails
 	req := newTestRequest(t, "GET", "/api/v0/records/42", nil)
@@ -157,7 +169,7 @@ func TestServerV2Sanity(t *testing.T) {
 	req = newTestRequest(t, "GET", "/api/v2/records/42", nil)
 	rr = httptest.NewRecorder()
 	ttServer.Router.ServeHTTP(rr, req)
-	if rr.Code != http.StatusBadRequest {
+	if rr.Code != http.StatusNotFound {
 		t.Errorf("Should have failed to read non-existant record, but got %v", rr.Code)
 	}
 
@@ -324,6 +336,1086 @@ func TestServerV2Sanity(t *testing.T) {
 	)
 }
 
+func TestServerIdempotencyKeys(t *testing.T) {
+	sqlService, err := service.NewSQLiteRecordService(
+		"testdata",
+		service.SQLiteRecordServiceSettings{ResetOnStart: true},
+	)
+	if err != nil {
+		t.Fatalf("Unable to create service for testing, error %e", err)
+	}
+	defer func() {
+		os.RemoveAll("testdata")
+	}()
+
+	ttServer := NewTimeTravelServer(&sqlService, Settings{})
+
+	// Helper to POST a JSON payload with an idempotency key and return the response
+	postWithKey := func(key string, jsonData map[string]interface{}) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		jsonBytes, err := json.Marshal(jsonData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := newTestRequest(t, "POST", "/api/v2/records/42", bytes.NewBuffer(jsonBytes))
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		req.Header.Set("Idempotency-Key", key)
+		ttServer.Router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	expectedFirstResponse := map[string]interface{}{
+		"id": float64(42),
+		"data": map[string]interface{}{
+			"hello": "world",
+		},
+		"version": float64(1),
+	}
+
+	rr := postWithKey("first", map[string]interface{}{"hello": "world"})
+	if rr.Code != http.StatusOK {
+		t.Errorf("Failed initial idempotent request, got %v", rr.Code)
+	}
+	compareResponseBody(t, rr.Result(), expectedFirstResponse)
+
+	// Create a second version so a replay that touched the record would be visible
+	rr = postWithKey("second", map[string]interface{}{"hello": "again"})
+	if rr.Code != http.StatusOK {
+		t.Errorf("Failed second idempotent request, got %v", rr.Code)
+	}
+
+	// Replaying the first key returns the original response verbatim
+	rr = postWithKey("first", map[string]interface{}{"hello": "world"})
+	if rr.Code != http.StatusOK {
+		t.Errorf("Failed replaying idempotent request, got %v", rr.Code)
+	}
+	if rr.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Replayed response should have been marked as such")
+	}
+	compareResponseBody(t, rr.Result(), expectedFirstResponse)
+
+	// Reusing a key with a different body is rejected
+	rr = postWithKey("first", map[string]interface{}{"hello": "mars"})
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Should have rejected reused idempotency key, got %v", rr.Code)
+	}
+
+	// Neither the replay nor the rejected request should have created a version
+	req := newTestRequest(t, "GET", "/api/v2/records/42", nil)
+	rr = httptest.NewRecorder()
+	ttServer.Router.ServeHTTP(rr, req)
+	compareResponseBody(t, rr.Result(), map[string]interface{}{
+		"id": float64(42),
+		"data": map[string]interface{}{
+			"hello": "again",
+		},
+		"version": float64(2),
+	})
+}
+
+// Test liveness and readiness probes, including after storage is closed
+func TestServerHealth(t *testing.T) {
+	sqlService, err := service.NewSQLiteRecordService(
+		"testdata",
+		service.SQLiteRecordServiceSettings{ResetOnStart: true},
+	)
+	if err != nil {
+		t.Fatalf("Unable to create service for testing, error %e", err)
+	}
+	defer func() {
+		os.RemoveAll("testdata")
+	}()
+
+	ttServer := NewTimeTravelServer(&sqlService, Settings{})
+
+	expectStatus := func(path string, expectedCode int) {
+		req := newTestRequest(t, "GET", path, nil)
+		rr := httptest.NewRecorder()
+		ttServer.Router.ServeHTTP(rr, req)
+		if rr.Code != expectedCode {
+			t.Errorf("Expected %s to return %v, got %v", path, expectedCode, rr.Code)
+		}
+	}
+
+	expectStatus("/healthz", http.StatusOK)
+	expectStatus("/readyz", http.StatusOK)
+
+	if err := sqlService.Close(); err != nil {
+		t.Errorf("Unable to close service, error %v", err)
+	}
+	expectStatus("/healthz", http.StatusOK)
+	expectStatus("/readyz", http.StatusServiceUnavailable)
+}
+
+// Test that requests, locks, queries and table sizes show up in /metrics
+func TestServerMetrics(t *testing.T) {
+	sqlService, err := service.NewSQLiteRecordService(
+		"testdata",
+		service.SQLiteRecordServiceSettings{ResetOnStart: true},
+	)
+	if err != nil {
+		t.Fatalf("Unable to create service for testing, error %e", err)
+	}
+	defer func() {
+		os.RemoveAll("testdata")
+	}()
+
+	ttServer := NewTimeTravelServer(&sqlService, Settings{})
+
+	for _, body := range []string{`{"hello":"world"}`, `{"hello":"mars"}`} {
+		req := newTestRequest(t, "POST", "/api/v2/records/42", bytes.NewBufferString(body))
+		ttServer.Router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	req := newTestRequest(t, "GET", "/api/v2/records/42/versions", nil)
+	ttServer.Router.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = newTestRequest(t, "GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+	ttServer.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Failed to scrape metrics, got %v", rr.Code)
+	}
+
+	scrape := rr.Body.String()
+	for _, expected := range []string{
+		`timetravel_http_requests_total{code="200",method="POST",route="/api/v2/records/{id}",version="v2"}`,
+		`timetravel_http_request_duration_seconds_count{method="GET",route="/api/v2/records/{id}/versions",version="v2"}`,
+		`timetravel_lock_wait_seconds_count{mode="write"}`,
+		`timetravel_sqlite_query_duration_seconds_count{statement="insert_record_delta"}`,
+		`timetravel_version_reconstruction_depth_count`,
+		`timetravel_table_rows{table="records"} 1`,
+		`timetravel_table_rows{table="record_deltas"} 2`, // the first version has a row too
+	} {
+		if !strings.Contains(scrape, expected) {
+			t.Errorf("Expected metrics to contain %s", expected)
+		}
+	}
+}
+
+// Test that a history read is traced through SQLite and delta replay, and
+// that in WAL mode it doesn't wait on the lock
+func TestServerTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+
+	sqlService, err := service.NewSQLiteRecordService(
+		"testdata",
+		service.SQLiteRecordServiceSettings{ResetOnStart: true},
+	)
+	if err != nil {
+		t.Fatalf("Unable to create service for testing, error %e", err)
+	}
+	defer func() {
+		os.RemoveAll("testdata")
+	}()
+
+	ttServer := NewTimeTravelServer(&sqlService, Settings{})
+
+	for _, body := range []string{`{"hello":"world"}`, `{"hello":"mars"}`} {
+		req := newTestRequest(t, "POST", "/api/v2/records/42", bytes.NewBufferString(body))
+		ttServer.Router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	spansBefore := len(recorder.Ended())
+	req := newTestRequest(t, "GET", "/api/v2/records/42/versions", nil)
+	ttServer.Router.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended()[spansBefore:] {
+		spans[span.Name()] = span
+	}
+	root, ok := spans["GET /api/v2/records/{id}/versions"]
+	if !ok {
+		t.Fatalf("Expected a span for the request, got %v", spans)
+	}
+	if _, ok := spans["lock.read"]; ok {
+		t.Errorf("Expected a snapshot read not to take the lock")
+	}
+	for _, name := range []string{"sqlite.query_record", "sqlite.query_record_deltas", "reconstruct_versions"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("Expected a %s span", name)
+		} else if span.SpanContext().TraceID() != root.SpanContext().TraceID() {
+			t.Errorf("Expected %s to be part of the request's trace", name)
+		}
+	}
+}
+
+// Test that service errors map to distinct statuses and machine-readable codes
+func TestServerErrors(t *testing.T) {
+	sqlService, err := service.NewSQLiteRecordService(
+		"testdata",
+		service.SQLiteRecordServiceSettings{ResetOnStart: true},
+	)
+	if err != nil {
+		t.Fatalf("Unable to create service for testing, error %e", err)
+	}
+	defer func() {
+		os.RemoveAll("testdata")
+	}()
+
+	ttServer := NewTimeTravelServer(&sqlService, Settings{})
+
+	req := newTestRequest(t, "POST", "/api/v2/records/42", bytes.NewBufferString(`{"hello":"world"}`))
+	rr := httptest.NewRecorder()
+	ttServer.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Failed creating record, got %v", rr.Code)
+	}
+
+	for _, tc := range []struct {
+		method       string
+		path         string
+		body         string
+		expectedCode int
+		expectedErr  string
+	}{
+		{"GET", "/api/v1/records/abc", "", http.StatusBadRequest, "invalid_id"},
+		{"GET", "/api/v2/records/42/versions/abc", "", http.StatusBadRequest, "invalid_version_id"},
+		{"POST", "/api/v2/records/42", "{", http.StatusBadRequest, "invalid_json"},
+		{"GET", "/api/v1/records/43", "", http.StatusNotFound, "record_not_found"},
+		{"GET", "/api/v2/records/43/versions", "", http.StatusNotFound, "record_not_found"},
+		{"GET", "/api/v2/records/43/versions/1", "", http.StatusNotFound, "record_not_found"},
+		{"GET", "/api/v2/records/42/versions/2", "", http.StatusNotFound, "version_not_found"},
+	} {
+		req := newTestRequest(t, tc.method, tc.path, bytes.NewBufferString(tc.body))
+		req.Header.Set("X-Request-ID", "test-request")
+		rr := httptest.NewRecorder()
+		ttServer.Router.ServeHTTP(rr, req)
+		if rr.Code != tc.expectedCode {
+			t.Errorf("%s %s: expected status %v, got %v", tc.method, tc.path, tc.expectedCode, rr.Code)
+		}
+
+		var body map[string]string
+		if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body["code"] != tc.expectedErr {
+			t.Errorf("%s %s: expected code %s, got %s", tc.method, tc.path, tc.expectedErr, body["code"])
+		}
+		if body["request_id"] != "test-request" || body["error"] == "" {
+			t.Errorf("%s %s: malformed error body %v", tc.method, tc.path, body)
+		}
+	}
+}
+
+// Test that ids beyond 32 bits round-trip, and ids beyond 64 bits are rejected
+func TestServer64BitIDs(t *testing.T) {
+	sqlService, err := service.NewSQLiteRecordService(
+		"testdata",
+		service.SQLiteRecordServiceSettings{ResetOnStart: true},
+	)
+	if err != nil {
+		t.Fatalf("Unable to create service for testing, error %e", err)
+	}
+	defer func() {
+		os.RemoveAll("testdata")
+	}()
+
+	ttServer := NewTimeTravelServer(&sqlService, Settings{})
+
+	for _, id := range []int64{math.MaxInt32, math.MaxInt32 + 1, math.MaxInt64} {
+		path := fmt.Sprintf("/api/v2/records/%d", id)
+		req := newTestRequest(t, "POST", path, bytes.NewBufferString(`{"hello":"world"}`))
+		rr := httptest.NewRecorder()
+		ttServer.Router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("Failed creating record %d, got %v", id, rr.Code)
+		}
+
+		req = newTestRequest(t, "GET", path, nil)
+		rr = httptest.NewRecorder()
+		ttServer.Router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("Failed fetching record %d, got %v", id, rr.Code)
+		}
+
+		// Decode into a typed record so the id isn't rounded through a float64
+		var record entity.Record
+		if err := json.NewDecoder(rr.Body).Decode(&record); err != nil {
+			t.Fatal(err)
+		} else if record.ID != id {
+			t.Errorf("Expected record id %d, got %d", id, record.ID)
+		}
+	}
+
+	for _, id := range []string{"0", "-1", "9223372036854775808"} {
+		req := newTestRequest(t, "GET", "/api/v2/records/"+id, nil)
+		rr := httptest.NewRecorder()
+		ttServer.Router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Should have rejected id %s, got %v", id, rr.Code)
+		}
+	}
+}
+
+// Test that /api requires credentials, and that admins can manage API keys
+func TestServerAuthentication(t *testing.T) {
+	sqlService, err := service.NewSQLiteRecordService(
+		"testdata",
+		service.SQLiteRecordServiceSettings{ResetOnStart: true},
+	)
+	if err != nil {
+		t.Fatalf("Unable to create service for testing, error %e", err)
+	}
+	defer func() {
+		os.RemoveAll("testdata")
+	}()
+
+	ttServer := NewTimeTravelServer(&sqlService, Settings{
+		Authenticators: []auth.Authenticator{auth.NewAPIKeyAuthenticator(&sqlService, "bootstrap")},
+	})
+
+	serve := func(method string, path string, key string, body string) *httptest.ResponseRecorder {
+		req := newTestRequest(t, method, path, bytes.NewBufferString(body))
+		if key != "" {
+			req.Header.Set(auth.APIKeyHeader, key)
+		}
+		rr := httptest.NewRecorder()
+		ttServer.Router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve("GET", "/api/v2/records/1", "", "")
+	if rr.Code != http.StatusUnauthorized || rr.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Expected a 401 challenge without credentials, got %v", rr.Code)
+	}
+	var errorBody map[string]string
+	json.Unmarshal(rr.Body.Bytes(), &errorBody)
+	if errorBody["code"] != "unauthenticated" || errorBody["request_id"] == "" {
+		t.Errorf("Expected an unauthenticated error body, got %v", errorBody)
+	}
+	if rr := serve("GET", "/api/v2/records/1", "tt_wrong", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a 401 for an unknown key, got %v", rr.Code)
+	}
+	for _, path := range []string{"/healthz", "/readyz", "/metrics"} {
+		if rr := serve("GET", path, "", ""); rr.Code != http.StatusOK {
+			t.Errorf("Expected %s to be public, got %v", path, rr.Code)
+		}
+	}
+
+	rr = serve("POST", "/api/admin/api-keys", "bootstrap", `{"principal":"billing","roles":["agent"]}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Failed to create api key, got %v: %s", rr.Code, rr.Body.String())
+	}
+	var created struct {
+		ID        string   `json:"id"`
+		Key       string   `json:"key"`
+		Principal string   `json:"principal"`
+		Roles     []string `json:"roles"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	if created.Key == "" || created.Principal != "billing" || !cmp.Equal(created.Roles, []string{"agent"}) {
+		t.Errorf("Unexpected created key %+v", created)
+	}
+	if rr := serve("POST", "/api/admin/api-keys", "bootstrap", `{"roles":["write"]}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected a key without principal to be refused, got %v", rr.Code)
+	}
+
+	if rr := serve("POST", "/api/v2/records/1", created.Key, `{"hello":"world"}`); rr.Code != http.StatusOK {
+		t.Errorf("Expected the new key to be accepted, got %v", rr.Code)
+	}
+	if rr := serve("GET", "/api/admin/api-keys", created.Key, ""); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected non-admins to be forbidden, got %v", rr.Code)
+	}
+
+	rr = serve("GET", "/api/admin/api-keys", "bootstrap", "")
+	if rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), created.Key) || !strings.Contains(rr.Body.String(), created.ID) {
+		t.Errorf("Expected keys to be listed without secrets, got %v: %s", rr.Code, rr.Body.String())
+	}
+
+	if rr := serve("DELETE", "/api/admin/api-keys/"+created.ID, "bootstrap", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("Failed to revoke api key, got %v", rr.Code)
+	}
+	if rr := serve("DELETE", "/api/admin/api-keys/missing", "bootstrap", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected revoking an unknown key to fail, got %v", rr.Code)
+	}
+	if rr := serve("GET", "/api/v2/records/1", created.Key, ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the revoked key to be refused, got %v", rr.Code)
+	}
+}
+
+// Test that with authentication disabled, records are open to anyone but
+// admin routes to no one
+func TestServerAdminWithoutAuthentication(t *testing.T) {
+	sqlService, err := service.NewSQLiteRecordService(t.TempDir(), service.SQLiteRecordServiceSettings{})
+	if err != nil {
+		t.Fatalf("Unable to create service for testing, error %e", err)
+	}
+	defer sqlService.Close()
+	ttServer := NewTimeTravelServer(&sqlService, Settings{})
+
+	serve := func(method string, path string, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		ttServer.Router.ServeHTTP(rr, newTestRequest(t, method, path, bytes.NewBufferString(body)))
+		return rr
+	}
+
+	if rr := serve("POST", "/api/v2/records/1", `{"hello":"world"}`); rr.Code != http.StatusOK {
+		t.Errorf("Expected records to be open, got %v", rr.Code)
+	}
+	for _, route := range []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"GET", "/api/admin/backup", ""},
+		{"GET", "/api/admin/api-keys", ""},
+		{"POST", "/api/admin/api-keys", `{"principal":"billing","roles":["admin"]}`},
+		{"POST", "/api/admin/records/1/erase", `{"all":true}`},
+		{"POST", "/api/admin/import", `{"id": 2, "versions": [{"version": 1, "data": {}}]}`},
+	} {
+		rr := serve(route.method, route.path, route.body)
+		var errorBody map[string]string
+		json.Unmarshal(rr.Body.Bytes(), &errorBody)
+		if rr.Code != http.StatusForbidden || errorBody["code"] != "forbidden" {
+			t.Errorf("Expected %s %s to be forbidden, got %v: %s", route.method, route.path, rr.Code, rr.Body.String())
+		}
+	}
+	if keys, err := sqlService.ListAPIKeys(context.Background()); err != nil || len(keys) != 0 {
+		t.Errorf("Expected no api keys to be created, got %v, error %v", keys, err)
+	}
+}
+
+// Test that each role of the policy is held to its operations over HTTP
+func TestServerAuthorization(t *testing.T) {
+	sqlService, err := service.NewSQLiteRecordService(
+		"testdata",
+		service.SQLiteRecordServiceSettings{ResetOnStart: true},
+	)
+	if err != nil {
+		t.Fatalf("Unable to create service for testing, error %e", err)
+	}
+	defer func() {
+		os.RemoveAll("testdata")
+	}()
+
+	policy := auth.DefaultPolicy()
+	policy.Collections = map[string][]auth.IDRange{"claims": {{Min: 100, Max: 199}}}
+	policy.Rules = append(policy.Rules, auth.Rule{
+		Role:        "claims-agent",
+		Operations:  []auth.Operation{auth.OpReadCurrent, auth.OpWrite},
+		Collections: []string{"claims"},
+	})
+	ttServer := NewTimeTravelServer(&sqlService, Settings{
+		Authenticators: []auth.Authenticator{auth.NewAPIKeyAuthenticator(&sqlService, "")},
+		Policy:         policy,
+	})
+
+	ctx := context.Background()
+	keys := map[string]string{}
+	for _, role := range []string{"agent", "auditor", "admin", "claims-agent", "stranger"} {
+		id, secret, err := auth.NewAPIKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sqlService.CreateAPIKey(ctx, entity.APIKey{
+			ID:        id,
+			Principal: role,
+			Roles:     []string{role},
+			KeyHash:   auth.HashAPIKey(secret),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		keys[role] = secret
+	}
+	for _, id := range []int{1, 100} {
+		if err := sqlService.CreateRecord(ctx, entity.Record{ID: int64(id), Data: map[string]string{"a": "b"}, Version: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	requests := []struct {
+		method string
+		path   string
+	}{
+		{"GET", "/api/v1/records/1"},
+		{"POST", "/api/v1/records/1"},
+		{"GET", "/api/v2/records/1"},
+		{"POST", "/api/v2/records/1"},
+		{"GET", "/api/v2/records/1/versions"},
+		{"GET", "/api/v2/records/1/versions/1"},
+		{"GET", "/api/v2/records/100"},
+		{"POST", "/api/v2/records/100"},
+		{"GET", "/api/admin/api-keys"},
+		{"GET", "/api/v2/records/1/verify"},
+	}
+	allowed := map[string][]bool{
+		"agent":        {true, true, true, true, false, false, true, true, false, false},
+		"auditor":      {false, false, false, false, true, true, false, false, false, true},
+		"admin":        {true, true, true, true, true, true, true, true, true, true},
+		"claims-agent": {false, false, false, false, false, false, true, true, false, false},
+		"stranger":     {false, false, false, false, false, false, false, false, false, false},
+	}
+	for role, expected := range allowed {
+		for i, request := range requests {
+			req := newTestRequest(t, request.method, request.path, bytes.NewBufferString(`{"a":"c"}`))
+			req.Header.Set(auth.APIKeyHeader, keys[role])
+			rr := httptest.NewRecorder()
+			ttServer.Router.ServeHTTP(rr, req)
+
+			if expected[i] && rr.Code != http.StatusOK {
+				t.Errorf("%s: expected %s %s to be allowed, got %v", role, request.method, request.path, rr.Code)
+			}
+			if !expected[i] && rr.Code != http.StatusForbidden {
+				t.Errorf("%s: expected %s %s to be forbidden, got %v", role, request.method, request.path, rr.Code)
+			}
+			if !expected[i] && !strings.Contains(rr.Body.String(), `"code":"forbidden"`) {
+				t.Errorf("%s: expected a forbidden error body, got %s", role, rr.Body.String())
+			}
+		}
+	}
+
+	// Malformed ids are reported as such, not hidden behind a 403
+	req := newTestRequest(t, "GET", "/api/v2/records/nope", nil)
+	req.Header.Set(auth.APIKeyHeader, keys["stranger"])
+	rr := httptest.NewRecorder()
+	ttServer.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected a 400 for a malformed id, got %v", rr.Code)
+	}
+}
+
+// Test that sensitive fields are hidden by role in current and historical reads
+func TestServerRedaction(t *testing.T) {
+	sqlService, err := service.NewSQLiteRecordService(
+		"testdata",
+		service.SQLiteRecordServiceSettings{ResetOnStart: true},
+	)
+	if err != nil {
+		t.Fatalf("Unable to create service for testing, error %e", err)
+	}
+	defer func() {
+		os.RemoveAll("testdata")
+	}()
+
+	ttServer := NewTimeTravelServer(&sqlService, Settings{
+		Authenticators: []auth.Authenticator{auth.NewAPIKeyAuthenticator(&sqlService, "")},
+		Redactor: &redact.Redactor{Fields: []redact.Field{
+			{Key: "ssn", Action: redact.ActionMask, KeepLast: 4, VisibleTo: []string{"admin"}},
+			{Key: "iban", Action: redact.ActionOmit, VisibleTo: []string{"admin"}},
+		}},
+	})
+
+	ctx := context.Background()
+	keys := map[string]string{}
+	for _, role := range []string{"agent", "auditor", "admin"} {
+		id, secret, err := auth.NewAPIKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sqlService.CreateAPIKey(ctx, entity.APIKey{
+			ID:        id,
+			Principal: role,
+			Roles:     []string{role},
+			KeyHash:   auth.HashAPIKey(secret),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		keys[role] = secret
+	}
+
+	serve := func(method string, path string, role string, body string) map[string]interface{} {
+		req := newTestRequest(t, method, path, bytes.NewBufferString(body))
+		req.Header.Set(auth.APIKeyHeader, keys[role])
+		rr := httptest.NewRecorder()
+		ttServer.Router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s %s as %s failed, got %v: %s", method, path, role, rr.Code, rr.Body.String())
+		}
+		var response map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &response)
+		return response
+	}
+
+	// The write response is redacted for the writer too
+	written := serve("POST", "/api/v2/records/1", "agent", `{"name":"Jane","ssn":"123-45-6789","iban":"DE89"}`)
+	expected := map[string]interface{}{"name": "Jane", "ssn": "*******6789"}
+	if !cmp.Equal(written["data"], expected) {
+		t.Errorf("Expected %v, got %v", expected, written["data"])
+	}
+	serve("POST", "/api/v2/records/1", "agent", `{"ssn":"987-65-4321"}`)
+
+	if got := serve("GET", "/api/v1/records/1", "agent", ""); !cmp.Equal(got["data"], map[string]interface{}{
+		"name": "Jane", "ssn": "*******4321",
+	}) {
+		t.Errorf("Expected a redacted v1 record, got %v", got["data"])
+	}
+	if got := serve("GET", "/api/v2/records/1", "admin", ""); !cmp.Equal(got["data"], map[string]interface{}{
+		"name": "Jane", "ssn": "987-65-4321", "iban": "DE89",
+	}) {
+		t.Errorf("Expected admins to see everything, got %v", got["data"])
+	}
+
+	// History is redacted as well, every version of it
+	versions := serve("GET", "/api/v2/records/1/versions", "auditor", "")["versions"].([]interface{})
+	for i, ssn := range []string{"*******6789", "*******4321"} {
+		data := versions[i].(map[string]interface{})["data"].(map[string]interface{})
+		if data["ssn"] != ssn || data["iban"] != nil {
+			t.Errorf("Expected version %d to be redacted, got %v", i+1, data)
+		}
+	}
+	if got := serve("GET", "/api/v2/records/1/versions/1", "auditor", ""); got["data"].(map[string]interface{})["ssn"] != "*******6789" {
+		t.Errorf("Expected a redacted version, got %v", got["data"])
+	}
+	if got := serve("GET", "/api/v2/records/1/versions/1", "admin", ""); got["data"].(map[string]interface{})["ssn"] != "123-45-6789" {
+		t.Errorf("Expected admins to see old versions in full, got %v", got["data"])
+	}
+
+	// Replaying an admin's idempotent response to an agent would leak
+	req := newTestRequest(t, "POST", "/api/v2/records/2", bytes.NewBufferString(`{"ssn":"111-22-3333"}`))
+	req.Header.Set(auth.APIKeyHeader, keys["admin"])
+	req.Header.Set("Idempotency-Key", "shared")
+	ttServer.Router.ServeHTTP(httptest.NewRecorder(), req)
+	req = newTestRequest(t, "POST", "/api/v2/records/2", bytes.NewBufferString(`{"ssn":"111-22-3333"}`))
+	req.Header.Set(auth.APIKeyHeader, keys["agent"])
+	req.Header.Set("Idempotency-Key", "shared")
+	rr := httptest.NewRecorder()
+	ttServer.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnprocessableEntity || strings.Contains(rr.Body.String(), "111-22-3333") {
+		t.Errorf("Expected another principal's idempotency key to be refused, got %v: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestServerErasure(t *testing.T) {
+	sqlService, err := service.NewSQLiteRecordService(
+		"testdata",
+		service.SQLiteRecordServiceSettings{ResetOnStart: true},
+	)
+	if err != nil {
+		t.Fatalf("Unable to create service for testing, error %e", err)
+	}
+	defer func() {
+		os.RemoveAll("testdata")
+	}()
+
+	ttServer := NewTimeTravelServer(&sqlService, Settings{
+		Authenticators: []auth.Authenticator{auth.NewAPIKeyAuthenticator(&sqlService, "")},
+	})
+
+	ctx := context.Background()
+	keys := map[string]string{}
+	for _, role := range []string{"agent", "admin"} {
+		id, secret, err := auth.NewAPIKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sqlService.CreateAPIKey(ctx, entity.APIKey{
+			ID:        id,
+			Principal: role,
+			Roles:     []string{role},
+			KeyHash:   auth.HashAPIKey(secret),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		keys[role] = secret
+	}
+
+	serve := func(method string, path string, role string, body string) *httptest.ResponseRecorder {
+		req := newTestRequest(t, method, path, bytes.NewBufferString(body))
+		req.Header.Set(auth.APIKeyHeader, keys[role])
+		rr := httptest.NewRecorder()
+		ttServer.Router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	serve("POST", "/api/v2/records/1", "agent", `{"name":"Jane","email":"jane@example.com"}`)
+	serve("POST", "/api/v2/records/1", "agent", `{"email":"jd@example.com"}`)
+
+	requests := []struct {
+		role   string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{"agent", "/api/admin/records/1/erase", `{"keys":["email"]}`, http.StatusForbidden, "forbidden"},
+		{"admin", "/api/admin/records/1/erase", `{}`, http.StatusBadRequest, "invalid_erasure"},
+		{"admin", "/api/admin/records/1/erase", `{"keys":`, http.StatusBadRequest, "invalid_json"},
+		{"admin", "/api/admin/records/0/erase", `{"all":true}`, http.StatusBadRequest, "invalid_id"},
+		{"admin", "/api/admin/records/2/erase", `{"all":true}`, http.StatusNotFound, "record_not_found"},
+	}
+	for _, request := range requests {
+		rr := serve("POST", request.path, request.role, request.body)
+		var body map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &body)
+		if rr.Code != request.status || body["code"] != request.code {
+			t.Errorf("%s %s: expected %v %s, got %v: %s", request.role, request.body, request.status, request.code, rr.Code, rr.Body.String())
+		}
+	}
+
+	rr := serve("POST", "/api/admin/records/1/erase", "admin", `{"keys":["email"]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Erasure failed, got %v: %s", rr.Code, rr.Body.String())
+	}
+	var erasure entity.Erasure
+	json.Unmarshal(rr.Body.Bytes(), &erasure)
+	if erasure.Principal != "admin" || erasure.AtVersion != 2 || !cmp.Equal(erasure.Keys, []string{"email"}) {
+		t.Errorf("Unexpected erasure marker %+v", erasure)
+	}
+
+	// The history keeps its versions, minus the erased key, plus the marker
+	rr = serve("GET", "/api/v2/records/1/versions", "admin", "")
+	if strings.Contains(rr.Body.String(), "example.com") {
+		t.Errorf("Erased values still in history: %s", rr.Body.String())
+	}
+	var history struct {
+		Versions []entity.Record  `json:"versions"`
+		Erasures []entity.Erasure `json:"erasures"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &history)
+	if len(history.Versions) != 2 || len(history.Erasures) != 1 || history.Erasures[0].Hash != erasure.Hash {
+		t.Errorf("Unexpected history %s", rr.Body.String())
+	}
+}
+
+func TestServerVerify(t *testing.T) {
+	memoryService, err := service.NewInMemoryRecordService(service.InMemoryRecordServiceSettings{})
+	if err != nil {
+		t.Fatalf("Unable to create service for testing, error %e", err)
+	}
+	ttServer := NewTimeTravelServer(memoryService, Settings{})
+
+	serve := func(method string, path string, body string) *httptest.ResponseRecorder {
+		req := newTestRequest(t, method, path, bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+		ttServer.Router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Every v2 record carries its version's hash; v1 records don't
+	var created map[string]interface{}
+	json.Unmarshal(serve("POST", "/api/v2/records/1", `{"hello":"world"}`).Body.Bytes(), &created)
+	serve("POST", "/api/v2/records/1", `{"hello":"mars"}`)
+	var versions struct {
+		Versions []entity.RecordV2 `json:"versions"`
+	}
+	json.Unmarshal(serve("GET", "/api/v2/records/1/versions", "").Body.Bytes(), &versions)
+	if len(versions.Versions) != 2 || versions.Versions[0].Hash != created["hash"] || versions.Versions[1].Hash == "" {
+		t.Errorf("Expected every version to carry its hash, got %+v", versions)
+	}
+	var current map[string]interface{}
+	json.Unmarshal(serve("GET", "/api/v2/records/1", "").Body.Bytes(), &current)
+	if current["hash"] != versions.Versions[1].Hash {
+		t.Errorf("Expected the current record to carry the latest hash, got %v", current)
+	}
+	if body := serve("GET", "/api/v1/records/1", "").Body.String(); strings.Contains(body, "hash") {
+		t.Errorf("Expected v1 records to be unchanged, got %s", body)
+	}
+
+	rr := serve("GET", "/api/v2/records/1/verify", "")
+	var verification entity.Verification
+	json.Unmarshal(rr.Body.Bytes(), &verification)
+	expected := entity.Verification{RecordID: 1, Valid: true, Versions: 2}
+	if rr.Code != http.StatusOK || !cmp.Equal(verification, expected) {
+		t.Errorf("Expected %+v, got %v: %s", expected, rr.Code, rr.Body.String())
+	}
+	if rr := serve("GET", "/api/v2/records/2/verify", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected verifying a nonexistant record to fail, got %v", rr.Code)
+	}
+}
+
+// Test that the export streams NDJSON redacted for the caller, who only gets
+// timestamps, and can only filter by them, if nothing is hidden from them
+func TestServerExport(t *testing.T) {
+	sqlService, err := service.NewSQLiteRecordService(t.TempDir(), service.SQLiteRecordServiceSettings{})
+	if err != nil {
+		t.Fatalf("Unable to create service for testing, error %e", err)
+	}
+	defer sqlService.Close()
+
+	ttServer := NewTimeTravelServer(&sqlService, Settings{
+		Authenticators: []auth.Authenticator{auth.NewAPIKeyAuthenticator(&sqlService, "")},
+		Redactor: &redact.Redactor{Fields: []redact.Field{
+			{Key: "ssn", Action: redact.ActionMask, KeepLast: 4, VisibleTo: []string{"admin"}},
+		}},
+	})
+	ctx := context.Background()
+	keys := map[string]string{}
+	for _, role := range []string{"agent", "auditor", "admin"} {
+		id, secret, err := auth.NewAPIKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sqlService.CreateAPIKey(ctx, entity.APIKey{
+			ID:        id,
+			Principal: role,
+			Roles:     []string{role},
+			KeyHash:   auth.HashAPIKey(secret),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		keys[role] = secret
+	}
+	serve := func(method string, path string, role string, body string) *httptest.ResponseRecorder {
+		req := newTestRequest(t, method, path, bytes.NewBufferString(body))
+		req.Header.Set(auth.APIKeyHeader, keys[role])
+		rr := httptest.NewRecorder()
+		ttServer.Router.ServeHTTP(rr, req)
+		return rr
+	}
+	export := func(path string, role string) []entity.ExportedRecord {
+		rr := serve("GET", path, role, "")
+		if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/x-ndjson" {
+			t.Fatalf("Expected an export as %s, got %v: %s", role, rr.Code, rr.Body.String())
+		}
+		exported := []entity.ExportedRecord{}
+		decoder := json.NewDecoder(rr.Body)
+		for decoder.More() {
+			var record entity.ExportedRecord
+			if err := decoder.Decode(&record); err != nil {
+				t.Fatal(err)
+			}
+			exported = append(exported, record)
+		}
+		return exported
+	}
+
+	serve("POST", "/api/v2/records/1", "admin", `{"ssn":"123-45-6789"}`)
+	serve("POST", "/api/v2/records/1", "admin", `{"name":"Jane"}`)
+	serve("POST", "/api/v2/records/2", "admin", `{"name":"John"}`)
+
+	exported := export("/api/v2/export", "auditor")
+	if len(exported) != 2 || len(exported[0].Versions) != 2 || exported[0].Versions[1].Data["ssn"] != "*******6789" {
+		t.Fatalf("Expected both records redacted, got %+v", exported)
+	}
+	for _, version := range exported[0].Versions {
+		if version.Hash == "" || version.CreatedAt != nil {
+			t.Errorf("Expected hashes without timestamps for auditors, got %+v", version)
+		}
+	}
+	exported = export("/api/v2/export?ids=1-1&as_of="+time.Now().UTC().Format(time.RFC3339Nano), "admin")
+	if len(exported) != 1 || exported[0].Versions[0].Data["ssn"] != "123-45-6789" || exported[0].Versions[0].CreatedAt == nil {
+		t.Errorf("Expected record 1 in full for admins, got %+v", exported)
+	}
+
+	for _, test := range []struct {
+		path   string
+		role   string
+		status int
+	}{
+		{"/api/v2/export", "agent", http.StatusForbidden},
+		{"/api/v2/export?as_of=2024-01-01T00:00:00Z", "auditor", http.StatusForbidden},
+		{"/api/v2/export?ids=2-1", "admin", http.StatusBadRequest},
+		{"/api/v2/export?as_of=yesterday", "admin", http.StatusBadRequest},
+	} {
+		if rr := serve("GET", test.path, test.role, ""); rr.Code != test.status {
+			t.Errorf("Expected %s as %s to fail with %d, got %v: %s", test.path, test.role, test.status, rr.Code, rr.Body.String())
+		}
+	}
+
+	memoryService, err := service.NewInMemoryRecordService(service.InMemoryRecordServiceSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	NewTimeTravelServer(memoryService, Settings{}).Router.ServeHTTP(rr, newTestRequest(t, "GET", "/api/v2/export", nil))
+	if rr.Code != http.StatusNotImplemented {
+		t.Errorf("Expected the memory backend not to export, got %v", rr.Code)
+	}
+}
+
+func TestServerImport(t *testing.T) {
+	sqlService, err := service.NewSQLiteRecordService(t.TempDir(), service.SQLiteRecordServiceSettings{})
+	if err != nil {
+		t.Fatalf("Unable to create service for testing, error %e", err)
+	}
+	defer sqlService.Close()
+
+	ttServer := NewTimeTravelServer(&sqlService, Settings{
+		Authenticators: []auth.Authenticator{auth.NewAPIKeyAuthenticator(&sqlService, "")},
+	})
+	ctx := context.Background()
+	keys := map[string]string{}
+	for _, role := range []string{"agent", "admin"} {
+		id, secret, err := auth.NewAPIKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sqlService.CreateAPIKey(ctx, entity.APIKey{
+			ID:        id,
+			Principal: role,
+			Roles:     []string{role},
+			KeyHash:   auth.HashAPIKey(secret),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		keys[role] = secret
+	}
+	serve := func(method string, path string, role string, body string) *httptest.ResponseRecorder {
+		req := newTestRequest(t, method, path, bytes.NewBufferString(body))
+		req.Header.Set(auth.APIKeyHeader, keys[role])
+		rr := httptest.NewRecorder()
+		ttServer.Router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	body := strings.Join([]string{
+		`{"id": 1, "versions": [{"version": 1, "data": {"plan": "basic"}, "created_at": "2015-01-01T00:00:00Z", "author": "jane"},` +
+			` {"version": 2, "data": {"plan": "gold"}, "created_at": "2015-06-01T00:00:00Z", "author": "john"}]}`,
+		`{"id": 2, "versions": [{"version": 2, "data": {}}]}`,
+		`not json`,
+	}, "\n")
+	if rr := serve("POST", "/api/admin/import", "agent", body); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected agents not to import, got %v", rr.Code)
+	}
+	rr := serve("POST", "/api/admin/import", "admin", body)
+	var summary struct {
+		Imported int                   `json:"imported"`
+		Failed   int                   `json:"failed"`
+		Errors   []entity.ImportResult `json:"errors"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &summary); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("Expected an import summary, got %v: %s", rr.Code, rr.Body.String())
+	}
+	if summary.Imported != 1 || summary.Failed != 2 || len(summary.Errors) != 2 ||
+		summary.Errors[0].Line != 2 || summary.Errors[0].RecordID != 2 || summary.Errors[1].Line != 3 {
+		t.Errorf("Expected one record imported and lines 2 and 3 failed, got %+v", summary)
+	}
+
+	rr = serve("GET", "/api/v2/records/1/versions/1", "admin", "")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"basic"`) {
+		t.Errorf("Expected the imported history, got %v: %s", rr.Code, rr.Body.String())
+	}
+	rr = serve("POST", "/api/admin/import", "admin", body)
+	if err := json.Unmarshal(rr.Body.Bytes(), &summary); err != nil || summary.Imported != 0 || summary.Failed != 3 {
+		t.Errorf("Expected record 1 to exist already on a second import, got %+v", summary)
+	}
+
+	memoryService, err := service.NewInMemoryRecordService(service.InMemoryRecordServiceSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	req := newTestRequest(t, "POST", "/api/admin/import", strings.NewReader(body))
+	req.Header.Set(auth.APIKeyHeader, "bootstrap")
+	NewTimeTravelServer(memoryService, Settings{
+		Authenticators: []auth.Authenticator{auth.NewAPIKeyAuthenticator(memoryService, "bootstrap")},
+	}).Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotImplemented {
+		t.Errorf("Expected the memory backend not to import, got %v", rr.Code)
+	}
+
+	// An import taking longer to upload than the server's timeouts allow
+	// isn't cut off
+	slow := httptest.NewUnstartedServer(ttServer.Router)
+	slow.Config.ReadTimeout = 100 * time.Millisecond
+	slow.Config.WriteTimeout = 100 * time.Millisecond
+	slow.Start()
+	defer slow.Close()
+	upload, uploading := io.Pipe()
+	go func() {
+		for id := 10; id < 13; id++ {
+			time.Sleep(100 * time.Millisecond)
+			fmt.Fprintf(uploading, `{"id": %d, "versions": [{"version": 1, "data": {}}]}`+"\n", id)
+		}
+		uploading.Close()
+	}()
+	req = newTestRequest(t, "POST", slow.URL+"/api/admin/import", upload)
+	req.Header.Set(auth.APIKeyHeader, keys["admin"])
+	response, err := slow.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Expected the slow import to finish, got error %v", err)
+	}
+	defer response.Body.Close()
+	if err := json.NewDecoder(response.Body).Decode(&summary); err != nil || response.StatusCode != http.StatusOK || summary.Imported != 3 {
+		t.Errorf("Expected three records imported, got %v: %+v, error %v", response.StatusCode, summary, err)
+	}
+}
+
+func TestServerBackup(t *testing.T) {
+	dbDir := t.TempDir()
+	sqlService, err := service.NewSQLiteRecordService(dbDir, service.SQLiteRecordServiceSettings{})
+	if err != nil {
+		t.Fatalf("Unable to create service for testing, error %e", err)
+	}
+	defer sqlService.Close()
+	ttServer := NewTimeTravelServer(&sqlService, Settings{
+		Authenticators: []auth.Authenticator{auth.NewAPIKeyAuthenticator(&sqlService, "bootstrap")},
+	})
+
+	serve := func(method string, path string, body string) *httptest.ResponseRecorder {
+		req := newTestRequest(t, method, path, bytes.NewBufferString(body))
+		req.Header.Set(auth.APIKeyHeader, "bootstrap")
+		rr := httptest.NewRecorder()
+		ttServer.Router.ServeHTTP(rr, req)
+		return rr
+	}
+	serve("POST", "/api/v2/records/1", `{"hello":"world"}`)
+
+	rr := serve("GET", "/api/admin/backup", "")
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/vnd.sqlite3" {
+		t.Fatalf("Expected a backup, got %v: %s", rr.Code, rr.Body.String())
+	}
+	if !bytes.HasPrefix(rr.Body.Bytes(), []byte("SQLite format 3\x00")) {
+		t.Errorf("Expected a sqlite database, got %q", rr.Body.Bytes()[:16])
+	}
+
+	// The backup is a database of its own
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/timetravel.db", rr.Body.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	backup, err := service.NewSQLiteRecordService(dir, service.SQLiteRecordServiceSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	if record, err := backup.GetRecord(context.Background(), 1); err != nil || record.Data["hello"] != "world" {
+		t.Errorf("Expected record 1 in the backup, got %+v, error %v", record, err)
+	}
+
+	// A backup asked for while another is being sent is refused
+	blocked := &blockingRecorder{ResponseRecorder: httptest.NewRecorder(), writing: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := newTestRequest(t, "GET", "/api/admin/backup", nil)
+		req.Header.Set(auth.APIKeyHeader, "bootstrap")
+		ttServer.Router.ServeHTTP(blocked, req)
+	}()
+	<-blocked.writing
+	if staged, _ := filepath.Glob(filepath.Join(dbDir, ".backup-*")); len(staged) != 1 {
+		t.Errorf("Expected the backup staged beside the database, got %v", staged)
+	}
+	rr = serve("GET", "/api/admin/backup", "")
+	var errorBody map[string]string
+	json.Unmarshal(rr.Body.Bytes(), &errorBody)
+	if rr.Code != http.StatusConflict || errorBody["code"] != "backup_in_progress" {
+		t.Errorf("Expected a concurrent backup to be refused, got %v: %s", rr.Code, rr.Body.String())
+	}
+	close(blocked.release)
+	<-done
+	if blocked.Code != http.StatusOK {
+		t.Errorf("Expected the first backup to finish, got %v", blocked.Code)
+	}
+	if staged, _ := filepath.Glob(filepath.Join(dbDir, ".backup-*")); len(staged) != 0 {
+		t.Errorf("Expected the staged backup removed, got %v", staged)
+	}
+	if rr := serve("GET", "/api/admin/backup", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected a backup once the last one finished, got %v", rr.Code)
+	}
+}
+
+// blockingRecorder closes writing on the first write of the body, and then
+// waits for release to be closed.
+type blockingRecorder struct {
+	*httptest.ResponseRecorder
+	writing chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (r *blockingRecorder) Write(body []byte) (int, error) {
+	r.once.Do(func() {
+		close(r.writing)
+		<-r.release
+	})
+	return r.ResponseRecorder.Write(body)
+}
+
 func newTestRequest(t *testing.T, method string, path string, body io.Reader) *http.Request {
 	req, err := http.NewRequest(method, path, body)
 	if err != nil {
@@ -339,7 +1431,27 @@ func compareResponseBody(t *testing.T, response *http.Response, expectedBody map
 	}
 	var body map[string]interface{}
 	json.Unmarshal(jsonBody, &body)
+	checkHashes(t, body)
 	if !cmp.Equal(body, expectedBody) {
 		t.Errorf("Expected %v, got %v", expectedBody, body)
 	}
 }
+
+// checkHashes removes the hash v2 adds to every record in a response body,
+// since it depends on when the version was written, after checking it
+// looks like one.
+func checkHashes(t *testing.T, body map[string]interface{}) {
+	if hash, ok := body["hash"]; ok {
+		if hash, _ := hash.(string); len(hash) != 64 {
+			t.Errorf("Expected a sha256 hash, got %v", body["hash"])
+		}
+		delete(body, "hash")
+	}
+	if versions, ok := body["versions"].([]interface{}); ok {
+		for _, version := range versions {
+			if version, ok := version.(map[string]interface{}); ok {
+				checkHashes(t, version)
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/temelpa/timetravel/data"
+	"github.com/temelpa/timetravel/entity"
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltAPIKey is an api_keys value. Unlike entity.APIKey, it keeps the hash
+// when marshalled.
+type boltAPIKey struct {
+	ID        string     `json:"id"`
+	Principal string     `json:"principal"`
+	Roles     []string   `json:"roles"`
+	KeyHash   string     `json:"key_hash"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+func putBoltAPIKey(tx *bolt.Tx, key entity.APIKey) error {
+	value, err := json.Marshal(boltAPIKey(key))
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(data.API_KEYS_TABLE)).Put([]byte(key.ID), value)
+}
+
+func getBoltAPIKey(tx *bolt.Tx, id string) (entity.APIKey, error) {
+	value := tx.Bucket([]byte(data.API_KEYS_TABLE)).Get([]byte(id))
+	if value == nil {
+		return entity.APIKey{}, fmt.Errorf("api key %s: %w", id, ErrAPIKeyDoesNotExist)
+	}
+	var key boltAPIKey
+	if err := json.Unmarshal(value, &key); err != nil {
+		return entity.APIKey{}, err
+	}
+	return entity.APIKey(key), nil
+}
+
+func (s *BoltRecordService) CreateAPIKey(
+	ctx context.Context,
+	key entity.APIKey,
+) error {
+	if key.CreatedAt.IsZero() {
+		key.CreatedAt = time.Now()
+	}
+
+	err := s.update(ctx, "create_api_key", func(tx *bolt.Tx) error {
+		hashes := tx.Bucket([]byte(data.API_KEY_HASHES_BUCKET))
+		if tx.Bucket([]byte(data.API_KEYS_TABLE)).Get([]byte(key.ID)) != nil || hashes.Get([]byte(key.KeyHash)) != nil {
+			return fmt.Errorf("api key %s: %w", key.ID, ErrRecordAlreadyExists)
+		}
+		if err := hashes.Put([]byte(key.KeyHash), []byte(key.ID)); err != nil {
+			return err
+		}
+		return putBoltAPIKey(tx, key)
+	})
+	if err != nil {
+		logError(ctx, err)
+		return err
+	}
+	return nil
+}
+
+func (s *BoltRecordService) GetAPIKeyByHash(
+	ctx context.Context,
+	keyHash string,
+) (entity.APIKey, error) {
+	var key entity.APIKey
+	err := s.view(ctx, "get_api_key_by_hash", func(tx *bolt.Tx) (err error) {
+		id := tx.Bucket([]byte(data.API_KEY_HASHES_BUCKET)).Get([]byte(keyHash))
+		if id == nil {
+			return ErrAPIKeyDoesNotExist
+		}
+		key, err = getBoltAPIKey(tx, string(id))
+		return err
+	})
+	if err != nil {
+		if !errors.Is(err, ErrAPIKeyDoesNotExist) {
+			logError(ctx, err)
+		}
+		return entity.APIKey{}, err
+	}
+	return key, nil
+}
+
+func (s *BoltRecordService) ListAPIKeys(
+	ctx context.Context,
+) ([]entity.APIKey, error) {
+	keys := []entity.APIKey{}
+	err := s.view(ctx, "list_api_keys", func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(data.API_KEYS_TABLE)).ForEach(func(_, value []byte) error {
+			var key boltAPIKey
+			if err := json.Unmarshal(value, &key); err != nil {
+				return err
+			}
+			keys = append(keys, entity.APIKey(key))
+			return nil
+		})
+	})
+	if err != nil {
+		logError(ctx, err)
+		return nil, err
+	}
+
+	// Keys are stored by id, so put them in the order they were created
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+func (s *BoltRecordService) RevokeAPIKey(
+	ctx context.Context,
+	id string,
+) error {
+	err := s.update(ctx, "revoke_api_key", func(tx *bolt.Tx) error {
+		key, err := getBoltAPIKey(tx, id)
+		if err != nil || key.RevokedAt != nil {
+			return err
+		}
+		revokedAt := time.Now()
+		key.RevokedAt = &revokedAt
+		return putBoltAPIKey(tx, key)
+	})
+	if err != nil && !errors.Is(err, ErrAPIKeyDoesNotExist) {
+		logError(ctx, err)
+	}
+	return err
+}
@@ -0,0 +1,156 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/temelpa/timetravel/data"
+	"github.com/temelpa/timetravel/entity"
+	bolt "go.etcd.io/bbolt"
+)
+
+func (s *BoltRecordService) EraseRecord(
+	ctx context.Context,
+	id int64,
+	keys []string,
+	wholeRecord bool,
+	principal string,
+) (entity.Erasure, error) {
+	var erasure entity.Erasure
+	err := s.update(ctx, "erase_record", func(tx *bolt.Tx) (err error) {
+		erasure, err = eraseBolt(tx, id, keys, wholeRecord, principal)
+		return err
+	})
+	if err != nil {
+		if !errors.Is(err, ErrRecordDoesNotExist) {
+			logError(ctx, err)
+		}
+		return entity.Erasure{}, err
+	}
+	return erasure, nil
+}
+
+func eraseBolt(
+	tx *bolt.Tx,
+	id int64,
+	keys []string,
+	wholeRecord bool,
+	principal string,
+) (entity.Erasure, error) {
+	current, err := getBoltRecord(tx, id)
+	if err != nil {
+		return entity.Erasure{}, err
+	}
+
+	deltas := map[int]boltDelta{}
+	err = scanBoltDeltas(tx, id, 0, func(versionBeforeDelta int, delta boltDelta) error {
+		deltas[versionBeforeDelta] = delta
+		return nil
+	})
+	if err != nil {
+		return entity.Erasure{}, err
+	}
+
+	erased := map[string]bool{}
+	for _, key := range keys {
+		erased[key] = true
+	}
+	if wholeRecord {
+		for key := range current.Data {
+			erased[key] = true
+		}
+		for _, delta := range deltas {
+			for key := range delta.InverseDelta {
+				erased[key] = true
+			}
+		}
+	}
+
+	for key := range erased {
+		delete(current.Data, key)
+		for _, delta := range deltas {
+			delete(delta.InverseDelta, key)
+		}
+	}
+	if err := putBoltRecord(tx, current); err != nil {
+		return entity.Erasure{}, err
+	}
+
+	// Erasing changes history, so it has to be rehashed, which stores the
+	// erased deltas too. The marker below is what records that it happened.
+	if err := rehashBolt(tx, current, deltas); err != nil {
+		return entity.Erasure{}, err
+	}
+
+	if err := deleteBoltIdempotencyKeys(tx, func(stored entity.IdempotentResponse) bool {
+		return stored.RecordID == id
+	}); err != nil {
+		return entity.Erasure{}, err
+	}
+
+	previous, err := getBoltErasures(tx, id)
+	if err != nil {
+		return entity.Erasure{}, err
+	}
+	erasure := entity.Erasure{
+		RecordID:    id,
+		Sequence:    len(previous) + 1,
+		AtVersion:   current.Version,
+		Keys:        []string{},
+		WholeRecord: wholeRecord,
+		Principal:   principal,
+		ErasedAt:    time.Now().UTC(),
+	}
+	for key := range erased {
+		erasure.Keys = append(erasure.Keys, key)
+	}
+	sort.Strings(erasure.Keys)
+	if len(previous) > 0 {
+		erasure.PreviousHash = previous[len(previous)-1].Hash
+	}
+	erasure.Hash = erasure.ComputeHash()
+
+	value, err := json.Marshal(erasure)
+	if err != nil {
+		return entity.Erasure{}, err
+	}
+	if err := tx.Bucket([]byte(data.RECORD_ERASURES_TABLE)).Put(boltVersionKey(id, erasure.Sequence), value); err != nil {
+		return entity.Erasure{}, err
+	}
+	return erasure, nil
+}
+
+func (s *BoltRecordService) GetErasures(
+	ctx context.Context,
+	id int64,
+) ([]entity.Erasure, error) {
+	var erasures []entity.Erasure
+	err := s.view(ctx, "get_erasures", func(tx *bolt.Tx) (err error) {
+		erasures, err = getBoltErasures(tx, id)
+		return err
+	})
+	if err != nil {
+		logError(ctx, err)
+		return nil, err
+	}
+	return erasures, nil
+}
+
+// getBoltErasures reads the erasure markers of a record, oldest first.
+func getBoltErasures(tx *bolt.Tx, id int64) ([]entity.Erasure, error) {
+	erasures := []entity.Erasure{}
+	prefix := boltID(id)
+	cursor := tx.Bucket([]byte(data.RECORD_ERASURES_TABLE)).Cursor()
+	for key, value := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = cursor.Next() {
+		var erasure entity.Erasure
+		if err := json.Unmarshal(value, &erasure); err != nil {
+			return nil, err
+		}
+		erasures = append(erasures, erasure)
+	}
+	return erasures, nil
+}
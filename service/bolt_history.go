@@ -0,0 +1,118 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/temelpa/timetravel/data"
+	"github.com/temelpa/timetravel/entity"
+	bolt "go.etcd.io/bbolt"
+)
+
+func (s *BoltRecordService) GetVersionHash(
+	ctx context.Context,
+	id int64,
+	version int,
+) (entity.VersionHash, error) {
+	var link entity.VersionHash
+	err := s.view(ctx, "get_version_hash", func(tx *bolt.Tx) error {
+		value := tx.Bucket([]byte(data.RECORD_DELTAS_TABLE)).Get(boltVersionKey(id, version-1))
+		if value != nil && version > 0 {
+			var delta boltDelta
+			if err := json.Unmarshal(value, &delta); err != nil {
+				return err
+			}
+			link = entity.VersionHash{Version: version, CreatedAt: time.Unix(0, delta.CreatedAt).UTC(), Hash: delta.Hash}
+			return nil
+		}
+
+		// Every version has a delta, so without one it's no version at all
+		if _, err := getBoltRecord(tx, id); err != nil {
+			return err
+		}
+		return fmt.Errorf("record %d version %d: %w", id, version, ErrVersionDoesNotExist)
+	})
+	if err != nil {
+		if !errors.Is(err, ErrRecordDoesNotExist) && !errors.Is(err, ErrVersionDoesNotExist) {
+			logError(ctx, err)
+		}
+		return entity.VersionHash{}, err
+	}
+	return link, nil
+}
+
+func (s *BoltRecordService) GetVersionHashes(
+	ctx context.Context,
+	id int64,
+) ([]entity.VersionHash, error) {
+	var hashes []entity.VersionHash
+	err := s.view(ctx, "get_version_hashes", func(tx *bolt.Tx) error {
+		current, err := getBoltRecord(tx, id)
+		if err != nil {
+			return err
+		}
+
+		hashes = make([]entity.VersionHash, current.Version)
+		for i := range hashes {
+			hashes[i].Version = i + 1
+		}
+		return scanBoltDeltas(tx, id, 0, func(versionBeforeDelta int, delta boltDelta) error {
+			if versionBeforeDelta < current.Version {
+				hashes[versionBeforeDelta] = entity.VersionHash{
+					Version:   versionBeforeDelta + 1,
+					CreatedAt: time.Unix(0, delta.CreatedAt).UTC(),
+					Hash:      delta.Hash,
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		if !errors.Is(err, ErrRecordDoesNotExist) {
+			logError(ctx, err)
+		}
+		return []entity.VersionHash{}, err
+	}
+	return hashes, nil
+}
+
+// rehashBolt recomputes the hash chain of a record within tx, after its
+// history was rewritten, from its current version and every delta, by the
+// version before the delta. It stores each delta with its new hash.
+func rehashBolt(tx *bolt.Tx, current entity.Record, deltas map[int]boltDelta) error {
+	versions := make([]entity.Record, current.Version)
+	hashes := make([]entity.VersionHash, current.Version)
+	record := current.Copy()
+	versions[record.Version-1] = record.Copy()
+	for versionBeforeDelta := current.Version - 1; versionBeforeDelta >= 0; versionBeforeDelta-- {
+		delta, ok := deltas[versionBeforeDelta]
+		if !ok {
+			continue
+		}
+		hashes[versionBeforeDelta] = entity.VersionHash{
+			Version:   versionBeforeDelta + 1,
+			CreatedAt: time.Unix(0, delta.CreatedAt).UTC(),
+			Hash:      delta.Hash,
+		}
+		record.ApplyUpdate(delta.InverseDelta)
+		record.Version = versionBeforeDelta
+		if versionBeforeDelta >= 1 {
+			versions[versionBeforeDelta-1] = record.Copy()
+		}
+	}
+
+	for i, link := range entity.ChainHashes(current.ID, versions, hashes) {
+		delta, ok := deltas[i]
+		if !ok {
+			continue
+		}
+		delta.Hash = link.Hash
+		if err := putBoltDelta(tx, current.ID, i, delta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
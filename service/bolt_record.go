@@ -0,0 +1,601 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/temelpa/timetravel/data"
+	"github.com/temelpa/timetravel/entity"
+	"github.com/temelpa/timetravel/metrics"
+	"github.com/temelpa/timetravel/tracing"
+	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// BoltRecordService is a record service on bbolt, an embedded key-value
+// store, for write-heavy workloads such as bulk imports. Versions are
+// stored as inverse deltas, like SQLiteRecordService does, under keys
+// ordered by record and version so history is read with a range scan.
+type BoltRecordService struct {
+	db             *bolt.DB
+	rwlock         sync.RWMutex
+	idempotencyTTL time.Duration
+}
+
+type BoltRecordServiceSettings struct {
+	// When the server is started, should the backing database
+	// be purged?
+	ResetOnStart bool
+
+	// How long responses stored for an Idempotency-Key are replayed.
+	// Zero uses DefaultIdempotencyKeyTTL.
+	IdempotencyKeyTTL time.Duration
+}
+
+// How long to wait for another process to let go of the database file
+// before giving up, rather than hanging forever.
+const boltOpenTimeout = 5 * time.Second
+
+func NewBoltRecordService(
+	dbDirectory string,
+	settings BoltRecordServiceSettings,
+) (BoltRecordService, error) {
+	dbPath := filepath.Join(dbDirectory, data.TIMETRAVEL_BOLT_DB)
+	if settings.ResetOnStart {
+		if err := os.RemoveAll(dbPath); err != nil {
+			logError(context.Background(), err)
+			return BoltRecordService{}, err
+		}
+	}
+
+	if err := os.MkdirAll(dbDirectory, 0755); err != nil {
+		logError(context.Background(), err)
+		return BoltRecordService{}, err
+	}
+
+	db, err := bolt.Open(dbPath, 0644, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		logError(context.Background(), err)
+		return BoltRecordService{}, err
+	}
+
+	if err := migrateBoltSchema(db); err != nil {
+		logError(context.Background(), err)
+		db.Close()
+		return BoltRecordService{}, err
+	}
+
+	idempotencyTTL := settings.IdempotencyKeyTTL
+	if idempotencyTTL <= 0 {
+		idempotencyTTL = DefaultIdempotencyKeyTTL
+	}
+
+	return BoltRecordService{
+		db:             db,
+		idempotencyTTL: idempotencyTTL,
+	}, nil
+}
+
+// migrateBoltSchema creates any missing buckets and refuses databases
+// written by a newer server, like migrateSchema.
+func migrateBoltSchema(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range data.BOLT_BUCKETS {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+
+		version, err := boltSchemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		if version > data.BOLT_SCHEMA_VERSION {
+			return fmt.Errorf("schema version %d, expected %d: %w", version, data.BOLT_SCHEMA_VERSION, ErrSchemaVersionMismatch)
+		}
+		return tx.Bucket([]byte(data.META_BUCKET)).Put(
+			[]byte(data.SCHEMA_VERSION_KEY),
+			[]byte(strconv.Itoa(data.BOLT_SCHEMA_VERSION)),
+		)
+	})
+}
+
+// boltSchemaVersion reads the schema version the database was written
+// with, 0 if it has none yet.
+func boltSchemaVersion(tx *bolt.Tx) (int, error) {
+	meta := tx.Bucket([]byte(data.META_BUCKET))
+	if meta == nil {
+		return 0, nil
+	}
+	version := meta.Get([]byte(data.SCHEMA_VERSION_KEY))
+	if version == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(string(version))
+}
+
+func (s *BoltRecordService) GetRWLockForAPI() *sync.RWMutex {
+	return &s.rwlock
+}
+
+func (s *BoltRecordService) CheckReady(ctx context.Context) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		version, err := boltSchemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		if version != data.BOLT_SCHEMA_VERSION {
+			return fmt.Errorf("schema version %d, expected %d: %w", version, data.BOLT_SCHEMA_VERSION, ErrSchemaVersionMismatch)
+		}
+		return nil
+	})
+}
+
+// TableSizes counts the keys of every bucket, for metrics.
+func (s *BoltRecordService) TableSizes(ctx context.Context) (map[string]int64, error) {
+	sizes := map[string]int64{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, bucket := range data.BOLT_BUCKETS {
+			if bucket == data.META_BUCKET {
+				continue
+			}
+			sizes[bucket] = int64(tx.Bucket([]byte(bucket)).Stats().KeyN)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
+
+func (s *BoltRecordService) Close() error {
+	return s.db.Close()
+}
+
+// instrumentBolt starts timing and tracing a bbolt transaction, like
+// instrumentQuery.
+func instrumentBolt(ctx context.Context, operation string) (context.Context, func(error)) {
+	queryCtx, done := instrumentStatement(ctx, "bbolt", operation, metrics.ObserveBoltTransaction)
+	return queryCtx, func(err error) {
+		// Like sql.ErrNoRows, asking for something that isn't there is an
+		// expected outcome, not a failure
+		if errors.Is(err, ErrRecordDoesNotExist) ||
+			errors.Is(err, ErrVersionDoesNotExist) ||
+			errors.Is(err, ErrIdempotencyKeyNotFound) ||
+			errors.Is(err, ErrAPIKeyDoesNotExist) {
+			err = nil
+		}
+		done(err)
+	}
+}
+
+// view runs fn in a read-only transaction, which sees the database as of
+// the moment it began.
+func (s *BoltRecordService) view(ctx context.Context, operation string, fn func(tx *bolt.Tx) error) error {
+	_, done := instrumentBolt(ctx, operation)
+	err := s.db.View(fn)
+	done(err)
+	return err
+}
+
+// update runs fn in a read-write transaction, committed if it returns nil.
+// Only one runs at a time.
+func (s *BoltRecordService) update(ctx context.Context, operation string, fn func(tx *bolt.Tx) error) error {
+	_, done := instrumentBolt(ctx, operation)
+	err := s.db.Update(fn)
+	done(err)
+	return err
+}
+
+// boltID encodes a record id as a key, ordered like the id.
+func boltID(id int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(id))
+}
+
+// boltVersionKey encodes the key of a record's row numbered n (a version or
+// sequence), ordered by id and then n.
+func boltVersionKey(id int64, n int) []byte {
+	return binary.BigEndian.AppendUint64(boltID(id), uint64(n))
+}
+
+// boltVersionFromKey decodes the number of the row keyed by key, as
+// encoded by boltVersionKey.
+func boltVersionFromKey(key []byte) int {
+	return int(binary.BigEndian.Uint64(key[8:]))
+}
+
+// boltDelta is a record_deltas value: the inverse of the update that took
+// the record past the version in its key, and the link of the version it
+// led to.
+type boltDelta struct {
+	InverseDelta map[string]*string `json:"inverseDelta"`
+	Hash         string             `json:"hash"`
+	CreatedAt    int64              `json:"createdAt"`
+}
+
+// getBoltRecord reads the latest version of a record.
+func getBoltRecord(tx *bolt.Tx, id int64) (entity.Record, error) {
+	value := tx.Bucket([]byte(data.RECORDS_TABLE)).Get(boltID(id))
+	if value == nil {
+		return entity.Record{}, fmt.Errorf("record %d: %w", id, ErrRecordDoesNotExist)
+	}
+	var record entity.Record
+	if err := json.Unmarshal(value, &record); err != nil {
+		return entity.Record{}, err
+	}
+	return record, nil
+}
+
+func putBoltRecord(tx *bolt.Tx, record entity.Record) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(data.RECORDS_TABLE)).Put(boltID(record.ID), value)
+}
+
+func putBoltDelta(tx *bolt.Tx, id int64, versionBeforeDelta int, delta boltDelta) error {
+	value, err := json.Marshal(delta)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(data.RECORD_DELTAS_TABLE)).Put(boltVersionKey(id, versionBeforeDelta), value)
+}
+
+// scanBoltDeltas calls fn with every delta of a record from
+// minVersionBeforeDelta on, oldest first.
+func scanBoltDeltas(tx *bolt.Tx, id int64, minVersionBeforeDelta int, fn func(versionBeforeDelta int, delta boltDelta) error) error {
+	prefix := boltID(id)
+	cursor := tx.Bucket([]byte(data.RECORD_DELTAS_TABLE)).Cursor()
+	for key, value := cursor.Seek(boltVersionKey(id, minVersionBeforeDelta)); key != nil && bytes.HasPrefix(key, prefix); key, value = cursor.Next() {
+		var delta boltDelta
+		if err := json.Unmarshal(value, &delta); err != nil {
+			return err
+		}
+		if err := fn(boltVersionFromKey(key), delta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BoltRecordService) GetRecord(
+	ctx context.Context,
+	id int64,
+) (entity.Record, error) {
+	var record entity.Record
+	err := s.view(ctx, "get_record", func(tx *bolt.Tx) (err error) {
+		record, err = getBoltRecord(tx, id)
+		return err
+	})
+	if err != nil && !errors.Is(err, ErrRecordDoesNotExist) {
+		logError(ctx, err)
+	}
+	return record, err
+}
+
+func (s *BoltRecordService) CreateRecord(
+	ctx context.Context,
+	record entity.Record,
+) error {
+	return s.CreateRecordKeyed(ctx, record, nil)
+}
+
+func (s *BoltRecordService) CreateRecordKeyed(
+	ctx context.Context,
+	record entity.Record,
+	respond IdempotentResponder,
+) error {
+	if record.ID <= 0 {
+		return fmt.Errorf("record %d: %w", record.ID, ErrRecordIDInvalid)
+	}
+
+	err := s.update(ctx, "create_record", func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(data.RECORDS_TABLE)).Get(boltID(record.ID)) != nil {
+			return fmt.Errorf("record %d: %w", record.ID, ErrRecordAlreadyExists)
+		}
+
+		record.Version = 1
+		if err := putBoltRecord(tx, record); err != nil {
+			return err
+		}
+
+		// The first version gets a delta too, to carry its hash
+		creationInverse := map[string]*string{}
+		for key := range record.Data {
+			creationInverse[key] = nil
+		}
+		link := newVersionHash("", record, nil)
+		if err := putBoltDelta(tx, record.ID, 0, boltDelta{
+			InverseDelta: creationInverse,
+			Hash:         link.Hash,
+			CreatedAt:    link.CreatedAt.UnixNano(),
+		}); err != nil {
+			return err
+		}
+		return s.saveResponse(tx, record, link, respond)
+	})
+	if err != nil && !errors.Is(err, ErrRecordAlreadyExists) {
+		logError(ctx, err)
+	}
+	return err
+}
+
+func (s *BoltRecordService) UpdateRecord(
+	ctx context.Context,
+	id int64,
+	updates map[string]*string,
+) (entity.Record, error) {
+	return s.UpdateRecordKeyed(ctx, id, updates, nil)
+}
+
+func (s *BoltRecordService) UpsertRecordKeyed(
+	ctx context.Context,
+	id int64,
+	updates map[string]*string,
+	respond IdempotentResponder,
+) (entity.Record, error) {
+	return upsertRecord(ctx, s, id, updates, respond)
+}
+
+func (s *BoltRecordService) UpdateRecordKeyed(
+	ctx context.Context,
+	id int64,
+	updates map[string]*string,
+	respond IdempotentResponder,
+) (entity.Record, error) {
+	var entry entity.Record
+	err := s.update(ctx, "update_record", func(tx *bolt.Tx) (err error) {
+		if entry, err = getBoltRecord(tx, id); err != nil {
+			return err
+		}
+
+		var previousHash boltDelta
+		if value := tx.Bucket([]byte(data.RECORD_DELTAS_TABLE)).Get(boltVersionKey(id, entry.Version-1)); value != nil {
+			if err := json.Unmarshal(value, &previousHash); err != nil {
+				return err
+			}
+		}
+
+		previous := entry.Copy()
+		updateInverse := entry.InverseUpdate(updates)
+		if !entry.ApplyUpdate(updates) {
+			return s.saveResponse(tx, entry, entity.VersionHash{
+				Version:   entry.Version,
+				CreatedAt: time.Unix(0, previousHash.CreatedAt).UTC(),
+				Hash:      previousHash.Hash,
+			}, respond)
+		}
+
+		entry.Version += 1
+		link := newVersionHash(previousHash.Hash, entry, previous.Data)
+		if err := putBoltDelta(tx, id, previous.Version, boltDelta{
+			InverseDelta: updateInverse,
+			Hash:         link.Hash,
+			CreatedAt:    link.CreatedAt.UnixNano(),
+		}); err != nil {
+			return err
+		}
+		if err := putBoltRecord(tx, entry); err != nil {
+			return err
+		}
+		return s.saveResponse(tx, entry, link, respond)
+	})
+	if err != nil {
+		if !errors.Is(err, ErrRecordDoesNotExist) {
+			logError(ctx, err)
+		}
+		return entity.Record{}, err
+	}
+	return entry.Copy(), nil
+}
+
+func (s *BoltRecordService) GetAllRecordVersions(
+	ctx context.Context,
+	id int64,
+) ([]entity.Record, error) {
+	return s.getRecordVersions(ctx, id, 1, 0)
+}
+
+func (s *BoltRecordService) GetVersionedRecord(
+	ctx context.Context,
+	id int64,
+	version int,
+) (entity.Record, error) {
+	r, err := s.getRecordVersions(ctx, id, version, 1)
+	if err != nil {
+		return entity.Record{}, err
+	}
+	if len(r) != 1 {
+		return entity.Record{}, fmt.Errorf("record %d version %d: %w", id, version, ErrVersionDoesNotExist)
+	}
+	return r[0], err
+}
+
+func (s *BoltRecordService) getRecordVersions(
+	ctx context.Context,
+	id int64,
+	minVersionToGrab int,
+	numOldestVersionsToGrab int,
+) ([]entity.Record, error) {
+	var versionedRecords []entity.Record
+	err := s.view(ctx, "get_record_versions", func(tx *bolt.Tx) error {
+		entry, err := getBoltRecord(tx, id)
+		if err != nil {
+			return err
+		}
+		if minVersionToGrab > entry.Version || minVersionToGrab < 0 {
+			return fmt.Errorf("record %d version %d: %w", id, minVersionToGrab, ErrVersionDoesNotExist)
+		}
+
+		if minVersionToGrab == 0 {
+			minVersionToGrab = entry.Version
+		}
+		if numOldestVersionsToGrab == 0 {
+			numOldestVersionsToGrab = entry.Version
+		}
+		if numVersionsAvailable := entry.Version - minVersionToGrab + 1; numVersionsAvailable < numOldestVersionsToGrab {
+			numOldestVersionsToGrab = numVersionsAvailable
+		}
+		maxVersionToGrab := minVersionToGrab + numOldestVersionsToGrab - 1
+
+		versionedRecords = make([]entity.Record, numOldestVersionsToGrab)
+		if maxVersionToGrab == entry.Version {
+			versionedRecords[entry.Version-minVersionToGrab] = entry.Copy()
+			if minVersionToGrab == entry.Version {
+				return nil
+			}
+		}
+
+		// The scan runs oldest first, but deltas have to be undone newest
+		// first
+		type versionedDelta struct {
+			versionBeforeDelta int
+			inverseDelta       map[string]*string
+		}
+		var deltas []versionedDelta
+		err = scanBoltDeltas(tx, id, minVersionToGrab, func(versionBeforeDelta int, delta boltDelta) error {
+			deltas = append(deltas, versionedDelta{versionBeforeDelta, delta.InverseDelta})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		_, reconstruction := tracing.Start(ctx, "reconstruct_versions",
+			attribute.Int64("record.id", id),
+			attribute.Int("record.version.min", minVersionToGrab),
+			attribute.Int("record.version.max", maxVersionToGrab),
+		)
+		for i := len(deltas) - 1; i >= 0; i-- {
+			entry.ApplyUpdate(deltas[i].inverseDelta)
+			entry.Version = deltas[i].versionBeforeDelta
+
+			if entry.Version >= minVersionToGrab && entry.Version <= maxVersionToGrab {
+				versionedRecords[entry.Version-minVersionToGrab] = entry.Copy()
+			}
+		}
+		metrics.ObserveReconstructionDepth(len(deltas))
+		reconstruction.SetAttributes(attribute.Int("deltas_applied", len(deltas)))
+		tracing.End(reconstruction, nil)
+		return nil
+	})
+	if err != nil {
+		if !errors.Is(err, ErrRecordDoesNotExist) && !errors.Is(err, ErrVersionDoesNotExist) {
+			logError(ctx, err)
+		}
+		return []entity.Record{}, err
+	}
+	return versionedRecords, nil
+}
+
+func (s *BoltRecordService) GetIdempotentResponse(
+	ctx context.Context,
+	key string,
+) (entity.IdempotentResponse, error) {
+	var response entity.IdempotentResponse
+	err := s.view(ctx, "get_idempotency_key", func(tx *bolt.Tx) error {
+		value := tx.Bucket([]byte(data.IDEMPOTENCY_KEYS_TABLE)).Get([]byte(key))
+		if value == nil {
+			return ErrIdempotencyKeyNotFound
+		}
+		return json.Unmarshal(value, &response)
+	})
+	if err == nil && time.Since(response.CreatedAt) > s.idempotencyTTL {
+		err = ErrIdempotencyKeyNotFound
+	}
+	if err != nil {
+		if err != ErrIdempotencyKeyNotFound {
+			logError(ctx, err)
+		}
+		return entity.IdempotentResponse{}, err
+	}
+	return response, nil
+}
+
+func (s *BoltRecordService) SaveIdempotentResponse(
+	ctx context.Context,
+	response entity.IdempotentResponse,
+) error {
+	err := s.update(ctx, "save_idempotency_key", func(tx *bolt.Tx) error {
+		return s.saveIdempotentResponse(tx, response)
+	})
+	if err != nil {
+		logError(ctx, err)
+		return err
+	}
+	return nil
+}
+
+// saveResponse stores the response respond builds from record within tx,
+// unless respond is nil.
+func (s *BoltRecordService) saveResponse(
+	tx *bolt.Tx,
+	record entity.Record,
+	link entity.VersionHash,
+	respond IdempotentResponder,
+) error {
+	if respond == nil {
+		return nil
+	}
+	response, err := respond(record.Copy(), link)
+	if err != nil {
+		return err
+	}
+	return s.saveIdempotentResponse(tx, response)
+}
+
+func (s *BoltRecordService) saveIdempotentResponse(tx *bolt.Tx, response entity.IdempotentResponse) error {
+	if response.CreatedAt.IsZero() {
+		response.CreatedAt = time.Now()
+	}
+
+	value, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	// As with SQLite, purging expired keys here is purely housekeeping
+	if err := deleteBoltIdempotencyKeys(tx, func(stored entity.IdempotentResponse) bool {
+		return time.Since(stored.CreatedAt) > s.idempotencyTTL
+	}); err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(data.IDEMPOTENCY_KEYS_TABLE)).Put([]byte(response.Key), value)
+}
+
+func deleteBoltIdempotencyKeys(tx *bolt.Tx, matching func(entity.IdempotentResponse) bool) error {
+	bucket := tx.Bucket([]byte(data.IDEMPOTENCY_KEYS_TABLE))
+
+	// Deleting under a cursor can make it skip keys, so find them all first
+	var keys [][]byte
+	err := bucket.ForEach(func(key, value []byte) error {
+		var stored entity.IdempotentResponse
+		if err := json.Unmarshal(value, &stored); err != nil {
+			return err
+		}
+		if matching(stored) {
+			keys = append(keys, bytes.Clone(key))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
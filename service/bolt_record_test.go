@@ -0,0 +1,227 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/temelpa/timetravel/data"
+	"github.com/temelpa/timetravel/entity"
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestBolt(t testing.TB, dir string, settings BoltRecordServiceSettings) *BoltRecordService {
+	service, err := NewBoltRecordService(dir, settings)
+	if err != nil {
+		t.Fatalf("Unable to create testing database, error %v", err)
+	}
+	t.Cleanup(func() { service.Close() })
+	return &service
+}
+
+// Test basic read + write functionality
+func TestSanityBolt(t *testing.T) {
+	dir := t.TempDir()
+	service := newTestBolt(t, dir, BoltRecordServiceSettings{})
+	testSanity(t, service)
+	service.Close()
+
+	// Everything survives reopening
+	reopened := newTestBolt(t, dir, BoltRecordServiceSettings{})
+	if r, err := reopened.GetRecord(context.Background(), 42); err != nil || r.Version != 3 || r.Data["goodbye"] != "unittest" {
+		t.Errorf("Expected version 3 of record 42 after reopening, got %v, error %v", r, err)
+	}
+	if err := reopened.CheckReady(context.Background()); err != nil {
+		t.Errorf("Expected service to be ready, got error %v", err)
+	}
+	reopened.Close()
+
+	// Unless it's reset
+	reset := newTestBolt(t, dir, BoltRecordServiceSettings{ResetOnStart: true})
+	if _, err := reset.GetRecord(context.Background(), 42); !errors.Is(err, ErrRecordDoesNotExist) {
+		t.Errorf("Expected a reset database to be empty, got error %v", err)
+	}
+}
+
+// Test that ids at the edges of the 64-bit range are stored and versioned intact
+func TestBoundaryIDsBolt(t *testing.T) {
+	testBoundaryIDs(t, newTestBolt(t, t.TempDir(), BoltRecordServiceSettings{}))
+}
+
+// Test that stored idempotent responses are only replayed within their TTL
+func TestIdempotentResponsesBolt(t *testing.T) {
+	testIdempotentResponses(t, newTestBolt(t, t.TempDir(), BoltRecordServiceSettings{IdempotencyKeyTTL: time.Hour}))
+}
+
+func TestAPIKeysBolt(t *testing.T) {
+	testAPIKeys(t, newTestBolt(t, t.TempDir(), BoltRecordServiceSettings{}))
+}
+
+func TestErasureBolt(t *testing.T) {
+	testErasure(t, newTestBolt(t, t.TempDir(), BoltRecordServiceSettings{}))
+}
+
+func TestHashChainBolt(t *testing.T) {
+	service := newTestBolt(t, t.TempDir(), BoltRecordServiceSettings{})
+	testHashChain(t, service)
+
+	// Editing history behind the service's back is detected
+	ctx := context.Background()
+	err := service.db.Update(func(tx *bolt.Tx) error {
+		var delta boltDelta
+		if err := json.Unmarshal(tx.Bucket([]byte(data.RECORD_DELTAS_TABLE)).Get(boltVersionKey(1, 1)), &delta); err != nil {
+			return err
+		}
+		pluto := "pluto"
+		delta.InverseDelta = map[string]*string{"hello": &pluto}
+		return putBoltDelta(tx, 1, 1, delta)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verification, err := VerifyRecord(ctx, service, 1); err != nil || verification.Valid || verification.BrokenVersion != 1 {
+		t.Errorf("Expected the edited version to break the chain, got %+v, error %v", verification, err)
+	}
+}
+
+// Test that databases from a newer server are refused
+func TestSchemaVersionBolt(t *testing.T) {
+	dir := t.TempDir()
+	service := newTestBolt(t, dir, BoltRecordServiceSettings{})
+	err := service.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(data.META_BUCKET)).Put(
+			[]byte(data.SCHEMA_VERSION_KEY),
+			[]byte(strconv.Itoa(data.BOLT_SCHEMA_VERSION+1)),
+		)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := service.CheckReady(context.Background()); !errors.Is(err, ErrSchemaVersionMismatch) {
+		t.Errorf("Expected readiness to fail on a newer schema, got error %v", err)
+	}
+	service.Close()
+	if _, err := NewBoltRecordService(dir, BoltRecordServiceSettings{}); !errors.Is(err, ErrSchemaVersionMismatch) {
+		t.Errorf("Expected a newer schema to be refused, got error %v", err)
+	}
+}
+
+// Test that history comes back in order even when ids and versions cross
+// byte boundaries, where a careless key encoding would sort them wrong
+func TestKeyOrderBolt(t *testing.T) {
+	service := newTestBolt(t, t.TempDir(), BoltRecordServiceSettings{})
+	ctx := context.Background()
+	for _, id := range []int64{255, 256, 257} {
+		if err := service.CreateRecord(ctx, entity.Record{ID: id, Data: map[string]string{}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for version := 2; version <= 300; version++ {
+		value := strconv.Itoa(version)
+		if _, err := service.UpdateRecord(ctx, 256, map[string]*string{"version": &value}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versions, err := service.GetAllRecordVersions(ctx, 256)
+	if err != nil || len(versions) != 300 {
+		t.Fatalf("Expected 300 versions, got %d, error %v", len(versions), err)
+	}
+	for i, version := range versions {
+		if version.ID != 256 || version.Version != i+1 || (i > 0 && version.Data["version"] != strconv.Itoa(i+1)) {
+			t.Errorf("Expected version %d of record 256, got %v", i+1, version)
+		}
+	}
+	for _, id := range []int64{255, 257} {
+		if versions, err := service.GetAllRecordVersions(ctx, id); err != nil || len(versions) != 1 {
+			t.Errorf("Expected record %d untouched, got %v, error %v", id, versions, err)
+		}
+	}
+	if verification, err := VerifyRecord(ctx, service, 256); err != nil || !verification.Valid {
+		t.Errorf("Expected the history to verify, got %+v, error %v", verification, err)
+	}
+}
+
+// benchmarkBackends are the persistent backends compared by the benchmarks
+// below, each opened fresh in its own directory.
+var benchmarkBackends = []struct {
+	name string
+	open func(b *testing.B) RecordServiceV2
+}{
+	{"sqlite", func(b *testing.B) RecordServiceV2 {
+		service, err := NewSQLiteRecordService(b.TempDir(), SQLiteRecordServiceSettings{})
+		if err != nil {
+			b.Fatalf("Unable to create benchmark database, error %v", err)
+		}
+		b.Cleanup(func() { service.Close() })
+		return &service
+	}},
+	{"bolt", func(b *testing.B) RecordServiceV2 {
+		return newTestBolt(b, b.TempDir(), BoltRecordServiceSettings{})
+	}},
+}
+
+func BenchmarkCreateRecord(b *testing.B) {
+	ctx := context.Background()
+	for _, backend := range benchmarkBackends {
+		b.Run(backend.name, func(b *testing.B) {
+			service := backend.open(b)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				record := entity.Record{ID: int64(i + 1), Data: map[string]string{"name": "policy holder", "state": "NY"}}
+				if err := service.CreateRecord(ctx, record); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUpdateRecord(b *testing.B) {
+	ctx := context.Background()
+	for _, backend := range benchmarkBackends {
+		b.Run(backend.name, func(b *testing.B) {
+			service := backend.open(b)
+			if err := service.CreateRecord(ctx, entity.Record{ID: 1, Data: map[string]string{"name": "policy holder"}}); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				value := strconv.Itoa(i)
+				if _, err := service.UpdateRecord(ctx, 1, map[string]*string{"employees": &value}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetAllRecordVersions(b *testing.B) {
+	ctx := context.Background()
+	for _, backend := range benchmarkBackends {
+		for _, versions := range []int{10, 100, 1000} {
+			b.Run(backend.name+"/versions="+strconv.Itoa(versions), func(b *testing.B) {
+				service := backend.open(b)
+				if err := service.CreateRecord(ctx, entity.Record{ID: 1, Data: map[string]string{"name": "policy holder"}}); err != nil {
+					b.Fatal(err)
+				}
+				for version := 2; version <= versions; version++ {
+					value := strconv.Itoa(version)
+					if _, err := service.UpdateRecord(ctx, 1, map[string]*string{"employees": &value}); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := service.GetAllRecordVersions(ctx, 1); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
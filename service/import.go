@@ -0,0 +1,90 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/temelpa/timetravel/entity"
+)
+
+// How many records ImportNDJSON writes per transaction.
+const importBatchSize = 500
+
+// The longest line ImportNDJSON reads. A record's whole history is one
+// line, so this bounds how long a history can be imported.
+const maxImportLineSize = 64 << 20
+
+// ImportBatch writes one batch of an import, like ImportRecords, holding
+// whatever lock the caller's ImportService relies on.
+type ImportBatch func(ctx context.Context, records []entity.ExportedRecord) ([]error, error)
+
+// ImportNDJSON reads records in the format Export writes, one per line, and
+// imports them in batches with importBatch. report is called with what
+// became of every line, in order; blank lines are skipped. Lines that can't
+// be parsed or imported are reported with their error and don't stop the
+// rest. The error returned is for a failure that stops the import, and
+// every batch before it stays imported.
+func ImportNDJSON(ctx context.Context, r io.Reader, importBatch ImportBatch, report func(entity.ImportResult)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportLineSize)
+
+	var batch []entity.ExportedRecord
+	var lines []int
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		errs, err := importBatch(ctx, batch)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lines[0], err)
+		}
+		for i, record := range batch {
+			result := entity.ImportResult{Line: lines[i], RecordID: record.ID}
+			if errs[i] != nil {
+				result.Error = errs[i].Error()
+			} else {
+				result.Versions = len(record.Versions)
+			}
+			report(result)
+		}
+		batch, lines = batch[:0], lines[:0]
+		return nil
+	}
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		var record entity.ExportedRecord
+		if err := json.Unmarshal(text, &record); err != nil {
+			// Earlier lines are reported first, so results stay in order
+			if err := flush(); err != nil {
+				return err
+			}
+			report(entity.ImportResult{Line: line, Error: "invalid json; " + err.Error()})
+			continue
+		}
+		batch = append(batch, record)
+		lines = append(lines, line)
+		if len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			err = ErrImportLineTooLong
+		}
+		return fmt.Errorf("line %d: %w", line+1, err)
+	}
+	return flush()
+}
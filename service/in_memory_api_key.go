@@ -0,0 +1,69 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/temelpa/timetravel/entity"
+)
+
+func (s *InMemoryRecordService) CreateAPIKey(ctx context.Context, key entity.APIKey) error {
+	s.apiKeysLock.Lock()
+	defer s.apiKeysLock.Unlock()
+
+	for _, existing := range s.apiKeys {
+		if existing.ID == key.ID || existing.KeyHash == key.KeyHash {
+			return fmt.Errorf("api key %s: %w", key.ID, ErrRecordAlreadyExists)
+		}
+	}
+
+	if key.CreatedAt.IsZero() {
+		key.CreatedAt = time.Now()
+	}
+	s.apiKeys[key.ID] = key
+	return nil
+}
+
+func (s *InMemoryRecordService) GetAPIKeyByHash(ctx context.Context, keyHash string) (entity.APIKey, error) {
+	s.apiKeysLock.Lock()
+	defer s.apiKeysLock.Unlock()
+
+	for _, key := range s.apiKeys {
+		if key.KeyHash == keyHash {
+			return key, nil
+		}
+	}
+	return entity.APIKey{}, ErrAPIKeyDoesNotExist
+}
+
+func (s *InMemoryRecordService) ListAPIKeys(ctx context.Context) ([]entity.APIKey, error) {
+	s.apiKeysLock.Lock()
+	defer s.apiKeysLock.Unlock()
+
+	keys := make([]entity.APIKey, 0, len(s.apiKeys))
+	for _, key := range s.apiKeys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+func (s *InMemoryRecordService) RevokeAPIKey(ctx context.Context, id string) error {
+	s.apiKeysLock.Lock()
+	defer s.apiKeysLock.Unlock()
+
+	key, exists := s.apiKeys[id]
+	if !exists {
+		return fmt.Errorf("api key %s: %w", id, ErrAPIKeyDoesNotExist)
+	}
+	if key.RevokedAt == nil {
+		revokedAt := time.Now()
+		key.RevokedAt = &revokedAt
+		s.apiKeys[id] = key
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/temelpa/timetravel/entity"
+)
+
+func (s *InMemoryRecordService) EraseRecord(
+	ctx context.Context,
+	id int64,
+	keys []string,
+	wholeRecord bool,
+	principal string,
+) (entity.Erasure, error) {
+	versions := s.data[id]
+	if len(versions) == 0 {
+		return entity.Erasure{}, fmt.Errorf("record %d: %w", id, ErrRecordDoesNotExist)
+	}
+
+	erased := map[string]bool{}
+	for _, key := range keys {
+		erased[key] = true
+	}
+	if wholeRecord {
+		for _, version := range versions {
+			for key := range version.Data {
+				erased[key] = true
+			}
+		}
+	}
+
+	previous := s.erasures[id]
+	erasure := entity.Erasure{
+		RecordID:    id,
+		Sequence:    len(previous) + 1,
+		AtVersion:   len(versions),
+		Keys:        []string{},
+		WholeRecord: wholeRecord,
+		Principal:   principal,
+		ErasedAt:    time.Now().UTC(),
+	}
+	for key := range erased {
+		erasure.Keys = append(erasure.Keys, key)
+	}
+	sort.Strings(erasure.Keys)
+	if len(previous) > 0 {
+		erasure.PreviousHash = previous[len(previous)-1].Hash
+	}
+	erasure.Hash = erasure.ComputeHash()
+
+	if err := s.logWrite(walEntry{Erasure: &erasure}); err != nil {
+		logError(ctx, err)
+		return entity.Erasure{}, err
+	}
+	s.applyErasure(erasure)
+	return erasure, nil
+}
+
+// applyErasure removes the erasure's keys from every version of its record,
+// along with the record's idempotent responses, and leaves its marker.
+func (s *InMemoryRecordService) applyErasure(erasure entity.Erasure) {
+	id := erasure.RecordID
+	versions := s.data[id]
+	for _, version := range versions {
+		for _, key := range erasure.Keys {
+			delete(version.Data, key)
+		}
+	}
+
+	// Erasing changes history, so it has to be rehashed. The marker is
+	// what records that it happened.
+	s.hashes[id] = entity.ChainHashes(id, versions, s.versionHashes(id))
+
+	for key, response := range s.idempotentResponses {
+		if response.RecordID == id {
+			delete(s.idempotentResponses, key)
+		}
+	}
+
+	s.erasures[id] = append(s.erasures[id], erasure)
+}
+
+func (s *InMemoryRecordService) GetErasures(ctx context.Context, id int64) ([]entity.Erasure, error) {
+	erasures := make([]entity.Erasure, len(s.erasures[id]))
+	copy(erasures, s.erasures[id])
+	return erasures, nil
+}
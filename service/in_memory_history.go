@@ -0,0 +1,53 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/temelpa/timetravel/entity"
+)
+
+func (s *InMemoryRecordService) GetVersionHash(ctx context.Context, id int64, version int) (entity.VersionHash, error) {
+	hashes, err := s.GetVersionHashes(ctx, id)
+	if err != nil {
+		return entity.VersionHash{}, err
+	}
+	if version <= 0 || version > len(hashes) {
+		return entity.VersionHash{}, fmt.Errorf("record %d version %d: %w", id, version, ErrVersionDoesNotExist)
+	}
+	return hashes[version-1], nil
+}
+
+func (s *InMemoryRecordService) GetVersionHashes(ctx context.Context, id int64) ([]entity.VersionHash, error) {
+	if len(s.data[id]) == 0 {
+		return []entity.VersionHash{}, fmt.Errorf("record %d: %w", id, ErrRecordDoesNotExist)
+	}
+	return s.versionHashes(id), nil
+}
+
+// versionHashes copies the links of every version of a record, including
+// the empty ones of versions restored from snapshots that predate hashing.
+func (s *InMemoryRecordService) versionHashes(id int64) []entity.VersionHash {
+	hashes := make([]entity.VersionHash, len(s.data[id]))
+	copy(hashes, s.hashes[id])
+	for i := len(s.hashes[id]); i < len(hashes); i++ {
+		hashes[i] = entity.VersionHash{Version: i + 1}
+	}
+	return hashes
+}
+
+// nextVersionHash links the next version of a record, which changed it
+// from previous, onto its chain.
+func (s *InMemoryRecordService) nextVersionHash(record entity.Record, previous map[string]string) entity.VersionHash {
+	previousHash := ""
+	if hashes := s.versionHashes(record.ID); len(hashes) > 0 {
+		previousHash = hashes[len(hashes)-1].Hash
+	}
+	return newVersionHash(previousHash, record, previous)
+}
+
+// appendVersion stores the next version of a record along with its link.
+func (s *InMemoryRecordService) appendVersion(record entity.Record, link entity.VersionHash) {
+	s.data[record.ID] = append(s.data[record.ID], record.Copy())
+	s.hashes[record.ID] = append(s.versionHashes(record.ID)[:record.Version-1], link)
+}
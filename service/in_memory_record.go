@@ -2,58 +2,446 @@ package service
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/temelpa/timetravel/entity"
 )
 
+// File the in-memory service periodically writes its state to, relative
+// to the configured snapshot directory.
+const InMemorySnapshotFile = "memory_snapshot.json"
+
 // InMemoryRecordService is an in-memory implementation of RecordService.
 type InMemoryRecordService struct {
-	data map[int]entity.Record
+	// Every version of each record, oldest first.
+	data                map[int64][]entity.Record
+	hashes              map[int64][]entity.VersionHash
+	erasures            map[int64][]entity.Erasure
+	idempotentResponses map[string]entity.IdempotentResponse
+	idempotencyTTL      time.Duration
+	rwlock              sync.RWMutex
+	snapshotPath        string
+	// Nil unless writes are logged ahead of being applied.
+	log              *writeAheadLog
+	closed           bool
+	stopSnapshots    chan struct{}
+	snapshotsStopped chan struct{}
+
+	// API keys are looked up before a request takes the API lock, so they
+	// are guarded separately. They aren't snapshotted.
+	apiKeys     map[string]entity.APIKey
+	apiKeysLock sync.Mutex
+}
+
+type InMemoryRecordServiceSettings struct {
+	// Directory to load a snapshot from at startup and periodically write
+	// one to. If empty, nothing survives the process.
+	SnapshotDirectory string
+
+	// How often to write a snapshot. Zero disables periodic snapshots.
+	SnapshotInterval time.Duration
+
+	// If set, every write is appended to a log in SnapshotDirectory before
+	// it's applied, and replayed on top of the snapshot at startup, so
+	// writes since the last snapshot survive a crash. Each snapshot
+	// empties the log. Like snapshots, it leaves out idempotent responses
+	// and API keys.
+	WriteAheadLog bool
+
+	// When the log is flushed to disk, LogSyncAlways if empty, and how
+	// often for LogSyncInterval. Zero uses DefaultLogSyncInterval.
+	LogSync         LogSyncPolicy
+	LogSyncInterval time.Duration
+
+	// How long responses stored for an Idempotency-Key are replayed.
+	// Zero uses DefaultIdempotencyKeyTTL.
+	IdempotencyKeyTTL time.Duration
 }
 
-func NewInMemoryRecordService() InMemoryRecordService {
-	return InMemoryRecordService{
-		data: map[int]entity.Record{},
+func NewInMemoryRecordService(
+	settings InMemoryRecordServiceSettings,
+) (*InMemoryRecordService, error) {
+	idempotencyTTL := settings.IdempotencyKeyTTL
+	if idempotencyTTL <= 0 {
+		idempotencyTTL = DefaultIdempotencyKeyTTL
+	}
+
+	s := &InMemoryRecordService{
+		data:                map[int64][]entity.Record{},
+		hashes:              map[int64][]entity.VersionHash{},
+		erasures:            map[int64][]entity.Erasure{},
+		idempotentResponses: map[string]entity.IdempotentResponse{},
+		idempotencyTTL:      idempotencyTTL,
+		apiKeys:             map[string]entity.APIKey{},
 	}
+
+	if settings.SnapshotDirectory != "" {
+		s.snapshotPath = filepath.Join(settings.SnapshotDirectory, InMemorySnapshotFile)
+		if settings.WriteAheadLog {
+			s.log = newWriteAheadLog(settings)
+		}
+		if err := s.loadSnapshot(); err != nil {
+			logError(context.Background(), err)
+			return nil, err
+		}
+		if s.log != nil {
+			if err := s.replayLog(); err != nil {
+				logError(context.Background(), err)
+				return nil, err
+			}
+			s.log.start(settings.LogSyncInterval)
+		}
+		if settings.SnapshotInterval > 0 {
+			s.stopSnapshots = make(chan struct{})
+			s.snapshotsStopped = make(chan struct{})
+			go s.snapshotEvery(settings.SnapshotInterval)
+		}
+	}
+
+	return s, nil
 }
 
-func (s *InMemoryRecordService) GetRecord(ctx context.Context, id int) (entity.Record, error) {
-	record := s.data[id]
-	if record.ID == 0 {
-		return entity.Record{}, ErrRecordDoesNotExist
+func (s *InMemoryRecordService) GetRWLockForAPI() *sync.RWMutex {
+	return &s.rwlock
+}
+
+func (s *InMemoryRecordService) CheckReady(ctx context.Context) error {
+	s.rwlock.RLock()
+	defer s.rwlock.RUnlock()
+	if s.closed {
+		return ErrServiceClosed
 	}
+	return nil
+}
 
+// Close stops periodic snapshots and, if snapshots are enabled, writes a
+// final one so nothing since the last tick is lost.
+func (s *InMemoryRecordService) Close() error {
+	s.rwlock.Lock()
+	alreadyClosed := s.closed
+	s.closed = true
+	s.rwlock.Unlock()
+	if alreadyClosed {
+		return nil
+	}
+
+	if s.stopSnapshots != nil {
+		close(s.stopSnapshots)
+		<-s.snapshotsStopped
+	}
+	if s.snapshotPath == "" {
+		return nil
+	}
+	err := s.writeSnapshot()
+	if s.log != nil {
+		if closeErr := s.log.close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (s *InMemoryRecordService) GetRecord(ctx context.Context, id int64) (entity.Record, error) {
+	versions := s.data[id]
+	if len(versions) == 0 {
+		return entity.Record{}, fmt.Errorf("record %d: %w", id, ErrRecordDoesNotExist)
+	}
+
+	record := versions[len(versions)-1]
 	record = record.Copy() // copy is necessary so modifations to the record don't change the stored record
 	return record, nil
 }
 
 func (s *InMemoryRecordService) CreateRecord(ctx context.Context, record entity.Record) error {
+	return s.CreateRecordKeyed(ctx, record, nil)
+}
+
+// CreateRecordKeyed builds the response before logging or applying the
+// write, so a failure leaves neither behind.
+func (s *InMemoryRecordService) CreateRecordKeyed(ctx context.Context, record entity.Record, respond IdempotentResponder) error {
 	id := record.ID
 	if id <= 0 {
-		return ErrRecordIDInvalid
+		return fmt.Errorf("record %d: %w", id, ErrRecordIDInvalid)
 	}
 
-	existingRecord := s.data[id]
-	if existingRecord.ID != 0 {
-		return ErrRecordAlreadyExists
+	if len(s.data[id]) != 0 {
+		return fmt.Errorf("record %d: %w", id, ErrRecordAlreadyExists)
 	}
 
 	record.Version = 1
-	s.data[id] = record
+	link := s.nextVersionHash(record, map[string]string{})
+	response, err := s.buildResponse(record, link, respond)
+	if err != nil {
+		logError(ctx, err)
+		return err
+	}
+	if err := s.logWrite(walEntry{Record: &record, Hash: &link}); err != nil {
+		logError(ctx, err)
+		return err
+	}
+	s.appendVersion(record, link)
+	s.storeResponse(response)
 	return nil
 }
 
-func (s *InMemoryRecordService) UpdateRecord(ctx context.Context, id int, updates map[string]*string) (entity.Record, error) {
-	entry := s.data[id]
-	if entry.ID == 0 {
-		return entity.Record{}, ErrRecordDoesNotExist
+func (s *InMemoryRecordService) UpdateRecord(ctx context.Context, id int64, updates map[string]*string) (entity.Record, error) {
+	return s.UpdateRecordKeyed(ctx, id, updates, nil)
+}
+
+func (s *InMemoryRecordService) UpsertRecordKeyed(
+	ctx context.Context,
+	id int64,
+	updates map[string]*string,
+	respond IdempotentResponder,
+) (entity.Record, error) {
+	return upsertRecord(ctx, s, id, updates, respond)
+}
+
+func (s *InMemoryRecordService) UpdateRecordKeyed(
+	ctx context.Context,
+	id int64,
+	updates map[string]*string,
+	respond IdempotentResponder,
+) (entity.Record, error) {
+	entry, err := s.GetRecord(ctx, id)
+	if err != nil {
+		return entity.Record{}, err
 	}
 
-	if entry.ApplyUpdate(updates) {
-		// TODO reconsider what we do if the udpate doesn't do anything meaninful
+	// TODO reconsider what we do if the udpate doesn't do anything meaninful
+	changed := entry.ApplyUpdate(updates)
+	link := s.versionHashes(id)[entry.Version-1]
+	if changed {
 		entry.Version += 1
-		s.data[id] = entry
+		link = s.nextVersionHash(entry, s.data[id][len(s.data[id])-1].Data)
+	}
+	response, err := s.buildResponse(entry, link, respond)
+	if err != nil {
+		logError(ctx, err)
+		return entity.Record{}, err
+	}
+	if changed {
+		if err := s.logWrite(walEntry{Record: &entry, Hash: &link}); err != nil {
+			logError(ctx, err)
+			return entity.Record{}, err
+		}
+		s.appendVersion(entry, link)
+	}
+	s.storeResponse(response)
+
+	return entry, nil
+}
+
+func (s *InMemoryRecordService) GetVersionedRecord(ctx context.Context, id int64, version int) (entity.Record, error) {
+	versions := s.data[id]
+	if len(versions) == 0 {
+		return entity.Record{}, fmt.Errorf("record %d: %w", id, ErrRecordDoesNotExist)
 	}
 
-	return entry.Copy(), nil
+	if version == 0 {
+		version = len(versions)
+	}
+	if version < 0 || version > len(versions) {
+		return entity.Record{}, fmt.Errorf("record %d version %d: %w", id, version, ErrVersionDoesNotExist)
+	}
+
+	return versions[version-1].Copy(), nil
+}
+
+func (s *InMemoryRecordService) GetAllRecordVersions(ctx context.Context, id int64) ([]entity.Record, error) {
+	versions := s.data[id]
+	if len(versions) == 0 {
+		return []entity.Record{}, fmt.Errorf("record %d: %w", id, ErrRecordDoesNotExist)
+	}
+
+	records := make([]entity.Record, len(versions))
+	for i, record := range versions {
+		records[i] = record.Copy()
+	}
+	return records, nil
+}
+
+func (s *InMemoryRecordService) GetIdempotentResponse(ctx context.Context, key string) (entity.IdempotentResponse, error) {
+	response, exists := s.idempotentResponses[key]
+	if !exists || time.Since(response.CreatedAt) > s.idempotencyTTL {
+		return entity.IdempotentResponse{}, ErrIdempotencyKeyNotFound
+	}
+	return response, nil
+}
+
+func (s *InMemoryRecordService) SaveIdempotentResponse(ctx context.Context, response entity.IdempotentResponse) error {
+	s.storeResponse(&response)
+	return nil
+}
+
+// buildResponse returns the response respond builds from record, or nil
+// if respond is nil.
+func (s *InMemoryRecordService) buildResponse(
+	record entity.Record,
+	link entity.VersionHash,
+	respond IdempotentResponder,
+) (*entity.IdempotentResponse, error) {
+	if respond == nil {
+		return nil, nil
+	}
+	response, err := respond(record.Copy(), link)
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// storeResponse stores a response unless it's nil, purging expired ones.
+func (s *InMemoryRecordService) storeResponse(response *entity.IdempotentResponse) {
+	if response == nil {
+		return
+	}
+	if response.CreatedAt.IsZero() {
+		response.CreatedAt = time.Now()
+	}
+
+	for key, stored := range s.idempotentResponses {
+		if time.Since(stored.CreatedAt) > s.idempotencyTTL {
+			delete(s.idempotentResponses, key)
+		}
+	}
+
+	s.idempotentResponses[response.Key] = *response
+}
+
+// inMemorySnapshot is what a snapshot file holds.
+type inMemorySnapshot struct {
+	Records  map[int64][]entity.Record      `json:"records"`
+	Hashes   map[int64][]entity.VersionHash `json:"hashes"`
+	Erasures map[int64][]entity.Erasure     `json:"erasures"`
+	// The last write-ahead log entry the snapshot includes.
+	LogSequence uint64 `json:"log_sequence,omitempty"`
+}
+
+// loadSnapshot restores the records from the last snapshot, if there is one.
+func (s *InMemoryRecordService) loadSnapshot() error {
+	snapshot, err := os.ReadFile(s.snapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(snapshot, &fields); err != nil {
+		return err
+	}
+	if _, ok := fields["records"]; !ok {
+		// Snapshots used to be just the records, keyed by id
+		return json.Unmarshal(snapshot, &s.data)
+	}
+
+	var state inMemorySnapshot
+	if err := json.Unmarshal(snapshot, &state); err != nil {
+		return err
+	}
+	if state.Records != nil {
+		s.data = state.Records
+	}
+	if state.Hashes != nil {
+		s.hashes = state.Hashes
+	}
+	if state.Erasures != nil {
+		s.erasures = state.Erasures
+	}
+	if s.log != nil {
+		s.log.sequence = state.LogSequence
+	}
+	return nil
+}
+
+// writeSnapshot atomically replaces the snapshot with the current records,
+// then empties the write-ahead log, if any, which the snapshot now holds.
+func (s *InMemoryRecordService) writeSnapshot() error {
+	// Held until the log is emptied, so no write lands in it meanwhile
+	// and goes missing from both
+	s.rwlock.RLock()
+	defer s.rwlock.RUnlock()
+
+	state := inMemorySnapshot{Records: s.data, Hashes: s.hashes, Erasures: s.erasures}
+	if s.log != nil {
+		state.LogSequence = s.log.sequence
+	}
+	snapshot, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.snapshotPath), 0755); err != nil {
+		return err
+	}
+
+	// Write to the side first, so a crash mid-write never leaves a torn snapshot
+	tmpPath := s.snapshotPath + ".tmp"
+	if err := writeFileSynced(tmpPath, snapshot); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, s.snapshotPath); err != nil {
+		return err
+	}
+	if s.log == nil {
+		return nil
+	}
+
+	// The log may only go once the rename itself is on disk
+	if err := syncDir(filepath.Dir(s.snapshotPath)); err != nil {
+		return err
+	}
+	return s.log.truncate()
+}
+
+// writeFileSynced writes a file and flushes it to disk.
+func writeFileSynced(path string, contents []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(contents); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// syncDir flushes a directory's entries, such as a file renamed into it,
+// to disk.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (s *InMemoryRecordService) snapshotEvery(interval time.Duration) {
+	defer close(s.snapshotsStopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopSnapshots:
+			return
+		case <-ticker.C:
+			if err := s.writeSnapshot(); err != nil {
+				slog.Error("unable to write snapshot", "path", s.snapshotPath, "error", err)
+			}
+		}
+	}
 }
@@ -1,8 +1,13 @@
 package service
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/temelpa/timetravel/entity"
@@ -10,7 +15,10 @@ import (
 
 // Test basic read + write functionality
 func TestSanity(t *testing.T) {
-	service := NewInMemoryRecordService()
+	service, err := NewInMemoryRecordService(InMemoryRecordServiceSettings{})
+	if err != nil {
+		t.Fatalf("Unable to create service, error %v", err)
+	}
 
 	testEntity := entity.Record{
 		ID:      42,
@@ -42,7 +50,7 @@ func TestSanity(t *testing.T) {
 	ctx := context.Background()
 
 	// Make sure the system is empty
-	if _, err := service.GetRecord(ctx, testEntity.ID); err != ErrRecordDoesNotExist {
+	if _, err := service.GetRecord(ctx, testEntity.ID); !errors.Is(err, ErrRecordDoesNotExist) {
 		t.Errorf("Should have failed grabbing nonexistant entry")
 	}
 	if service.CreateRecord(ctx, testEntity) != nil {
@@ -51,7 +59,7 @@ func TestSanity(t *testing.T) {
 
 	// Attempting to create the same record again ought to fail
 	// as well as not mutate the original data
-	if service.CreateRecord(ctx, testEntityUpdate) != ErrRecordAlreadyExists {
+	if !errors.Is(service.CreateRecord(ctx, testEntityUpdate), ErrRecordAlreadyExists) {
 		t.Errorf("Erroneously created second conflicting record %v", testEntityUpdate)
 	}
 
@@ -82,3 +90,385 @@ func TestSanity(t *testing.T) {
 		t.Errorf("Update entry %v not the same as %v", r, testEntityUpdate2)
 	}
 }
+
+// Test version history and that snapshots restore it
+// Test that stored idempotent responses are only replayed within their TTL
+func TestIdempotentResponses(t *testing.T) {
+	service, err := NewInMemoryRecordService(InMemoryRecordServiceSettings{IdempotencyKeyTTL: time.Hour})
+	if err != nil {
+		t.Fatalf("Unable to create service, error %v", err)
+	}
+	testIdempotentResponses(t, service)
+}
+
+func TestVersionsAndSnapshot(t *testing.T) {
+	service, err := NewInMemoryRecordService(InMemoryRecordServiceSettings{
+		SnapshotDirectory: "testdata",
+		SnapshotInterval:  time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Unable to create service, error %v", err)
+	}
+	defer func() {
+		os.RemoveAll("testdata")
+	}()
+
+	ctx := context.Background()
+	testValue := "world"
+
+	testEntity := entity.Record{ID: 42, Version: 1, Data: map[string]string{}}
+	testEntityUpdate := entity.Record{ID: 42, Version: 2, Data: map[string]string{"hello": "world"}}
+
+	if err := service.CreateRecord(ctx, testEntity); err != nil {
+		t.Errorf("Unable to create record for %v", testEntity)
+	}
+	if r, err := service.UpdateRecord(ctx, 42, map[string]*string{"hello": &testValue}); err != nil {
+		t.Errorf("Unable to update record, error %v", err)
+	} else if !cmp.Equal(r, testEntityUpdate) {
+		t.Errorf("Update entry %v not the same as %v", r, testEntityUpdate)
+	}
+
+	if _, err := service.GetVersionedRecord(ctx, 42, 3); !errors.Is(err, ErrVersionDoesNotExist) {
+		t.Errorf("Should have failed grabbing entry for nonexistant version, error %v", err)
+	}
+	if _, err := service.GetVersionedRecord(ctx, 43, 1); !errors.Is(err, ErrRecordDoesNotExist) {
+		t.Errorf("Should have failed grabbing entry for nonexistant record, error %v", err)
+	}
+	if r, err := service.GetVersionedRecord(ctx, 42, 0); err != nil {
+		t.Errorf("Error grabbing newest version record, error %v", err)
+	} else if !cmp.Equal(r, testEntityUpdate) {
+		t.Errorf("Failed to grab newest version, got %v, expected %v", r, testEntityUpdate)
+	}
+
+	expected := []entity.Record{testEntity, testEntityUpdate}
+	if rs, err := service.GetAllRecordVersions(ctx, 42); err != nil {
+		t.Errorf("Error grabbing versions of record, error %v", err)
+	} else if !cmp.Equal(rs, expected) {
+		t.Errorf("Failed to grab all versions, got %v, expected %v", rs, expected)
+	}
+
+	// Closing writes a final snapshot
+	if err := service.Close(); err != nil {
+		t.Fatalf("Unable to close service, error %v", err)
+	}
+	if err := service.CheckReady(ctx); !errors.Is(err, ErrServiceClosed) {
+		t.Errorf("Closed service should not be ready, got error %v", err)
+	}
+	service, err = NewInMemoryRecordService(InMemoryRecordServiceSettings{
+		SnapshotDirectory: "testdata",
+	})
+	if err != nil {
+		t.Fatalf("Unable to restore service, error %v", err)
+	}
+	if rs, err := service.GetAllRecordVersions(ctx, 42); err != nil {
+		t.Errorf("Error grabbing restored versions of record, error %v", err)
+	} else if !cmp.Equal(rs, expected) {
+		t.Errorf("Failed to restore all versions, got %v, expected %v", rs, expected)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	service, err := NewInMemoryRecordService(InMemoryRecordServiceSettings{})
+	if err != nil {
+		t.Fatalf("Unable to create service, error %v", err)
+	}
+	testAPIKeys(t, service)
+}
+
+func TestErasure(t *testing.T) {
+	service, err := NewInMemoryRecordService(InMemoryRecordServiceSettings{SnapshotDirectory: "testdata"})
+	if err != nil {
+		t.Fatalf("Unable to create service, error %v", err)
+	}
+	defer func() {
+		os.RemoveAll("testdata")
+	}()
+	testErasure(t, service)
+
+	// Markers survive a snapshot
+	ctx := context.Background()
+	expected, _ := service.GetErasures(ctx, 1)
+	if err := service.Close(); err != nil {
+		t.Fatalf("Unable to close service, error %v", err)
+	}
+	service, err = NewInMemoryRecordService(InMemoryRecordServiceSettings{SnapshotDirectory: "testdata"})
+	if err != nil {
+		t.Fatalf("Unable to restore service, error %v", err)
+	}
+	if erasures, err := service.GetErasures(ctx, 1); err != nil || !cmp.Equal(erasures, expected) {
+		t.Errorf("Expected restored erasures %v, got %v, error %v", expected, erasures, err)
+	}
+}
+
+func TestHashChain(t *testing.T) {
+	service, err := NewInMemoryRecordService(InMemoryRecordServiceSettings{SnapshotDirectory: "testdata"})
+	if err != nil {
+		t.Fatalf("Unable to create service, error %v", err)
+	}
+	defer func() {
+		os.RemoveAll("testdata")
+	}()
+	testHashChain(t, service)
+
+	// Editing history behind the service's back is detected
+	ctx := context.Background()
+	service.data[1][0].Data["hello"] = "pluto"
+	if verification, err := VerifyRecord(ctx, service, 1); err != nil || verification.Valid || verification.BrokenVersion != 1 {
+		t.Errorf("Expected the edited version to break the chain, got %+v, error %v", verification, err)
+	}
+
+	// Hashes survive a snapshot
+	expected, _ := service.GetVersionHashes(ctx, 2)
+	if err := service.Close(); err != nil {
+		t.Fatalf("Unable to close service, error %v", err)
+	}
+	service, err = NewInMemoryRecordService(InMemoryRecordServiceSettings{SnapshotDirectory: "testdata"})
+	if err != nil {
+		t.Fatalf("Unable to restore service, error %v", err)
+	}
+	if hashes, err := service.GetVersionHashes(ctx, 2); err != nil || !cmp.Equal(hashes, expected) {
+		t.Errorf("Expected restored hashes %v, got %v, error %v", expected, hashes, err)
+	}
+}
+
+func TestLegacySnapshot(t *testing.T) {
+	defer func() {
+		os.RemoveAll("testdata")
+	}()
+	if err := os.MkdirAll("testdata", 0755); err != nil {
+		t.Fatal(err)
+	}
+	legacy := `{"7":[{"id":7,"version":1,"data":{"hello":"world"}}]}`
+	if err := os.WriteFile(filepath.Join("testdata", InMemorySnapshotFile), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	service, err := NewInMemoryRecordService(InMemoryRecordServiceSettings{SnapshotDirectory: "testdata"})
+	if err != nil {
+		t.Fatalf("Unable to load legacy snapshot, error %v", err)
+	}
+	expected := entity.Record{ID: 7, Version: 1, Data: map[string]string{"hello": "world"}}
+	if r, err := service.GetRecord(context.Background(), 7); err != nil || !cmp.Equal(r, expected) {
+		t.Errorf("Expected %v, got %v, error %v", expected, r, err)
+	}
+	if verification, err := VerifyRecord(context.Background(), service, 7); err != nil || !verification.Valid || verification.Unhashed != 1 {
+		t.Errorf("Expected a valid history with an unhashed version, got %+v, error %v", verification, err)
+	}
+}
+
+// history is everything the write-ahead log has to bring back of a record.
+type history struct {
+	Versions []entity.Record
+	Hashes   []entity.VersionHash
+	Erasures []entity.Erasure
+}
+
+func getHistory(t *testing.T, service *InMemoryRecordService, id int64) history {
+	t.Helper()
+	ctx := context.Background()
+	versions, err := service.GetAllRecordVersions(ctx, id)
+	if err != nil {
+		t.Fatalf("Unable to get versions of record %d, error %v", id, err)
+	}
+	hashes, _ := service.GetVersionHashes(ctx, id)
+	erasures, _ := service.GetErasures(ctx, id)
+	return history{versions, hashes, erasures}
+}
+
+// Test that writes since the last snapshot survive a crash, and that a
+// snapshot empties the log without anything being applied twice
+func TestWriteAheadLog(t *testing.T) {
+	dir := t.TempDir()
+	settings := InMemoryRecordServiceSettings{SnapshotDirectory: dir, WriteAheadLog: true}
+	service, err := NewInMemoryRecordService(settings)
+	if err != nil {
+		t.Fatalf("Unable to create service, error %v", err)
+	}
+
+	ctx := context.Background()
+	world, mars := "world", "mars"
+	for _, id := range []int64{1, 2} {
+		if err := service.CreateRecord(ctx, entity.Record{ID: id, Data: map[string]string{"hello": world}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := service.UpdateRecord(ctx, 1, map[string]*string{"hello": &mars, "name": &world}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.EraseRecord(ctx, 1, []string{"name"}, false, "ops"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.UpdateRecord(ctx, 1, map[string]*string{"hello": nil}); err != nil {
+		t.Fatal(err)
+	}
+	expected := getHistory(t, service, 1)
+
+	// Crashing, without a final snapshot, loses nothing
+	recovered, err := NewInMemoryRecordService(settings)
+	if err != nil {
+		t.Fatalf("Unable to recover service, error %v", err)
+	}
+	if got := getHistory(t, recovered, 1); !cmp.Equal(got, expected) {
+		t.Errorf("Expected recovered history %+v, got %+v", expected, got)
+	}
+	if verification, err := VerifyRecord(ctx, recovered, 1); err != nil || !verification.Valid {
+		t.Errorf("Expected the recovered history to verify, got %+v, error %v", verification, err)
+	}
+
+	// Closing snapshots, which empties the log
+	if err := recovered.Close(); err != nil {
+		t.Fatalf("Unable to close service, error %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, InMemoryLogFile)); err != nil || info.Size() != 0 {
+		t.Errorf("Expected an empty log after the snapshot, got %v, error %v", info, err)
+	}
+
+	// Writes after a snapshot are logged on top of it
+	restored, err := NewInMemoryRecordService(settings)
+	if err != nil {
+		t.Fatalf("Unable to restore service, error %v", err)
+	}
+	if _, err := restored.UpdateRecord(ctx, 2, map[string]*string{"hello": &mars}); err != nil {
+		t.Fatal(err)
+	}
+	expected2 := getHistory(t, restored, 2)
+	recovered, err = NewInMemoryRecordService(settings)
+	if err != nil {
+		t.Fatalf("Unable to recover service, error %v", err)
+	}
+	if got := getHistory(t, recovered, 1); !cmp.Equal(got, expected) {
+		t.Errorf("Expected history %+v from the snapshot, got %+v", expected, got)
+	}
+	if got := getHistory(t, recovered, 2); !cmp.Equal(got, expected2) {
+		t.Errorf("Expected history %+v from the log, got %+v", expected2, got)
+	}
+}
+
+// Test that a crash mid-write, leaving the last entry torn, loses only that
+// write, and that the log carries on cleanly after it
+func TestWriteAheadLogTornEntry(t *testing.T) {
+	dir := t.TempDir()
+	settings := InMemoryRecordServiceSettings{SnapshotDirectory: dir, WriteAheadLog: true, LogSync: LogSyncInterval}
+	service, err := NewInMemoryRecordService(settings)
+	if err != nil {
+		t.Fatalf("Unable to create service, error %v", err)
+	}
+	defer service.log.close()
+
+	ctx := context.Background()
+	world, mars := "world", "mars"
+	if err := service.CreateRecord(ctx, entity.Record{ID: 1, Data: map[string]string{"hello": world}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.UpdateRecord(ctx, 1, map[string]*string{"hello": &mars}); err != nil {
+		t.Fatal(err)
+	}
+	expected := getHistory(t, service, 1)
+	intact := service.log.size
+	if _, err := service.UpdateRecord(ctx, 1, map[string]*string{"name": &world}); err != nil {
+		t.Fatal(err)
+	}
+	log, err := os.ReadFile(filepath.Join(dir, InMemoryLogFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flipped := bytes.Clone(log)
+	flipped[len(flipped)-5] ^= 1
+	for name, torn := range map[string][]byte{
+		"one byte":        log[:intact+1],
+		"half":            log[:intact+(int64(len(log))-intact)/2],
+		"no newline":      log[:len(log)-1],
+		"bad checksum":    flipped,
+		"garbage newline": append(bytes.Clone(log[:intact]), "0000\n"...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			crashDir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(crashDir, InMemoryLogFile), torn, 0644); err != nil {
+				t.Fatal(err)
+			}
+			crashSettings := InMemoryRecordServiceSettings{SnapshotDirectory: crashDir, WriteAheadLog: true}
+			recovered, err := NewInMemoryRecordService(crashSettings)
+			if err != nil {
+				t.Fatalf("Unable to recover from a torn entry, error %v", err)
+			}
+			if got := getHistory(t, recovered, 1); !cmp.Equal(got, expected) {
+				t.Errorf("Expected history %+v without the torn write, got %+v", expected, got)
+			}
+			if info, err := os.Stat(filepath.Join(crashDir, InMemoryLogFile)); err != nil || info.Size() != intact {
+				t.Errorf("Expected the torn entry cut off, leaving %d bytes, got %v, error %v", intact, info, err)
+			}
+
+			// The next write follows the last intact entry
+			if _, err := recovered.UpdateRecord(ctx, 1, map[string]*string{"name": &world}); err != nil {
+				t.Fatal(err)
+			}
+			recovered.log.close()
+			recovered, err = NewInMemoryRecordService(crashSettings)
+			if err != nil {
+				t.Fatalf("Unable to recover service again, error %v", err)
+			}
+			if r, err := recovered.GetRecord(ctx, 1); err != nil || r.Version != 3 || r.Data["name"] != world {
+				t.Errorf("Expected the write after recovery to survive, got %v, error %v", r, err)
+			}
+			if verification, err := VerifyRecord(ctx, recovered, 1); err != nil || !verification.Valid {
+				t.Errorf("Expected the history to verify, got %+v, error %v", verification, err)
+			}
+			recovered.log.close()
+		})
+	}
+
+	// Damage before the last entry isn't a torn write, and isn't skipped
+	corruptDir := t.TempDir()
+	corrupt := bytes.Clone(log)
+	corrupt[20] ^= 1
+	if err := os.WriteFile(filepath.Join(corruptDir, InMemoryLogFile), corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewInMemoryRecordService(InMemoryRecordServiceSettings{SnapshotDirectory: corruptDir, WriteAheadLog: true}); !errors.Is(err, ErrLogCorrupt) {
+		t.Errorf("Expected a corrupt log to be refused, got error %v", err)
+	}
+}
+
+// Test that a log outliving the snapshot that holds it, from crashing
+// before it was emptied, isn't applied twice
+func TestWriteAheadLogAfterSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	settings := InMemoryRecordServiceSettings{SnapshotDirectory: dir, WriteAheadLog: true}
+	service, err := NewInMemoryRecordService(settings)
+	if err != nil {
+		t.Fatalf("Unable to create service, error %v", err)
+	}
+	defer service.log.close()
+
+	ctx := context.Background()
+	world := "world"
+	if err := service.CreateRecord(ctx, entity.Record{ID: 1, Data: map[string]string{}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.UpdateRecord(ctx, 1, map[string]*string{"hello": &world}); err != nil {
+		t.Fatal(err)
+	}
+	expected := getHistory(t, service, 1)
+
+	logPath := filepath.Join(dir, InMemoryLogFile)
+	log, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := service.writeSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(logPath, log, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, err := NewInMemoryRecordService(settings)
+	if err != nil {
+		t.Fatalf("Unable to recover service, error %v", err)
+	}
+	defer recovered.log.close()
+	if got := getHistory(t, recovered, 1); !cmp.Equal(got, expected) {
+		t.Errorf("Expected history %+v, got %+v", expected, got)
+	}
+}
@@ -0,0 +1,286 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/temelpa/timetravel/entity"
+)
+
+// File the in-memory service logs writes to, relative to the snapshot
+// directory, when its write-ahead log is enabled.
+const InMemoryLogFile = "memory_wal.log"
+
+// When writes to the log are flushed to disk.
+type LogSyncPolicy string
+
+const (
+	// Every write is flushed before it's acknowledged.
+	LogSyncAlways LogSyncPolicy = "always"
+	// Writes are flushed every LogSyncInterval, so a machine crash (though
+	// not a process crash) can lose the last interval's writes.
+	LogSyncInterval LogSyncPolicy = "interval"
+	// Flushing is left to the operating system until the service closes.
+	LogSyncNever LogSyncPolicy = "never"
+)
+
+// How often LogSyncInterval flushes if the settings don't say otherwise.
+const DefaultLogSyncInterval = time.Second
+
+var ErrLogCorrupt = errors.New("write-ahead log is corrupt")
+
+// walEntry is a line of the log: one write, applied on top of the snapshot
+// at startup. Each line is the entry's JSON preceded by its CRC-32, so a
+// line torn by a crash is told apart from a complete one.
+type walEntry struct {
+	// Numbers entries from 1. A snapshot notes the last one it includes,
+	// so entries it already holds are skipped if the log outlived it.
+	Sequence uint64 `json:"seq"`
+
+	// Either a new version of a record and its link in the hash chain...
+	Record *entity.Record      `json:"record,omitempty"`
+	Hash   *entity.VersionHash `json:"hash,omitempty"`
+	// ...or an erasure, whose keys are removed from every version.
+	Erasure *entity.Erasure `json:"erasure,omitempty"`
+}
+
+// writeAheadLog is the append-only file writes are logged to before the
+// in-memory service applies them.
+type writeAheadLog struct {
+	path   string
+	policy LogSyncPolicy
+
+	// Guards the file, which the periodic flush uses outside the API lock.
+	lock     sync.Mutex
+	file     *os.File
+	size     int64
+	sequence uint64
+
+	stopSync    chan struct{}
+	syncStopped chan struct{}
+}
+
+func newWriteAheadLog(settings InMemoryRecordServiceSettings) *writeAheadLog {
+	policy := settings.LogSync
+	if policy == "" {
+		policy = LogSyncAlways
+	}
+	return &writeAheadLog{
+		path:   filepath.Join(settings.SnapshotDirectory, InMemoryLogFile),
+		policy: policy,
+	}
+}
+
+// start flushes the log every interval, if that's its policy, until it's
+// closed. Zero uses DefaultLogSyncInterval.
+func (l *writeAheadLog) start(interval time.Duration) {
+	if l.policy != LogSyncInterval {
+		return
+	}
+	if interval <= 0 {
+		interval = DefaultLogSyncInterval
+	}
+	l.stopSync = make(chan struct{})
+	l.syncStopped = make(chan struct{})
+	go l.syncEvery(interval)
+}
+
+// encodeLogEntry returns the line of an entry, newline included.
+func encodeLogEntry(entry walEntry) ([]byte, error) {
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	line := fmt.Appendf(nil, "%08x ", crc32.ChecksumIEEE(entryJSON))
+	line = append(line, entryJSON...)
+	return append(line, '\n'), nil
+}
+
+// decodeLogEntry parses a line, without its newline, failing if it's torn.
+func decodeLogEntry(line []byte) (walEntry, error) {
+	checksum, entryJSON, found := bytes.Cut(line, []byte(" "))
+	if !found {
+		return walEntry{}, ErrLogCorrupt
+	}
+	expected, err := strconv.ParseUint(string(checksum), 16, 32)
+	if err != nil || uint32(expected) != crc32.ChecksumIEEE(entryJSON) {
+		return walEntry{}, ErrLogCorrupt
+	}
+	var entry walEntry
+	if err := json.Unmarshal(entryJSON, &entry); err != nil {
+		return walEntry{}, ErrLogCorrupt
+	}
+	return entry, nil
+}
+
+// replayLog applies the entries logged since the snapshot was written, then
+// opens the log for appending. A torn last entry, from crashing mid-write,
+// was never acknowledged, so it's cut off; damage anywhere else fails.
+func (s *InMemoryRecordService) replayLog() error {
+	contents, err := os.ReadFile(s.log.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var offset int
+	for offset < len(contents) {
+		end := bytes.IndexByte(contents[offset:], '\n')
+		if end < 0 {
+			break // torn: the newline is written last
+		}
+		entry, err := decodeLogEntry(contents[offset : offset+end])
+		if err != nil {
+			if offset+end+1 < len(contents) {
+				return fmt.Errorf("entry at byte %d of %s: %w", offset, s.log.path, err)
+			}
+			break // torn, though it reached the newline
+		}
+		if err := s.applyLogEntry(entry); err != nil {
+			return fmt.Errorf("entry %d of %s: %w", entry.Sequence, s.log.path, err)
+		}
+		offset += end + 1
+	}
+	if offset < len(contents) {
+		slog.Warn("discarding torn write-ahead log entry", "path", s.log.path, "offset", offset, "bytes", len(contents)-offset)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.log.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.log.path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(int64(offset)); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Seek(int64(offset), 0); err != nil {
+		file.Close()
+		return err
+	}
+	s.log.file = file
+	s.log.size = int64(offset)
+	return nil
+}
+
+// applyLogEntry applies a replayed entry, unless the snapshot already
+// holds it.
+func (s *InMemoryRecordService) applyLogEntry(entry walEntry) error {
+	if entry.Sequence <= s.log.sequence {
+		return nil
+	}
+	if entry.Sequence != s.log.sequence+1 {
+		return fmt.Errorf("expected entry %d: %w", s.log.sequence+1, ErrLogCorrupt)
+	}
+
+	switch {
+	case entry.Record != nil && entry.Hash != nil:
+		if entry.Record.Version != len(s.data[entry.Record.ID])+1 {
+			return fmt.Errorf("version %d of record %d out of order: %w", entry.Record.Version, entry.Record.ID, ErrLogCorrupt)
+		}
+		s.appendVersion(*entry.Record, *entry.Hash)
+	case entry.Erasure != nil:
+		if len(s.data[entry.Erasure.RecordID]) == 0 {
+			return fmt.Errorf("erasure of missing record %d: %w", entry.Erasure.RecordID, ErrLogCorrupt)
+		}
+		s.applyErasure(*entry.Erasure)
+	default:
+		return ErrLogCorrupt
+	}
+	s.log.sequence = entry.Sequence
+	return nil
+}
+
+// logWrite appends a write to the log, if there is one, before it's
+// applied. The write must not be applied if this fails.
+func (s *InMemoryRecordService) logWrite(entry walEntry) error {
+	if s.log == nil {
+		return nil
+	}
+	return s.log.append(entry)
+}
+
+func (l *writeAheadLog) append(entry walEntry) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	entry.Sequence = l.sequence + 1
+	line, err := encodeLogEntry(entry)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Write(line)
+	if err == nil && l.policy == LogSyncAlways {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		// The write won't be applied, so don't leave it, or half of it,
+		// for the next entry to follow
+		l.file.Truncate(l.size)
+		l.file.Seek(l.size, 0)
+		return err
+	}
+	l.size += int64(len(line))
+	l.sequence = entry.Sequence
+	return nil
+}
+
+// truncate empties the log once a snapshot holding every entry in it is
+// safely on disk.
+func (l *writeAheadLog) truncate() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := l.file.Seek(0, 0); err != nil {
+		return err
+	}
+	l.size = 0
+	return l.file.Sync()
+}
+
+func (l *writeAheadLog) syncEvery(interval time.Duration) {
+	defer close(l.syncStopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stopSync:
+			return
+		case <-ticker.C:
+			l.lock.Lock()
+			err := l.file.Sync()
+			l.lock.Unlock()
+			if err != nil {
+				slog.Error("unable to flush write-ahead log", "path", l.path, "error", err)
+			}
+		}
+	}
+}
+
+// close stops periodic flushing and flushes whatever is left.
+func (l *writeAheadLog) close() error {
+	if l.stopSync != nil {
+		close(l.stopSync)
+		<-l.syncStopped
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
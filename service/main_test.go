@@ -0,0 +1,12 @@
+package service
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	stopTestPostgres()
+	os.Exit(code)
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/temelpa/timetravel/data"
+	"github.com/temelpa/timetravel/entity"
+)
+
+func (s *PostgresRecordService) CreateAPIKey(
+	ctx context.Context,
+	key entity.APIKey,
+) error {
+	if key.CreatedAt.IsZero() {
+		key.CreatedAt = time.Now()
+	}
+
+	roles, err := json.Marshal(key.Roles)
+	if err != nil {
+		logError(ctx, err)
+		return err
+	}
+
+	queryCtx, done := instrumentPostgres(ctx, "insert_api_key")
+	_, err = s.db.ExecContext(
+		queryCtx,
+		data.PG_INSERT_API_KEY,
+		key.ID,
+		key.KeyHash,
+		key.Principal,
+		string(roles),
+		key.CreatedAt.UnixNano(),
+	)
+	done(err)
+	if err != nil {
+		logError(ctx, err)
+		if isUniqueViolation(err) {
+			return fmt.Errorf("api key %s: %w", key.ID, ErrRecordAlreadyExists)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresRecordService) GetAPIKeyByHash(
+	ctx context.Context,
+	keyHash string,
+) (entity.APIKey, error) {
+	queryCtx, done := instrumentPostgres(ctx, "query_api_key_by_hash")
+	key, err := scanAPIKey(s.db.QueryRowContext(queryCtx, data.PG_QUERY_API_KEY_BY_HASH, keyHash))
+	done(err)
+	if err == sql.ErrNoRows {
+		return entity.APIKey{}, ErrAPIKeyDoesNotExist
+	}
+	if err != nil {
+		logError(ctx, err)
+		return entity.APIKey{}, err
+	}
+	return key, nil
+}
+
+func (s *PostgresRecordService) ListAPIKeys(
+	ctx context.Context,
+) ([]entity.APIKey, error) {
+	queryCtx, done := instrumentPostgres(ctx, "query_api_keys")
+	rows, err := s.db.QueryContext(queryCtx, data.PG_QUERY_API_KEYS)
+	defer func() { done(err) }()
+	if err != nil {
+		logError(ctx, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []entity.APIKey{}
+	for rows.Next() {
+		var key entity.APIKey
+		if key, err = scanAPIKey(rows); err != nil {
+			logError(ctx, err)
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if err = rows.Err(); err != nil {
+		logError(ctx, err)
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *PostgresRecordService) RevokeAPIKey(
+	ctx context.Context,
+	id string,
+) error {
+	queryCtx, done := instrumentPostgres(ctx, "revoke_api_key")
+	result, err := s.db.ExecContext(queryCtx, data.PG_REVOKE_API_KEY, time.Now().UnixNano(), id)
+	done(err)
+	if err != nil {
+		logError(ctx, err)
+		return err
+	}
+
+	if revoked, err := result.RowsAffected(); err != nil || revoked != 0 {
+		return err
+	}
+
+	// Nothing changed: either the key is already revoked, which is fine,
+	// or it never existed
+	var exists int
+	if err := s.db.QueryRowContext(ctx, data.PG_QUERY_API_KEY_EXISTS, id).Scan(&exists); err != nil {
+		logError(ctx, err)
+		return err
+	}
+	if exists == 0 {
+		return fmt.Errorf("api key %s: %w", id, ErrAPIKeyDoesNotExist)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/temelpa/timetravel/data"
+	"github.com/temelpa/timetravel/entity"
+)
+
+func (s *PostgresRecordService) EraseRecord(
+	ctx context.Context,
+	id int64,
+	keys []string,
+	wholeRecord bool,
+	principal string,
+) (entity.Erasure, error) {
+	// Everything happens in one transaction, holding the record's row lock
+	// so no version is written mid-erasure
+	tx, end, err := s.beginWrite(ctx)
+	if err != nil {
+		logError(ctx, err)
+		return entity.Erasure{}, err
+	}
+	defer end()
+	defer tx.Rollback()
+
+	erasure, err := s.erase(ctx, tx, id, keys, wholeRecord, principal)
+	if err != nil {
+		logError(ctx, err)
+		return entity.Erasure{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		logError(ctx, err)
+		return entity.Erasure{}, err
+	}
+	return erasure, nil
+}
+
+func (s *PostgresRecordService) erase(
+	ctx context.Context,
+	tx *sql.Tx,
+	id int64,
+	keys []string,
+	wholeRecord bool,
+	principal string,
+) (entity.Erasure, error) {
+	current, err := queryPostgresRecord(ctx, tx, data.PG_QUERY_RECORD_FOR_UPDATE, id)
+	if err != nil {
+		return entity.Erasure{}, err
+	}
+
+	deltas, err := queryAllPostgresDeltas(ctx, tx, id)
+	if err != nil {
+		return entity.Erasure{}, err
+	}
+
+	erased := map[string]bool{}
+	for _, key := range keys {
+		erased[key] = true
+	}
+	if wholeRecord {
+		for key := range current.Data {
+			erased[key] = true
+		}
+		for _, delta := range deltas {
+			for key := range delta {
+				erased[key] = true
+			}
+		}
+	}
+
+	for key := range erased {
+		delete(current.Data, key)
+	}
+	jsonBytes, err := json.Marshal(current.Data)
+	if err != nil {
+		return entity.Erasure{}, err
+	}
+	queryCtx, done := instrumentPostgres(ctx, "update_record")
+	_, err = tx.ExecContext(queryCtx, data.PG_UPDATE_RECORD, current.Version, string(jsonBytes), id)
+	done(err)
+	if err != nil {
+		return entity.Erasure{}, err
+	}
+
+	for versionBeforeDelta, delta := range deltas {
+		for key := range erased {
+			delete(delta, key)
+		}
+		if jsonBytes, err = json.Marshal(delta); err != nil {
+			return entity.Erasure{}, err
+		}
+		queryCtx, done := instrumentPostgres(ctx, "update_record_delta")
+		_, err = tx.ExecContext(queryCtx, data.PG_UPDATE_RECORD_DELTA, string(jsonBytes), id, versionBeforeDelta)
+		done(err)
+		if err != nil {
+			return entity.Erasure{}, err
+		}
+	}
+
+	// Erasing changes history, so it has to be rehashed. The marker below
+	// is what records that it happened.
+	if err := rehashPostgres(ctx, tx, current, deltas); err != nil {
+		return entity.Erasure{}, err
+	}
+
+	queryCtx, done = instrumentPostgres(ctx, "delete_record_idempotency_keys")
+	_, err = tx.ExecContext(queryCtx, data.PG_DELETE_RECORD_IDEMPOTENCY_KEYS, id)
+	done(err)
+	if err != nil {
+		return entity.Erasure{}, err
+	}
+
+	previous, err := queryPostgresErasures(ctx, tx, id)
+	if err != nil {
+		return entity.Erasure{}, err
+	}
+	erasure := entity.Erasure{
+		RecordID:    id,
+		Sequence:    len(previous) + 1,
+		AtVersion:   current.Version,
+		Keys:        []string{},
+		WholeRecord: wholeRecord,
+		Principal:   principal,
+		ErasedAt:    time.Now().UTC(),
+	}
+	for key := range erased {
+		erasure.Keys = append(erasure.Keys, key)
+	}
+	sort.Strings(erasure.Keys)
+	if len(previous) > 0 {
+		erasure.PreviousHash = previous[len(previous)-1].Hash
+	}
+	erasure.Hash = erasure.ComputeHash()
+
+	keysJSON, err := json.Marshal(erasure.Keys)
+	if err != nil {
+		return entity.Erasure{}, err
+	}
+	queryCtx, done = instrumentPostgres(ctx, "insert_record_erasure")
+	_, err = tx.ExecContext(
+		queryCtx,
+		data.PG_INSERT_RECORD_ERASURE,
+		erasure.RecordID,
+		erasure.Sequence,
+		erasure.AtVersion,
+		string(keysJSON),
+		erasure.WholeRecord,
+		erasure.Principal,
+		erasure.ErasedAt.UnixNano(),
+		erasure.PreviousHash,
+		erasure.Hash,
+	)
+	done(err)
+	if err != nil {
+		return entity.Erasure{}, err
+	}
+	return erasure, nil
+}
+
+func (s *PostgresRecordService) GetErasures(
+	ctx context.Context,
+	id int64,
+) ([]entity.Erasure, error) {
+	erasures, err := queryPostgresErasures(ctx, s.db, id)
+	if err != nil {
+		logError(ctx, err)
+		return nil, err
+	}
+	return erasures, nil
+}
+
+func queryPostgresErasures(ctx context.Context, db queryer, id int64) ([]entity.Erasure, error) {
+	queryCtx, done := instrumentPostgres(ctx, "query_record_erasures")
+	rows, err := db.QueryContext(queryCtx, data.PG_QUERY_RECORD_ERASURES, id)
+	defer func() { done(err) }()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	erasures := []entity.Erasure{}
+	for rows.Next() {
+		var erasure entity.Erasure
+		var keys string
+		var erasedAt int64
+		if err = rows.Scan(
+			&erasure.RecordID,
+			&erasure.Sequence,
+			&erasure.AtVersion,
+			&keys,
+			&erasure.WholeRecord,
+			&erasure.Principal,
+			&erasedAt,
+			&erasure.PreviousHash,
+			&erasure.Hash,
+		); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(keys), &erasure.Keys); err != nil {
+			return nil, err
+		}
+		erasure.ErasedAt = time.Unix(0, erasedAt).UTC()
+		erasures = append(erasures, erasure)
+	}
+	err = rows.Err()
+	return erasures, err
+}
@@ -0,0 +1,243 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/temelpa/timetravel/data"
+	"github.com/temelpa/timetravel/entity"
+)
+
+func (s *PostgresRecordService) GetVersionHash(
+	ctx context.Context,
+	id int64,
+	version int,
+) (entity.VersionHash, error) {
+	link, err := queryPostgresVersionHash(ctx, s.db, id, version)
+	if err == nil {
+		return link, nil
+	}
+	if err != sql.ErrNoRows {
+		logError(ctx, err)
+		return entity.VersionHash{}, err
+	}
+
+	// Every version has a row, so without one it's no version at all
+	queryCtx, done := instrumentPostgres(ctx, "query_record_version")
+	err = s.db.QueryRowContext(queryCtx, data.PG_QUERY_RECORD_VERSION, id).Scan(&version)
+	done(err)
+	if err == sql.ErrNoRows {
+		return entity.VersionHash{}, fmt.Errorf("record %d: %w", id, ErrRecordDoesNotExist)
+	}
+	if err != nil {
+		logError(ctx, err)
+		return entity.VersionHash{}, err
+	}
+	return entity.VersionHash{}, fmt.Errorf("record %d version %d: %w", id, version, ErrVersionDoesNotExist)
+}
+
+// queryPostgresVersionHash reads the link of one version of a record,
+// failing with sql.ErrNoRows if it has none.
+func queryPostgresVersionHash(ctx context.Context, db rowQueryer, id int64, version int) (entity.VersionHash, error) {
+	var hash string
+	var createdAt int64
+	queryCtx, done := instrumentPostgres(ctx, "query_record_delta_hash")
+	err := db.QueryRowContext(queryCtx, data.PG_QUERY_RECORD_DELTA_HASH, id, version-1).Scan(&hash, &createdAt)
+	done(err)
+	if err != nil {
+		return entity.VersionHash{}, err
+	}
+	return entity.VersionHash{Version: version, CreatedAt: time.Unix(0, createdAt).UTC(), Hash: hash}, nil
+}
+
+func (s *PostgresRecordService) GetVersionHashes(
+	ctx context.Context,
+	id int64,
+) ([]entity.VersionHash, error) {
+	tx, err := s.db.BeginTx(ctx, readOnlySnapshot)
+	if err != nil {
+		logError(ctx, err)
+		return []entity.VersionHash{}, err
+	}
+	defer tx.Rollback()
+
+	var currentVersion int
+	queryCtx, done := instrumentPostgres(ctx, "query_record_version")
+	err = tx.QueryRowContext(queryCtx, data.PG_QUERY_RECORD_VERSION, id).Scan(&currentVersion)
+	done(err)
+	if err == sql.ErrNoRows {
+		return []entity.VersionHash{}, fmt.Errorf("record %d: %w", id, ErrRecordDoesNotExist)
+	}
+	if err != nil {
+		logError(ctx, err)
+		return []entity.VersionHash{}, err
+	}
+
+	hashes, err := queryPostgresVersionHashes(ctx, tx, id, currentVersion)
+	if err != nil {
+		logError(ctx, err)
+		return []entity.VersionHash{}, err
+	}
+	return hashes, nil
+}
+
+func (s *PostgresRecordService) GetHistory(
+	ctx context.Context,
+	id int64,
+	version int,
+) (RecordHistory, error) {
+	// Writers on other replicas never wait for reads, so everything is read
+	// in one snapshot lest an erasure land in between
+	tx, err := s.db.BeginTx(ctx, readOnlySnapshot)
+	if err != nil {
+		logError(ctx, err)
+		return RecordHistory{}, err
+	}
+	defer tx.Rollback()
+
+	var history RecordHistory
+	if version == 0 {
+		history.Versions, err = s.readRecordVersions(ctx, tx, id, 1, 0)
+	} else {
+		history.Versions, err = s.readRecordVersions(ctx, tx, id, version, 1)
+	}
+	if err != nil {
+		return RecordHistory{}, err
+	}
+	if len(history.Versions) == 0 {
+		return RecordHistory{}, fmt.Errorf("record %d version %d: %w", id, version, ErrVersionDoesNotExist)
+	}
+
+	currentVersion := history.Versions[len(history.Versions)-1].Version
+	if version != 0 {
+		queryCtx, done := instrumentPostgres(ctx, "query_record_version")
+		err = tx.QueryRowContext(queryCtx, data.PG_QUERY_RECORD_VERSION, id).Scan(&currentVersion)
+		done(err)
+	}
+	var hashes []entity.VersionHash
+	if err == nil {
+		hashes, err = queryPostgresVersionHashes(ctx, tx, id, currentVersion)
+	}
+	if err == nil {
+		history.Erasures, err = queryPostgresErasures(ctx, tx, id)
+	}
+	if err != nil {
+		logError(ctx, err)
+		return RecordHistory{}, err
+	}
+	history.Links = linksOf(history.Versions, hashes)
+	history.Compactions = []entity.Compaction{}
+	return history, nil
+}
+
+// queryPostgresVersionHashes reads the links of versions 1 to
+// currentVersion of a record.
+func queryPostgresVersionHashes(ctx context.Context, tx *sql.Tx, id int64, currentVersion int) ([]entity.VersionHash, error) {
+	hashes := make([]entity.VersionHash, currentVersion)
+	for i := range hashes {
+		hashes[i].Version = i + 1
+	}
+
+	queryCtx, done := instrumentPostgres(ctx, "query_record_delta_hashes")
+	rows, err := tx.QueryContext(queryCtx, data.PG_QUERY_RECORD_DELTA_HASHES, id)
+	defer func() { done(err) }()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var versionBeforeDelta int
+		var hash string
+		var createdAt int64
+		if err = rows.Scan(&versionBeforeDelta, &hash, &createdAt); err != nil {
+			return nil, err
+		}
+		if versionBeforeDelta < 0 || versionBeforeDelta >= currentVersion {
+			continue
+		}
+		hashes[versionBeforeDelta] = entity.VersionHash{
+			Version:   versionBeforeDelta + 1,
+			CreatedAt: time.Unix(0, createdAt).UTC(),
+			Hash:      hash,
+		}
+	}
+	err = rows.Err()
+	return hashes, err
+}
+
+// queryAllPostgresDeltas reads every inverse delta of a record, by the
+// version before the delta.
+func queryAllPostgresDeltas(ctx context.Context, tx *sql.Tx, id int64) (map[int]map[string]*string, error) {
+	queryCtx, done := instrumentPostgres(ctx, "query_all_record_deltas")
+	rows, err := tx.QueryContext(queryCtx, data.PG_QUERY_ALL_RECORD_DELTAS, id)
+	defer func() { done(err) }()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deltas := map[int]map[string]*string{}
+	for rows.Next() {
+		var versionBeforeDelta int
+		var inverseDelta string
+		if err = rows.Scan(&versionBeforeDelta, &inverseDelta); err != nil {
+			return nil, err
+		}
+		var delta map[string]*string
+		if err = json.Unmarshal([]byte(inverseDelta), &delta); err != nil {
+			return nil, err
+		}
+		deltas[versionBeforeDelta] = delta
+	}
+	err = rows.Err()
+	return deltas, err
+}
+
+// rehashPostgres recomputes the hash chain of a record within tx, after
+// its history was rewritten, from its current version and every inverse
+// delta.
+func rehashPostgres(
+	ctx context.Context,
+	tx *sql.Tx,
+	current entity.Record,
+	deltas map[int]map[string]*string,
+) error {
+	versionsBeforeDelta := make([]int, 0, len(deltas))
+	for versionBeforeDelta := range deltas {
+		versionsBeforeDelta = append(versionsBeforeDelta, versionBeforeDelta)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versionsBeforeDelta)))
+
+	versions := make([]entity.Record, current.Version)
+	record := current.Copy()
+	versions[record.Version-1] = record.Copy()
+	for _, versionBeforeDelta := range versionsBeforeDelta {
+		record.ApplyUpdate(deltas[versionBeforeDelta])
+		record.Version = versionBeforeDelta
+		if versionBeforeDelta >= 1 && versionBeforeDelta <= current.Version {
+			versions[versionBeforeDelta-1] = record.Copy()
+		}
+	}
+
+	hashes, err := queryPostgresVersionHashes(ctx, tx, current.ID, current.Version)
+	if err != nil {
+		return err
+	}
+	for i, link := range entity.ChainHashes(current.ID, versions, hashes) {
+		if link.Hash == hashes[i].Hash {
+			continue
+		}
+		queryCtx, done := instrumentPostgres(ctx, "update_record_delta_hash")
+		_, err = tx.ExecContext(queryCtx, data.PG_UPDATE_RECORD_DELTA_HASH, link.Hash, current.ID, link.Version-1)
+		done(err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,748 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/temelpa/timetravel/data"
+	"github.com/temelpa/timetravel/entity"
+	"github.com/temelpa/timetravel/metrics"
+	"github.com/temelpa/timetravel/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// PostgresRecordService is a PostgreSQL-backed record service, so several
+// replicas of the server can share one database. Versions are stored as
+// inverse deltas, like SQLiteRecordService does, but writers lock the rows
+// they change instead of relying on the in-process API lock.
+type PostgresRecordService struct {
+	db             *sql.DB
+	idempotencyTTL time.Duration
+
+	// Shared by copies of the service, since it's returned by value
+	writes *postgresWrites
+}
+
+// postgresWrites lets Close wait out writes in flight: they hold the read
+// side for their transaction, and Close takes the write side.
+type postgresWrites struct {
+	sync.RWMutex
+	closed bool
+}
+
+type PostgresRecordServiceSettings struct {
+	// When the server is started, should every table be dropped?
+	ResetOnStart bool
+
+	// How long responses stored for an Idempotency-Key are replayed.
+	// Zero uses DefaultIdempotencyKeyTTL.
+	IdempotencyKeyTTL time.Duration
+}
+
+// The SQLSTATE of a statement violating a primary key or unique constraint.
+const postgresUniqueViolation = "23505"
+
+func NewPostgresRecordService(
+	dsn string,
+	settings PostgresRecordServiceSettings,
+) (PostgresRecordService, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		logError(context.Background(), err)
+		return PostgresRecordService{}, err
+	}
+
+	if err := db.Ping(); err != nil {
+		logError(context.Background(), err)
+		db.Close()
+		return PostgresRecordService{}, err
+	}
+
+	if settings.ResetOnStart {
+		if _, err := db.Exec(data.PG_DROP_TABLES); err != nil {
+			logError(context.Background(), err)
+			db.Close()
+			return PostgresRecordService{}, err
+		}
+	}
+
+	if err := migratePostgresSchema(db); err != nil {
+		logError(context.Background(), err)
+		db.Close()
+		return PostgresRecordService{}, err
+	}
+
+	idempotencyTTL := settings.IdempotencyKeyTTL
+	if idempotencyTTL <= 0 {
+		idempotencyTTL = DefaultIdempotencyKeyTTL
+	}
+
+	return PostgresRecordService{
+		db:             db,
+		idempotencyTTL: idempotencyTTL,
+		writes:         &postgresWrites{},
+	}, nil
+}
+
+// migratePostgresSchema creates any missing tables and refuses databases
+// written by a newer server, like migrateSchema. Replicas starting at once
+// take turns.
+func migratePostgresSchema(db *sql.DB) error {
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, data.PG_MIGRATION_LOCK); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, data.PG_CREATE_SCHEMA_VERSION_TABLE); err != nil {
+		return err
+	}
+	var version int
+	if err := tx.QueryRowContext(ctx, data.PG_QUERY_SCHEMA_VERSION).Scan(&version); err != nil {
+		return err
+	}
+	if version > data.PG_SCHEMA_VERSION {
+		return fmt.Errorf("schema version %d, expected %d: %w", version, data.PG_SCHEMA_VERSION, ErrSchemaVersionMismatch)
+	}
+
+	for _, sqlStatement := range []string{
+		data.PG_CREATE_RECORDS_TABLE,
+		data.PG_CREATE_RECORD_DELTAS_TABLE,
+		data.PG_CREATE_IDEMPOTENCY_KEYS_TABLE,
+		data.PG_CREATE_API_KEYS_TABLE,
+		data.PG_CREATE_RECORD_ERASURES_TABLE,
+	} {
+		if _, err := tx.ExecContext(ctx, sqlStatement); err != nil {
+			return err
+		}
+	}
+
+	if version < data.PG_SCHEMA_VERSION {
+		if _, err := tx.ExecContext(ctx, data.PG_UPDATE_SCHEMA_VERSION, data.PG_SCHEMA_VERSION); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetRWLockForAPI returns a lock no other caller shares. Writers lock rows
+// and claim idempotency keys in the database instead, which also keeps them
+// apart from writers on other replicas, so requests never wait on each
+// other in process. Close waits for writes in flight by itself.
+func (s *PostgresRecordService) GetRWLockForAPI() *sync.RWMutex {
+	return &sync.RWMutex{}
+}
+
+func (s *PostgresRecordService) CheckReady(ctx context.Context) error {
+	if err := s.db.PingContext(ctx); err != nil {
+		return err
+	}
+
+	var version int
+	if err := s.db.QueryRowContext(ctx, data.PG_QUERY_SCHEMA_VERSION).Scan(&version); err != nil {
+		return err
+	}
+	if version != data.PG_SCHEMA_VERSION {
+		return fmt.Errorf("schema version %d, expected %d: %w", version, data.PG_SCHEMA_VERSION, ErrSchemaVersionMismatch)
+	}
+	return nil
+}
+
+// instrumentPostgres starts timing and tracing a PostgreSQL statement, like
+// instrumentQuery.
+func instrumentPostgres(ctx context.Context, statement string) (context.Context, func(error)) {
+	return instrumentStatement(ctx, "postgresql", statement, metrics.ObservePostgresQuery)
+}
+
+// isUniqueViolation reports whether a Postgres statement failed because a
+// row with the same key already exists.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == postgresUniqueViolation
+}
+
+// TableSizes counts the rows of every table, for metrics.
+func (s *PostgresRecordService) TableSizes(ctx context.Context) (map[string]int64, error) {
+	sizes := map[string]int64{}
+	for _, table := range []string{
+		data.RECORDS_TABLE,
+		data.RECORD_DELTAS_TABLE,
+		data.IDEMPOTENCY_KEYS_TABLE,
+		data.API_KEYS_TABLE,
+		data.RECORD_ERASURES_TABLE,
+	} {
+		var rows int64
+		if err := s.db.QueryRowContext(ctx, data.COUNT_ROWS+table).Scan(&rows); err != nil {
+			return nil, err
+		}
+		sizes[table] = rows
+	}
+	return sizes, nil
+}
+
+// Close waits for writes in flight to finish, then refuses any more.
+func (s *PostgresRecordService) Close() error {
+	s.writes.Lock()
+	defer s.writes.Unlock()
+	s.writes.closed = true
+	return s.db.Close()
+}
+
+// rowQueryer is satisfied by both *sql.DB and *sql.Tx.
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// queryPostgresRecord reads the current version of a record with the given
+// statement, PG_QUERY_RECORD or PG_QUERY_RECORD_FOR_UPDATE.
+func queryPostgresRecord(ctx context.Context, db rowQueryer, statement string, id int64) (entity.Record, error) {
+	var record entity.Record
+	var jsonData string
+	queryCtx, done := instrumentPostgres(ctx, "query_record")
+	err := db.QueryRowContext(queryCtx, statement, id).Scan(&record.ID, &record.Version, &jsonData)
+	done(err)
+	if err == sql.ErrNoRows {
+		return entity.Record{}, fmt.Errorf("record %d: %w", id, ErrRecordDoesNotExist)
+	}
+	if err != nil {
+		return entity.Record{}, err
+	}
+
+	if err := json.Unmarshal([]byte(jsonData), &record.Data); err != nil {
+		return entity.Record{}, err
+	}
+	return record, nil
+}
+
+func (s *PostgresRecordService) GetRecord(
+	ctx context.Context,
+	id int64,
+) (entity.Record, error) {
+	record, err := queryPostgresRecord(ctx, s.db, data.PG_QUERY_RECORD, id)
+	if err != nil && !errors.Is(err, ErrRecordDoesNotExist) {
+		logError(ctx, err)
+	}
+	return record, err
+}
+
+func (s *PostgresRecordService) CreateRecord(
+	ctx context.Context,
+	record entity.Record,
+) error {
+	return s.CreateRecordKeyed(ctx, record, nil)
+}
+
+func (s *PostgresRecordService) CreateRecordKeyed(
+	ctx context.Context,
+	record entity.Record,
+	respond IdempotentResponder,
+) error {
+	if record.ID <= 0 {
+		return fmt.Errorf("record %d: %w", record.ID, ErrRecordIDInvalid)
+	}
+
+	// The record and the delta carrying its first hash appear together
+	tx, end, err := s.beginWrite(ctx)
+	if err != nil {
+		logError(ctx, err)
+		return err
+	}
+	defer end()
+	defer tx.Rollback()
+
+	record.Version = 1
+	link, err := createPostgresRecord(ctx, tx, record)
+	if err != nil {
+		logError(ctx, err)
+		return err
+	}
+	return s.commitWrite(ctx, tx, record, link, respond)
+}
+
+func (s *PostgresRecordService) UpdateRecord(
+	ctx context.Context,
+	id int64,
+	updates map[string]*string,
+) (entity.Record, error) {
+	return s.UpdateRecordKeyed(ctx, id, updates, nil)
+}
+
+func (s *PostgresRecordService) UpdateRecordKeyed(
+	ctx context.Context,
+	id int64,
+	updates map[string]*string,
+	respond IdempotentResponder,
+) (entity.Record, error) {
+	tx, end, err := s.beginWrite(ctx)
+	if err != nil {
+		logError(ctx, err)
+		return entity.Record{}, err
+	}
+	defer end()
+	defer tx.Rollback()
+
+	entry, link, changed, err := updatePostgresRecord(ctx, tx, id, updates)
+	if err != nil {
+		logError(ctx, err)
+		return entity.Record{}, err
+	}
+	if !changed && respond == nil {
+		return entry, nil
+	}
+	if err := s.commitWrite(ctx, tx, entry, link, respond); err != nil {
+		return entity.Record{}, err
+	}
+	return entry.Copy(), nil
+}
+
+// UpsertRecordKeyed decides between creating and updating the record in the
+// same transaction as the write, so replicas writing a new record at once
+// create it once and update it after.
+func (s *PostgresRecordService) UpsertRecordKeyed(
+	ctx context.Context,
+	id int64,
+	updates map[string]*string,
+	respond IdempotentResponder,
+) (entity.Record, error) {
+	if id <= 0 {
+		return entity.Record{}, fmt.Errorf("record %d: %w", id, ErrRecordIDInvalid)
+	}
+
+	tx, end, err := s.beginWrite(ctx)
+	if err != nil {
+		logError(ctx, err)
+		return entity.Record{}, err
+	}
+	defer end()
+	defer tx.Rollback()
+
+	entry := recordFromUpdates(id, updates)
+	changed := true
+	link, err := createPostgresRecord(ctx, tx, entry)
+	if errors.Is(err, ErrRecordAlreadyExists) {
+		// The insert waited for any concurrent creation to commit, so the
+		// row is there to lock
+		entry, link, changed, err = updatePostgresRecord(ctx, tx, id, updates)
+	}
+	if err != nil {
+		logError(ctx, err)
+		return entity.Record{}, err
+	}
+	if !changed && respond == nil {
+		return entry, nil
+	}
+	if err := s.commitWrite(ctx, tx, entry, link, respond); err != nil {
+		return entity.Record{}, err
+	}
+	return entry.Copy(), nil
+}
+
+// beginWrite starts a transaction that writes, which Close waits for. end
+// must be called once the transaction is over.
+func (s *PostgresRecordService) beginWrite(ctx context.Context) (*sql.Tx, func(), error) {
+	s.writes.RLock()
+	if s.writes.closed {
+		s.writes.RUnlock()
+		return nil, nil, ErrServiceClosed
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.writes.RUnlock()
+		return nil, nil, err
+	}
+	return tx, s.writes.RUnlock, nil
+}
+
+// commitWrite stores the response respond builds, if any, and commits the
+// write along with it.
+func (s *PostgresRecordService) commitWrite(
+	ctx context.Context,
+	tx *sql.Tx,
+	record entity.Record,
+	link entity.VersionHash,
+	respond IdempotentResponder,
+) error {
+	if err := s.saveResponse(ctx, tx, record, link, respond); err != nil {
+		logError(ctx, err)
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		logError(ctx, err)
+		return err
+	}
+	return nil
+}
+
+// createPostgresRecord inserts the first version of a record within tx,
+// and returns its link. If the record exists, or another transaction is
+// creating it and commits, it fails with ErrRecordAlreadyExists and tx can
+// carry on.
+func createPostgresRecord(ctx context.Context, tx *sql.Tx, record entity.Record) (entity.VersionHash, error) {
+	jsonBytes, err := json.Marshal(record.Data)
+	if err != nil {
+		return entity.VersionHash{}, err
+	}
+
+	queryCtx, done := instrumentPostgres(ctx, "insert_record")
+	result, err := tx.ExecContext(queryCtx, data.PG_INSERT_RECORD, record.ID, string(jsonBytes))
+	done(err)
+	if err != nil {
+		return entity.VersionHash{}, err
+	}
+	if inserted, err := result.RowsAffected(); err != nil {
+		return entity.VersionHash{}, err
+	} else if inserted == 0 {
+		return entity.VersionHash{}, fmt.Errorf("record %d: %w", record.ID, ErrRecordAlreadyExists)
+	}
+
+	creationInverse := map[string]*string{}
+	for key := range record.Data {
+		creationInverse[key] = nil
+	}
+	link := newVersionHash("", record, nil)
+	if err := insertPostgresDelta(ctx, tx, record.ID, 0, creationInverse, link); err != nil {
+		return entity.VersionHash{}, err
+	}
+	return link, nil
+}
+
+// updatePostgresRecord applies the updates to a record within tx, and
+// returns the record and the link of its version, which is its current one
+// if the updates change nothing.
+func updatePostgresRecord(
+	ctx context.Context,
+	tx *sql.Tx,
+	id int64,
+	updates map[string]*string,
+) (entity.Record, entity.VersionHash, bool, error) {
+	// Holding the row lock until commit, no other writer can slip a
+	// version in between reading this one and writing the next
+	entry, err := queryPostgresRecord(ctx, tx, data.PG_QUERY_RECORD_FOR_UPDATE, id)
+	if err != nil {
+		return entity.Record{}, entity.VersionHash{}, false, err
+	}
+	link, err := queryPostgresVersionHash(ctx, tx, id, entry.Version)
+	if err != nil {
+		return entity.Record{}, entity.VersionHash{}, false, err
+	}
+
+	previous := entry.Copy()
+	updateInverse := entry.InverseUpdate(updates)
+	if !entry.ApplyUpdate(updates) {
+		return entry, link, false, nil
+	}
+
+	entry.Version += 1
+	link = newVersionHash(link.Hash, entry, previous.Data)
+	if err := insertPostgresDelta(ctx, tx, id, previous.Version, updateInverse, link); err != nil {
+		return entity.Record{}, entity.VersionHash{}, false, err
+	}
+
+	jsonBytes, err := json.Marshal(entry.Data)
+	if err != nil {
+		return entity.Record{}, entity.VersionHash{}, false, err
+	}
+	queryCtx, done := instrumentPostgres(ctx, "update_record")
+	_, err = tx.ExecContext(queryCtx, data.PG_UPDATE_RECORD, entry.Version, string(jsonBytes), id)
+	done(err)
+	if err != nil {
+		return entity.Record{}, entity.VersionHash{}, false, err
+	}
+	return entry, link, true, nil
+}
+
+// insertPostgresDelta stores the inverse of the update that took the record
+// past versionBeforeDelta, along with the link of the version it led to.
+func insertPostgresDelta(
+	ctx context.Context,
+	tx *sql.Tx,
+	id int64,
+	versionBeforeDelta int,
+	inverseDelta map[string]*string,
+	link entity.VersionHash,
+) error {
+	jsonBytes, err := json.Marshal(inverseDelta)
+	if err != nil {
+		return err
+	}
+
+	queryCtx, done := instrumentPostgres(ctx, "insert_record_delta")
+	_, err = tx.ExecContext(
+		queryCtx,
+		data.PG_INSERT_RECORD_DELTA,
+		id,
+		versionBeforeDelta,
+		string(jsonBytes),
+		link.Hash,
+		link.CreatedAt.UnixNano(),
+	)
+	done(err)
+	return err
+}
+
+func (s *PostgresRecordService) GetAllRecordVersions(
+	ctx context.Context,
+	id int64,
+) ([]entity.Record, error) {
+	return s.getRecordVersions(ctx, id, 1, 0)
+}
+
+func (s *PostgresRecordService) GetVersionedRecord(
+	ctx context.Context,
+	id int64,
+	version int,
+) (entity.Record, error) {
+	r, err := s.getRecordVersions(ctx, id, version, 1)
+	if err != nil {
+		return entity.Record{}, err
+	}
+	if len(r) != 1 {
+		return entity.Record{}, fmt.Errorf("record %d version %d: %w", id, version, ErrVersionDoesNotExist)
+	}
+	return r[0], err
+}
+
+// readOnlySnapshot is the transaction reads spanning several statements
+// run in, so they all see the database as of the same moment, however
+// many writers commit in the meantime.
+var readOnlySnapshot = &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+
+func (s *PostgresRecordService) getRecordVersions(
+	ctx context.Context,
+	id int64,
+	minVersionToGrab int,
+	numOldestVersionsToGrab int,
+) ([]entity.Record, error) {
+	tx, err := s.db.BeginTx(ctx, readOnlySnapshot)
+	if err != nil {
+		logError(ctx, err)
+		return []entity.Record{}, err
+	}
+	defer tx.Rollback()
+	return s.readRecordVersions(ctx, tx, id, minVersionToGrab, numOldestVersionsToGrab)
+}
+
+// readRecordVersions is getRecordVersions within tx, a read-only snapshot.
+func (s *PostgresRecordService) readRecordVersions(
+	ctx context.Context,
+	tx *sql.Tx,
+	id int64,
+	minVersionToGrab int,
+	numOldestVersionsToGrab int,
+) ([]entity.Record, error) {
+	entry, err := queryPostgresRecord(ctx, tx, data.PG_QUERY_RECORD, id)
+	if err != nil {
+		logError(ctx, err)
+		return []entity.Record{}, err
+	}
+	if minVersionToGrab > entry.Version || minVersionToGrab < 0 {
+		return []entity.Record{}, fmt.Errorf("record %d version %d: %w", id, minVersionToGrab, ErrVersionDoesNotExist)
+	}
+
+	if minVersionToGrab == 0 {
+		minVersionToGrab = entry.Version
+	}
+	if numOldestVersionsToGrab == 0 {
+		numOldestVersionsToGrab = entry.Version
+	}
+	if numVersionsAvailable := entry.Version - minVersionToGrab + 1; numVersionsAvailable < numOldestVersionsToGrab {
+		numOldestVersionsToGrab = numVersionsAvailable
+	}
+	maxVersionToGrab := minVersionToGrab + numOldestVersionsToGrab - 1
+
+	versionedRecords := make([]entity.Record, numOldestVersionsToGrab)
+	if maxVersionToGrab == entry.Version {
+		versionedRecords[entry.Version-minVersionToGrab] = entry.Copy()
+		if minVersionToGrab == entry.Version {
+			return versionedRecords, nil
+		}
+	}
+
+	queryCtx, done := instrumentPostgres(ctx, "query_record_deltas")
+	defer func() { done(err) }()
+	rows, err := tx.QueryContext(queryCtx, data.PG_QUERY_RECORD_DELTAS, minVersionToGrab, id)
+	if err != nil {
+		logError(ctx, err)
+		return []entity.Record{}, err
+	}
+	defer rows.Close()
+
+	_, reconstruction := tracing.Start(queryCtx, "reconstruct_versions",
+		attribute.Int64("record.id", id),
+		attribute.Int("record.version.min", minVersionToGrab),
+		attribute.Int("record.version.max", maxVersionToGrab),
+	)
+	deltasApplied := 0
+	defer func() {
+		metrics.ObserveReconstructionDepth(deltasApplied)
+		reconstruction.SetAttributes(attribute.Int("deltas_applied", deltasApplied))
+		tracing.End(reconstruction, err)
+	}()
+	for rows.Next() {
+		var inverseDelta string
+		var versionBeforeUpdate int
+		if err = rows.Scan(&versionBeforeUpdate, &inverseDelta); err != nil {
+			logError(ctx, err)
+			return []entity.Record{}, err
+		}
+
+		var delta map[string]*string
+		if err = json.Unmarshal([]byte(inverseDelta), &delta); err != nil {
+			logError(ctx, err)
+			return []entity.Record{}, err
+		}
+
+		entry.ApplyUpdate(delta)
+		entry.Version = versionBeforeUpdate
+		deltasApplied++
+
+		if entry.Version >= minVersionToGrab && entry.Version <= maxVersionToGrab {
+			versionedRecords[entry.Version-minVersionToGrab] = entry.Copy()
+		}
+	}
+	if err = rows.Err(); err != nil {
+		logError(ctx, err)
+		return []entity.Record{}, err
+	}
+	return versionedRecords, nil
+}
+
+func (s *PostgresRecordService) GetIdempotentResponse(
+	ctx context.Context,
+	key string,
+) (entity.IdempotentResponse, error) {
+	oldestValid := time.Now().Add(-s.idempotencyTTL).UnixNano()
+	response, err := queryPostgresIdempotentResponse(ctx, s.db, key, oldestValid)
+	if err != nil && !errors.Is(err, ErrIdempotencyKeyNotFound) {
+		logError(ctx, err)
+	}
+	return response, err
+}
+
+// queryPostgresIdempotentResponse reads the response stored for a key no
+// earlier than oldestValid.
+func queryPostgresIdempotentResponse(ctx context.Context, db rowQueryer, key string, oldestValid int64) (entity.IdempotentResponse, error) {
+	queryCtx, done := instrumentPostgres(ctx, "query_idempotency_key")
+	row := db.QueryRowContext(queryCtx, data.PG_QUERY_IDEMPOTENCY_KEY, key, oldestValid)
+
+	var response entity.IdempotentResponse
+	var createdAt int64
+	err := row.Scan(
+		&response.Key,
+		&response.RequestHash,
+		&response.StatusCode,
+		&response.Body,
+		&createdAt,
+		&response.RecordID,
+	)
+	done(err)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return entity.IdempotentResponse{}, ErrIdempotencyKeyNotFound
+		}
+		return entity.IdempotentResponse{}, err
+	}
+
+	response.CreatedAt = time.Unix(0, createdAt)
+	return response, nil
+}
+
+func (s *PostgresRecordService) SaveIdempotentResponse(
+	ctx context.Context,
+	response entity.IdempotentResponse,
+) error {
+	tx, end, err := s.beginWrite(ctx)
+	if err != nil {
+		logError(ctx, err)
+		return err
+	}
+	defer end()
+	defer tx.Rollback()
+
+	if err := s.saveIdempotentResponse(ctx, tx, response); err != nil {
+		logError(ctx, err)
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		logError(ctx, err)
+		return err
+	}
+	return nil
+}
+
+// saveResponse stores the response respond builds from record within tx,
+// unless respond is nil.
+func (s *PostgresRecordService) saveResponse(
+	ctx context.Context,
+	tx *sql.Tx,
+	record entity.Record,
+	link entity.VersionHash,
+	respond IdempotentResponder,
+) error {
+	if respond == nil {
+		return nil
+	}
+	response, err := respond(record.Copy(), link)
+	if err != nil {
+		return err
+	}
+	return s.saveIdempotentResponse(ctx, tx, response)
+}
+
+func (s *PostgresRecordService) saveIdempotentResponse(
+	ctx context.Context,
+	tx *sql.Tx,
+	response entity.IdempotentResponse,
+) error {
+	if response.CreatedAt.IsZero() {
+		response.CreatedAt = time.Now()
+	}
+
+	// As with SQLite, purging expired keys here is purely housekeeping
+	queryCtx, done := instrumentPostgres(ctx, "delete_expired_idempotency_keys")
+	_, err := tx.ExecContext(queryCtx, data.PG_DELETE_EXPIRED_IDEMPOTENCY_KEYS, time.Now().Add(-s.idempotencyTTL).UnixNano())
+	done(err)
+	if err != nil {
+		return err
+	}
+
+	// Claiming the key in the write's transaction, rather than looking it
+	// up beforehand, means that of two writers racing with one key, the
+	// second waits for the first to commit and then writes nothing
+	oldestValid := time.Now().Add(-s.idempotencyTTL).UnixNano()
+	queryCtx, done = instrumentPostgres(ctx, "claim_idempotency_key")
+	result, err := tx.ExecContext(
+		queryCtx,
+		data.PG_CLAIM_IDEMPOTENCY_KEY,
+		response.Key,
+		response.RequestHash,
+		response.StatusCode,
+		response.Body,
+		response.CreatedAt.UnixNano(),
+		response.RecordID,
+		oldestValid,
+	)
+	done(err)
+	if err != nil {
+		return err
+	}
+	if claimed, err := result.RowsAffected(); err != nil || claimed > 0 {
+		return err
+	}
+
+	stored, err := queryPostgresIdempotentResponse(ctx, tx, response.Key, oldestValid)
+	if err != nil {
+		return err
+	}
+	return &IdempotencyKeyUsedError{Stored: stored}
+}
@@ -0,0 +1,312 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"github.com/temelpa/timetravel/data"
+	"github.com/temelpa/timetravel/entity"
+)
+
+// Set to the DSN of a Postgres server the tests may wipe, to use it instead
+// of starting one.
+const testPostgresEnv = "TIMETRAVEL_TEST_POSTGRES_DSN"
+
+// Set to anything to fail, rather than skip, the tests if there's no
+// Postgres server to be had, e.g. in CI.
+const requirePostgresEnv = "TIMETRAVEL_REQUIRE_POSTGRES"
+
+var testPostgres struct {
+	once       sync.Once
+	dsn        string
+	err        error
+	embedded   *embeddedpostgres.EmbeddedPostgres
+	runtimeDir string
+}
+
+// stopTestPostgres stops the embedded server, if one was started, and
+// removes its files.
+func stopTestPostgres() {
+	if testPostgres.embedded != nil {
+		testPostgres.embedded.Stop()
+	}
+	if testPostgres.runtimeDir != "" {
+		os.RemoveAll(testPostgres.runtimeDir)
+	}
+}
+
+// postgresDSN returns the DSN of the Postgres server the tests share,
+// starting an embedded one on first use. The test is skipped if there's no
+// server to be had, e.g. when the binaries can't be downloaded or, since
+// Postgres refuses to, the tests run as root, unless requirePostgresEnv is
+// set.
+func postgresDSN(t *testing.T) string {
+	testPostgres.once.Do(func() {
+		if testPostgres.dsn = os.Getenv(testPostgresEnv); testPostgres.dsn != "" {
+			return
+		}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			testPostgres.err = err
+			return
+		}
+		port := listener.Addr().(*net.TCPAddr).Port
+		listener.Close()
+
+		dir, err := os.MkdirTemp("", "timetravel-postgres")
+		if err != nil {
+			testPostgres.err = err
+			return
+		}
+		config := embeddedpostgres.DefaultConfig().
+			Port(uint32(port)).
+			RuntimePath(dir).
+			Logger(io.Discard)
+		embedded := embeddedpostgres.NewDatabase(config)
+		if testPostgres.err = embedded.Start(); testPostgres.err != nil {
+			os.RemoveAll(dir)
+			return
+		}
+		testPostgres.embedded = embedded
+		testPostgres.runtimeDir = dir
+		testPostgres.dsn = config.GetConnectionURL() + "?sslmode=disable"
+	})
+	if testPostgres.err != nil && os.Getenv(requirePostgresEnv) != "" {
+		t.Fatalf("Postgres unavailable, but %s is set: %v", requirePostgresEnv, testPostgres.err)
+	}
+	if testPostgres.err != nil {
+		t.Skipf("Postgres unavailable, set %s to run against a server: %v", testPostgresEnv, testPostgres.err)
+	}
+	return testPostgres.dsn
+}
+
+// newTestPostgres connects to the shared server with every table dropped.
+func newTestPostgres(t *testing.T, settings PostgresRecordServiceSettings) *PostgresRecordService {
+	dsn := postgresDSN(t)
+	settings.ResetOnStart = true
+	service, err := NewPostgresRecordService(dsn, settings)
+	if err != nil {
+		t.Fatalf("Unable to create testing database, error %v", err)
+	}
+	t.Cleanup(func() { service.Close() })
+	return &service
+}
+
+// Test basic read + write functionality
+func TestSanityPostgres(t *testing.T) {
+	service := newTestPostgres(t, PostgresRecordServiceSettings{})
+	testSanity(t, service)
+
+	// Everything survives reconnecting
+	reopened, err := NewPostgresRecordService(postgresDSN(t), PostgresRecordServiceSettings{})
+	if err != nil {
+		t.Fatalf("Unable to reconnect to testing database, error %v", err)
+	}
+	defer reopened.Close()
+	if r, err := reopened.GetRecord(context.Background(), 42); err != nil || r.Version != 3 {
+		t.Errorf("Expected version 3 of record 42 after reconnecting, got %v, error %v", r, err)
+	}
+	if err := reopened.CheckReady(context.Background()); err != nil {
+		t.Errorf("Expected service to be ready, got error %v", err)
+	}
+}
+
+// Test that ids at the edges of the 64-bit range are stored and versioned intact
+func TestBoundaryIDsPostgres(t *testing.T) {
+	testBoundaryIDs(t, newTestPostgres(t, PostgresRecordServiceSettings{}))
+}
+
+// Test that stored idempotent responses are only replayed within their TTL
+func TestIdempotentResponsesPostgres(t *testing.T) {
+	testIdempotentResponses(t, newTestPostgres(t, PostgresRecordServiceSettings{IdempotencyKeyTTL: time.Hour}))
+}
+
+func TestAPIKeysPostgres(t *testing.T) {
+	testAPIKeys(t, newTestPostgres(t, PostgresRecordServiceSettings{}))
+}
+
+func TestErasurePostgres(t *testing.T) {
+	testErasure(t, newTestPostgres(t, PostgresRecordServiceSettings{}))
+}
+
+func TestHashChainPostgres(t *testing.T) {
+	service := newTestPostgres(t, PostgresRecordServiceSettings{})
+	testHashChain(t, service)
+
+	// Editing history behind the service's back is detected
+	ctx := context.Background()
+	if _, err := service.db.Exec(`UPDATE record_deltas SET inverseDelta = '{"hello":"pluto"}' WHERE id = 1 AND versionBeforeDelta = 1`); err != nil {
+		t.Fatal(err)
+	}
+	if verification, err := VerifyRecord(ctx, service, 1); err != nil || verification.Valid || verification.BrokenVersion != 1 {
+		t.Errorf("Expected the edited version to break the chain, got %+v, error %v", verification, err)
+	}
+}
+
+// Test that databases from a newer server are refused
+func TestSchemaVersionPostgres(t *testing.T) {
+	service := newTestPostgres(t, PostgresRecordServiceSettings{})
+	if _, err := service.db.Exec(data.PG_UPDATE_SCHEMA_VERSION, data.PG_SCHEMA_VERSION+1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := service.CheckReady(context.Background()); !errors.Is(err, ErrSchemaVersionMismatch) {
+		t.Errorf("Expected readiness to fail on a newer schema, got error %v", err)
+	}
+	if _, err := NewPostgresRecordService(postgresDSN(t), PostgresRecordServiceSettings{}); !errors.Is(err, ErrSchemaVersionMismatch) {
+		t.Errorf("Expected a newer schema to be refused, got error %v", err)
+	}
+}
+
+// Test that writers on separate replicas, with no API lock between them,
+// never lose an update or break the hash chain
+func TestConcurrentUpdatesPostgres(t *testing.T) {
+	first := newTestPostgres(t, PostgresRecordServiceSettings{})
+	second, err := NewPostgresRecordService(postgresDSN(t), PostgresRecordServiceSettings{})
+	if err != nil {
+		t.Fatalf("Unable to connect a second replica, error %v", err)
+	}
+	defer second.Close()
+
+	ctx := context.Background()
+	if err := first.CreateRecord(ctx, entity.Record{ID: 1, Version: 1, Data: map[string]string{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	const writers = 8
+	const updatesEach = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*updatesEach)
+	for writer := 0; writer < writers; writer++ {
+		replica := first
+		if writer%2 == 1 {
+			replica = &second
+		}
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for update := 0; update < updatesEach; update++ {
+				value := strconv.Itoa(update)
+				key := fmt.Sprintf("writer-%d", writer)
+				if _, err := replica.UpdateRecord(ctx, 1, map[string]*string{key: &value}); err != nil {
+					errs <- err
+				}
+			}
+		}(writer)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Unable to update record concurrently, error %v", err)
+	}
+
+	record, err := second.GetRecord(ctx, 1)
+	if err != nil || record.Version != 1+writers*updatesEach || len(record.Data) != writers {
+		t.Fatalf("Expected every update applied, got %v, error %v", record, err)
+	}
+	for writer := 0; writer < writers; writer++ {
+		if value := record.Data[fmt.Sprintf("writer-%d", writer)]; value != strconv.Itoa(updatesEach-1) {
+			t.Errorf("Expected writer %d's last update, got %q", writer, value)
+		}
+	}
+	versions, err := first.GetAllRecordVersions(ctx, 1)
+	if err != nil || len(versions) != 1+writers*updatesEach {
+		t.Errorf("Expected every version kept, got %d, error %v", len(versions), err)
+	}
+	if verification, err := VerifyRecord(ctx, first, 1); err != nil || !verification.Valid {
+		t.Errorf("Expected the history to verify, got %+v, error %v", verification, err)
+	}
+
+	// Creating the same record on both replicas at once lets exactly one win
+	created := make(chan error, 2)
+	for _, replica := range []*PostgresRecordService{first, &second} {
+		go func(replica *PostgresRecordService) {
+			created <- replica.CreateRecord(ctx, entity.Record{ID: 2, Version: 1, Data: map[string]string{}})
+		}(replica)
+	}
+	results := []error{<-created, <-created}
+	if (results[0] == nil) == (results[1] == nil) {
+		t.Errorf("Expected exactly one create to succeed, got errors %v", results)
+	}
+	for _, err := range results {
+		if err != nil && !errors.Is(err, ErrRecordAlreadyExists) {
+			t.Errorf("Expected the losing create to fail with ErrRecordAlreadyExists, got %v", err)
+		}
+	}
+}
+
+// Test that retries of a keyed write racing on separate replicas write one
+// version, and that a record created on both at once is created once and
+// then updated
+func TestConcurrentKeyedWritesPostgres(t *testing.T) {
+	first := newTestPostgres(t, PostgresRecordServiceSettings{})
+	second, err := NewPostgresRecordService(postgresDSN(t), PostgresRecordServiceSettings{})
+	if err != nil {
+		t.Fatalf("Unable to connect a second replica, error %v", err)
+	}
+	defer second.Close()
+	replicas := []*PostgresRecordService{first, &second}
+
+	ctx := context.Background()
+	respond := func(record entity.Record, link entity.VersionHash) (entity.IdempotentResponse, error) {
+		return entity.IdempotentResponse{Key: "retry", RecordID: record.ID, StatusCode: 200, CreatedAt: time.Now()}, nil
+	}
+	value := "world"
+	written := make(chan error, len(replicas))
+	for _, replica := range replicas {
+		go func(replica *PostgresRecordService) {
+			_, err := replica.UpsertRecordKeyed(ctx, 1, map[string]*string{"hello": &value}, respond)
+			written <- err
+		}(replica)
+	}
+	results := []error{<-written, <-written}
+	if (results[0] == nil) == (results[1] == nil) {
+		t.Errorf("Expected exactly one keyed write to succeed, got errors %v", results)
+	}
+	for _, err := range results {
+		var used *IdempotencyKeyUsedError
+		if err != nil && (!errors.As(err, &used) || used.Stored.Key != "retry") {
+			t.Errorf("Expected the other write to find the stored response, got %v", err)
+		}
+	}
+	if versions, err := first.GetAllRecordVersions(ctx, 1); err != nil || len(versions) != 1 {
+		t.Errorf("Expected one version written, got %d, error %v", len(versions), err)
+	}
+
+	for i, replica := range replicas {
+		go func(i int, replica *PostgresRecordService) {
+			key := fmt.Sprintf("replica-%d", i)
+			_, err := replica.UpsertRecordKeyed(ctx, 2, map[string]*string{key: &value}, nil)
+			written <- err
+		}(i, replica)
+	}
+	for range replicas {
+		if err := <-written; err != nil {
+			t.Errorf("Unable to write new record concurrently, error %v", err)
+		}
+	}
+	if record, err := first.GetRecord(ctx, 2); err != nil || record.Version != 2 || len(record.Data) != 2 {
+		t.Errorf("Expected the record created then updated, got %v, error %v", record, err)
+	}
+	if verification, err := VerifyRecord(ctx, first, 2); err != nil || !verification.Valid {
+		t.Errorf("Expected the history to verify, got %+v, error %v", verification, err)
+	}
+
+	// Writes after closing are refused
+	if err := second.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.UpsertRecordKeyed(ctx, 3, map[string]*string{}, nil); !errors.Is(err, ErrServiceClosed) {
+		t.Errorf("Expected writes to a closed service to fail, got error %v", err)
+	}
+}
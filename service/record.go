@@ -3,14 +3,39 @@ package service
 import (
 	"context"
 	"errors"
+	"fmt"
 	"sync"
 
 	"github.com/temelpa/timetravel/entity"
 )
 
+// Errors returned by record services. Implementations wrap these with
+// details such as the record id, so compare them with errors.Is.
 var ErrRecordDoesNotExist = errors.New("record with that id does not exist")
+var ErrVersionDoesNotExist = errors.New("record version does not exist")
+var ErrVersionCompacted = errors.New("record version was compacted away by retention")
 var ErrRecordIDInvalid = errors.New("record id must >= 0")
 var ErrRecordAlreadyExists = errors.New("record already exists")
+var ErrIdempotencyKeyNotFound = errors.New("no response stored for that idempotency key")
+var ErrSchemaVersionMismatch = errors.New("database schema version does not match this server")
+var ErrServiceClosed = errors.New("record service is closed")
+var ErrAPIKeyDoesNotExist = errors.New("api key does not exist")
+var ErrImportLineTooLong = errors.New("import line is too long")
+var ErrIdempotencyKeyUsed = errors.New("a response is already stored for that idempotency key")
+
+// IdempotencyKeyUsedError is how keyed writes fail with ErrIdempotencyKeyUsed,
+// carrying the response stored for the key.
+type IdempotencyKeyUsedError struct {
+	Stored entity.IdempotentResponse
+}
+
+func (e *IdempotencyKeyUsedError) Error() string {
+	return fmt.Sprintf("key %q: %v", e.Stored.Key, ErrIdempotencyKeyUsed)
+}
+
+func (e *IdempotencyKeyUsedError) Unwrap() error {
+	return ErrIdempotencyKeyUsed
+}
 
 type RecordServiceBase interface {
 	// TODO: It seems awkward for a rwlock to be used mostly outside the
@@ -18,14 +43,69 @@ type RecordServiceBase interface {
 	// Try to make things structured so that the lock lives elsewhere,
 	// or the service is the true user of the lock.
 	GetRWLockForAPI() *sync.RWMutex
+
+	// CheckReady reports whether the service can currently serve requests,
+	// e.g. that its backing store is reachable and has the expected schema.
+	CheckReady(ctx context.Context) error
+
+	// Close flushes and releases anything backing the service. The service
+	// must not be used afterwards.
+	Close() error
+}
+
+// Implemented by services whose GetRecord, GetVersionedRecord and
+// GetAllRecordVersions each read a consistent snapshot, which writes never
+// leave half-applied. The API doesn't take its lock around those reads if
+// ReadsSnapshots is true, so they don't wait on writers.
+type SnapshotReader interface {
+	ReadsSnapshots() bool
+}
+
+// RecordHistory is versions of a record along with everything describing
+// them, all read from one snapshot. Links[i] is the link of Versions[i].
+type RecordHistory struct {
+	Versions    []entity.Record
+	Links       []entity.VersionHash
+	Erasures    []entity.Erasure
+	Compactions []entity.Compaction
+}
+
+// Implemented by services whose history reads may run alongside writes,
+// without the API lock, so a version read separately from its link or the
+// record's erasures might not match them.
+type HistoryReader interface {
+	// GetHistory reads the given version of a record, or every remaining
+	// version if version is 0, like GetVersionedRecord and
+	// GetAllRecordVersions do, in one snapshot with their links and the
+	// record's erasures and compactions.
+	GetHistory(ctx context.Context, id int64, version int) (RecordHistory, error)
+}
+
+// Persists responses keyed by a client-provided Idempotency-Key so that
+// retried writes can be answered without being applied twice.
+type IdempotencyService interface {
+	// GetIdempotentResponse retrieves the stored response for a key.
+	//
+	// Returns ErrIdempotencyKeyNotFound if the key was never used or has expired.
+	GetIdempotentResponse(ctx context.Context, key string) (entity.IdempotentResponse, error)
+
+	// SaveIdempotentResponse stores a response, replacing any expired entry
+	// for the same key.
+	SaveIdempotentResponse(ctx context.Context, response entity.IdempotentResponse) error
 }
 
+// IdempotentResponder builds the response stored for an Idempotency-Key
+// from the record as written and the link of its version, which can't be
+// read back until the write commits.
+type IdempotentResponder func(record entity.Record, link entity.VersionHash) (entity.IdempotentResponse, error)
+
 // Implements method to get, create, and update record data.
 type RecordServiceV1 interface {
 	RecordServiceBase
+	IdempotencyService
 
 	// GetRecord will retrieve an record.
-	GetRecord(ctx context.Context, id int) (entity.Record, error)
+	GetRecord(ctx context.Context, id int64) (entity.Record, error)
 
 	// CreateRecord will insert a new record.
 	//
@@ -36,7 +116,27 @@ type RecordServiceV1 interface {
 	// if the update[key] is null it will delete that key from the record's Map.
 	//
 	// UpdateRecord will error if id <= 0 or the record does not exist with that id.
-	UpdateRecord(ctx context.Context, id int, updates map[string]*string) (entity.Record, error)
+	UpdateRecord(ctx context.Context, id int64, updates map[string]*string) (entity.Record, error)
+
+	// CreateRecordKeyed and UpdateRecordKeyed are CreateRecord and
+	// UpdateRecord that also store the response respond builds from the
+	// written record, atomically with the write: if either fails, neither
+	// is kept. An update that changes nothing still stores its response.
+	// With a nil respond they're just CreateRecord and UpdateRecord.
+	//
+	// Backends whose API lock doesn't keep writers apart, like Postgres,
+	// claim the key in the write's transaction: if a live response is
+	// already stored for it, they fail with an *IdempotencyKeyUsedError and
+	// write nothing. Others rely on the caller looking the key up under
+	// the API lock first.
+	CreateRecordKeyed(ctx context.Context, record entity.Record, respond IdempotentResponder) error
+	UpdateRecordKeyed(ctx context.Context, id int64, updates map[string]*string, respond IdempotentResponder) (entity.Record, error)
+
+	// UpsertRecordKeyed is UpdateRecordKeyed if the record exists, and
+	// otherwise CreateRecordKeyed with the updates that aren't null. A
+	// record created concurrently is updated rather than failing with
+	// ErrRecordAlreadyExists.
+	UpsertRecordKeyed(ctx context.Context, id int64, updates map[string]*string, respond IdempotentResponder) (entity.Record, error)
 }
 
 // Introduce the concept of record versions. Versions will start at 1 and increment per
@@ -47,13 +147,184 @@ type RecordServiceV2 interface {
 
 	// Retrieve a record. If `version` is nil or 0, return the latest version that
 	// exists.
-	GetVersionedRecord(ctx context.Context, id int, version int) (entity.Record, error)
+	//
+	// Fails with ErrRecordDoesNotExist if there's no such record, and with
+	// ErrVersionDoesNotExist if the record exists but the version doesn't,
+	// or with ErrVersionCompacted if retention removed it.
+	GetVersionedRecord(ctx context.Context, id int64, version int) (entity.Record, error)
 
 	// Retrieves all versions of a record.
-	GetAllRecordVersions(ctx context.Context, id int) ([]entity.Record, error)
+	GetAllRecordVersions(ctx context.Context, id int64) ([]entity.Record, error)
+
+	HashChainService
+}
+
+// Every version of a record is hashed as it's written, chaining onto the
+// hash of the version before, so edits to history can be detected.
+type HashChainService interface {
+	// GetVersionHash retrieves the link of one version of a record. Its
+	// Hash is empty if the version was written before history was hashed.
+	//
+	// Fails like GetVersionedRecord, except that version 0 isn't the latest.
+	GetVersionHash(ctx context.Context, id int64, version int) (entity.VersionHash, error)
+
+	// GetVersionHashes retrieves the links of every version of a record,
+	// oldest first.
+	GetVersionHashes(ctx context.Context, id int64) ([]entity.VersionHash, error)
+}
+
+// Stores the API keys callers authenticate with. Unlike record methods,
+// these don't rely on the API lock; implementations synchronize themselves.
+type APIKeyService interface {
+	// CreateAPIKey stores a new key. The key's hash must be unique.
+	CreateAPIKey(ctx context.Context, key entity.APIKey) error
+
+	// GetAPIKeyByHash retrieves the key with that hash, including revoked keys.
+	//
+	// Fails with ErrAPIKeyDoesNotExist if no key has that hash.
+	GetAPIKeyByHash(ctx context.Context, keyHash string) (entity.APIKey, error)
+
+	// ListAPIKeys retrieves every key, oldest first.
+	ListAPIKeys(ctx context.Context) ([]entity.APIKey, error)
+
+	// RevokeAPIKey marks a key as revoked, so it no longer authenticates.
+	//
+	// Fails with ErrAPIKeyDoesNotExist if no key has that id.
+	RevokeAPIKey(ctx context.Context, id string) error
+}
+
+// Purges data from the whole history of records. Like record methods,
+// these rely on the API lock being held for writing.
+type ErasureService interface {
+	// EraseRecord removes the keys from every version of the record, or all
+	// of its keys if wholeRecord is set, along with any stored idempotent
+	// responses for it. Versions keep their numbers; an erased key simply
+	// never existed in any of them. It returns the marker left in the
+	// record's history.
+	//
+	// Fails with ErrRecordDoesNotExist if there's no such record.
+	EraseRecord(ctx context.Context, id int64, keys []string, wholeRecord bool, principal string) (entity.Erasure, error)
+
+	// GetErasures retrieves the markers of every erasure of the record,
+	// oldest first.
+	GetErasures(ctx context.Context, id int64) ([]entity.Erasure, error)
+}
+
+// Implemented by services that compact old history away under a retention
+// policy.
+type CompactionService interface {
+	// GetCompactions retrieves the ranges of versions compacted away from a
+	// record, oldest first.
+	GetCompactions(ctx context.Context, id int64) ([]entity.Compaction, error)
+}
+
+// Implemented by services that can dump every record with its history from
+// a single consistent snapshot, without the API lock if they read
+// snapshots (see SnapshotReader).
+type ExportService interface {
+	// Export calls emit with each record the filter selects, in order of
+	// id, and stops at the first error emit returns. Records aren't all
+	// held in memory at once.
+	Export(ctx context.Context, filter entity.ExportFilter, emit func(entity.ExportedRecord) error) error
+}
+
+// Implemented by services that can take in records along with their
+// histories, such as an export from another server or a legacy system.
+type ImportService interface {
+	RecordServiceBase
+
+	// ImportRecords writes the records and their histories in one
+	// transaction, and returns what became of each record in order: nil if
+	// it was written, or why it wasn't, such as ErrRecordAlreadyExists. The
+	// error returned is for failures that stop the whole batch, none of
+	// which is then written.
+	//
+	// Like record methods, this relies on the API lock being held for
+	// writing.
+	ImportRecords(ctx context.Context, records []entity.ExportedRecord) ([]error, error)
+}
+
+// Implemented by services that can copy their whole database while
+// serving.
+type BackupService interface {
+	// Backup writes a consistent copy of the database to path, which must
+	// not exist yet or be empty. It doesn't need the API lock.
+	Backup(ctx context.Context, path string) error
+
+	// StageBackup writes a copy like Backup to a new file beside the
+	// database, on the same disk, and returns its path. The caller removes
+	// the file.
+	StageBackup(ctx context.Context) (string, error)
 }
 
 type RecordService interface {
 	// The current supported max API level
 	RecordServiceV2
+
+	APIKeyService
+	ErasureService
+}
+
+// upsertRecord is UpsertRecordKeyed for services that rely on the API lock
+// being held for writing, which keeps the record from being created between
+// looking for it and writing it.
+func upsertRecord(
+	ctx context.Context,
+	records RecordServiceV1,
+	id int64,
+	updates map[string]*string,
+	respond IdempotentResponder,
+) (entity.Record, error) {
+	_, err := records.GetRecord(ctx, id)
+	if err == nil {
+		return records.UpdateRecordKeyed(ctx, id, updates, respond)
+	}
+	if !errors.Is(err, ErrRecordDoesNotExist) {
+		return entity.Record{}, err
+	}
+	record := recordFromUpdates(id, updates)
+	if err := records.CreateRecordKeyed(ctx, record, respond); err != nil {
+		return entity.Record{}, err
+	}
+	return record, nil
+}
+
+// recordFromUpdates is the first version of a record created by updates,
+// leaving out the keys they delete.
+func recordFromUpdates(id int64, updates map[string]*string) entity.Record {
+	data := map[string]string{}
+	for key, value := range updates {
+		if value != nil {
+			data[key] = *value
+		}
+	}
+	return entity.Record{ID: id, Data: data, Version: 1}
+}
+
+// VerifyRecord checks a record's history against its hash chain, and its
+// erasure markers, if the service keeps any, against theirs.
+func VerifyRecord(ctx context.Context, records RecordServiceV2, id int64) (entity.Verification, error) {
+	if reader, ok := records.(HistoryReader); ok {
+		history, err := reader.GetHistory(ctx, id, 0)
+		if err != nil {
+			return entity.Verification{}, err
+		}
+		return entity.VerifyHistory(id, history.Versions, history.Links, history.Erasures), nil
+	}
+
+	versions, err := records.GetAllRecordVersions(ctx, id)
+	if err != nil {
+		return entity.Verification{}, err
+	}
+	hashes, err := records.GetVersionHashes(ctx, id)
+	if err != nil {
+		return entity.Verification{}, err
+	}
+	var erasures []entity.Erasure
+	if erasureService, ok := records.(ErasureService); ok {
+		if erasures, err = erasureService.GetErasures(ctx, id); err != nil {
+			return entity.Verification{}, err
+		}
+	}
+	return entity.VerifyHistory(id, versions, hashes, erasures), nil
 }
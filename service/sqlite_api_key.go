@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/temelpa/timetravel/data"
+	"github.com/temelpa/timetravel/entity"
+)
+
+func (s *SQLiteRecordService) CreateAPIKey(
+	ctx context.Context,
+	key entity.APIKey,
+) error {
+	if key.CreatedAt.IsZero() {
+		key.CreatedAt = time.Now()
+	}
+
+	roles, err := json.Marshal(key.Roles)
+	if err != nil {
+		logError(ctx, err)
+		return err
+	}
+
+	queryCtx, done := instrumentQuery(ctx, "insert_api_key")
+	_, err = s.db.ExecContext(
+		queryCtx,
+		data.INSERT_API_KEY,
+		key.ID,
+		key.KeyHash,
+		key.Principal,
+		string(roles),
+		key.CreatedAt.UnixNano(),
+	)
+	done(err)
+	if err != nil {
+		logError(ctx, err)
+		if isConstraintViolation(err) {
+			return fmt.Errorf("api key %s: %w", key.ID, ErrRecordAlreadyExists)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *SQLiteRecordService) GetAPIKeyByHash(
+	ctx context.Context,
+	keyHash string,
+) (entity.APIKey, error) {
+	queryCtx, done := instrumentQuery(ctx, "query_api_key_by_hash")
+	key, err := scanAPIKey(s.db.QueryRowContext(queryCtx, data.QUERY_API_KEY_BY_HASH, keyHash))
+	done(err)
+	if err == sql.ErrNoRows {
+		return entity.APIKey{}, ErrAPIKeyDoesNotExist
+	}
+	if err != nil {
+		logError(ctx, err)
+		return entity.APIKey{}, err
+	}
+	return key, nil
+}
+
+func (s *SQLiteRecordService) ListAPIKeys(
+	ctx context.Context,
+) ([]entity.APIKey, error) {
+	queryCtx, done := instrumentQuery(ctx, "query_api_keys")
+	rows, err := s.db.QueryContext(queryCtx, data.QUERY_API_KEYS)
+	defer func() { done(err) }()
+	if err != nil {
+		logError(ctx, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []entity.APIKey{}
+	for rows.Next() {
+		var key entity.APIKey
+		if key, err = scanAPIKey(rows); err != nil {
+			logError(ctx, err)
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if err = rows.Err(); err != nil {
+		logError(ctx, err)
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *SQLiteRecordService) RevokeAPIKey(
+	ctx context.Context,
+	id string,
+) error {
+	queryCtx, done := instrumentQuery(ctx, "revoke_api_key")
+	result, err := s.db.ExecContext(queryCtx, data.REVOKE_API_KEY, time.Now().UnixNano(), id)
+	done(err)
+	if err != nil {
+		logError(ctx, err)
+		return err
+	}
+
+	if revoked, err := result.RowsAffected(); err != nil || revoked != 0 {
+		return err
+	}
+
+	// Nothing changed: either the key is already revoked, which is fine,
+	// or it never existed
+	var exists int
+	if err := s.db.QueryRowContext(ctx, data.QUERY_API_KEY_EXISTS, id).Scan(&exists); err != nil {
+		logError(ctx, err)
+		return err
+	}
+	if exists == 0 {
+		return fmt.Errorf("api key %s: %w", id, ErrAPIKeyDoesNotExist)
+	}
+	return nil
+}
+
+// scanAPIKey reads a row of the api keys table, in the order of its columns.
+func scanAPIKey(row interface{ Scan(...any) error }) (entity.APIKey, error) {
+	var key entity.APIKey
+	var roles string
+	var createdAt int64
+	var revokedAt sql.NullInt64
+	if err := row.Scan(
+		&key.ID,
+		&key.KeyHash,
+		&key.Principal,
+		&roles,
+		&createdAt,
+		&revokedAt,
+	); err != nil {
+		return entity.APIKey{}, err
+	}
+
+	if err := json.Unmarshal([]byte(roles), &key.Roles); err != nil {
+		return entity.APIKey{}, err
+	}
+	key.CreatedAt = time.Unix(0, createdAt)
+	if revokedAt.Valid {
+		revoked := time.Unix(0, revokedAt.Int64)
+		key.RevokedAt = &revoked
+	}
+	return key, nil
+}
@@ -0,0 +1,271 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/temelpa/timetravel/data"
+	"github.com/temelpa/timetravel/entity"
+)
+
+// Backup writes a copy of the database to path with VACUUM INTO. The copy
+// is of a single snapshot, and in WAL mode writes carry on while it's
+// taken; in the other journal modes they wait for it. path must not exist
+// yet, or be an empty file. Encrypted data stays encrypted in the copy.
+func (s *SQLiteRecordService) Backup(ctx context.Context, path string) error {
+	queryCtx, done := instrumentQuery(ctx, "backup")
+	_, err := s.db.ExecContext(queryCtx, data.BACKUP_INTO, path)
+	done(err)
+	if err != nil {
+		logError(ctx, err)
+		return err
+	}
+	return nil
+}
+
+// StageBackup writes a backup to a new file in the database's directory,
+// where there's likelier to be room for a copy than in the temporary
+// directory, and returns its path.
+func (s *SQLiteRecordService) StageBackup(ctx context.Context) (string, error) {
+	staged, err := os.CreateTemp(s.directory, ".backup-*.db")
+	if err != nil {
+		logError(ctx, err)
+		return "", err
+	}
+	staged.Close()
+	if err := s.Backup(ctx, staged.Name()); err != nil {
+		os.Remove(staged.Name())
+		return "", err
+	}
+	return staged.Name(), nil
+}
+
+// RewindResult counts what rewinding a database changed.
+type RewindResult struct {
+	// Records that lost their versions after the point.
+	Rewound int
+	// Records created after the point, and so removed.
+	Removed int
+}
+
+// RestoreSQLiteBackup replaces the database in sqlDirectory with a copy of
+// the backup, rewound to the point if it's set, and brought up to the
+// current schema. The copy is prepared beside the database and swapped in
+// whole, so a failed restore leaves the database as it was. It fails with
+// ErrDatabaseInUse if a server or anything else has the database open, and
+// nothing can open it until it's done.
+func RestoreSQLiteBackup(
+	ctx context.Context,
+	backup string,
+	sqlDirectory string,
+	settings SQLiteRecordServiceSettings,
+	point entity.RestorePoint,
+) (RewindResult, error) {
+	// The same permissions NewSQLiteRecordService creates it with
+	if err := os.MkdirAll(sqlDirectory, 0644); err != nil {
+		return RewindResult{}, err
+	}
+	lock, err := lockDirectory(sqlDirectory, true)
+	if err != nil {
+		return RewindResult{}, err
+	}
+	defer lock.Close()
+
+	staging, err := os.MkdirTemp(sqlDirectory, ".restore-")
+	if err != nil {
+		return RewindResult{}, err
+	}
+	defer os.RemoveAll(staging)
+	staged := filepath.Join(staging, data.TIMETRAVEL_DB)
+	if err := copyFile(backup, staged); err != nil {
+		return RewindResult{}, err
+	}
+
+	settings.ResetOnStart = false
+	settings.Retention = nil
+	restored, err := NewSQLiteRecordService(staging, settings)
+	if err != nil {
+		return RewindResult{}, err
+	}
+	var result RewindResult
+	if !point.IsZero() {
+		result, err = restored.rewind(ctx, point)
+	}
+	if err == nil {
+		// Everything has to be in the file itself before it's moved
+		_, err = restored.db.ExecContext(ctx, data.CHECKPOINT_WAL)
+	}
+	if closeErr := restored.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return RewindResult{}, err
+	}
+
+	// Journals left by the old database would be applied to the new one
+	dbPath := filepath.Join(sqlDirectory, data.TIMETRAVEL_DB)
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		if err := os.Remove(dbPath + suffix); err != nil && !os.IsNotExist(err) {
+			return RewindResult{}, err
+		}
+	}
+	if err := os.Rename(staged, dbPath); err != nil {
+		return RewindResult{}, err
+	}
+	return result, nil
+}
+
+// copyFile copies from to a new file at to, and syncs it.
+func copyFile(from string, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// rewind trims every version after the point from the database, in one
+// transaction. A record keeps its versions up to the point, and the last of
+// them becomes its current version again; a record created after the point
+// is removed entirely. Stored idempotent responses of those records are
+// dropped, since they may describe trimmed versions. Erasure markers stay,
+// as the erased data doesn't come back.
+func (s *SQLiteRecordService) rewind(ctx context.Context, point entity.RestorePoint) (RewindResult, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logError(ctx, err)
+		return RewindResult{}, err
+	}
+	defer tx.Rollback()
+
+	trimmed, err := queryRecordDeltasAfter(ctx, tx, point)
+	if err != nil {
+		logError(ctx, err)
+		return RewindResult{}, err
+	}
+	ids := make([]int64, 0, len(trimmed))
+	for id := range trimmed {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var result RewindResult
+	for _, id := range ids {
+		removed, err := s.rewindRecord(ctx, tx, id, trimmed[id])
+		if err != nil {
+			logError(ctx, err)
+			return RewindResult{}, err
+		}
+		if removed {
+			result.Removed++
+		} else {
+			result.Rewound++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		logError(ctx, err)
+		return RewindResult{}, err
+	}
+	// Trimmed versions may be written again with other data
+	s.versionCache.clear()
+	return result, nil
+}
+
+// queryRecordDeltasAfter reads, for each record with versions after the
+// point, the first delta row to trim, by versionBeforeDelta.
+func queryRecordDeltasAfter(ctx context.Context, tx *sql.Tx, point entity.RestorePoint) (map[int64]int, error) {
+	query, after := data.QUERY_RECORD_DELTAS_AFTER_SEQUENCE, point.Sequence
+	if point.Sequence == 0 {
+		query, after = data.QUERY_RECORD_DELTAS_AFTER_TIME, point.AsOf.UnixNano()
+	}
+	queryCtx, done := instrumentQuery(ctx, "query_record_deltas_after")
+	rows, err := tx.QueryContext(queryCtx, query, after)
+	defer func() { done(err) }()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	trimmed := map[int64]int{}
+	for rows.Next() {
+		var id int64
+		var versionBeforeDelta int
+		if err = rows.Scan(&id, &versionBeforeDelta); err != nil {
+			return nil, err
+		}
+		trimmed[id] = versionBeforeDelta
+	}
+	err = rows.Err()
+	return trimmed, err
+}
+
+// rewindRecord trims the versions of a record from the one the delta row
+// after firstTrimmed leads to, and reports whether none were left.
+func (s *SQLiteRecordService) rewindRecord(ctx context.Context, tx *sql.Tx, id int64, firstTrimmed int) (bool, error) {
+	versions, _, err := s.loadHistory(ctx, tx, id)
+	if err != nil {
+		return false, err
+	}
+	kept := -1
+	for i, version := range versions {
+		if version.Version <= firstTrimmed {
+			kept = i
+		}
+	}
+
+	exec := func(name string, query string, args ...any) error {
+		queryCtx, done := instrumentQuery(ctx, name)
+		_, err := tx.ExecContext(queryCtx, query, args...)
+		done(err)
+		return err
+	}
+	if err := exec("delete_record_idempotency_keys", data.DELETE_RECORD_IDEMPOTENCY_KEYS, id); err != nil {
+		return false, err
+	}
+	if kept < 0 {
+		for _, statement := range []struct {
+			name  string
+			query string
+			args  []any
+		}{
+			{"delete_record", data.DELETE_RECORD, []any{id}},
+			{"delete_record_deltas_between", data.DELETE_RECORD_DELTAS_BETWEEN, []any{id, math.MinInt64, math.MaxInt64}},
+			{"delete_record_erasures", data.DELETE_RECORD_ERASURES, []any{id}},
+			{"delete_record_compactions_between", data.DELETE_RECORD_COMPACTIONS_BETWEEN, []any{id, math.MinInt64, math.MaxInt64}},
+		} {
+			if err := exec(statement.name, statement.query, statement.args...); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	current := versions[kept]
+	if err := s.updateRecord(ctx, tx, current); err != nil {
+		return false, err
+	}
+	if err := exec("delete_record_deltas_between", data.DELETE_RECORD_DELTAS_BETWEEN, id, firstTrimmed, math.MaxInt64); err != nil {
+		return false, err
+	}
+	err = exec("delete_record_compactions_between", data.DELETE_RECORD_COMPACTIONS_BETWEEN, id, current.Version+1, math.MaxInt64)
+	return false, err
+}
@@ -0,0 +1,278 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/temelpa/timetravel/data"
+	"github.com/temelpa/timetravel/entity"
+	"github.com/temelpa/timetravel/logging"
+	"github.com/temelpa/timetravel/retention"
+)
+
+// How often history is compacted if the settings don't say otherwise.
+const DefaultCompactionInterval = 24 * time.Hour
+
+func (s *SQLiteRecordService) GetCompactions(
+	ctx context.Context,
+	id int64,
+) ([]entity.Compaction, error) {
+	compactions, err := queryCompactions(ctx, s.db, id)
+	if err != nil {
+		logError(ctx, err)
+		return nil, err
+	}
+	return compactions, nil
+}
+
+func queryCompactions(ctx context.Context, db queryer, id int64) ([]entity.Compaction, error) {
+	queryCtx, done := instrumentQuery(ctx, "query_record_compactions")
+	rows, err := db.QueryContext(queryCtx, data.QUERY_RECORD_COMPACTIONS, id)
+	defer func() { done(err) }()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	compactions := []entity.Compaction{}
+	for rows.Next() {
+		var compaction entity.Compaction
+		var compactedAt int64
+		if err = rows.Scan(&compaction.RecordID, &compaction.FromVersion, &compaction.ToVersion, &compactedAt); err != nil {
+			return nil, err
+		}
+		compaction.CompactedAt = time.Unix(0, compactedAt).UTC()
+		compactions = append(compactions, compaction)
+	}
+	err = rows.Err()
+	return compactions, err
+}
+
+func isCompacted(compactions []entity.Compaction, version int) bool {
+	for _, compaction := range compactions {
+		if compaction.Contains(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// compactedThrough returns the first version of the compacted range ending
+// at version, if there is one.
+func compactedThrough(compactions []entity.Compaction, version int) (int, bool) {
+	for _, compaction := range compactions {
+		if compaction.ToVersion == version {
+			return compaction.FromVersion, true
+		}
+	}
+	return 0, false
+}
+
+// Compact removes the versions of every record that the retention policy
+// no longer keeps, and returns how many were removed. Each record is
+// compacted in its own transaction, holding the API lock for writing.
+func (s *SQLiteRecordService) Compact(ctx context.Context) (int, error) {
+	return s.compact(ctx, time.Now())
+}
+
+func (s *SQLiteRecordService) compact(ctx context.Context, now time.Time) (int, error) {
+	if s.retention == nil {
+		return 0, nil
+	}
+
+	queryCtx, done := instrumentQuery(ctx, "query_record_ids")
+	rows, err := s.db.QueryContext(queryCtx, data.QUERY_RECORD_IDS)
+	if err != nil {
+		done(err)
+		return 0, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	done(err)
+	if err != nil {
+		return 0, err
+	}
+
+	compacted := 0
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return compacted, err
+		}
+		rule, ok := s.retention.RuleFor(id)
+		if !ok {
+			continue
+		}
+		n, err := s.compactRecord(ctx, id, rule, now)
+		compacted += n
+		if err != nil {
+			return compacted, err
+		}
+	}
+	return compacted, nil
+}
+
+// compactRecord removes the versions of one record that rule no longer
+// keeps as of now, and returns how many were removed.
+func (s *SQLiteRecordService) compactRecord(ctx context.Context, id int64, rule retention.Rule, now time.Time) (int, error) {
+	s.rwlock.Lock()
+	defer s.rwlock.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	versions, hashes, err := s.loadHistory(ctx, tx, id)
+	if err != nil {
+		return 0, err
+	}
+	createdAt := make([]time.Time, len(hashes))
+	for i, link := range hashes {
+		// Only hashed versions are known to be as old as they claim
+		if link.Hash != "" {
+			createdAt[i] = link.CreatedAt
+		}
+	}
+	keep := rule.Keep(createdAt, now)
+
+	compacted := 0
+	for i := 0; i < len(versions); i++ {
+		if keep[i] {
+			continue
+		}
+		// Collapse the run of dropped versions, and any range compacted
+		// before that it borders, into one range
+		start := i
+		for !keep[i] {
+			i++
+		}
+		from := 1
+		previous := map[string]string{}
+		if start > 0 {
+			from = versions[start-1].Version + 1
+			previous = versions[start-1].Data
+		}
+		next := versions[i]
+		if err := s.compactRange(ctx, tx, id, from, next, previous, now); err != nil {
+			return 0, err
+		}
+		compacted += i - start
+	}
+	if compacted == 0 {
+		return 0, nil
+	}
+
+	// Compacting changes history, so it has to be rehashed. The range
+	// markers are what record that it happened.
+	if err := s.rehash(ctx, tx, id); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	s.versionCache.invalidate(id)
+	return compacted, nil
+}
+
+// compactRange removes versions from up to the one before next, leaving an
+// inverse delta from next straight back to previous, the data of version
+// from - 1, or nothing if from is 1.
+func (s *SQLiteRecordService) compactRange(
+	ctx context.Context,
+	tx *sql.Tx,
+	id int64,
+	from int,
+	next entity.Record,
+	previous map[string]string,
+	now time.Time,
+) error {
+	to := next.Version - 1
+
+	queryCtx, done := instrumentQuery(ctx, "delete_record_deltas_between")
+	_, err := tx.ExecContext(queryCtx, data.DELETE_RECORD_DELTAS_BETWEEN, id, from-1, to-1)
+	done(err)
+	if err != nil {
+		return err
+	}
+
+	// The inverse of an update taking previous to next
+	jsonBytes, err := json.Marshal(entity.Diff(next.Data, previous))
+	if err != nil {
+		return err
+	}
+	aad := rowAAD(data.RECORD_DELTAS_TABLE, strconv.FormatInt(id, 10), strconv.Itoa(to))
+	storedDelta, keyID, err := seal(s.keyring, jsonBytes, aad)
+	if err != nil {
+		return err
+	}
+	queryCtx, done = instrumentQuery(ctx, "update_record_delta")
+	_, err = tx.ExecContext(queryCtx, data.UPDATE_RECORD_DELTA, storedDelta, keyID, id, to)
+	done(err)
+	if err != nil {
+		return err
+	}
+
+	queryCtx, done = instrumentQuery(ctx, "delete_record_compactions_between")
+	_, err = tx.ExecContext(queryCtx, data.DELETE_RECORD_COMPACTIONS_BETWEEN, id, from, to)
+	done(err)
+	if err != nil {
+		return err
+	}
+	queryCtx, done = instrumentQuery(ctx, "insert_record_compaction")
+	_, err = tx.ExecContext(queryCtx, data.INSERT_RECORD_COMPACTION, id, from, to, now.UnixNano())
+	done(err)
+	return err
+}
+
+// StartCompaction compacts history in the background, right away and then
+// every interval (DefaultCompactionInterval if zero), until the service is
+// closed. It does nothing without a retention policy.
+func (s *SQLiteRecordService) StartCompaction(interval time.Duration) {
+	if s.retention == nil || s.stopCompaction != nil {
+		return
+	}
+	if interval <= 0 {
+		interval = DefaultCompactionInterval
+	}
+	var ctx context.Context
+	ctx, s.stopCompaction = context.WithCancel(context.Background())
+	s.compactionDone = make(chan struct{})
+	go s.compactEvery(ctx, interval, s.compactionDone)
+}
+
+// compactEvery compacts history on every tick of interval, and once right
+// away, until ctx is cancelled.
+func (s *SQLiteRecordService) compactEvery(ctx context.Context, interval time.Duration, finished chan<- struct{}) {
+	defer close(finished)
+	logger := logging.FromContext(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		compacted, err := s.Compact(ctx)
+		if err != nil && ctx.Err() == nil {
+			logger.Error("history compaction failed", "versions_compacted", compacted, "error", err)
+		} else if compacted > 0 {
+			logger.Info("history compaction finished", "versions_compacted", compacted)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,40 @@
+//go:build cgo && !sqlite_purego
+
+package service
+
+import (
+	"errors"
+	"strings"
+
+	// This library uses cgo, which can complicate the
+	// build environment and portability of the code, but
+	// offers better performance at larger scales. For lack
+	// of knowning exactly how many records this service will
+	// manage, using this now is a slight bit of future-proofing.
+	// Build with -tags sqlite_purego, or without cgo, to use a
+	// pure Go SQLite instead.
+	"github.com/mattn/go-sqlite3"
+)
+
+// The database/sql driver the SQLite backend opens its database with.
+const sqliteDriver = "sqlite3"
+
+// sqliteDSN returns the data source name opening the database at dbPath,
+// with every connection running the given pragmas. Deleted content is
+// zeroed out instead of left in free pages, so erased data doesn't linger
+// in the file.
+func sqliteDSN(dbPath string, pragmas ...sqlitePragma) string {
+	var dsn strings.Builder
+	dsn.WriteString(dbPath + "?_secure_delete=on")
+	for _, pragma := range pragmas {
+		dsn.WriteString("&_" + pragma.name + "=" + pragma.value)
+	}
+	return dsn.String()
+}
+
+// isConstraintViolation tells whether err is SQLite refusing a write that
+// breaks a constraint, such as inserting a duplicate primary key.
+func isConstraintViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrConstraint
+}
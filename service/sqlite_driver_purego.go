@@ -0,0 +1,39 @@
+//go:build !cgo || sqlite_purego
+
+package service
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	// A translation of SQLite to Go: slower than the C library, but it
+	// builds anywhere Go does, without a C toolchain.
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// The database/sql driver the SQLite backend opens its database with.
+const sqliteDriver = "sqlite"
+
+// sqliteDSN returns the data source name opening the database at dbPath,
+// with every connection running the given pragmas. Deleted content is
+// zeroed out instead of left in free pages, so erased data doesn't linger
+// in the file.
+func sqliteDSN(dbPath string, pragmas ...sqlitePragma) string {
+	var dsn strings.Builder
+	dsn.WriteString("file:" + (&url.URL{Path: dbPath}).EscapedPath() + "?_pragma=secure_delete(on)")
+	for _, pragma := range pragmas {
+		dsn.WriteString("&_pragma=" + pragma.name + "(" + pragma.value + ")")
+	}
+	return dsn.String()
+}
+
+// isConstraintViolation tells whether err is SQLite refusing a write that
+// breaks a constraint, such as inserting a duplicate primary key.
+func isConstraintViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	// The code is extended (e.g. SQLITE_CONSTRAINT_PRIMARYKEY), with the
+	// primary code in its low byte
+	return errors.As(err, &sqliteErr) && sqliteErr.Code()&0xff == sqlite3.SQLITE_CONSTRAINT
+}
@@ -0,0 +1,186 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/temelpa/timetravel/data"
+	"github.com/temelpa/timetravel/encryption"
+	"github.com/temelpa/timetravel/logging"
+)
+
+// ErrEncrypted is returned when reading data encrypted at rest by a server
+// that has no keys configured.
+var ErrEncrypted = errors.New("data is encrypted but no encryption keys are configured")
+
+// How many rows key rotation re-encrypts per statement.
+const rekeyBatchSize = 100
+
+// rowAAD is the associated data a row's payload is encrypted with, so that
+// a ciphertext copied into another row (or table) fails to decrypt.
+func rowAAD(table string, identity ...string) []byte {
+	return []byte(table + ":" + strings.Join(identity, ":"))
+}
+
+// seal prepares a payload for storage, returning what to store along with
+// the id of the key it's encrypted with. Without a keyring the payload is
+// stored as is, with an empty key id.
+func seal(keyring *encryption.Keyring, payload []byte, aad []byte) (string, string, error) {
+	if keyring == nil {
+		return string(payload), "", nil
+	}
+	keyID, ciphertext, err := keyring.Encrypt(payload, aad)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(ciphertext), keyID, nil
+}
+
+// unseal recovers a payload stored by seal.
+func unseal(keyring *encryption.Keyring, stored string, keyID string, aad []byte) ([]byte, error) {
+	if keyID == "" {
+		return []byte(stored), nil
+	}
+	if keyring == nil {
+		return nil, fmt.Errorf("key %q: %w", keyID, ErrEncrypted)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %w", keyID, encryption.ErrDecrypt)
+	}
+	return keyring.Decrypt(keyID, ciphertext, aad)
+}
+
+// A table whose payload column is encrypted, and how to re-encrypt it.
+type encryptedTable struct {
+	name string
+	// Selects a batch of identity columns, the payload and the key id of
+	// rows not under a given key.
+	queryStale string
+	// Sets the payload and key id of a row given by its identity columns,
+	// if its key id and payload are still the given ones.
+	rekey    string
+	identity int
+}
+
+var encryptedTables = []encryptedTable{
+	{data.RECORDS_TABLE, data.QUERY_STALE_RECORDS, data.REKEY_RECORD, 1},
+	{data.RECORD_DELTAS_TABLE, data.QUERY_STALE_RECORD_DELTAS, data.REKEY_RECORD_DELTA, 2},
+	{data.IDEMPOTENCY_KEYS_TABLE, data.QUERY_STALE_IDEMPOTENCY_KEYS, data.REKEY_IDEMPOTENCY_KEY, 1},
+}
+
+// RotateKeys re-encrypts every row whose data isn't under the keyring's
+// current key, including plaintext rows written before encryption was
+// enabled, and returns how many it rewrote. It's safe to run alongside
+// requests: a row rewritten concurrently is left alone, since the write
+// already used the current key.
+//
+// Once it returns without error, keys other than the current one can be
+// dropped from the keyring.
+func (s *SQLiteRecordService) RotateKeys(ctx context.Context) (int64, error) {
+	return rotateKeys(ctx, s.db, s.keyring)
+}
+
+func rotateKeys(ctx context.Context, db *sql.DB, keyring *encryption.Keyring) (int64, error) {
+	if keyring == nil {
+		return 0, nil
+	}
+	var rotated int64
+	for _, table := range encryptedTables {
+		n, err := rotateTable(ctx, db, keyring, table)
+		rotated += n
+		if err != nil {
+			return rotated, fmt.Errorf("rotating keys of %s: %w", table.name, err)
+		}
+	}
+	return rotated, nil
+}
+
+func rotateTable(ctx context.Context, db *sql.DB, keyring *encryption.Keyring, table encryptedTable) (int64, error) {
+	var rotated int64
+	for {
+		stale, err := queryStaleRows(ctx, db, keyring, table)
+		if err != nil || len(stale) == 0 {
+			return rotated, err
+		}
+
+		for _, row := range stale {
+			aad := rowAAD(table.name, row.identity...)
+			payload, err := unseal(keyring, row.payload, row.keyID, aad)
+			if err != nil {
+				return rotated, fmt.Errorf("row %v: %w", row.identity, err)
+			}
+			sealed, keyID, err := seal(keyring, payload, aad)
+			if err != nil {
+				return rotated, err
+			}
+
+			args := []any{sealed, keyID}
+			for _, column := range row.identity {
+				args = append(args, column)
+			}
+			args = append(args, row.keyID, row.payload)
+
+			queryCtx, done := instrumentQuery(ctx, "rekey_"+table.name)
+			result, err := db.ExecContext(queryCtx, table.rekey, args...)
+			done(err)
+			if err != nil {
+				return rotated, err
+			}
+			if n, err := result.RowsAffected(); err == nil {
+				rotated += n
+			}
+		}
+	}
+}
+
+type staleRow struct {
+	identity []string
+	payload  string
+	keyID    string
+}
+
+func queryStaleRows(ctx context.Context, db *sql.DB, keyring *encryption.Keyring, table encryptedTable) ([]staleRow, error) {
+	queryCtx, done := instrumentQuery(ctx, "query_stale_"+table.name)
+	rows, err := db.QueryContext(queryCtx, table.queryStale, keyring.CurrentKeyID(), rekeyBatchSize)
+	defer func() { done(err) }()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stale []staleRow
+	for rows.Next() {
+		row := staleRow{identity: make([]string, table.identity)}
+		dest := make([]any, 0, table.identity+2)
+		for i := range row.identity {
+			dest = append(dest, &row.identity[i])
+		}
+		dest = append(dest, &row.payload, &row.keyID)
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		stale = append(stale, row)
+	}
+	err = rows.Err()
+	return stale, err
+}
+
+// rotateInBackground re-encrypts stale rows until done or ctx is canceled,
+// then closes finished.
+func rotateInBackground(ctx context.Context, db *sql.DB, keyring *encryption.Keyring, finished chan<- struct{}) {
+	defer close(finished)
+	logger := logging.FromContext(ctx).With("current_key_id", keyring.CurrentKeyID())
+	rotated, err := rotateKeys(ctx, db, keyring)
+	if err != nil && ctx.Err() == nil {
+		logger.Error("key rotation failed", "rows_rotated", rotated, "error", err)
+		return
+	}
+	if rotated > 0 {
+		logger.Info("key rotation finished", "rows_rotated", rotated)
+	}
+}
@@ -0,0 +1,289 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/temelpa/timetravel/data"
+	"github.com/temelpa/timetravel/entity"
+)
+
+func (s *SQLiteRecordService) EraseRecord(
+	ctx context.Context,
+	id int64,
+	keys []string,
+	wholeRecord bool,
+	principal string,
+) (entity.Erasure, error) {
+	// Everything happens in one transaction, so an erasure is never
+	// half-applied across versions
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logError(ctx, err)
+		return entity.Erasure{}, err
+	}
+	defer tx.Rollback()
+
+	erasure, err := s.erase(ctx, tx, id, keys, wholeRecord, principal)
+	if err != nil {
+		logError(ctx, err)
+		return entity.Erasure{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		logError(ctx, err)
+		return entity.Erasure{}, err
+	}
+	s.versionCache.invalidate(id)
+	return erasure, nil
+}
+
+func (s *SQLiteRecordService) erase(
+	ctx context.Context,
+	tx *sql.Tx,
+	id int64,
+	keys []string,
+	wholeRecord bool,
+	principal string,
+) (entity.Erasure, error) {
+	recordAAD := rowAAD(data.RECORDS_TABLE, strconv.FormatInt(id, 10))
+	var version int
+	var storedData, keyID string
+	queryCtx, done := instrumentQuery(ctx, "query_record")
+	err := tx.QueryRowContext(queryCtx, data.QUERY_RECORD, id).Scan(&id, &version, &storedData, &keyID)
+	done(err)
+	if err == sql.ErrNoRows {
+		return entity.Erasure{}, fmt.Errorf("record %d: %w", id, ErrRecordDoesNotExist)
+	}
+	if err != nil {
+		return entity.Erasure{}, err
+	}
+
+	jsonBytes, err := unseal(s.keyring, storedData, keyID, recordAAD)
+	if err != nil {
+		return entity.Erasure{}, fmt.Errorf("record %d: %w", id, err)
+	}
+	var current map[string]string
+	if err := json.Unmarshal(jsonBytes, &current); err != nil {
+		return entity.Erasure{}, err
+	}
+
+	deltas, err := s.queryAllDeltas(ctx, tx, id)
+	if err != nil {
+		return entity.Erasure{}, err
+	}
+
+	erased := map[string]bool{}
+	for _, key := range keys {
+		erased[key] = true
+	}
+	if wholeRecord {
+		for key := range current {
+			erased[key] = true
+		}
+		for _, delta := range deltas {
+			for key := range delta {
+				erased[key] = true
+			}
+		}
+	}
+
+	for key := range erased {
+		delete(current, key)
+	}
+	if jsonBytes, err = json.Marshal(current); err != nil {
+		return entity.Erasure{}, err
+	}
+	if storedData, keyID, err = seal(s.keyring, jsonBytes, recordAAD); err != nil {
+		return entity.Erasure{}, err
+	}
+	queryCtx, done = instrumentQuery(ctx, "update_record")
+	_, err = tx.ExecContext(queryCtx, data.UPDATE_RECORD, version, storedData, keyID, id)
+	done(err)
+	if err != nil {
+		return entity.Erasure{}, err
+	}
+
+	for versionBeforeDelta, delta := range deltas {
+		for key := range erased {
+			delete(delta, key)
+		}
+		if err := s.updateDelta(ctx, tx, id, versionBeforeDelta, delta); err != nil {
+			return entity.Erasure{}, err
+		}
+	}
+
+	// Erasing changes history, so it has to be rehashed. The marker below
+	// is what records that it happened.
+	if err := s.rehash(ctx, tx, id); err != nil {
+		return entity.Erasure{}, err
+	}
+
+	queryCtx, done = instrumentQuery(ctx, "delete_record_idempotency_keys")
+	_, err = tx.ExecContext(queryCtx, data.DELETE_RECORD_IDEMPOTENCY_KEYS, id)
+	done(err)
+	if err != nil {
+		return entity.Erasure{}, err
+	}
+
+	previous, err := queryErasures(ctx, tx, id)
+	if err != nil {
+		return entity.Erasure{}, err
+	}
+	erasure := entity.Erasure{
+		RecordID:    id,
+		Sequence:    len(previous) + 1,
+		AtVersion:   version,
+		Keys:        []string{},
+		WholeRecord: wholeRecord,
+		Principal:   principal,
+		ErasedAt:    time.Now().UTC(),
+	}
+	for key := range erased {
+		erasure.Keys = append(erasure.Keys, key)
+	}
+	sort.Strings(erasure.Keys)
+	if len(previous) > 0 {
+		erasure.PreviousHash = previous[len(previous)-1].Hash
+	}
+	erasure.Hash = erasure.ComputeHash()
+
+	keysJSON, err := json.Marshal(erasure.Keys)
+	if err != nil {
+		return entity.Erasure{}, err
+	}
+	queryCtx, done = instrumentQuery(ctx, "insert_record_erasure")
+	_, err = tx.ExecContext(
+		queryCtx,
+		data.INSERT_RECORD_ERASURE,
+		erasure.RecordID,
+		erasure.Sequence,
+		erasure.AtVersion,
+		string(keysJSON),
+		erasure.WholeRecord,
+		erasure.Principal,
+		erasure.ErasedAt.UnixNano(),
+		erasure.PreviousHash,
+		erasure.Hash,
+	)
+	done(err)
+	if err != nil {
+		return entity.Erasure{}, err
+	}
+	return erasure, nil
+}
+
+// queryAllDeltas reads every inverse delta of a record, by the version
+// before the delta.
+func (s *SQLiteRecordService) queryAllDeltas(ctx context.Context, tx *sql.Tx, id int64) (map[int]map[string]*string, error) {
+	queryCtx, done := instrumentQuery(ctx, "query_all_record_deltas")
+	rows, err := tx.QueryContext(queryCtx, data.QUERY_ALL_RECORD_DELTAS, id)
+	defer func() { done(err) }()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deltas := map[int]map[string]*string{}
+	for rows.Next() {
+		var versionBeforeDelta int
+		var storedDelta, keyID string
+		if err = rows.Scan(&versionBeforeDelta, &storedDelta, &keyID); err != nil {
+			return nil, err
+		}
+		aad := rowAAD(data.RECORD_DELTAS_TABLE, strconv.FormatInt(id, 10), strconv.Itoa(versionBeforeDelta))
+		var jsonBytes []byte
+		if jsonBytes, err = unseal(s.keyring, storedDelta, keyID, aad); err != nil {
+			return nil, fmt.Errorf("record %d version %d: %w", id, versionBeforeDelta, err)
+		}
+		var delta map[string]*string
+		if err = json.Unmarshal(jsonBytes, &delta); err != nil {
+			return nil, err
+		}
+		deltas[versionBeforeDelta] = delta
+	}
+	err = rows.Err()
+	return deltas, err
+}
+
+// updateDelta overwrites a stored inverse delta.
+func (s *SQLiteRecordService) updateDelta(
+	ctx context.Context,
+	tx *sql.Tx,
+	id int64,
+	versionBeforeDelta int,
+	delta map[string]*string,
+) error {
+	jsonBytes, err := json.Marshal(delta)
+	if err != nil {
+		return err
+	}
+	aad := rowAAD(data.RECORD_DELTAS_TABLE, strconv.FormatInt(id, 10), strconv.Itoa(versionBeforeDelta))
+	storedDelta, keyID, err := seal(s.keyring, jsonBytes, aad)
+	if err != nil {
+		return err
+	}
+
+	queryCtx, done := instrumentQuery(ctx, "update_record_delta")
+	_, err = tx.ExecContext(queryCtx, data.UPDATE_RECORD_DELTA, storedDelta, keyID, id, versionBeforeDelta)
+	done(err)
+	return err
+}
+
+func (s *SQLiteRecordService) GetErasures(
+	ctx context.Context,
+	id int64,
+) ([]entity.Erasure, error) {
+	erasures, err := queryErasures(ctx, s.db, id)
+	if err != nil {
+		logError(ctx, err)
+		return nil, err
+	}
+	return erasures, nil
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+func queryErasures(ctx context.Context, db queryer, id int64) ([]entity.Erasure, error) {
+	queryCtx, done := instrumentQuery(ctx, "query_record_erasures")
+	rows, err := db.QueryContext(queryCtx, data.QUERY_RECORD_ERASURES, id)
+	defer func() { done(err) }()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	erasures := []entity.Erasure{}
+	for rows.Next() {
+		var erasure entity.Erasure
+		var keys string
+		var erasedAt int64
+		if err = rows.Scan(
+			&erasure.RecordID,
+			&erasure.Sequence,
+			&erasure.AtVersion,
+			&keys,
+			&erasure.WholeRecord,
+			&erasure.Principal,
+			&erasedAt,
+			&erasure.PreviousHash,
+			&erasure.Hash,
+		); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(keys), &erasure.Keys); err != nil {
+			return nil, err
+		}
+		erasure.ErasedAt = time.Unix(0, erasedAt).UTC()
+		erasures = append(erasures, erasure)
+	}
+	err = rows.Err()
+	return erasures, err
+}
@@ -0,0 +1,159 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"math"
+
+	"github.com/temelpa/timetravel/data"
+	"github.com/temelpa/timetravel/entity"
+)
+
+// How many record ids Export reads at a time.
+const exportBatchSize = 500
+
+// Export reads every record in one transaction of the read pool, so in WAL
+// mode the whole export is a snapshot of the last commit before it began,
+// and writes go on meanwhile. Only a batch of ids and the history of one
+// record are held in memory at a time.
+func (s *SQLiteRecordService) Export(
+	ctx context.Context,
+	filter entity.ExportFilter,
+	emit func(entity.ExportedRecord) error,
+) error {
+	tx, err := s.readDB.BeginTx(ctx, nil)
+	if err != nil {
+		logError(ctx, err)
+		return err
+	}
+	defer tx.Rollback()
+
+	ids := entity.IDRange{Min: math.MinInt64, Max: math.MaxInt64}
+	if filter.IDs != nil {
+		ids = *filter.IDs
+	}
+	for {
+		batch, err := queryRecordIDsBetween(ctx, tx, ids)
+		if err != nil {
+			logError(ctx, err)
+			return err
+		}
+		for _, id := range batch {
+			record, err := s.exportRecord(ctx, tx, id, filter)
+			if err != nil {
+				logError(ctx, err)
+				return err
+			}
+			if len(record.Versions) == 0 {
+				continue
+			}
+			if err := emit(record); err != nil {
+				return err
+			}
+		}
+		if len(batch) < exportBatchSize || batch[len(batch)-1] == ids.Max {
+			return nil
+		}
+		ids.Min = batch[len(batch)-1] + 1
+	}
+}
+
+// queryRecordIDsBetween reads up to exportBatchSize ids in the range, lowest
+// first.
+func queryRecordIDsBetween(ctx context.Context, tx *sql.Tx, ids entity.IDRange) ([]int64, error) {
+	queryCtx, done := instrumentQuery(ctx, "query_record_ids_between")
+	rows, err := tx.QueryContext(queryCtx, data.QUERY_RECORD_IDS_BETWEEN, ids.Min, ids.Max, exportBatchSize)
+	defer func() { done(err) }()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	batch := make([]int64, 0, exportBatchSize)
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		batch = append(batch, id)
+	}
+	err = rows.Err()
+	return batch, err
+}
+
+// exportRecord reads the history of one record within tx, leaving out
+// versions the filter doesn't include.
+func (s *SQLiteRecordService) exportRecord(
+	ctx context.Context,
+	tx *sql.Tx,
+	id int64,
+	filter entity.ExportFilter,
+) (entity.ExportedRecord, error) {
+	versions, hashes, err := s.loadHistory(ctx, tx, id)
+	if err != nil {
+		return entity.ExportedRecord{}, err
+	}
+	provenance, err := queryRecordProvenance(ctx, tx, id)
+	if err != nil {
+		return entity.ExportedRecord{}, err
+	}
+	record := entity.ExportedRecord{ID: id, Versions: []entity.ExportedVersion{}}
+	for i, version := range versions {
+		link := hashes[i]
+		if !filter.Includes(link) {
+			break
+		}
+		exported := entity.ExportedVersion{
+			Version:  version.Version,
+			Data:     version.Data,
+			Hash:     link.Hash,
+			Author:   provenance[version.Version].author,
+			Sequence: provenance[version.Version].sequence,
+		}
+		if link.Hash != "" {
+			createdAt := link.CreatedAt
+			exported.CreatedAt = &createdAt
+		}
+		record.Versions = append(record.Versions, exported)
+	}
+
+	// Markers are kept whatever the filter, since they say why data is
+	// missing from versions before them too
+	if record.Erasures, err = queryErasures(ctx, tx, id); err != nil {
+		return entity.ExportedRecord{}, err
+	}
+	if record.Compactions, err = queryCompactions(ctx, tx, id); err != nil {
+		return entity.ExportedRecord{}, err
+	}
+	return record, nil
+}
+
+// Where a version came from, as far as the database knows.
+type versionProvenance struct {
+	sequence int64
+	author   string
+}
+
+// queryRecordProvenance reads the sequence and author of a record's
+// versions, by version.
+func queryRecordProvenance(ctx context.Context, tx *sql.Tx, id int64) (map[int]versionProvenance, error) {
+	queryCtx, done := instrumentQuery(ctx, "query_record_delta_provenance")
+	rows, err := tx.QueryContext(queryCtx, data.QUERY_RECORD_DELTA_PROVENANCE, id)
+	defer func() { done(err) }()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	provenance := map[int]versionProvenance{}
+	for rows.Next() {
+		var versionBeforeDelta int
+		var version versionProvenance
+		if err = rows.Scan(&versionBeforeDelta, &version.sequence, &version.author); err != nil {
+			return nil, err
+		}
+		provenance[versionBeforeDelta+1] = version
+	}
+	err = rows.Err()
+	return provenance, err
+}
@@ -0,0 +1,365 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/temelpa/timetravel/data"
+	"github.com/temelpa/timetravel/entity"
+	"github.com/temelpa/timetravel/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// newVersionHash links a version that changed the record from previous,
+// written now, onto the version before it.
+func newVersionHash(previousHash string, record entity.Record, previous map[string]string) entity.VersionHash {
+	createdAt := time.Now().UTC()
+	return entity.VersionHash{
+		Version:   record.Version,
+		CreatedAt: createdAt,
+		Hash:      entity.HashVersion(previousHash, record.ID, record.Version, createdAt, entity.Diff(previous, record.Data)),
+	}
+}
+
+func (s *SQLiteRecordService) GetVersionHash(
+	ctx context.Context,
+	id int64,
+	version int,
+) (entity.VersionHash, error) {
+	var hash string
+	var createdAt int64
+	queryCtx, done := instrumentQuery(ctx, "query_record_delta_hash")
+	err := s.statements.queryRecordDeltaHash.QueryRowContext(queryCtx, id, version-1).Scan(&hash, &createdAt)
+	done(err)
+	if err == nil {
+		return entity.VersionHash{Version: version, CreatedAt: time.Unix(0, createdAt).UTC(), Hash: hash}, nil
+	}
+	if err != sql.ErrNoRows {
+		logError(ctx, err)
+		return entity.VersionHash{}, err
+	}
+
+	// Without a row, it's a version from before history was hashed, one
+	// compacted away, or no version at all
+	currentVersion, err := s.queryRecordVersion(ctx, id)
+	if err != nil {
+		return entity.VersionHash{}, err
+	}
+	if version <= 0 || version > currentVersion {
+		return entity.VersionHash{}, fmt.Errorf("record %d version %d: %w", id, version, ErrVersionDoesNotExist)
+	}
+	compactions, err := queryCompactions(ctx, s.db, id)
+	if err != nil {
+		logError(ctx, err)
+		return entity.VersionHash{}, err
+	}
+	if isCompacted(compactions, version) {
+		return entity.VersionHash{}, fmt.Errorf("record %d version %d: %w", id, version, ErrVersionCompacted)
+	}
+	return entity.VersionHash{Version: version}, nil
+}
+
+func (s *SQLiteRecordService) GetVersionHashes(
+	ctx context.Context,
+	id int64,
+) ([]entity.VersionHash, error) {
+	currentVersion, err := s.queryRecordVersion(ctx, id)
+	if err != nil {
+		return []entity.VersionHash{}, err
+	}
+	compactions, err := queryCompactions(ctx, s.db, id)
+	if err != nil {
+		logError(ctx, err)
+		return []entity.VersionHash{}, err
+	}
+	hashes, err := queryVersionHashes(ctx, s.db, id, currentVersion, compactions)
+	if err != nil {
+		logError(ctx, err)
+		return []entity.VersionHash{}, err
+	}
+	return hashes, nil
+}
+
+func (s *SQLiteRecordService) GetHistory(
+	ctx context.Context,
+	id int64,
+	version int,
+) (RecordHistory, error) {
+	generation := s.versionCache.generation()
+	var cached entity.Record
+	var cachedLink entity.VersionHash
+	var hit bool
+	if version != 0 {
+		cached, cachedLink, hit = s.versionCache.get(id, version)
+		if s.versionCache != nil {
+			tracing.Annotate(ctx, attribute.Bool("version_cache.hit", hit))
+		}
+	}
+
+	// In WAL mode, reads don't take the API lock, so everything is read in
+	// one transaction of the read pool lest an erasure land in between
+	tx, err := s.readDB.BeginTx(ctx, nil)
+	if err != nil {
+		logError(ctx, err)
+		return RecordHistory{}, err
+	}
+	defer tx.Rollback()
+
+	var currentVersion int
+	queryCtx, done := instrumentQuery(ctx, "query_record_version")
+	err = tx.QueryRowContext(queryCtx, data.QUERY_RECORD_VERSION, id).Scan(&currentVersion)
+	done(err)
+	if err == sql.ErrNoRows {
+		return RecordHistory{}, fmt.Errorf("record %d: %w", id, ErrRecordDoesNotExist)
+	}
+	var history RecordHistory
+	if err == nil {
+		history.Compactions, err = queryCompactions(ctx, tx, id)
+	}
+	var hashes []entity.VersionHash
+	if err == nil {
+		hashes, err = queryVersionHashes(ctx, tx, id, currentVersion, history.Compactions)
+	}
+	if err == nil {
+		history.Erasures, err = queryErasures(ctx, tx, id)
+	}
+	if err != nil {
+		logError(ctx, err)
+		return RecordHistory{}, err
+	}
+
+	// A cached version is only served if its link is the one in this
+	// snapshot, since an erasure rewrites the links of what it changes
+	if hit {
+		history.Versions = []entity.Record{cached}
+		if link := linksOf(history.Versions, hashes)[0]; link.Hash != "" && link.Hash == cachedLink.Hash {
+			history.Links = []entity.VersionHash{link}
+			return history, nil
+		}
+	}
+
+	if version == 0 {
+		history.Versions, err = s.readRecordVersions(ctx, tx, id, 1, 0)
+	} else {
+		history.Versions, err = s.readRecordVersions(ctx, tx, id, version, 1)
+	}
+	if err != nil {
+		return RecordHistory{}, err
+	}
+	if len(history.Versions) == 0 {
+		return RecordHistory{}, fmt.Errorf("record %d version %d: %w", id, version, ErrVersionDoesNotExist)
+	}
+	history.Links = linksOf(history.Versions, hashes)
+	if version != 0 {
+		s.versionCache.put(generation, history.Versions[0], history.Links[0])
+	}
+	return history, nil
+}
+
+// linksOf picks the link of each of versions out of hashes.
+func linksOf(versions []entity.Record, hashes []entity.VersionHash) []entity.VersionHash {
+	byVersion := make(map[int]entity.VersionHash, len(hashes))
+	for _, link := range hashes {
+		byVersion[link.Version] = link
+	}
+	links := make([]entity.VersionHash, len(versions))
+	for i, version := range versions {
+		links[i] = byVersion[version.Version]
+		links[i].Version = version.Version
+	}
+	return links
+}
+
+func (s *SQLiteRecordService) queryRecordVersion(ctx context.Context, id int64) (int, error) {
+	var version int
+	queryCtx, done := instrumentQuery(ctx, "query_record_version")
+	err := s.db.QueryRowContext(queryCtx, data.QUERY_RECORD_VERSION, id).Scan(&version)
+	done(err)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("record %d: %w", id, ErrRecordDoesNotExist)
+	}
+	if err != nil {
+		logError(ctx, err)
+		return 0, err
+	}
+	return version, nil
+}
+
+// queryVersionHashes reads the links of versions 1 to currentVersion of a
+// record, bar compacted ones, filling in empty ones for versions that have
+// no row.
+func queryVersionHashes(
+	ctx context.Context,
+	db queryer,
+	id int64,
+	currentVersion int,
+	compactions []entity.Compaction,
+) ([]entity.VersionHash, error) {
+	hashes := make([]entity.VersionHash, currentVersion)
+	for i := range hashes {
+		hashes[i].Version = i + 1
+	}
+
+	queryCtx, done := instrumentQuery(ctx, "query_record_delta_hashes")
+	rows, err := db.QueryContext(queryCtx, data.QUERY_RECORD_DELTA_HASHES, id)
+	defer func() { done(err) }()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var versionBeforeDelta int
+		var hash string
+		var createdAt int64
+		if err = rows.Scan(&versionBeforeDelta, &hash, &createdAt); err != nil {
+			return nil, err
+		}
+		if versionBeforeDelta < 0 || versionBeforeDelta >= currentVersion {
+			continue
+		}
+		hashes[versionBeforeDelta] = entity.VersionHash{
+			Version:   versionBeforeDelta + 1,
+			CreatedAt: time.Unix(0, createdAt).UTC(),
+			Hash:      hash,
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	remaining := []entity.VersionHash{}
+	for _, link := range hashes {
+		if !isCompacted(compactions, link.Version) {
+			remaining = append(remaining, link)
+		}
+	}
+	return remaining, nil
+}
+
+// VerifyAll checks the history of every record in the database, in order
+// of id, reporting each outcome as it goes. A record that can't be read,
+// e.g. because its data no longer decrypts, is reported with the error.
+func (s *SQLiteRecordService) VerifyAll(ctx context.Context, report func(entity.Verification, error)) error {
+	queryCtx, done := instrumentQuery(ctx, "query_record_ids")
+	rows, err := s.db.QueryContext(queryCtx, data.QUERY_RECORD_IDS)
+	if err != nil {
+		done(err)
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	done(err)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		verification, err := VerifyRecord(ctx, s, id)
+		if err != nil {
+			verification = entity.Verification{RecordID: id}
+		}
+		report(verification, err)
+	}
+	return nil
+}
+
+// loadHistory reconstructs every remaining version of a record within tx,
+// oldest first, along with their links.
+func (s *SQLiteRecordService) loadHistory(
+	ctx context.Context,
+	tx *sql.Tx,
+	id int64,
+) ([]entity.Record, []entity.VersionHash, error) {
+	var current entity.Record
+	var storedData, keyID string
+	queryCtx, done := instrumentQuery(ctx, "query_record")
+	err := tx.QueryRowContext(queryCtx, data.QUERY_RECORD, id).Scan(&current.ID, &current.Version, &storedData, &keyID)
+	done(err)
+	if err == sql.ErrNoRows {
+		return nil, nil, fmt.Errorf("record %d: %w", id, ErrRecordDoesNotExist)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	jsonBytes, err := unseal(s.keyring, storedData, keyID, rowAAD(data.RECORDS_TABLE, strconv.FormatInt(id, 10)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("record %d: %w", id, err)
+	}
+	if err := json.Unmarshal(jsonBytes, &current.Data); err != nil {
+		return nil, nil, err
+	}
+
+	deltas, err := s.queryAllDeltas(ctx, tx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	compactions, err := queryCompactions(ctx, tx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes, err := queryVersionHashes(ctx, tx, id, current.Version, compactions)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	versionsBeforeDelta := make([]int, 0, len(deltas))
+	for versionBeforeDelta := range deltas {
+		versionsBeforeDelta = append(versionsBeforeDelta, versionBeforeDelta)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versionsBeforeDelta)))
+
+	states := map[int]entity.Record{current.Version: current.Copy()}
+	record := current.Copy()
+	for _, versionBeforeDelta := range versionsBeforeDelta {
+		record.ApplyUpdate(deltas[versionBeforeDelta])
+		record.Version = versionBeforeDelta
+		if from, ok := compactedThrough(compactions, versionBeforeDelta); ok {
+			record.Version = from - 1
+		}
+		states[record.Version] = record.Copy()
+	}
+
+	versions := make([]entity.Record, len(hashes))
+	for i, link := range hashes {
+		versions[i] = states[link.Version]
+	}
+	return versions, hashes, nil
+}
+
+// rehash recomputes the hash chain of a record within tx, after its history
+// was rewritten. Versions that were never hashed stay unhashed.
+func (s *SQLiteRecordService) rehash(ctx context.Context, tx *sql.Tx, id int64) error {
+	versions, hashes, err := s.loadHistory(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	for i, link := range entity.ChainHashes(id, versions, hashes) {
+		if link.Hash == hashes[i].Hash {
+			continue
+		}
+		queryCtx, done := instrumentQuery(ctx, "update_record_delta_hash")
+		_, err = tx.ExecContext(queryCtx, data.UPDATE_RECORD_DELTA_HASH, link.Hash, id, link.Version-1)
+		done(err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/temelpa/timetravel/data"
+	"github.com/temelpa/timetravel/entity"
+)
+
+// ImportRecords writes each record's current version, an inverse delta for
+// every version with the link its timestamp gives it, and its erasure
+// markers as they are. Records that are invalid or already exist are
+// skipped without writing anything of them.
+func (s *SQLiteRecordService) ImportRecords(ctx context.Context, records []entity.ExportedRecord) ([]error, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logError(ctx, err)
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	errs := make([]error, len(records))
+	for i, record := range records {
+		links, err := record.ImportLinks()
+		if err != nil {
+			errs[i] = fmt.Errorf("record %d: %w", record.ID, err)
+			continue
+		}
+		var version int
+		queryCtx, done := instrumentQuery(ctx, "query_record_version")
+		err = tx.QueryRowContext(queryCtx, data.QUERY_RECORD_VERSION, record.ID).Scan(&version)
+		if err == sql.ErrNoRows {
+			err = nil
+		} else if err == nil {
+			errs[i] = fmt.Errorf("record %d: %w", record.ID, ErrRecordAlreadyExists)
+		}
+		done(err)
+		if err != nil {
+			logError(ctx, err)
+			return nil, err
+		}
+		if errs[i] != nil {
+			continue
+		}
+		if err := s.importRecord(ctx, tx, record, links); err != nil {
+			logError(ctx, err)
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		logError(ctx, err)
+		return nil, err
+	}
+	return errs, nil
+}
+
+// importRecord writes one record that ImportLinks has checked.
+func (s *SQLiteRecordService) importRecord(
+	ctx context.Context,
+	tx *sql.Tx,
+	record entity.ExportedRecord,
+	links []entity.VersionHash,
+) error {
+	current := record.Versions[len(record.Versions)-1]
+	if current.Data == nil {
+		current.Data = map[string]string{}
+	}
+	jsonBytes, err := json.Marshal(current.Data)
+	if err != nil {
+		return err
+	}
+	storedData, keyID, err := seal(s.keyring, jsonBytes, rowAAD(data.RECORDS_TABLE, strconv.FormatInt(record.ID, 10)))
+	if err != nil {
+		return err
+	}
+	queryCtx, done := instrumentQuery(ctx, "insert_imported_record")
+	_, err = tx.ExecContext(queryCtx, data.INSERT_IMPORTED_RECORD, record.ID, current.Version, storedData, keyID)
+	done(err)
+	if err != nil {
+		return err
+	}
+
+	previous := map[string]string{}
+	for i, version := range record.Versions {
+		inverseDelta := entity.Diff(version.Data, previous)
+		if jsonBytes, err = json.Marshal(inverseDelta); err != nil {
+			return err
+		}
+		aad := rowAAD(data.RECORD_DELTAS_TABLE, strconv.FormatInt(record.ID, 10), strconv.Itoa(i))
+		storedDelta, keyID, err := seal(s.keyring, jsonBytes, aad)
+		if err != nil {
+			return err
+		}
+		var createdAt int64
+		if links[i].Hash != "" {
+			createdAt = links[i].CreatedAt.UnixNano()
+		}
+		queryCtx, done := instrumentQuery(ctx, "insert_imported_record_delta")
+		_, err = tx.ExecContext(
+			queryCtx,
+			data.INSERT_IMPORTED_RECORD_DELTA,
+			record.ID,
+			i,
+			storedDelta,
+			keyID,
+			links[i].Hash,
+			createdAt,
+			version.Author,
+		)
+		done(err)
+		if err != nil {
+			return err
+		}
+		previous = version.Data
+	}
+
+	for _, erasure := range record.Erasures {
+		keysJSON, err := json.Marshal(erasure.Keys)
+		if err != nil {
+			return err
+		}
+		queryCtx, done := instrumentQuery(ctx, "insert_record_erasure")
+		_, err = tx.ExecContext(
+			queryCtx,
+			data.INSERT_RECORD_ERASURE,
+			erasure.RecordID,
+			erasure.Sequence,
+			erasure.AtVersion,
+			string(keysJSON),
+			erasure.WholeRecord,
+			erasure.Principal,
+			erasure.ErasedAt.UnixNano(),
+			erasure.PreviousHash,
+			erasure.Hash,
+		)
+		done(err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
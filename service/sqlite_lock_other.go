@@ -0,0 +1,17 @@
+//go:build !unix
+
+package service
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/temelpa/timetravel/data"
+)
+
+// lockDirectory opens the lock file of the database in sqlDirectory, but
+// can't lock it on this platform, so a restore can't tell whether anything
+// has the database open.
+func lockDirectory(sqlDirectory string, exclusive bool) (*os.File, error) {
+	return os.OpenFile(filepath.Join(sqlDirectory, data.TIMETRAVEL_DB_LOCK), os.O_RDWR|os.O_CREATE, 0644)
+}
@@ -0,0 +1,35 @@
+//go:build unix
+
+package service
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/temelpa/timetravel/data"
+)
+
+// lockDirectory locks the lock file of the database in sqlDirectory,
+// shared by services having it open or exclusively for a restore. It fails
+// with ErrDatabaseInUse rather than waiting if the lock is held the other
+// way. Closing the file releases the lock.
+func lockDirectory(sqlDirectory string, exclusive bool) (*os.File, error) {
+	file, err := os.OpenFile(filepath.Join(sqlDirectory, data.TIMETRAVEL_DB_LOCK), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrDatabaseInUse
+		}
+		return nil, err
+	}
+	return file, nil
+}
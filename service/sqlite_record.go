@@ -4,39 +4,196 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"strconv"
 	"sync"
+	"time"
 
-	// This library uses cgo, which can complicate the
-	// build environment and portability of the code, but
-	// offers better performance at larger scales. For lack
-	// of knowning exactly how many records this service will
-	// manage, using this now is a slight bit of future-proofing.
-
-	"github.com/mattn/go-sqlite3"
 	"github.com/temelpa/timetravel/data"
+	"github.com/temelpa/timetravel/encryption"
 	"github.com/temelpa/timetravel/entity"
+	"github.com/temelpa/timetravel/logging"
+	"github.com/temelpa/timetravel/metrics"
+	"github.com/temelpa/timetravel/retention"
+	"github.com/temelpa/timetravel/tracing"
+	"go.opentelemetry.io/otel/attribute"
 
 	"os"
 	"path/filepath"
 )
 
+// Returned when restoring over a database that's open, or opening one that's
+// being restored.
+var ErrDatabaseInUse = errors.New("database is in use")
+
 // SQLiteRecordService is an SQLite-backed record service that
 // persists data between runs of the server.
 type SQLiteRecordService struct {
-	db     *sql.DB
-	rwlock sync.RWMutex
+	// The directory holding the database, where backups are staged.
+	directory string
+	// Holds a shared lock on the database's lock file while it's open.
+	lock       *os.File
+	db         *sql.DB
+	statements *sqliteStatements
+	// In WAL mode, GetRecord, GetVersionedRecord and GetAllRecordVersions
+	// read from a pool of query-only connections of their own, which don't
+	// wait on writes. Otherwise readDB is db.
+	readDB         *sql.DB
+	readStatements *sqliteReadStatements
+	rwlock         sync.RWMutex
+	idempotencyTTL time.Duration
+	keyring        *encryption.Keyring
+	// Versions GetVersionedRecord has reconstructed; nil caches nothing.
+	versionCache *versionCache
+
+	// Stops the key rotation started with the service, and is closed
+	// once it has stopped. Both are nil without encryption.
+	stopRotation context.CancelFunc
+	rotationDone chan struct{}
+
+	// Which old versions Compact removes; nil keeps every version.
+	retention *retention.Policy
+	// Stops the compaction started with StartCompaction, and is closed
+	// once it has stopped. Both are nil until then.
+	stopCompaction context.CancelFunc
+	compactionDone chan struct{}
 }
 
+// How long a stored idempotent response is replayed if the settings
+// don't say otherwise.
+const DefaultIdempotencyKeyTTL = 24 * time.Hour
+
+// How SQLite journals a transaction, so it can be rolled back or recovered
+// after a crash. Modes that risk corrupting the database on a crash, MEMORY
+// and OFF, aren't offered.
+type SQLiteJournalMode string
+
+const (
+	// Writes go to a write-ahead log that's checkpointed into the database
+	// later, so readers aren't blocked by a writer and commits are cheaper.
+	SQLiteJournalWAL SQLiteJournalMode = "wal"
+	// A rollback journal, deleted, truncated or kept at the end of each
+	// transaction: SQLite's default, under which a writer blocks readers.
+	SQLiteJournalDelete   SQLiteJournalMode = "delete"
+	SQLiteJournalTruncate SQLiteJournalMode = "truncate"
+	SQLiteJournalPersist  SQLiteJournalMode = "persist"
+)
+
+// How often SQLite waits for writes to reach the disk. Every level keeps the
+// database from being corrupted by a crash; OFF, which doesn't, isn't
+// offered.
+type SQLiteSynchronous string
+
+const (
+	// In WAL mode, the last commits can be lost to a power failure or an
+	// operating system crash, though not to the process crashing.
+	SQLiteSynchronousNormal SQLiteSynchronous = "normal"
+	// Every commit is on disk before it's acknowledged.
+	SQLiteSynchronousFull SQLiteSynchronous = "full"
+	// FULL, also syncing the directory when a rollback journal is deleted.
+	SQLiteSynchronousExtra SQLiteSynchronous = "extra"
+)
+
+// The connection settings used where SQLiteRecordServiceSettings don't say
+// otherwise: WAL with NORMAL is what SQLite recommends for a busy server.
+const (
+	DefaultSQLiteJournalMode = SQLiteJournalWAL
+	DefaultSQLiteSynchronous = SQLiteSynchronousNormal
+	DefaultSQLiteBusyTimeout = 5 * time.Second
+
+	DefaultSQLiteReadConnections = 8
+)
+
 type SQLiteRecordServiceSettings struct {
 	// When the server is started, should the backing database
 	// be purged?
 	ResetOnStart bool
+
+	// How long responses stored for an Idempotency-Key are replayed.
+	// Zero uses DefaultIdempotencyKeyTTL.
+	IdempotencyKeyTTL time.Duration
+
+	// If set, record data is encrypted at rest with the keyring's current
+	// key, and rows under any other key (or none) are re-encrypted in the
+	// background once the service starts.
+	Keyring *encryption.Keyring
+
+	// Leaves rows under other keys as they are, e.g. for tools that only
+	// read the database.
+	DisableKeyRotation bool
+
+	// If set, Compact and StartCompaction remove the versions it no
+	// longer keeps.
+	Retention *retention.Policy
+
+	// The database's journal mode. Empty uses DefaultSQLiteJournalMode.
+	JournalMode SQLiteJournalMode
+
+	// How durable each commit is. Empty uses DefaultSQLiteSynchronous.
+	Synchronous SQLiteSynchronous
+
+	// How long a connection waits for another holding a lock on the
+	// database, e.g. a tool reading it, before giving up with SQLITE_BUSY.
+	// Zero uses DefaultSQLiteBusyTimeout.
+	BusyTimeout time.Duration
+
+	// How many connections readers may hold open at once in WAL mode.
+	// Zero uses DefaultSQLiteReadConnections.
+	ReadConnections int
+
+	// How many versions GetVersionedRecord keeps in memory once it has
+	// reconstructed them. Zero caches nothing.
+	VersionCacheSize int
+}
+
+// sqlitePragma is a PRAGMA every connection to the database runs when it's
+// opened, passed to the driver through the data source name.
+type sqlitePragma struct {
+	name  string
+	value string
+}
+
+// pragmas returns the connection settings as pragmas, failing on a journal
+// mode or synchronous level that isn't offered.
+func (settings SQLiteRecordServiceSettings) pragmas() ([]sqlitePragma, error) {
+	journalMode := settings.JournalMode
+	if journalMode == "" {
+		journalMode = DefaultSQLiteJournalMode
+	}
+	switch journalMode {
+	case SQLiteJournalWAL, SQLiteJournalDelete, SQLiteJournalTruncate, SQLiteJournalPersist:
+	default:
+		return nil, fmt.Errorf("unknown SQLite journal mode %q", journalMode)
+	}
+
+	synchronous := settings.Synchronous
+	if synchronous == "" {
+		synchronous = DefaultSQLiteSynchronous
+	}
+	switch synchronous {
+	case SQLiteSynchronousNormal, SQLiteSynchronousFull, SQLiteSynchronousExtra:
+	default:
+		return nil, fmt.Errorf("unknown SQLite synchronous level %q", synchronous)
+	}
+
+	busyTimeout := settings.BusyTimeout
+	if busyTimeout <= 0 {
+		busyTimeout = DefaultSQLiteBusyTimeout
+	}
+
+	return []sqlitePragma{
+		{"busy_timeout", strconv.FormatInt(busyTimeout.Milliseconds(), 10)},
+		{"journal_mode", string(journalMode)},
+		{"synchronous", string(synchronous)},
+	}, nil
 }
 
-func logError(err error) {
+// logs an error if it's not nil, tagged with whatever the context's logger
+// carries (request id, route, record id...)
+func logError(ctx context.Context, err error) {
 	if err != nil {
-		log.Printf("error: %v", err)
+		logging.FromContext(ctx).Error("storage operation failed", "error", err)
 	}
 }
 
@@ -44,202 +201,635 @@ func NewSQLiteRecordService(
 	sqlDirectory string,
 	settings SQLiteRecordServiceSettings,
 ) (SQLiteRecordService, error) {
-	dbPath := filepath.Join(sqlDirectory, data.TIMETRAVEL_DB)
-	if settings.ResetOnStart {
-		if err := os.RemoveAll(dbPath); err != nil {
-			logError(err)
-			return SQLiteRecordService{}, err
-		}
+	pragmas, err := settings.pragmas()
+	if err != nil {
+		logError(context.Background(), err)
+		return SQLiteRecordService{}, err
 	}
 
 	// File permissions for the DB directory: R+W for owner, read only otherwise
 	if err := os.MkdirAll(sqlDirectory, 0644); err != nil {
-		logError(err)
+		logError(context.Background(), err)
 		return SQLiteRecordService{}, err
 	}
+	lock, err := lockDirectory(sqlDirectory, false)
+	if err != nil {
+		logError(context.Background(), err)
+		return SQLiteRecordService{}, err
+	}
+	return openSQLiteRecordService(sqlDirectory, settings, pragmas, lock)
+}
+
+// openSQLiteRecordService is NewSQLiteRecordService once the database's
+// directory is locked, releasing the lock if it fails.
+func openSQLiteRecordService(
+	sqlDirectory string,
+	settings SQLiteRecordServiceSettings,
+	pragmas []sqlitePragma,
+	lock *os.File,
+) (_ SQLiteRecordService, err error) {
+	defer func() {
+		if err != nil {
+			lock.Close()
+		}
+	}()
+
+	dbPath := filepath.Join(sqlDirectory, data.TIMETRAVEL_DB)
+	if settings.ResetOnStart {
+		// Along with the write-ahead log and its index, if there are any
+		for _, path := range []string{dbPath, dbPath + "-wal", dbPath + "-shm"} {
+			if err := os.RemoveAll(path); err != nil {
+				logError(context.Background(), err)
+				return SQLiteRecordService{}, err
+			}
+		}
+	}
 
-	db, err := sql.Open("sqlite3", dbPath)
+	db, err := sql.Open(sqliteDriver, sqliteDSN(dbPath, pragmas...))
 	if err != nil {
-		logError(err)
+		logError(context.Background(), err)
 		return SQLiteRecordService{}, err
 	}
 
 	if err := db.Ping(); err != nil {
-		logError(err)
+		logError(context.Background(), err)
+		db.Close()
+		return SQLiteRecordService{}, err
+	}
+
+	if err := migrateSchema(db); err != nil {
+		logError(context.Background(), err)
+		db.Close()
+		return SQLiteRecordService{}, err
+	}
+
+	statements := &sqliteStatements{}
+	if err := prepareAll(context.Background(), db, statements.all()); err != nil {
+		logError(context.Background(), err)
 		db.Close()
 		return SQLiteRecordService{}, err
 	}
 
+	// In WAL mode, each read sees a snapshot of the last commit however
+	// long a write takes, so readers get a pool of their own. Otherwise a
+	// write locks readers out of the file anyway, so they share the pool.
+	readDB := db
+	if settings.JournalMode == "" || settings.JournalMode == SQLiteJournalWAL {
+		readDB, err = openReadPool(dbPath, pragmas, settings.ReadConnections)
+		if err != nil {
+			logError(context.Background(), err)
+			closeAll(statements.all())
+			db.Close()
+			return SQLiteRecordService{}, err
+		}
+	}
+	readStatements := &sqliteReadStatements{}
+	if err := prepareAll(context.Background(), readDB, readStatements.all()); err != nil {
+		logError(context.Background(), err)
+		closeAll(statements.all())
+		if readDB != db {
+			readDB.Close()
+		}
+		db.Close()
+		return SQLiteRecordService{}, err
+	}
+
+	idempotencyTTL := settings.IdempotencyKeyTTL
+	if idempotencyTTL <= 0 {
+		idempotencyTTL = DefaultIdempotencyKeyTTL
+	}
+
+	var stopRotation context.CancelFunc
+	var rotationDone chan struct{}
+	if settings.Keyring != nil && !settings.DisableKeyRotation {
+		var ctx context.Context
+		ctx, stopRotation = context.WithCancel(context.Background())
+		rotationDone = make(chan struct{})
+		go rotateInBackground(ctx, db, settings.Keyring, rotationDone)
+	}
+
+	return SQLiteRecordService{
+		directory:      sqlDirectory,
+		lock:           lock,
+		db:             db,
+		statements:     statements,
+		readDB:         readDB,
+		readStatements: readStatements,
+		rwlock:         sync.RWMutex{},
+		idempotencyTTL: idempotencyTTL,
+		keyring:        settings.Keyring,
+		versionCache:   newVersionCache(settings.VersionCacheSize),
+		stopRotation:   stopRotation,
+		rotationDone:   rotationDone,
+		retention:      settings.Retention,
+	}, nil
+}
+
+// openReadPool opens the pool of query-only connections readers use.
+func openReadPool(dbPath string, pragmas []sqlitePragma, connections int) (*sql.DB, error) {
+	if connections <= 0 {
+		connections = DefaultSQLiteReadConnections
+	}
+	readDB, err := sql.Open(sqliteDriver, sqliteDSN(dbPath, append(pragmas, sqlitePragma{"query_only", "1"})...))
+	if err != nil {
+		return nil, err
+	}
+	readDB.SetMaxOpenConns(connections)
+	readDB.SetMaxIdleConns(connections)
+	if err := readDB.Ping(); err != nil {
+		readDB.Close()
+		return nil, err
+	}
+	return readDB, nil
+}
+
+// migrateSchema creates any missing tables, brings an existing database up
+// to the current schema version, and refuses databases written by a newer
+// server. It all happens in one transaction, so a failed migration leaves
+// the database as it was.
+func migrateSchema(db *sql.DB) error {
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var version, recordsTables int
+	if err := tx.QueryRowContext(ctx, data.QUERY_SCHEMA_VERSION).Scan(&version); err != nil {
+		return err
+	}
+	if err := tx.QueryRowContext(ctx, data.QUERY_RECORDS_TABLE_EXISTS).Scan(&recordsTables); err != nil {
+		return err
+	}
+
+	switch {
+	case version > data.SCHEMA_VERSION:
+		return fmt.Errorf("schema version %d, expected %d: %w", version, data.SCHEMA_VERSION, ErrSchemaVersionMismatch)
+	case recordsTables == 0:
+		// A fresh database; the tables below are created in their current shape
+		version = data.SCHEMA_VERSION
+	case version == 0:
+		version = 1
+	}
+
 	for _, sqlStatement := range []string{
 		data.CREATE_RECORDS_TABLE,
 		data.CREATE_RECORD_DELTAS_TABLE,
+		data.CREATE_IDEMPOTENCY_KEYS_TABLE,
+		data.CREATE_API_KEYS_TABLE,
+		data.CREATE_RECORD_ERASURES_TABLE,
+		data.CREATE_RECORD_COMPACTIONS_TABLE,
 	} {
-		statement, err := db.Prepare(sqlStatement)
-		if err == nil {
-			_, err = statement.Exec()
+		if _, err := tx.ExecContext(ctx, sqlStatement); err != nil {
+			return err
 		}
-		if err != nil {
-			logError(err)
-			db.Close()
-			return SQLiteRecordService{}, err
+	}
+
+	for nextVersion := version + 1; nextVersion <= data.SCHEMA_VERSION; nextVersion++ {
+		for _, sqlStatement := range data.MIGRATIONS[nextVersion] {
+			if _, err := tx.ExecContext(ctx, sqlStatement); err != nil {
+				return fmt.Errorf("migrating to schema version %d: %w", nextVersion, err)
+			}
+		}
+	}
+	for _, sqlStatement := range data.INDEXES {
+		if _, err := tx.ExecContext(ctx, sqlStatement); err != nil {
+			return err
 		}
 	}
 
-	return SQLiteRecordService{db, sync.RWMutex{}}, nil
+	if _, err := tx.ExecContext(ctx, data.UPDATE_SCHEMA_VERSION+strconv.Itoa(data.SCHEMA_VERSION)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func querySchemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRowContext(ctx, data.QUERY_SCHEMA_VERSION).Scan(&version)
+	return version, err
 }
 
 func (s *SQLiteRecordService) GetRWLockForAPI() *sync.RWMutex {
 	return &s.rwlock
 }
 
+// ReadsSnapshots is true in WAL mode, where reads have their own pool and
+// writes commit each version whole.
+func (s *SQLiteRecordService) ReadsSnapshots() bool {
+	return s.readDB != s.db
+}
+
+func (s *SQLiteRecordService) CheckReady(ctx context.Context) error {
+	if err := s.db.PingContext(ctx); err != nil {
+		return err
+	}
+
+	version, err := querySchemaVersion(ctx, s.db)
+	if err != nil {
+		return err
+	}
+	if version != data.SCHEMA_VERSION {
+		return fmt.Errorf("schema version %d, expected %d: %w", version, data.SCHEMA_VERSION, ErrSchemaVersionMismatch)
+	}
+	return nil
+}
+
+// instrumentQuery starts timing and tracing a SQLite statement. Call the
+// returned function with the statement's error once it has finished.
+func instrumentQuery(ctx context.Context, statement string) (context.Context, func(error)) {
+	return instrumentStatement(ctx, "sqlite", statement, metrics.ObserveQuery)
+}
+
+// instrumentStatement starts timing and tracing a statement against the
+// given database system, named as OpenTelemetry's db.system, and records
+// its duration with observe.
+func instrumentStatement(
+	ctx context.Context,
+	system string,
+	statement string,
+	observe func(statement string, start time.Time),
+) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, system+"."+statement,
+		attribute.String("db.system", system),
+		attribute.String("db.operation", statement),
+	)
+	return ctx, func(err error) {
+		observe(statement, start)
+		if err == sql.ErrNoRows {
+			err = nil // an expected outcome, not a failure
+		}
+		tracing.End(span, err)
+	}
+}
+
+// TableSizes counts the rows of every table, for metrics.
+func (s *SQLiteRecordService) TableSizes(ctx context.Context) (map[string]int64, error) {
+	sizes := map[string]int64{}
+	for _, table := range []string{
+		data.RECORDS_TABLE,
+		data.RECORD_DELTAS_TABLE,
+		data.IDEMPOTENCY_KEYS_TABLE,
+		data.API_KEYS_TABLE,
+		data.RECORD_ERASURES_TABLE,
+		data.RECORD_COMPACTIONS_TABLE,
+	} {
+		var rows int64
+		if err := s.db.QueryRowContext(ctx, data.COUNT_ROWS+table).Scan(&rows); err != nil {
+			return nil, err
+		}
+		sizes[table] = rows
+	}
+	return sizes, nil
+}
+
+func (s *SQLiteRecordService) Close() error {
+	if s.stopCompaction != nil {
+		s.stopCompaction()
+		<-s.compactionDone
+	}
+	if s.stopRotation != nil {
+		s.stopRotation()
+		<-s.rotationDone
+	}
+	s.versionCache.clear()
+	closeAll(s.readStatements.all())
+	closeAll(s.statements.all())
+	if s.readDB != s.db {
+		s.readDB.Close()
+	}
+	err := s.db.Close()
+	s.lock.Close()
+	return err
+}
+
 func (s *SQLiteRecordService) GetRecord(
 	ctx context.Context,
-	id int,
+	id int64,
 ) (entity.Record, error) {
-	statement, err := s.db.Prepare(data.QUERY_RECORD)
-	if err != nil {
-		logError(err)
-		return entity.Record{}, err
-	}
-	row := statement.QueryRow(id)
+	return s.queryRecord(ctx, s.readStatements.queryRecord, id)
+}
 
-	var jsonString string
+// queryRecord reads the current version of a record with statement, a
+// QUERY_RECORD prepared against the read pool or a transaction of it.
+func (s *SQLiteRecordService) queryRecord(
+	ctx context.Context,
+	statement *sql.Stmt,
+	id int64,
+) (entity.Record, error) {
+	queryCtx, done := instrumentQuery(ctx, "query_record")
+	row := statement.QueryRowContext(queryCtx, id)
+
+	var storedData, keyID string
 	var recordVersion int
-	if err = row.Scan(&id, &recordVersion, &jsonString); err != nil {
-		logError(err)
+	err := row.Scan(&id, &recordVersion, &storedData, &keyID)
+	done(err)
+	if err != nil {
 		if err == sql.ErrNoRows {
-			err = ErrRecordDoesNotExist
+			return entity.Record{}, fmt.Errorf("record %d: %w", id, ErrRecordDoesNotExist)
 		}
+		logError(ctx, err)
 		return entity.Record{}, err
 	}
 
 	if id == 0 {
-		return entity.Record{}, ErrRecordDoesNotExist
+		return entity.Record{}, fmt.Errorf("record %d: %w", id, ErrRecordDoesNotExist)
 	}
 
-	var data map[string]string
-	if err = json.Unmarshal([]byte(jsonString), &data); err != nil {
-		logError(err)
+	jsonBytes, err := unseal(s.keyring, storedData, keyID, rowAAD(data.RECORDS_TABLE, strconv.FormatInt(id, 10)))
+	if err != nil {
+		err = fmt.Errorf("record %d: %w", id, err)
+		logError(ctx, err)
 		return entity.Record{}, err
 	}
 
-	return entity.Record{ID: id, Version: recordVersion, Data: data}, nil
+	var recordData map[string]string
+	if err = json.Unmarshal(jsonBytes, &recordData); err != nil {
+		logError(ctx, err)
+		return entity.Record{}, err
+	}
+
+	return entity.Record{ID: id, Version: recordVersion, Data: recordData}, nil
 }
 
 func (s *SQLiteRecordService) CreateRecord(
 	ctx context.Context,
 	record entity.Record,
+) error {
+	return s.CreateRecordKeyed(ctx, record, nil)
+}
+
+func (s *SQLiteRecordService) CreateRecordKeyed(
+	ctx context.Context,
+	record entity.Record,
+	respond IdempotentResponder,
 ) error {
 	if record.ID <= 0 {
-		return ErrRecordIDInvalid
+		return fmt.Errorf("record %d: %w", record.ID, ErrRecordIDInvalid)
 	}
 
-	statement, err := s.db.Prepare(data.INSERT_RECORD)
+	jsonBytes, err := json.Marshal(record.Data)
 	if err != nil {
-		logError(err)
+		logError(ctx, err)
+		return err
+	}
+	storedData, keyID, err := seal(s.keyring, jsonBytes, rowAAD(data.RECORDS_TABLE, strconv.FormatInt(record.ID, 10)))
+	if err != nil {
+		logError(ctx, err)
 		return err
 	}
 
-	jsonBytes, err := json.Marshal(record.Data)
+	// The record and its first delta commit together, so readers outside
+	// the API lock never see one without the other
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		logError(err)
+		logError(ctx, err)
 		return err
 	}
+	defer tx.Rollback()
 
-	_, err = statement.Exec(record.ID, string(jsonBytes))
+	queryCtx, done := instrumentQuery(ctx, "insert_record")
+	_, err = tx.StmtContext(ctx, s.statements.insertRecord).ExecContext(queryCtx, record.ID, storedData, keyID)
+	done(err)
 	if err != nil {
-		logError(err)
-		sqliteErr, ok := err.(sqlite3.Error)
-		if ok && sqliteErr.Code == sqlite3.ErrConstraint {
-			err = ErrRecordAlreadyExists
+		logError(ctx, err)
+		if isConstraintViolation(err) {
+			err = fmt.Errorf("record %d: %w", record.ID, ErrRecordAlreadyExists)
 		}
 		return err
 	}
 
+	// The first version gets a delta row too, to carry its hash
+	record.Version = 1
+	creationInverse := map[string]*string{}
+	for key := range record.Data {
+		creationInverse[key] = nil
+	}
+	link := newVersionHash("", record, nil)
+	if err := s.insertRecordDelta(ctx, tx, record.ID, 0, creationInverse, link); err != nil {
+		logError(ctx, err)
+		return err
+	}
+	if err := s.saveResponse(ctx, tx, record, link, respond); err != nil {
+		logError(ctx, err)
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logError(ctx, err)
+		return err
+	}
 	return nil
 }
 
 func (s *SQLiteRecordService) UpdateRecord(
 	ctx context.Context,
-	id int,
+	id int64,
+	updates map[string]*string,
+) (entity.Record, error) {
+	return s.UpdateRecordKeyed(ctx, id, updates, nil)
+}
+
+func (s *SQLiteRecordService) UpsertRecordKeyed(
+	ctx context.Context,
+	id int64,
+	updates map[string]*string,
+	respond IdempotentResponder,
+) (entity.Record, error) {
+	return upsertRecord(ctx, s, id, updates, respond)
+}
+
+func (s *SQLiteRecordService) UpdateRecordKeyed(
+	ctx context.Context,
+	id int64,
 	updates map[string]*string,
+	respond IdempotentResponder,
 ) (entity.Record, error) {
 	entry, err := s.GetRecord(ctx, id)
 	if err != nil {
-		logError(err)
+		logError(ctx, err)
 		return entity.Record{}, err
 	}
 
+	previous := entry.Copy()
 	updateInverse := entry.InverseUpdate(updates)
-	if !entry.ApplyUpdate(updates) {
+	changed := entry.ApplyUpdate(updates)
+	if !changed && respond == nil {
 		return entry, nil
 	}
 
-	if statement, err := s.db.Prepare(data.INSERT_RECORD_DELTA); err == nil {
-		if jsonBytes, err := json.Marshal(updateInverse); err == nil {
-			_, err = statement.Exec(id, entry.Version, string(jsonBytes))
-		}
+	link, err := s.GetVersionHash(ctx, id, previous.Version)
+	if err != nil {
+		logError(ctx, err)
+		return entity.Record{}, err
 	}
+
+	// The delta, the new version and any stored response commit together,
+	// so readers outside the API lock never apply a delta to the version
+	// it came from
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		logError(err)
+		logError(ctx, err)
 		return entity.Record{}, err
 	}
+	defer tx.Rollback()
 
-	entry.Version += 1
-	if statement, err := s.db.Prepare(data.UPDATE_RECORD); err == nil {
-		if jsonBytes, err := json.Marshal(entry.Data); err == nil {
-			_, err = statement.Exec(entry.Version, string(jsonBytes), id)
+	if changed {
+		entry.Version += 1
+		link = newVersionHash(link.Hash, entry, previous.Data)
+		if err := s.insertRecordDelta(ctx, tx, id, previous.Version, updateInverse, link); err != nil {
+			logError(ctx, err)
+			return entity.Record{}, err
+		}
+
+		if err := s.updateRecord(ctx, tx, entry); err != nil {
+			logError(ctx, err)
+			return entity.Record{}, err
 		}
 	}
-	if err != nil {
-		logError(err)
+	if err := s.saveResponse(ctx, tx, entry, link, respond); err != nil {
+		logError(ctx, err)
 		return entity.Record{}, err
 	}
 
+	if err := tx.Commit(); err != nil {
+		logError(ctx, err)
+		return entity.Record{}, err
+	}
 	return entry.Copy(), nil
 }
 
+// insertRecordDelta stores the inverse of the update that took the record
+// past versionBeforeDelta, along with the link of the version it led to.
+func (s *SQLiteRecordService) insertRecordDelta(
+	ctx context.Context,
+	tx *sql.Tx,
+	id int64,
+	versionBeforeDelta int,
+	inverseDelta map[string]*string,
+	link entity.VersionHash,
+) error {
+	jsonBytes, err := json.Marshal(inverseDelta)
+	if err != nil {
+		return err
+	}
+	aad := rowAAD(data.RECORD_DELTAS_TABLE, strconv.FormatInt(id, 10), strconv.Itoa(versionBeforeDelta))
+	storedDelta, keyID, err := seal(s.keyring, jsonBytes, aad)
+	if err != nil {
+		return err
+	}
+
+	queryCtx, done := instrumentQuery(ctx, "insert_record_delta")
+	_, err = tx.StmtContext(ctx, s.statements.insertRecordDelta).ExecContext(
+		queryCtx,
+		id,
+		versionBeforeDelta,
+		storedDelta,
+		keyID,
+		link.Hash,
+		link.CreatedAt.UnixNano(),
+	)
+	done(err)
+	return err
+}
+
+// updateRecord overwrites the current version of the record.
+func (s *SQLiteRecordService) updateRecord(ctx context.Context, tx *sql.Tx, record entity.Record) error {
+	jsonBytes, err := json.Marshal(record.Data)
+	if err != nil {
+		return err
+	}
+	storedData, keyID, err := seal(s.keyring, jsonBytes, rowAAD(data.RECORDS_TABLE, strconv.FormatInt(record.ID, 10)))
+	if err != nil {
+		return err
+	}
+
+	queryCtx, done := instrumentQuery(ctx, "update_record")
+	_, err = tx.StmtContext(ctx, s.statements.updateRecord).ExecContext(queryCtx, record.Version, storedData, keyID, record.ID)
+	done(err)
+	return err
+}
+
 func (s *SQLiteRecordService) GetAllRecordVersions(
 	ctx context.Context,
-	id int,
+	id int64,
 ) ([]entity.Record, error) {
 	return s.getRecordVersions(ctx, id, 1, 0)
 }
 
 func (s *SQLiteRecordService) GetVersionedRecord(
 	ctx context.Context,
-	id int,
+	id int64,
 	version int,
 ) (entity.Record, error) {
+	record, _, ok := s.versionCache.get(id, version)
+	if s.versionCache != nil {
+		tracing.Annotate(ctx, attribute.Bool("version_cache.hit", ok))
+	}
+	if ok {
+		return record, nil
+	}
+	generation := s.versionCache.generation()
 	r, err := s.getRecordVersions(ctx, id, version, 1)
 	if err != nil {
 		return entity.Record{}, err
 	}
 	if len(r) != 1 {
-		// TODO appropriate error here
-		return entity.Record{}, ErrRecordDoesNotExist
+		return entity.Record{}, fmt.Errorf("record %d version %d: %w", id, version, ErrVersionDoesNotExist)
 	}
+	s.versionCache.put(generation, r[0], entity.VersionHash{})
 	return r[0], err
 }
 
 func (s *SQLiteRecordService) getRecordVersions(
 	ctx context.Context,
-	id int,
+	id int64,
 	minVersionToGrab int,
 	numOldestVersionsToGrab int,
 ) ([]entity.Record, error) {
-	entry, err := s.GetRecord(ctx, id)
+	// The record, its compactions and its deltas are read in one
+	// transaction, so they agree even if a write commits meanwhile
+	tx, err := s.readDB.BeginTx(ctx, nil)
 	if err != nil {
-		logError(err)
+		logError(ctx, err)
 		return []entity.Record{}, err
 	}
-	if minVersionToGrab > entry.Version {
-		return []entity.Record{}, ErrRecordDoesNotExist
+	defer tx.Rollback()
+	return s.readRecordVersions(ctx, tx, id, minVersionToGrab, numOldestVersionsToGrab)
+}
+
+// readRecordVersions is getRecordVersions within tx, a transaction of the
+// read pool.
+func (s *SQLiteRecordService) readRecordVersions(
+	ctx context.Context,
+	tx *sql.Tx,
+	id int64,
+	minVersionToGrab int,
+	numOldestVersionsToGrab int,
+) ([]entity.Record, error) {
+	entry, err := s.queryRecord(ctx, tx.StmtContext(ctx, s.readStatements.queryRecord), id)
+	if err != nil {
+		logError(ctx, err)
+		return []entity.Record{}, err
+	}
+	if minVersionToGrab > entry.Version || minVersionToGrab < 0 {
+		return []entity.Record{}, fmt.Errorf("record %d version %d: %w", id, minVersionToGrab, ErrVersionDoesNotExist)
 	}
 
 	if minVersionToGrab == 0 {
 		minVersionToGrab = entry.Version
 	}
+
+	compactions, err := queryCompactions(ctx, tx, id)
+	if err != nil {
+		logError(ctx, err)
+		return []entity.Record{}, err
+	}
+	if numOldestVersionsToGrab == 1 && isCompacted(compactions, minVersionToGrab) {
+		return []entity.Record{}, fmt.Errorf("record %d version %d: %w", id, minVersionToGrab, ErrVersionCompacted)
+	}
 	if numOldestVersionsToGrab == 0 {
 		numOldestVersionsToGrab = entry.Version
 	}
@@ -256,42 +846,192 @@ func (s *SQLiteRecordService) getRecordVersions(
 		}
 	}
 
-	statement, err := s.db.Prepare(data.QUERY_RECORD_DELTAS)
-	if err != nil {
-		logError(err)
-		return []entity.Record{}, err
-	}
-	rows, err := statement.Query(minVersionToGrab, id)
+	// Time the whole scan, since rows are streamed from SQLite as we go
+	queryCtx, done := instrumentQuery(ctx, "query_record_deltas")
+	defer func() { done(err) }()
+	rows, err := tx.StmtContext(ctx, s.readStatements.queryRecordDeltas).QueryContext(queryCtx, minVersionToGrab, id)
 	if err != nil {
-		logError(err)
+		logError(ctx, err)
 		return []entity.Record{}, err
 	}
+	defer rows.Close()
 
+	_, reconstruction := tracing.Start(queryCtx, "reconstruct_versions",
+		attribute.Int64("record.id", id),
+		attribute.Int("record.version.min", minVersionToGrab),
+		attribute.Int("record.version.max", maxVersionToGrab),
+	)
+	deltasApplied := 0
+	defer func() {
+		metrics.ObserveReconstructionDepth(deltasApplied)
+		reconstruction.SetAttributes(attribute.Int("deltas_applied", deltasApplied))
+		tracing.End(reconstruction, err)
+	}()
 	for rows.Next() {
-		var jsonString string
+		var storedDelta, keyID string
 		var versionBeforeUpdate int
 
-		if err = rows.Scan(&id, &versionBeforeUpdate, &jsonString); err != nil {
-			logError(err)
-			if err == sql.ErrNoRows {
-				err = ErrRecordDoesNotExist
-			}
+		if err = rows.Scan(&id, &versionBeforeUpdate, &storedDelta, &keyID); err != nil {
+			logError(ctx, err)
+			return []entity.Record{}, err
+		}
+
+		aad := rowAAD(data.RECORD_DELTAS_TABLE, strconv.FormatInt(id, 10), strconv.Itoa(versionBeforeUpdate))
+		var jsonBytes []byte
+		if jsonBytes, err = unseal(s.keyring, storedDelta, keyID, aad); err != nil {
+			err = fmt.Errorf("record %d version %d: %w", id, versionBeforeUpdate, err)
+			logError(ctx, err)
 			return []entity.Record{}, err
 		}
 
-		var data map[string]*string
-		if err = json.Unmarshal([]byte(jsonString), &data); err != nil {
-			logError(err)
+		var delta map[string]*string
+		if err = json.Unmarshal(jsonBytes, &delta); err != nil {
+			logError(ctx, err)
 			return []entity.Record{}, err
 		}
 
-		entry.ApplyUpdate(data)
+		entry.ApplyUpdate(delta)
 		entry.Version = versionBeforeUpdate
+		// A compacted range's delta leads straight to the version before it
+		if from, ok := compactedThrough(compactions, versionBeforeUpdate); ok {
+			entry.Version = from - 1
+		}
+		deltasApplied++
 
-		if entry.Version <= maxVersionToGrab {
+		if entry.Version >= minVersionToGrab && entry.Version <= maxVersionToGrab {
 			versionedRecords[entry.Version-minVersionToGrab] = entry.Copy()
 		}
 	}
+	if err = rows.Err(); err != nil {
+		logError(ctx, err)
+		return []entity.Record{}, err
+	}
+
+	if len(compactions) == 0 {
+		return versionedRecords, nil
+	}
+	remaining := []entity.Record{}
+	for i, record := range versionedRecords {
+		if !isCompacted(compactions, minVersionToGrab+i) {
+			remaining = append(remaining, record)
+		}
+	}
+	return remaining, nil
+}
+
+func (s *SQLiteRecordService) GetIdempotentResponse(
+	ctx context.Context,
+	key string,
+) (entity.IdempotentResponse, error) {
+	oldestValid := time.Now().Add(-s.idempotencyTTL).UnixNano()
+	queryCtx, done := instrumentQuery(ctx, "query_idempotency_key")
+	row := s.statements.queryIdempotencyKey.QueryRowContext(queryCtx, key, oldestValid)
+
+	var response entity.IdempotentResponse
+	var storedBody, keyID string
+	var createdAt int64
+	err := row.Scan(
+		&response.Key,
+		&response.RequestHash,
+		&response.StatusCode,
+		&storedBody,
+		&createdAt,
+		&keyID,
+		&response.RecordID,
+	)
+	done(err)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return entity.IdempotentResponse{}, ErrIdempotencyKeyNotFound
+		}
+		logError(ctx, err)
+		return entity.IdempotentResponse{}, err
+	}
+
+	response.Body, err = unseal(s.keyring, storedBody, keyID, rowAAD(data.IDEMPOTENCY_KEYS_TABLE, response.Key))
+	if err != nil {
+		logError(ctx, err)
+		return entity.IdempotentResponse{}, err
+	}
+	response.CreatedAt = time.Unix(0, createdAt)
+	return response, nil
+}
+
+func (s *SQLiteRecordService) SaveIdempotentResponse(
+	ctx context.Context,
+	response entity.IdempotentResponse,
+) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logError(ctx, err)
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.saveIdempotentResponse(ctx, tx, response); err != nil {
+		logError(ctx, err)
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		logError(ctx, err)
+		return err
+	}
+	return nil
+}
+
+// saveResponse stores the response respond builds from record within tx,
+// unless respond is nil.
+func (s *SQLiteRecordService) saveResponse(
+	ctx context.Context,
+	tx *sql.Tx,
+	record entity.Record,
+	link entity.VersionHash,
+	respond IdempotentResponder,
+) error {
+	if respond == nil {
+		return nil
+	}
+	response, err := respond(record.Copy(), link)
+	if err != nil {
+		return err
+	}
+	return s.saveIdempotentResponse(ctx, tx, response)
+}
+
+func (s *SQLiteRecordService) saveIdempotentResponse(
+	ctx context.Context,
+	tx *sql.Tx,
+	response entity.IdempotentResponse,
+) error {
+	if response.CreatedAt.IsZero() {
+		response.CreatedAt = time.Now()
+	}
+
+	// Expired keys are only ever read through QUERY_IDEMPOTENCY_KEY, which
+	// already ignores them, so purging them here is purely housekeeping.
+	queryCtx, done := instrumentQuery(ctx, "delete_expired_idempotency_keys")
+	_, err := tx.StmtContext(ctx, s.statements.deleteExpiredIdempotencyKeys).ExecContext(queryCtx, time.Now().Add(-s.idempotencyTTL).UnixNano())
+	done(err)
+	if err != nil {
+		return err
+	}
+
+	storedBody, keyID, err := seal(s.keyring, response.Body, rowAAD(data.IDEMPOTENCY_KEYS_TABLE, response.Key))
+	if err != nil {
+		return err
+	}
 
-	return versionedRecords, nil
+	queryCtx, done = instrumentQuery(ctx, "upsert_idempotency_key")
+	_, err = tx.StmtContext(ctx, s.statements.upsertIdempotencyKey).ExecContext(
+		queryCtx,
+		response.Key,
+		response.RequestHash,
+		response.StatusCode,
+		storedBody,
+		response.CreatedAt.UnixNano(),
+		keyID,
+		response.RecordID,
+	)
+	done(err)
+	return err
 }
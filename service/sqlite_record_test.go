@@ -2,11 +2,24 @@ package service
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/temelpa/timetravel/data"
+	"github.com/temelpa/timetravel/encryption"
 	"github.com/temelpa/timetravel/entity"
+	"github.com/temelpa/timetravel/retention"
 )
 
 // Test basic read + write functionality
@@ -21,7 +34,28 @@ func TestSanitySQL(t *testing.T) {
 	defer func() {
 		os.RemoveAll("testdata")
 	}()
+	testSanity(t, &service)
 
+	service, err = NewSQLiteRecordService(
+		"testdata",
+		SQLiteRecordServiceSettings{ResetOnStart: false},
+	)
+	if err != nil {
+		t.Errorf("Unable to create testing database, got err %v", err)
+	}
+
+	// Test fetching the data and data integrity
+	expected := entity.Record{ID: 42, Version: 3, Data: map[string]string{"goodbye": "unittest"}}
+	if r, err := service.GetRecord(context.Background(), expected.ID); err != nil {
+		t.Errorf("Unable to fetch record for %v, got err %v", expected, err)
+	} else if !cmp.Equal(r, expected) {
+		t.Errorf("Fetched entry %v not the same as %v", r, expected)
+	}
+}
+
+// Shared by every backend: records are created, updated and read back at
+// each version
+func testSanity(t *testing.T, service RecordServiceV2) {
 	testEntity := entity.Record{
 		ID:      42,
 		Version: 1,
@@ -52,7 +86,7 @@ func TestSanitySQL(t *testing.T) {
 	ctx := context.Background()
 
 	// Make sure the system is empty
-	if _, err := service.GetRecord(ctx, testEntity.ID); err != ErrRecordDoesNotExist {
+	if _, err := service.GetRecord(ctx, testEntity.ID); !errors.Is(err, ErrRecordDoesNotExist) {
 		t.Errorf("Should have failed grabbing nonexistant entry, got error %v", err)
 	}
 	if service.CreateRecord(ctx, testEntity) != nil {
@@ -61,7 +95,7 @@ func TestSanitySQL(t *testing.T) {
 
 	// Attempting to create the same record again ought to fail
 	// as well as not mutate the original data
-	if service.CreateRecord(ctx, testEntityUpdate) != ErrRecordAlreadyExists {
+	if !errors.Is(service.CreateRecord(ctx, testEntityUpdate), ErrRecordAlreadyExists) {
 		t.Errorf("Erroneously created second conflicting record %v", testEntityUpdate)
 	}
 
@@ -93,7 +127,7 @@ func TestSanitySQL(t *testing.T) {
 		t.Errorf("Update entry %v not the same as %v", r, testEntityUpdate2)
 	}
 
-	if _, err := service.GetVersionedRecord(ctx, testEntity.ID, 4); err != ErrRecordDoesNotExist {
+	if _, err := service.GetVersionedRecord(ctx, testEntity.ID, 4); !errors.Is(err, ErrVersionDoesNotExist) {
 		t.Errorf("Should have failed grabbing entry for nonexistant version, error %v", err)
 	}
 
@@ -126,20 +160,521 @@ func TestSanitySQL(t *testing.T) {
 	} else if expected := []entity.Record{testEntity, testEntityUpdate, testEntityUpdate2}; !cmp.Equal(rs, expected) {
 		t.Errorf("Failed to grab all versions, got %v, expected %v", rs, expected)
 	}
+}
 
-	service, err = NewSQLiteRecordService(
+// Test that ids at the edges of the 64-bit range are stored and versioned intact
+func TestBoundaryIDsSQL(t *testing.T) {
+	service, err := NewSQLiteRecordService(
+		"testdata",
+		SQLiteRecordServiceSettings{ResetOnStart: true},
+	)
+	if err != nil {
+		t.Errorf("Unable to create testing database, error %v", err)
+	}
+	defer func() {
+		os.RemoveAll("testdata")
+	}()
+	testBoundaryIDs(t, &service)
+}
+
+// Shared by every backend
+func testBoundaryIDs(t *testing.T, service RecordServiceV2) {
+	ctx := context.Background()
+	testValue := "value"
+
+	for _, id := range []int64{1, math.MaxInt32 + 1, math.MaxInt64} {
+		testEntity := entity.Record{ID: id, Version: 1, Data: map[string]string{}}
+		if err := service.CreateRecord(ctx, testEntity); err != nil {
+			t.Errorf("Unable to create record %d, error %v", id, err)
+		}
+		if _, err := service.UpdateRecord(ctx, id, map[string]*string{"key": &testValue}); err != nil {
+			t.Errorf("Unable to update record %d, error %v", id, err)
+		}
+		if r, err := service.GetVersionedRecord(ctx, id, 1); err != nil {
+			t.Errorf("Unable to fetch first version of record %d, error %v", id, err)
+		} else if !cmp.Equal(r, testEntity) {
+			t.Errorf("Fetched entry %v not the same as %v", r, testEntity)
+		}
+	}
+
+	if err := service.CreateRecord(ctx, entity.Record{ID: math.MinInt64}); !errors.Is(err, ErrRecordIDInvalid) {
+		t.Errorf("Should have rejected negative id, got error %v", err)
+	}
+}
+
+// Test that stored idempotent responses are only replayed within their TTL
+func TestIdempotentResponsesSQL(t *testing.T) {
+	service, err := NewSQLiteRecordService(
+		"testdata",
+		SQLiteRecordServiceSettings{ResetOnStart: true, IdempotencyKeyTTL: time.Hour},
+	)
+	if err != nil {
+		t.Errorf("Unable to create testing database, error %v", err)
+	}
+	defer func() {
+		os.RemoveAll("testdata")
+	}()
+	testIdempotentResponses(t, &service)
+}
+
+// Shared by every backend; the service must replay responses for an hour
+func testIdempotentResponses(t *testing.T, service RecordServiceV2) {
+	ctx := context.Background()
+
+	if _, err := service.GetIdempotentResponse(ctx, "key"); !errors.Is(err, ErrIdempotencyKeyNotFound) {
+		t.Errorf("Should have failed grabbing unused key, got error %v", err)
+	}
+
+	response := entity.IdempotentResponse{
+		Key:         "key",
+		RequestHash: "hash",
+		StatusCode:  200,
+		Body:        []byte(`{"id":1}`),
+		CreatedAt:   time.Unix(0, time.Now().UnixNano()),
+	}
+	if err := service.SaveIdempotentResponse(ctx, response); err != nil {
+		t.Errorf("Unable to save idempotent response, error %v", err)
+	}
+	if r, err := service.GetIdempotentResponse(ctx, "key"); err != nil {
+		t.Errorf("Unable to fetch idempotent response, error %v", err)
+	} else if !cmp.Equal(r, response) {
+		t.Errorf("Fetched response %v not the same as %v", r, response)
+	}
+
+	// Responses older than the TTL are treated as if they never existed
+	response.Key = "expired"
+	response.CreatedAt = time.Now().Add(-2 * time.Hour)
+	if err := service.SaveIdempotentResponse(ctx, response); err != nil {
+		t.Errorf("Unable to save idempotent response, error %v", err)
+	}
+	if _, err := service.GetIdempotentResponse(ctx, "expired"); !errors.Is(err, ErrIdempotencyKeyNotFound) {
+		t.Errorf("Should have failed grabbing expired key, got error %v", err)
+	}
+
+	// Keyed writes keep their response only if the write is kept, and the
+	// other way around
+	failed := errors.New("failed")
+	fail := func(record entity.Record, link entity.VersionHash) (entity.IdempotentResponse, error) {
+		return entity.IdempotentResponse{}, failed
+	}
+	var links []entity.VersionHash
+	respond := func(key string) IdempotentResponder {
+		return func(record entity.Record, link entity.VersionHash) (entity.IdempotentResponse, error) {
+			links = append(links, link)
+			return entity.IdempotentResponse{Key: key, RecordID: record.ID, StatusCode: 200, CreatedAt: time.Now()}, nil
+		}
+	}
+	record := entity.Record{ID: 7, Data: map[string]string{"hello": "world"}}
+	if err := service.CreateRecordKeyed(ctx, record, fail); !errors.Is(err, failed) {
+		t.Errorf("Should have failed creating record, got error %v", err)
+	}
+	if _, err := service.GetRecord(ctx, record.ID); !errors.Is(err, ErrRecordDoesNotExist) {
+		t.Errorf("Should not have kept record whose response failed, got error %v", err)
+	}
+	if err := service.CreateRecordKeyed(ctx, record, respond("create")); err != nil {
+		t.Errorf("Unable to create record, error %v", err)
+	}
+	if _, err := service.UpdateRecordKeyed(ctx, record.ID, map[string]*string{"missing": nil}, respond("unchanged")); err != nil {
+		t.Errorf("Unable to update record, error %v", err)
+	}
+	goodbye := "goodbye"
+	if _, err := service.UpdateRecordKeyed(ctx, record.ID, map[string]*string{"hello": &goodbye}, fail); !errors.Is(err, failed) {
+		t.Errorf("Should have failed updating record, got error %v", err)
+	}
+	if r, err := service.GetRecord(ctx, record.ID); err != nil || r.Version != 1 {
+		t.Errorf("Should not have kept update whose response failed, got version %d, error %v", r.Version, err)
+	}
+	for _, key := range []string{"create", "unchanged"} {
+		if _, err := service.GetIdempotentResponse(ctx, key); err != nil {
+			t.Errorf("Unable to fetch idempotent response %q, error %v", key, err)
+		}
+	}
+	// Responders get the link of the version written, or of the current
+	// one if nothing changed
+	link, err := service.GetVersionHash(ctx, record.ID, 1)
+	if err != nil {
+		t.Errorf("Unable to fetch version hash, error %v", err)
+	}
+	if want := []entity.VersionHash{link, link}; !cmp.Equal(links, want) {
+		t.Errorf("Responders got links %v, expected %v", links, want)
+	}
+}
+
+// Test that databases from a newer server are refused, and readiness checks the version
+func TestSchemaVersionSQL(t *testing.T) {
+	service, err := NewSQLiteRecordService(
+		"testdata",
+		SQLiteRecordServiceSettings{ResetOnStart: true},
+	)
+	if err != nil {
+		t.Fatalf("Unable to create testing database, error %v", err)
+	}
+	defer func() {
+		os.RemoveAll("testdata")
+	}()
+
+	ctx := context.Background()
+	if err := service.CheckReady(ctx); err != nil {
+		t.Errorf("Fresh database should be ready, got error %v", err)
+	}
+
+	if _, err := service.db.Exec(data.UPDATE_SCHEMA_VERSION + "9999"); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.CheckReady(ctx); !errors.Is(err, ErrSchemaVersionMismatch) {
+		t.Errorf("Should not be ready on a different schema, got error %v", err)
+	}
+	service.Close()
+
+	if _, err := NewSQLiteRecordService(
 		"testdata",
 		SQLiteRecordServiceSettings{ResetOnStart: false},
+	); !errors.Is(err, ErrSchemaVersionMismatch) {
+		t.Errorf("Should have refused a newer schema, got error %v", err)
+	}
+}
+
+// Test that whichever driver is built in opens the database with deleted
+// content zeroed out
+func TestSecureDeleteSQL(t *testing.T) {
+	service, err := NewSQLiteRecordService(
+		"testdata",
+		SQLiteRecordServiceSettings{ResetOnStart: true},
 	)
 	if err != nil {
-		t.Errorf("Unable to create testing database, got err %v", err)
+		t.Fatalf("Unable to create testing database, error %v", err)
 	}
+	defer func() {
+		os.RemoveAll("testdata")
+	}()
+	defer service.Close()
 
-	// Test fetching the data and data integrity
-	if r, err := service.GetRecord(ctx, testEntity.ID); err != nil {
-		t.Errorf("Unable to fetch record for %v, got err %v", testEntityUpdate2, err)
-	} else if !cmp.Equal(r, testEntityUpdate2) {
-		t.Errorf("Fetched entry %v not the same as %v", r, testEntityUpdate2)
+	var secureDelete int
+	if err := service.db.QueryRow(`PRAGMA secure_delete`).Scan(&secureDelete); err != nil || secureDelete != 1 {
+		t.Errorf("Expected secure_delete on, got %d, error %v", secureDelete, err)
+	}
+}
+
+// Test that every pooled connection runs the configured pragmas, and that
+// ones that could corrupt the database are refused
+func TestConnectionSettingsSQL(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		settings    SQLiteRecordServiceSettings
+		journalMode string
+		synchronous int
+		busyTimeout int
+	}{
+		{SQLiteRecordServiceSettings{}, "wal", 1, 5000},
+		{SQLiteRecordServiceSettings{
+			JournalMode: SQLiteJournalDelete,
+			Synchronous: SQLiteSynchronousFull,
+			BusyTimeout: 250 * time.Millisecond,
+		}, "delete", 2, 250},
+	} {
+		test.settings.ResetOnStart = true
+		service, err := NewSQLiteRecordService(t.TempDir(), test.settings)
+		if err != nil {
+			t.Fatalf("Unable to create testing database, error %v", err)
+		}
+
+		// Hold two connections at once, so the pool has to open a second
+		var conns []*sql.Conn
+		for i := 0; i < 2; i++ {
+			conn, err := service.db.Conn(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conns = append(conns, conn)
+		}
+		for i, conn := range conns {
+			var journalMode string
+			var synchronous, busyTimeout int
+			err := conn.QueryRowContext(ctx, `PRAGMA journal_mode`).Scan(&journalMode)
+			if err == nil {
+				err = conn.QueryRowContext(ctx, `PRAGMA synchronous`).Scan(&synchronous)
+			}
+			if err == nil {
+				err = conn.QueryRowContext(ctx, `PRAGMA busy_timeout`).Scan(&busyTimeout)
+			}
+			if err != nil || journalMode != test.journalMode || synchronous != test.synchronous || busyTimeout != test.busyTimeout {
+				t.Errorf("Expected connection %d with %+v to run journal_mode %s, synchronous %d and busy_timeout %d, got %s, %d and %d, error %v",
+					i, test.settings, test.journalMode, test.synchronous, test.busyTimeout, journalMode, synchronous, busyTimeout, err)
+			}
+			conn.Close()
+		}
+		service.Close()
+	}
+
+	for _, settings := range []SQLiteRecordServiceSettings{
+		{JournalMode: "off"},
+		{JournalMode: "memory"},
+		{Synchronous: "off"},
+		{Synchronous: "full; DROP TABLE records"},
+	} {
+		if _, err := NewSQLiteRecordService(t.TempDir(), settings); err == nil {
+			t.Errorf("Expected %+v to be refused", settings)
+		}
+	}
+}
+
+// Test that readers outside the API lock never see a half-applied update
+// or erasure, however their reads interleave with a writer's
+func TestConcurrentReadsSQL(t *testing.T) {
+	// A small cache, so readers race the writer's invalidations as well
+	service, err := NewSQLiteRecordService(t.TempDir(), SQLiteRecordServiceSettings{VersionCacheSize: 16})
+	if err != nil {
+		t.Fatalf("Unable to create testing database, error %v", err)
+	}
+	defer service.Close()
+	if !service.ReadsSnapshots() {
+		t.Fatal("Expected a WAL database to read snapshots")
+	}
+
+	// Every version v has a and b set to v, odd set if v is odd, and tmp
+	// set to v unless it's been erased since
+	ctx := context.Background()
+	valid := func(record entity.Record) bool {
+		version := strconv.Itoa(record.Version)
+		_, odd := record.Data["odd"]
+		tmp, hasTmp := record.Data["tmp"]
+		keys := 2
+		if odd {
+			keys++
+		}
+		if hasTmp {
+			keys++
+		}
+		return record.Data["a"] == version && record.Data["b"] == version && odd == (record.Version%2 == 1) &&
+			(!hasTmp || tmp == version) && len(record.Data) == keys
+	}
+	if err := service.CreateRecord(ctx, entity.Record{ID: 1, Data: map[string]string{"a": "1", "b": "1", "odd": "yes", "tmp": "1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	const versions = 300
+	var written atomic.Int64
+	written.Store(1)
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for reader := 0; reader < 8; reader++ {
+		readers.Add(1)
+		go func(reader int) {
+			defer readers.Done()
+			var latest int
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// Whatever's been acknowledged must be visible
+				acknowledged := int(written.Load())
+
+				current, err := service.GetRecord(ctx, 1)
+				if err != nil || !valid(current) || current.Version < acknowledged || current.Version < latest {
+					t.Errorf("Reader %d expected a whole version at least %d, got %v, error %v", reader, max(acknowledged, latest), current, err)
+					return
+				}
+				latest = current.Version
+
+				version := 1 + (reader+i)%current.Version
+				old, err := service.GetVersionedRecord(ctx, 1, version)
+				if err != nil || old.Version != version || !valid(old) {
+					t.Errorf("Reader %d expected a whole version %d, got %v, error %v", reader, version, old, err)
+					return
+				}
+
+				history, err := service.GetAllRecordVersions(ctx, 1)
+				if err != nil || len(history) < latest {
+					t.Errorf("Reader %d expected at least %d versions, got %d, error %v", reader, latest, len(history), err)
+					return
+				}
+				for i, record := range history {
+					if record.Version != i+1 || !valid(record) {
+						t.Errorf("Reader %d expected a whole version %d in the history, got %v", reader, i+1, record)
+						return
+					}
+				}
+				latest = len(history)
+
+				// Hashes come from the same snapshot as the versions, so
+				// they verify even as erasures rewrite them
+				single, err := service.GetHistory(ctx, 1, version)
+				if err != nil || len(single.Versions) != 1 || !valid(single.Versions[0]) {
+					t.Errorf("Reader %d expected a whole version %d, got %+v, error %v", reader, version, single, err)
+					return
+				}
+				full, err := service.GetHistory(ctx, 1, 0)
+				if err != nil || len(full.Versions) < latest {
+					t.Errorf("Reader %d expected at least %d versions, got %+v, error %v", reader, latest, full, err)
+					return
+				}
+				if verification := entity.VerifyHistory(1, full.Versions, full.Links, full.Erasures); !verification.Valid {
+					t.Errorf("Reader %d expected the history to verify, got %+v", reader, verification)
+					return
+				}
+				// A version whose link hasn't been rewritten since is the same
+				if single.Links[0].Hash == full.Links[version-1].Hash && !cmp.Equal(single.Versions[0], full.Versions[version-1]) {
+					t.Errorf("Reader %d got version %v with the link of %v", reader, single.Versions[0], full.Versions[version-1])
+					return
+				}
+				latest = len(full.Versions)
+			}
+		}(reader)
+	}
+
+	lock := service.GetRWLockForAPI()
+	for version := 2; version <= versions; version++ {
+		value := strconv.Itoa(version)
+		odd := &value
+		if version%2 == 0 {
+			odd = nil
+		}
+		lock.Lock()
+		_, err := service.UpdateRecord(ctx, 1, map[string]*string{"a": &value, "b": &value, "odd": odd, "tmp": &value})
+		if err == nil && version%10 == 0 {
+			_, err = service.EraseRecord(ctx, 1, []string{"tmp"}, false, "admin")
+		}
+		lock.Unlock()
+		if err != nil {
+			t.Error(err)
+			break
+		}
+		written.Store(int64(version))
+	}
+	close(stop)
+	readers.Wait()
+}
+
+// Test that a database from the first schema version is upgraded in place
+func TestSchemaMigrationSQL(t *testing.T) {
+	defer func() {
+		os.RemoveAll("testdata")
+	}()
+	os.RemoveAll("testdata")
+	if err := os.MkdirAll("testdata", 0755); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open(sqliteDriver, sqliteDSN(filepath.Join("testdata", data.TIMETRAVEL_DB)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range []string{
+		`CREATE TABLE records(id INTEGER PRIMARY KEY AUTOINCREMENT, version INTEGER NOT NULL, jsonData TEXT NOT NULL)`,
+		`CREATE TABLE record_deltas(id INTEGER NOT NULL, versionBeforeDelta INTEGER NOT NULL,
+			inverseDelta TEXT NOT NULL, PRIMARY KEY (id, versionBeforeDelta))`,
+		`CREATE TABLE idempotency_keys(idempotencyKey TEXT PRIMARY KEY, requestHash TEXT NOT NULL,
+			statusCode INTEGER NOT NULL, response TEXT NOT NULL, createdAt INTEGER NOT NULL)`,
+		`INSERT INTO records (id, version, jsonData) VALUES (1, 2, '{"hello":"mars"}')`,
+		`INSERT INTO record_deltas (id, versionBeforeDelta, inverseDelta) VALUES (1, 1, '{"hello":"world"}')`,
+		data.UPDATE_SCHEMA_VERSION + "1",
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	service, err := NewSQLiteRecordService(
+		"testdata",
+		SQLiteRecordServiceSettings{ResetOnStart: false},
+	)
+	if err != nil {
+		t.Fatalf("Should have migrated the database, got error %v", err)
+	}
+	defer service.Close()
+
+	ctx := context.Background()
+	if err := service.CheckReady(ctx); err != nil {
+		t.Errorf("Migrated database should be ready, got error %v", err)
+	}
+	versions, err := service.GetAllRecordVersions(ctx, 1)
+	expected := []entity.Record{
+		{ID: 1, Data: map[string]string{"hello": "world"}, Version: 1},
+		{ID: 1, Data: map[string]string{"hello": "mars"}, Version: 2},
+	}
+	if err != nil || !cmp.Equal(versions, expected) {
+		t.Errorf("Migration should keep records, got %v, error %v", versions, err)
+	}
+	if _, err := service.ListAPIKeys(ctx); err != nil {
+		t.Errorf("Migration should create the api keys table, got error %v", err)
+	}
+
+	// Versions from before hashing can't be verified, but new ones chain on
+	if verification, err := VerifyRecord(ctx, &service, 1); err != nil || !verification.Valid || verification.Unhashed != 2 {
+		t.Errorf("Expected a valid history with 2 unhashed versions, got %+v, error %v", verification, err)
+	}
+	hello := "venus"
+	if _, err := service.UpdateRecord(ctx, 1, map[string]*string{"hello": &hello}); err != nil {
+		t.Fatal(err)
+	}
+	if verification, err := VerifyRecord(ctx, &service, 1); err != nil || !verification.Valid || verification.Unhashed != 2 || verification.Versions != 3 {
+		t.Errorf("Expected a valid history with 2 unhashed versions, got %+v, error %v", verification, err)
+	}
+}
+
+func TestAPIKeysSQL(t *testing.T) {
+	service, err := NewSQLiteRecordService(
+		"testdata",
+		SQLiteRecordServiceSettings{ResetOnStart: true},
+	)
+	if err != nil {
+		t.Fatalf("Unable to create testing database, error %v", err)
+	}
+	defer func() {
+		os.RemoveAll("testdata")
+	}()
+	testAPIKeys(t, &service)
+}
+
+// Shared by both backends: create, look up, list and revoke keys
+func testAPIKeys(t *testing.T, service APIKeyService) {
+	ctx := context.Background()
+
+	if _, err := service.GetAPIKeyByHash(ctx, "nope"); !errors.Is(err, ErrAPIKeyDoesNotExist) {
+		t.Errorf("Should have failed grabbing unknown key, got error %v", err)
+	}
+
+	key := entity.APIKey{
+		ID:        "key1",
+		Principal: "billing",
+		Roles:     []string{"read-current", "write"},
+		KeyHash:   "hash1",
+		CreatedAt: time.Unix(100, 0),
+	}
+	if err := service.CreateAPIKey(ctx, key); err != nil {
+		t.Fatalf("Unable to create key, error %v", err)
+	}
+	if err := service.CreateAPIKey(ctx, key); !errors.Is(err, ErrRecordAlreadyExists) {
+		t.Errorf("Should have refused a duplicate key, got error %v", err)
+	}
+	other := entity.APIKey{ID: "key2", Principal: "ops", Roles: []string{}, KeyHash: "hash2", CreatedAt: time.Unix(200, 0)}
+	if err := service.CreateAPIKey(ctx, other); err != nil {
+		t.Fatalf("Unable to create key, error %v", err)
+	}
+
+	got, err := service.GetAPIKeyByHash(ctx, "hash1")
+	if err != nil || !cmp.Equal(got, key) {
+		t.Errorf("Expected %v, got %v, error %v", key, got, err)
+	}
+
+	keys, err := service.ListAPIKeys(ctx)
+	if err != nil || len(keys) != 2 || keys[0].ID != "key1" || keys[1].ID != "key2" {
+		t.Errorf("Expected both keys oldest first, got %v, error %v", keys, err)
+	}
+
+	if err := service.RevokeAPIKey(ctx, "key1"); err != nil {
+		t.Errorf("Unable to revoke key, error %v", err)
+	}
+	if err := service.RevokeAPIKey(ctx, "key1"); err != nil {
+		t.Errorf("Revoking twice should succeed, got error %v", err)
+	}
+	if err := service.RevokeAPIKey(ctx, "missing"); !errors.Is(err, ErrAPIKeyDoesNotExist) {
+		t.Errorf("Should have failed revoking unknown key, got error %v", err)
+	}
+	if got, err := service.GetAPIKeyByHash(ctx, "hash1"); err != nil || got.RevokedAt == nil {
+		t.Errorf("Key should be revoked, got %v, error %v", got, err)
 	}
 }
 
@@ -167,3 +702,900 @@ func TestUpdateInverse(t *testing.T) {
 		t.Errorf("Expected %v, got %v", expectedInverse, inverse)
 	}
 }
+
+// Test that record data is encrypted at rest, survives key rotation, and
+// that history reconstruction is unaffected
+func TestEncryptionSQL(t *testing.T) {
+	defer func() {
+		os.RemoveAll("testdata")
+	}()
+	ctx := context.Background()
+	oldKey, _ := encryption.NewKey()
+	newKey, _ := encryption.NewKey()
+
+	// Start in plaintext, as a server from before encryption would have
+	service, err := NewSQLiteRecordService(
+		"testdata",
+		SQLiteRecordServiceSettings{ResetOnStart: true},
+	)
+	if err != nil {
+		t.Fatalf("Unable to create testing database, error %v", err)
+	}
+	hello, mars := "world", "mars"
+	if err := service.CreateRecord(ctx, entity.Record{ID: 1, Data: map[string]string{"ssn": "123-45-6789"}, Version: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.UpdateRecord(ctx, 1, map[string]*string{"hello": &hello}); err != nil {
+		t.Fatal(err)
+	}
+	service.Close()
+
+	// countKeyIDs counts rows holding record data by the key they're under
+	countKeyIDs := func(service *SQLiteRecordService) map[string]int {
+		counts := map[string]int{}
+		for _, table := range []string{data.RECORDS_TABLE, data.RECORD_DELTAS_TABLE} {
+			rows, err := service.db.Query(`SELECT keyID FROM ` + table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for rows.Next() {
+				var keyID string
+				rows.Scan(&keyID)
+				counts[keyID]++
+			}
+			rows.Close()
+		}
+		return counts
+	}
+
+	keyring, err := encryption.ParseKeyring("old:" + oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err = NewSQLiteRecordService("testdata", SQLiteRecordServiceSettings{Keyring: keyring})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.RotateKeys(ctx); err != nil {
+		t.Fatalf("Unable to encrypt plaintext rows, error %v", err)
+	}
+	if _, err := service.UpdateRecord(ctx, 1, map[string]*string{"hello": &mars}); err != nil {
+		t.Fatal(err)
+	}
+	if counts := countKeyIDs(&service); !cmp.Equal(counts, map[string]int{"old": 4}) {
+		t.Errorf("Expected every row under the old key, got %v", counts)
+	}
+	var stored string
+	if err := service.db.QueryRow(`SELECT jsonData FROM records WHERE id = 1`).Scan(&stored); err != nil || strings.Contains(stored, "6789") {
+		t.Errorf("Expected record data to be encrypted, got %q, error %v", stored, err)
+	}
+	service.Close()
+
+	keyring, err = encryption.ParseKeyring("new:" + newKey + ",old:" + oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err = NewSQLiteRecordService("testdata", SQLiteRecordServiceSettings{Keyring: keyring})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.RotateKeys(ctx); err != nil {
+		t.Fatalf("Unable to rotate keys, error %v", err)
+	}
+	if counts := countKeyIDs(&service); !cmp.Equal(counts, map[string]int{"new": 4}) {
+		t.Errorf("Expected every row under the new key, got %v", counts)
+	}
+	service.Close()
+
+	// The old key can be dropped once rotation is done
+	keyring, err = encryption.ParseKeyring("new:" + newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err = NewSQLiteRecordService("testdata", SQLiteRecordServiceSettings{Keyring: keyring})
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, err := service.GetAllRecordVersions(ctx, 1)
+	expected := []entity.Record{
+		{ID: 1, Data: map[string]string{"ssn": "123-45-6789"}, Version: 1},
+		{ID: 1, Data: map[string]string{"ssn": "123-45-6789", "hello": "world"}, Version: 2},
+		{ID: 1, Data: map[string]string{"ssn": "123-45-6789", "hello": "mars"}, Version: 3},
+	}
+	if err != nil || !cmp.Equal(versions, expected) {
+		t.Errorf("Expected %v, got %v, error %v", expected, versions, err)
+	}
+
+	// Ciphertext moved to another row doesn't decrypt
+	if _, err := service.db.Exec(`INSERT INTO records (id, version, jsonData, keyID)
+		SELECT 2, version, jsonData, keyID FROM records WHERE id = 1`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.GetRecord(ctx, 2); !errors.Is(err, encryption.ErrDecrypt) {
+		t.Errorf("Expected a copied ciphertext to fail to decrypt, got error %v", err)
+	}
+	service.Close()
+
+	// Without keys, encrypted data can't be read
+	service, err = NewSQLiteRecordService("testdata", SQLiteRecordServiceSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	if _, err := service.GetRecord(ctx, 1); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("Expected encrypted data to be unreadable without keys, got error %v", err)
+	}
+}
+
+func TestErasureSQL(t *testing.T) {
+	key, _ := encryption.NewKey()
+	keyring, err := encryption.ParseKeyring("k1:" + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := NewSQLiteRecordService(
+		"testdata",
+		SQLiteRecordServiceSettings{ResetOnStart: true, Keyring: keyring},
+	)
+	if err != nil {
+		t.Fatalf("Unable to create testing database, error %v", err)
+	}
+	defer func() {
+		service.Close()
+		os.RemoveAll("testdata")
+	}()
+	testErasure(t, &service)
+}
+
+// Shared by both backends: erase keys, then the whole record, from every
+// version, and check the chain of markers left behind
+func testErasure(t *testing.T, service RecordService) {
+	ctx := context.Background()
+	ssn, newSSN, hello := "123-45-6789", "987-65-4321", "world"
+
+	if _, err := service.EraseRecord(ctx, 1, []string{"ssn"}, false, "ops"); !errors.Is(err, ErrRecordDoesNotExist) {
+		t.Errorf("Should have failed erasing nonexistant record, got error %v", err)
+	}
+
+	if err := service.CreateRecord(ctx, entity.Record{ID: 1, Version: 1, Data: map[string]string{"ssn": ssn}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.UpdateRecord(ctx, 1, map[string]*string{"hello": &hello}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.UpdateRecord(ctx, 1, map[string]*string{"ssn": &newSSN}); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.SaveIdempotentResponse(ctx, entity.IdempotentResponse{Key: "k", RecordID: 1, Body: []byte(`{"ssn":"987-65-4321"}`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := service.EraseRecord(ctx, 1, []string{"ssn"}, false, "ops")
+	if err != nil {
+		t.Fatalf("Unable to erase record, error %v", err)
+	}
+	if first.Sequence != 1 || first.AtVersion != 3 || !cmp.Equal(first.Keys, []string{"ssn"}) || first.PreviousHash != "" {
+		t.Errorf("Unexpected erasure marker %+v", first)
+	}
+
+	expected := []entity.Record{
+		{ID: 1, Version: 1, Data: map[string]string{}},
+		{ID: 1, Version: 2, Data: map[string]string{"hello": hello}},
+		{ID: 1, Version: 3, Data: map[string]string{"hello": hello}},
+	}
+	if rs, err := service.GetAllRecordVersions(ctx, 1); err != nil || !cmp.Equal(rs, expected) {
+		t.Errorf("Expected versions %v, got %v, error %v", expected, rs, err)
+	}
+	if _, err := service.GetIdempotentResponse(ctx, "k"); !errors.Is(err, ErrIdempotencyKeyNotFound) {
+		t.Errorf("Erasure should purge the record's idempotent responses, got error %v", err)
+	}
+
+	second, err := service.EraseRecord(ctx, 1, nil, true, "ops")
+	if err != nil {
+		t.Fatalf("Unable to erase whole record, error %v", err)
+	}
+	if second.Sequence != 2 || !cmp.Equal(second.Keys, []string{"hello"}) || second.PreviousHash != first.Hash {
+		t.Errorf("Unexpected erasure marker %+v", second)
+	}
+	for version := 1; version <= 3; version++ {
+		if r, err := service.GetVersionedRecord(ctx, 1, version); err != nil || len(r.Data) != 0 {
+			t.Errorf("Version %d should be empty, got %v, error %v", version, r, err)
+		}
+	}
+
+	erasures, err := service.GetErasures(ctx, 1)
+	if err != nil || !cmp.Equal(erasures, []entity.Erasure{first, second}) {
+		t.Errorf("Expected erasures %v, got %v, error %v", []entity.Erasure{first, second}, erasures, err)
+	}
+	if broken := entity.VerifyErasures(erasures); broken != 0 {
+		t.Errorf("Chain should verify, broke at %d", broken)
+	}
+	erasures[0].Keys = []string{"name"}
+	if broken := entity.VerifyErasures(erasures); broken != 1 {
+		t.Errorf("Tampering should break the chain at 1, broke at %d", broken)
+	}
+}
+
+func TestHashChainSQL(t *testing.T) {
+	service, err := NewSQLiteRecordService(
+		"testdata",
+		SQLiteRecordServiceSettings{ResetOnStart: true},
+	)
+	if err != nil {
+		t.Fatalf("Unable to create testing database, error %v", err)
+	}
+	defer func() {
+		service.Close()
+		os.RemoveAll("testdata")
+	}()
+	testHashChain(t, &service)
+
+	// Editing history behind the service's back is detected
+	ctx := context.Background()
+	if _, err := service.db.Exec(`UPDATE record_deltas SET inverseDelta = '{"hello":"pluto"}' WHERE id = 1 AND versionBeforeDelta = 1`); err != nil {
+		t.Fatal(err)
+	}
+	if verification, err := VerifyRecord(ctx, &service, 1); err != nil || verification.Valid || verification.BrokenVersion != 1 {
+		t.Errorf("Expected the edited version to break the chain, got %+v, error %v", verification, err)
+	}
+	if _, err := service.db.Exec(`UPDATE record_deltas SET hash = '' WHERE id = 2 AND versionBeforeDelta = 1`); err != nil {
+		t.Fatal(err)
+	}
+
+	var reported []entity.Verification
+	err = service.VerifyAll(ctx, func(verification entity.Verification, err error) {
+		if err != nil {
+			t.Errorf("Unable to verify record %d, error %v", verification.RecordID, err)
+		}
+		reported = append(reported, verification)
+	})
+	if err != nil || len(reported) != 2 {
+		t.Fatalf("Expected both records to be verified, got %+v, error %v", reported, err)
+	}
+	if reported[0].RecordID != 1 || reported[0].Valid || reported[1].RecordID != 2 || reported[1].BrokenVersion != 2 {
+		t.Errorf("Expected both records to fail verification, got %+v", reported)
+	}
+}
+
+// Shared by both backends: every version is hashed onto the one before,
+// and erasing data rehashes the chain rather than breaking it
+func testHashChain(t *testing.T, service RecordService) {
+	ctx := context.Background()
+	world, mars := "world", "mars"
+
+	if _, err := service.GetVersionHashes(ctx, 1); !errors.Is(err, ErrRecordDoesNotExist) {
+		t.Errorf("Should have failed hashing nonexistant record, got error %v", err)
+	}
+
+	for _, id := range []int64{1, 2} {
+		if err := service.CreateRecord(ctx, entity.Record{ID: id, Version: 1, Data: map[string]string{"hello": world}}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := service.UpdateRecord(ctx, id, map[string]*string{"hello": &mars, "name": &world}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := service.UpdateRecord(ctx, 1, map[string]*string{"name": nil}); err != nil {
+		t.Fatal(err)
+	}
+
+	hashes, err := service.GetVersionHashes(ctx, 1)
+	if err != nil || len(hashes) != 3 {
+		t.Fatalf("Expected 3 hashes, got %v, error %v", hashes, err)
+	}
+	versions, _ := service.GetAllRecordVersions(ctx, 1)
+	previousHash := ""
+	previous := map[string]string{}
+	for i, link := range hashes {
+		expected := entity.HashVersion(previousHash, 1, i+1, link.CreatedAt, entity.Diff(previous, versions[i].Data))
+		if link.Version != i+1 || link.Hash != expected {
+			t.Errorf("Expected version %d to hash to %s, got %+v", i+1, expected, link)
+		}
+		previousHash, previous = link.Hash, versions[i].Data
+	}
+	if link, err := service.GetVersionHash(ctx, 1, 2); err != nil || !cmp.Equal(link, hashes[1]) {
+		t.Errorf("Expected %+v, got %+v, error %v", hashes[1], link, err)
+	}
+	if _, err := service.GetVersionHash(ctx, 1, 4); !errors.Is(err, ErrVersionDoesNotExist) {
+		t.Errorf("Should have failed hashing nonexistant version, got error %v", err)
+	}
+	if verification, err := VerifyRecord(ctx, service, 1); err != nil || !verification.Valid || verification.Versions != 3 || verification.Unhashed != 0 {
+		t.Errorf("Expected a valid history, got %+v, error %v", verification, err)
+	}
+
+	if _, err := service.EraseRecord(ctx, 2, []string{"name"}, false, "ops"); err != nil {
+		t.Fatal(err)
+	}
+	erased, _ := service.GetVersionHashes(ctx, 2)
+	if erased[0].Hash == "" || erased[1].Hash == "" || erased[1].CreatedAt.IsZero() {
+		t.Errorf("Expected erasure to keep every version hashed, got %+v", erased)
+	}
+	if verification, err := VerifyRecord(ctx, service, 2); err != nil || !verification.Valid {
+		t.Errorf("Expected a valid history after erasure, got %+v, error %v", verification, err)
+	}
+}
+
+// Test that retention compacts old versions away without renumbering the
+// rest, and that history still verifies afterwards
+func TestCompactionSQL(t *testing.T) {
+	service, err := NewSQLiteRecordService(
+		"testdata",
+		SQLiteRecordServiceSettings{ResetOnStart: true},
+	)
+	if err != nil {
+		t.Fatalf("Unable to create testing database, error %v", err)
+	}
+	defer func() {
+		service.Close()
+		os.RemoveAll("testdata")
+	}()
+	ctx := context.Background()
+	now := time.Now()
+
+	// Record 1 is in the claims collection the policy applies to
+	service.retention = &retention.Policy{
+		Collections: map[string][]entity.IDRange{"claims": {{Min: 1, Max: 1}}},
+		Rules: []retention.Rule{
+			{Collections: []string{"claims"}, KeepAllDays: 7 * 365, Snapshots: retention.SnapshotsYearly},
+		},
+	}
+	written := []time.Time{
+		time.Date(2010, 3, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2010, 6, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2011, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2011, 5, 1, 0, 0, 0, 0, time.UTC),
+		now.Add(-24 * time.Hour),
+		now,
+	}
+	b := "x"
+	for _, id := range []int64{1, 2} {
+		if err := service.CreateRecord(ctx, entity.Record{ID: id, Version: 1, Data: map[string]string{"a": "1"}}); err != nil {
+			t.Fatal(err)
+		}
+		for version := 2; version <= 6; version++ {
+			a := strconv.Itoa(version)
+			update := map[string]*string{"a": &a}
+			switch version {
+			case 3:
+				update["b"] = &b
+			case 4:
+				update["b"] = nil
+			}
+			if _, err := service.UpdateRecord(ctx, id, update); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Backdating breaks the chain until compaction rehashes it
+	for i, createdAt := range written {
+		if _, err := service.db.Exec(`UPDATE record_deltas SET createdAt = ? WHERE id = 1 AND versionBeforeDelta = ?`, createdAt.UnixNano(), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Versions 1 and 3 aren't the last of their year
+	if compacted, err := service.compact(ctx, now); err != nil || compacted != 2 {
+		t.Fatalf("Expected 2 versions compacted, got %d, error %v", compacted, err)
+	}
+	for _, version := range []int{1, 3} {
+		if _, err := service.GetVersionedRecord(ctx, 1, version); !errors.Is(err, ErrVersionCompacted) {
+			t.Errorf("Expected version %d to be compacted, got error %v", version, err)
+		}
+		if _, err := service.GetVersionHash(ctx, 1, version); !errors.Is(err, ErrVersionCompacted) {
+			t.Errorf("Expected the hash of version %d to be compacted, got error %v", version, err)
+		}
+	}
+	if _, err := service.GetVersionedRecord(ctx, 1, 7); !errors.Is(err, ErrVersionDoesNotExist) {
+		t.Errorf("Expected version 7 not to exist, got error %v", err)
+	}
+	versions, err := service.GetAllRecordVersions(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []entity.Record{
+		{ID: 1, Version: 2, Data: map[string]string{"a": "2"}},
+		{ID: 1, Version: 4, Data: map[string]string{"a": "4"}},
+		{ID: 1, Version: 5, Data: map[string]string{"a": "5"}},
+		{ID: 1, Version: 6, Data: map[string]string{"a": "6"}},
+	}
+	if diff := cmp.Diff(expected, versions); diff != "" {
+		t.Errorf("Unexpected versions after compaction (-want +got):\n%s", diff)
+	}
+	for _, record := range expected {
+		got, err := service.GetVersionedRecord(ctx, 1, record.Version)
+		if err != nil || !cmp.Equal(record, got) {
+			t.Errorf("Expected version %d to be %+v, got %+v, error %v", record.Version, record, got, err)
+		}
+	}
+	if versions, err := service.GetAllRecordVersions(ctx, 2); err != nil || len(versions) != 6 {
+		t.Errorf("Expected record 2 to keep every version, got %d, error %v", len(versions), err)
+	}
+	for _, id := range []int64{1, 2} {
+		if verification, err := VerifyRecord(ctx, &service, id); err != nil || !verification.Valid {
+			t.Errorf("Expected record %d to verify, got %+v, error %v", id, verification, err)
+		}
+	}
+
+	// Compacting again merges with the earlier ranges, and an erasure
+	// afterwards still rehashes the chain
+	service.retention = &retention.Policy{
+		Rules: []retention.Rule{{KeepAllDays: 30, Snapshots: retention.SnapshotsNone}},
+	}
+	if compacted, err := service.compact(ctx, now); err != nil || compacted != 2 {
+		t.Fatalf("Expected 2 versions compacted, got %d, error %v", compacted, err)
+	}
+	compactions, err := service.GetCompactions(ctx, 1)
+	if err != nil || len(compactions) != 1 || compactions[0].FromVersion != 1 || compactions[0].ToVersion != 4 {
+		t.Errorf("Expected versions 1-4 compacted, got %+v, error %v", compactions, err)
+	}
+	versions, err = service.GetAllRecordVersions(ctx, 1)
+	if err != nil || len(versions) != 2 || versions[0].Version != 5 || versions[0].Data["a"] != "5" {
+		t.Errorf("Expected record 1 to keep versions 5 and 6, got %+v, error %v", versions, err)
+	}
+	if _, err := service.EraseRecord(ctx, 1, []string{"a"}, false, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if verification, err := VerifyRecord(ctx, &service, 1); err != nil || !verification.Valid || verification.Versions != 2 {
+		t.Errorf("Expected the erased record to verify, got %+v, error %v", verification, err)
+	}
+}
+
+// Test that reconstructed versions are cached up to the cache's size, and
+// dropped once an erasure or compaction rewrites their record's history
+func TestVersionCacheSQL(t *testing.T) {
+	service, err := NewSQLiteRecordService(t.TempDir(), SQLiteRecordServiceSettings{VersionCacheSize: 2})
+	if err != nil {
+		t.Fatalf("Unable to create testing database, error %v", err)
+	}
+	defer service.Close()
+	ctx := context.Background()
+	cached := func(version int) bool {
+		_, ok := service.versionCache.entries[1][version]
+		return ok
+	}
+
+	if err := service.CreateRecord(ctx, entity.Record{ID: 1, Version: 1, Data: map[string]string{"a": "1", "secret": "s"}}); err != nil {
+		t.Fatal(err)
+	}
+	for version := 2; version <= 4; version++ {
+		a := strconv.Itoa(version)
+		if _, err := service.UpdateRecord(ctx, 1, map[string]*string{"a": &a}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, version := range []int{1, 2, 1, 3} {
+		record, err := service.GetVersionedRecord(ctx, 1, version)
+		if err != nil || record.Version != version || record.Data["a"] != strconv.Itoa(version) {
+			t.Fatalf("Expected version %d, got %+v, error %v", version, record, err)
+		}
+		// Callers get a copy of what's cached
+		record.Data["a"] = "changed"
+	}
+	// Version 2 was used least recently
+	if !cached(1) || cached(2) || !cached(3) {
+		t.Errorf("Expected versions 1 and 3 cached, got %v", service.versionCache.entries)
+	}
+	if record, err := service.GetVersionedRecord(ctx, 1, 1); err != nil || record.Data["a"] != "1" {
+		t.Errorf("Expected the cached version 1 unchanged, got %+v, error %v", record, err)
+	}
+
+	if _, err := service.EraseRecord(ctx, 1, []string{"secret"}, false, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if cached(1) || cached(3) {
+		t.Errorf("Expected the erasure to drop cached versions, got %v", service.versionCache.entries)
+	}
+	record, err := service.GetVersionedRecord(ctx, 1, 1)
+	if _, ok := record.Data["secret"]; err != nil || ok {
+		t.Errorf("Expected version 1 without the erased key, got %+v, error %v", record, err)
+	}
+
+	// A version read before an erasure committed isn't cached after it
+	generation := service.versionCache.generation()
+	service.versionCache.invalidate(1)
+	service.versionCache.put(generation, entity.Record{ID: 1, Version: 2, Data: map[string]string{"secret": "s"}}, entity.VersionHash{})
+	if cached(2) {
+		t.Error("Expected a version read before an invalidation not to be cached")
+	}
+
+	// Versions 1 and 2 are too old to keep
+	service.retention = &retention.Policy{
+		Rules: []retention.Rule{{KeepAllDays: 30, Snapshots: retention.SnapshotsNone}},
+	}
+	for versionBeforeDelta := 0; versionBeforeDelta < 2; versionBeforeDelta++ {
+		if _, err := service.db.Exec(`UPDATE record_deltas SET createdAt = ? WHERE id = 1 AND versionBeforeDelta = ?`, time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano(), versionBeforeDelta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := service.GetVersionedRecord(ctx, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if compacted, err := service.compact(ctx, time.Now()); err != nil || compacted != 2 {
+		t.Fatalf("Expected 2 versions compacted, got %d, error %v", compacted, err)
+	}
+	for _, version := range []int{1, 2} {
+		if _, err := service.GetVersionedRecord(ctx, 1, version); !errors.Is(err, ErrVersionCompacted) {
+			t.Errorf("Expected version %d to be compacted, got error %v", version, err)
+		}
+	}
+}
+
+// Test that an export holds every record with its history, across batches
+// of ids, filtered by id and time, and unaffected by writes made during it
+func TestExportSQL(t *testing.T) {
+	service, err := NewSQLiteRecordService(t.TempDir(), SQLiteRecordServiceSettings{})
+	if err != nil {
+		t.Fatalf("Unable to create testing database, error %v", err)
+	}
+	defer service.Close()
+	ctx := context.Background()
+
+	// Record 1 has a history; the rest only a first version
+	records := int64(exportBatchSize + 2)
+	for id := int64(1); id <= records; id++ {
+		if err := service.CreateRecord(ctx, entity.Record{ID: id, Version: 1, Data: map[string]string{"a": "1", "ssn": "s"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	two := "2"
+	if _, err := service.UpdateRecord(ctx, 1, map[string]*string{"a": &two}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.EraseRecord(ctx, 1, []string{"ssn"}, false, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	// Everything but the last version of record 1 was written in 2010
+	old := time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := service.db.Exec(`UPDATE record_deltas SET createdAt = ? WHERE NOT (id = 1 AND versionBeforeDelta = 1)`, old.UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"records", "record_deltas"} {
+		if _, err := service.db.Exec(`UPDATE `+table+` SET id = ? WHERE id = ?`, int64(math.MaxInt64), records); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	export := func(filter entity.ExportFilter) []entity.ExportedRecord {
+		exported := []entity.ExportedRecord{}
+		err := service.Export(ctx, filter, func(record entity.ExportedRecord) error {
+			// Writes meanwhile aren't seen by the rest of the export
+			if record.ID == 1 {
+				three := "3"
+				if _, err := service.UpdateRecord(ctx, 2, map[string]*string{"a": &three}); err != nil {
+					return err
+				}
+			}
+			exported = append(exported, record)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return exported
+	}
+
+	exported := export(entity.ExportFilter{})
+	if len(exported) != int(records) || exported[len(exported)-1].ID != math.MaxInt64 {
+		t.Fatalf("Expected %d records up to the highest id, got %d", records, len(exported))
+	}
+	first := exported[0]
+	if len(first.Versions) != 2 || len(first.Erasures) != 1 ||
+		!cmp.Equal(first.Versions[0].Data, map[string]string{"a": "1"}) || !cmp.Equal(first.Versions[1].Data, map[string]string{"a": "2"}) ||
+		first.Versions[0].Hash == "" || !first.Versions[0].CreatedAt.Equal(old) {
+		t.Errorf("Expected record 1 with both versions, erased, and their links, got %+v", first)
+	}
+	if second := exported[1]; len(second.Versions) != 1 || second.Versions[0].Data["a"] != "1" {
+		t.Errorf("Expected record 2 as it was when the export began, got %+v", second)
+	}
+
+	// Records 1 and 2 have had a version since 2010
+	exported = export(entity.ExportFilter{IDs: &entity.IDRange{Min: 1, Max: 3}, AsOf: old})
+	if len(exported) != 3 || len(exported[0].Versions) != 1 || exported[0].Versions[0].Version != 1 || len(exported[1].Versions) != 1 {
+		t.Errorf("Expected 3 records as of 2010, got %+v", exported)
+	}
+	if exported := export(entity.ExportFilter{AsOf: old.Add(-time.Hour)}); len(exported) != 0 {
+		t.Errorf("Expected no records before any was written, got %+v", exported)
+	}
+}
+
+func TestImportSQL(t *testing.T) {
+	source, err := NewSQLiteRecordService(t.TempDir(), SQLiteRecordServiceSettings{})
+	if err != nil {
+		t.Fatalf("Unable to create testing database, error %v", err)
+	}
+	defer source.Close()
+	service, err := NewSQLiteRecordService(t.TempDir(), SQLiteRecordServiceSettings{})
+	if err != nil {
+		t.Fatalf("Unable to create testing database, error %v", err)
+	}
+	defer service.Close()
+	ctx := context.Background()
+
+	// An export of a record with an erasure imports as it was
+	if err := source.CreateRecord(ctx, entity.Record{ID: 1, Data: map[string]string{"a": "1", "ssn": "s"}}); err != nil {
+		t.Fatal(err)
+	}
+	two := "2"
+	if _, err := source.UpdateRecord(ctx, 1, map[string]*string{"a": &two}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.EraseRecord(ctx, 1, []string{"ssn"}, false, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	err = source.Export(ctx, entity.ExportFilter{}, func(record entity.ExportedRecord) error {
+		line, err := json.Marshal(record)
+		lines = append(lines, string(line))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A legacy record with authors, and invalid ones around it
+	legacy := func(id int64, versions ...int) string {
+		record := entity.ExportedRecord{ID: id}
+		for i, version := range versions {
+			createdAt := time.Date(2015, 1, 1+i, 0, 0, 0, 0, time.UTC)
+			record.Versions = append(record.Versions, entity.ExportedVersion{
+				Version:   version,
+				Data:      map[string]string{"plan": strconv.Itoa(version)},
+				CreatedAt: &createdAt,
+				Author:    "underwriter " + strconv.Itoa(version),
+			})
+		}
+		line, _ := json.Marshal(record)
+		return string(line)
+	}
+	lines = append(lines,
+		legacy(2, 1, 2, 3),
+		"",
+		legacy(3, 1, 3),
+		`{"id": 4, "versions": [`,
+		strings.Replace(legacy(5, 1, 2), `"version":2`, `"version":2,"hash":"forged"`, 1),
+		strings.Replace(legacy(6, 1, 2), "2015-01-02", "2014-01-02", 1),
+		legacy(2, 1),
+		`{"id": 7, "versions": [{"version": 1, "data": {}}], "compactions": [{"record_id": 7, "from_version": 2, "to_version": 3}]}`,
+	)
+
+	var results []entity.ImportResult
+	err = ImportNDJSON(ctx, strings.NewReader(strings.Join(lines, "\n")), service.ImportRecords, func(result entity.ImportResult) {
+		results = append(results, result)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		line     int
+		versions int
+		failed   bool
+	}{{1, 2, false}, {2, 3, false}, {4, 0, true}, {5, 0, true}, {6, 0, true}, {7, 0, true}, {8, 0, true}, {9, 0, true}}
+	if len(results) != len(expected) {
+		t.Fatalf("Expected %d results, got %+v", len(expected), results)
+	}
+	for i, result := range results {
+		if result.Line != expected[i].line || result.Versions != expected[i].versions || (result.Error != "") != expected[i].failed {
+			t.Errorf("Expected line %d with %d versions, failed %v, got %+v", expected[i].line, expected[i].versions, expected[i].failed, result)
+		}
+	}
+	if !strings.Contains(results[6].Error, ErrRecordAlreadyExists.Error()) {
+		t.Errorf("Expected record 2 to exist already, got %q", results[6].Error)
+	}
+
+	var imported []string
+	err = service.Export(ctx, entity.ExportFilter{}, func(record entity.ExportedRecord) error {
+		line, err := json.Marshal(record)
+		imported = append(imported, string(line))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != 2 || imported[0] != lines[0] || !strings.Contains(imported[1], `"author":"underwriter 3"`) {
+		t.Errorf("Expected both records exported as imported, got %v", imported)
+	}
+	for _, id := range []int64{1, 2} {
+		if verification, err := VerifyRecord(ctx, &service, id); err != nil || !verification.Valid || verification.Unhashed != 0 {
+			t.Errorf("Expected record %d to verify, got %+v, error %v", id, verification, err)
+		}
+	}
+	if record, err := service.GetVersionedRecord(ctx, 2, 2); err != nil || record.Data["plan"] != "2" {
+		t.Errorf("Expected version 2 of record 2, got %+v, error %v", record, err)
+	}
+
+	// Imported records carry on from their last version
+	if record, err := service.UpdateRecord(ctx, 2, map[string]*string{"plan": &two}); err != nil || record.Version != 4 {
+		t.Errorf("Expected version 4 of record 2, got %+v, error %v", record, err)
+	}
+}
+
+func TestBackupRestoreSQL(t *testing.T) {
+	dir := t.TempDir()
+	service, err := NewSQLiteRecordService(dir, SQLiteRecordServiceSettings{})
+	if err != nil {
+		t.Fatalf("Unable to create testing database, error %v", err)
+	}
+	ctx := context.Background()
+
+	// Sequences 1 to 5, in this order
+	write := func(id int64, value string) {
+		if _, err := service.GetRecord(ctx, id); errors.Is(err, ErrRecordDoesNotExist) {
+			err = service.CreateRecord(ctx, entity.Record{ID: id, Data: map[string]string{"a": value}})
+		} else if err == nil {
+			_, err = service.UpdateRecord(ctx, id, map[string]*string{"a": &value})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(1, "1")
+	write(1, "2")
+	write(2, "1")
+	middle := time.Now()
+	write(1, "3")
+	write(3, "1")
+
+	backup := filepath.Join(t.TempDir(), "backup.db")
+	if err := service.Backup(ctx, backup); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.Backup(ctx, backup); err == nil {
+		t.Errorf("Expected backing up over an existing backup to fail")
+	}
+	write(4, "1")
+	service.Close()
+
+	restore := func(point entity.RestorePoint, expected RewindResult) {
+		t.Helper()
+		result, err := RestoreSQLiteBackup(ctx, backup, dir, SQLiteRecordServiceSettings{}, point)
+		if err != nil || result != expected {
+			t.Fatalf("Expected restore to change %+v, got %+v, error %v", expected, result, err)
+		}
+		if service, err = NewSQLiteRecordService(dir, SQLiteRecordServiceSettings{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The backup has everything written before it, and nothing after
+	restore(entity.RestorePoint{}, RewindResult{})
+	if record, err := service.GetRecord(ctx, 1); err != nil || record.Version != 3 {
+		t.Errorf("Expected version 3 of record 1, got %+v, error %v", record, err)
+	}
+	if _, err := service.GetRecord(ctx, 4); !errors.Is(err, ErrRecordDoesNotExist) {
+		t.Errorf("Expected record 4 to postdate the backup, got error %v", err)
+	}
+
+	// Nothing is restored over a database that's open
+	if _, err := RestoreSQLiteBackup(ctx, backup, dir, SQLiteRecordServiceSettings{}, entity.RestorePoint{Sequence: 3}); !errors.Is(err, ErrDatabaseInUse) {
+		t.Errorf("Expected restoring over an open database to fail, got error %v", err)
+	}
+	if record, err := service.GetRecord(ctx, 1); err != nil || record.Version != 3 {
+		t.Errorf("Expected the open database untouched, got %+v, error %v", record, err)
+	}
+	service.Close()
+
+	for _, point := range []entity.RestorePoint{{Sequence: 3}, {AsOf: middle}} {
+		restore(point, RewindResult{Rewound: 1, Removed: 1})
+		if record, err := service.GetRecord(ctx, 1); err != nil || record.Version != 2 || record.Data["a"] != "2" {
+			t.Errorf("Expected record 1 rewound to version 2 at %+v, got %+v, error %v", point, record, err)
+		}
+		if _, err := service.GetVersionedRecord(ctx, 1, 3); !errors.Is(err, ErrVersionDoesNotExist) {
+			t.Errorf("Expected version 3 of record 1 trimmed at %+v, got error %v", point, err)
+		}
+		if record, err := service.GetRecord(ctx, 2); err != nil || record.Version != 1 {
+			t.Errorf("Expected record 2 untouched at %+v, got %+v, error %v", point, record, err)
+		}
+		if _, err := service.GetRecord(ctx, 3); !errors.Is(err, ErrRecordDoesNotExist) {
+			t.Errorf("Expected record 3 removed at %+v, got error %v", point, err)
+		}
+
+		// History carries on from the point, with new sequences
+		write(1, "4")
+		if verification, err := VerifyRecord(ctx, &service, 1); err != nil || !verification.Valid || verification.Versions != 3 {
+			t.Errorf("Expected a valid history of 3 versions at %+v, got %+v, error %v", point, verification, err)
+		}
+		var sequence int64
+		if err := service.db.QueryRow(`SELECT MAX(sequence) FROM record_deltas`).Scan(&sequence); err != nil || sequence != 4 {
+			t.Errorf("Expected the next write to take sequence 4, got %d, error %v", sequence, err)
+		}
+		service.Close()
+	}
+
+	// Versions trimmed by a rewind and written again aren't read from the
+	// cache
+	service, err = NewSQLiteRecordService(t.TempDir(), SQLiteRecordServiceSettings{VersionCacheSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	write(5, "1")
+	write(5, "2")
+	write(5, "3")
+	if record, err := service.GetVersionedRecord(ctx, 5, 2); err != nil || record.Data["a"] != "2" {
+		t.Fatalf("Expected version 2 of record 5, got %+v, error %v", record, err)
+	}
+	if _, err := service.rewind(ctx, entity.RestorePoint{Sequence: 1}); err != nil {
+		t.Fatal(err)
+	}
+	write(5, "rewritten")
+	write(5, "4")
+	if record, err := service.GetVersionedRecord(ctx, 5, 2); err != nil || record.Data["a"] != "rewritten" {
+		t.Errorf("Expected version 2 of record 5 rewritten, got %+v, error %v", record, err)
+	}
+}
+
+// benchmarkSQLiteSettings are the connection settings compared by
+// BenchmarkConcurrentSQLite.
+var benchmarkSQLiteSettings = []struct {
+	name     string
+	settings SQLiteRecordServiceSettings
+}{
+	{"delete", SQLiteRecordServiceSettings{JournalMode: SQLiteJournalDelete}},
+	{"wal", SQLiteRecordServiceSettings{JournalMode: SQLiteJournalWAL}},
+	{"wal-full", SQLiteRecordServiceSettings{JournalMode: SQLiteJournalWAL, Synchronous: SQLiteSynchronousFull}},
+}
+
+// BenchmarkConcurrentSQLite has parallel clients read records, and in the
+// mixed workload update one in every 10, holding the API lock the way the
+// handlers do.
+func BenchmarkConcurrentSQLite(b *testing.B) {
+	ctx := context.Background()
+	const records = 100
+	for _, configuration := range benchmarkSQLiteSettings {
+		for _, workload := range []struct {
+			name       string
+			writeEvery int
+		}{{"reads", 0}, {"mixed", 10}} {
+			b.Run(configuration.name+"/"+workload.name, func(b *testing.B) {
+				service, err := NewSQLiteRecordService(b.TempDir(), configuration.settings)
+				if err != nil {
+					b.Fatalf("Unable to create benchmark database, error %v", err)
+				}
+				b.Cleanup(func() { service.Close() })
+				for id := int64(1); id <= records; id++ {
+					if err := service.CreateRecord(ctx, entity.Record{ID: id, Data: map[string]string{"name": "policy holder"}}); err != nil {
+						b.Fatal(err)
+					}
+					for version := 2; version <= 10; version++ {
+						value := strconv.Itoa(version)
+						if _, err := service.UpdateRecord(ctx, id, map[string]*string{"employees": &value}); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+
+				lock := service.GetRWLockForAPI()
+				var clients atomic.Int64
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					client := clients.Add(1)
+					for i := 0; pb.Next(); i++ {
+						id := (client*7919+int64(i))%records + 1
+						if workload.writeEvery > 0 && i%workload.writeEvery == 0 {
+							value := strconv.Itoa(i)
+							lock.Lock()
+							_, err := service.UpdateRecord(ctx, id, map[string]*string{"employees": &value})
+							lock.Unlock()
+							if err != nil {
+								b.Error(err)
+								return
+							}
+							continue
+						}
+						lock.RLock()
+						_, err := service.GetRecord(ctx, id)
+						if err == nil {
+							_, err = service.GetVersionedRecord(ctx, id, 5)
+						}
+						lock.RUnlock()
+						if err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				})
+			})
+		}
+	}
+}
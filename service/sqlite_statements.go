@@ -0,0 +1,83 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/temelpa/timetravel/data"
+)
+
+// sqliteStatements are the statements every write runs, prepared once when
+// the service starts rather than parsed again on each call. database/sql
+// prepares them again on any pooled connection that hasn't seen them yet.
+// Statements used within a transaction go through tx.StmtContext.
+type sqliteStatements struct {
+	insertRecord                 *sql.Stmt
+	updateRecord                 *sql.Stmt
+	insertRecordDelta            *sql.Stmt
+	queryRecordDeltaHash         *sql.Stmt
+	queryIdempotencyKey          *sql.Stmt
+	deleteExpiredIdempotencyKeys *sql.Stmt
+	upsertIdempotencyKey         *sql.Stmt
+}
+
+// sqliteReadStatements are the statements of GetRecord, GetVersionedRecord
+// and GetAllRecordVersions, prepared against the read pool.
+type sqliteReadStatements struct {
+	queryRecord       *sql.Stmt
+	queryRecordDeltas *sql.Stmt
+}
+
+// preparedStatement is a field of sqliteStatements or sqliteReadStatements
+// and the query it's prepared from.
+type preparedStatement struct {
+	stmt  **sql.Stmt
+	query string
+}
+
+func (s *sqliteStatements) all() []preparedStatement {
+	return []preparedStatement{
+		{&s.insertRecord, data.INSERT_RECORD},
+		{&s.updateRecord, data.UPDATE_RECORD},
+		{&s.insertRecordDelta, data.INSERT_RECORD_DELTA},
+		{&s.queryRecordDeltaHash, data.QUERY_RECORD_DELTA_HASH},
+		{&s.queryIdempotencyKey, data.QUERY_IDEMPOTENCY_KEY},
+		{&s.deleteExpiredIdempotencyKeys, data.DELETE_EXPIRED_IDEMPOTENCY_KEYS},
+		{&s.upsertIdempotencyKey, data.UPSERT_IDEMPOTENCY_KEY},
+	}
+}
+
+func (s *sqliteReadStatements) all() []preparedStatement {
+	return []preparedStatement{
+		{&s.queryRecord, data.QUERY_RECORD},
+		{&s.queryRecordDeltas, data.QUERY_RECORD_DELTAS},
+	}
+}
+
+// prepareAll prepares every statement against db, closing those already
+// prepared if one fails.
+func prepareAll(ctx context.Context, db *sql.DB, statements []preparedStatement) error {
+	for _, statement := range statements {
+		stmt, err := db.PrepareContext(ctx, statement.query)
+		if err != nil {
+			closeAll(statements)
+			return err
+		}
+		*statement.stmt = stmt
+	}
+	return nil
+}
+
+// closeAll closes every statement that was prepared.
+func closeAll(statements []preparedStatement) error {
+	var firstErr error
+	for _, statement := range statements {
+		if *statement.stmt == nil {
+			continue
+		}
+		if err := (*statement.stmt).Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
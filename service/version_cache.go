@@ -0,0 +1,157 @@
+package service
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/temelpa/timetravel/entity"
+	"github.com/temelpa/timetravel/metrics"
+)
+
+// How many reconstructed versions are cached if the settings don't say
+// otherwise.
+const DefaultVersionCacheSize = 10000
+
+// versionCache keeps the most recently read versions of records, so reading
+// an old version again doesn't replay the deltas leading to it. A version
+// never changes once written, unless an erasure or compaction rewrites its
+// record's history, which must call invalidate once it has committed, or a
+// rewind trims the history of any number of records, which must call clear
+// once it has committed.
+//
+// A nil *versionCache caches nothing.
+type versionCache struct {
+	mu       sync.Mutex
+	capacity int
+	// Elements of order, by record id and then version. The front of
+	// order is the most recently used.
+	entries map[int64]map[int]*list.Element
+	order   *list.List
+	// Bumped by every invalidate, so a read that began before a rewrite
+	// committed can't cache what it read.
+	invalidations uint64
+}
+
+// cachedVersion is a version along with its link, if the read that cached
+// it had one, so readers can check it against a snapshot they read.
+type cachedVersion struct {
+	record entity.Record
+	link   entity.VersionHash
+}
+
+// newVersionCache returns a cache holding up to capacity versions, or nil
+// if capacity isn't positive.
+func newVersionCache(capacity int) *versionCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &versionCache{
+		capacity: capacity,
+		entries:  map[int64]map[int]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+// generation is taken before reading a version, and passed to put with
+// what was read.
+func (c *versionCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.invalidations
+}
+
+// get returns a copy of a cached version of a record, and its link if it
+// was cached with one.
+func (c *versionCache) get(id int64, version int) (entity.Record, entity.VersionHash, bool) {
+	if c == nil {
+		return entity.Record{}, entity.VersionHash{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[id][version]
+	metrics.ObserveVersionCacheLookup(ok)
+	if !ok {
+		return entity.Record{}, entity.VersionHash{}, false
+	}
+	c.order.MoveToFront(element)
+	cached := element.Value.(*cachedVersion)
+	return cached.record.Copy(), cached.link, true
+}
+
+// put caches a copy of record, and its link if known, read since
+// generation returned the given one, unless a record has been invalidated
+// in between. The least recently used versions are evicted to make room.
+func (c *versionCache) put(generation uint64, record entity.Record, link entity.VersionHash) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.invalidations {
+		return
+	}
+	versions, ok := c.entries[record.ID]
+	if !ok {
+		versions = map[int]*list.Element{}
+		c.entries[record.ID] = versions
+	}
+	cached := &cachedVersion{record: record.Copy(), link: link}
+	if element, ok := versions[record.Version]; ok {
+		element.Value = cached
+		c.order.MoveToFront(element)
+		return
+	}
+	versions[record.Version] = c.order.PushFront(cached)
+	metrics.AddVersionCacheEntries(1)
+
+	evicted := 0
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+		evicted++
+	}
+	metrics.ObserveVersionCacheEvictions("capacity", evicted)
+}
+
+// invalidate drops every cached version of a record, and stops reads that
+// began before it from caching theirs.
+func (c *versionCache) invalidate(id int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidations++
+	evicted := 0
+	for _, element := range c.entries[id] {
+		c.remove(element)
+		evicted++
+	}
+	metrics.ObserveVersionCacheEvictions("invalidated", evicted)
+}
+
+// clear drops every cached version.
+func (c *versionCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidations++
+	metrics.AddVersionCacheEntries(-c.order.Len())
+	c.entries = map[int64]map[int]*list.Element{}
+	c.order.Init()
+}
+
+// remove drops one cached version. c.mu must be held.
+func (c *versionCache) remove(element *list.Element) {
+	record := element.Value.(*cachedVersion).record
+	c.order.Remove(element)
+	delete(c.entries[record.ID], record.Version)
+	if len(c.entries[record.ID]) == 0 {
+		delete(c.entries, record.ID)
+	}
+	metrics.AddVersionCacheEntries(-1)
+}